@@ -0,0 +1,107 @@
+package main
+
+// 用户的状态
+// Account.Status 以前是 *bool，只有 false(禁用) 有意义，而且没人检查；现在是一个状态机：
+//   active                正常
+//   disabled              被管理员禁用，只有管理员能启用
+//   locked                被锁定，比如怀疑被盗号，解锁之后恢复正常
+//   pending_verification  注册了还没通过验证，auth.verify_registration 打开的时候新用户是这个状态，管理员审核通过后变成 active
+// 不是 active 的用户不能登录、不能续期，变成非 active 的时候已经签发的 token 全部失效
+// 每次状态变化都记一条 AccountStatusChange，带上原因和时间，管理员在后台可以查，见 admin.go
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 用户的状态
+const (
+	AccountActive   = "active"
+	AccountDisabled = "disabled"
+	AccountLocked   = "locked"
+	AccountPending  = "pending_verification"
+)
+
+// accountTransitions 每个状态能变成哪些状态，不在这里的变化都不允许
+var accountTransitions = map[string][]string{
+	AccountActive:   {AccountDisabled, AccountLocked},
+	AccountDisabled: {AccountActive},
+	AccountLocked:   {AccountActive, AccountDisabled},
+	AccountPending:  {AccountActive, AccountDisabled},
+}
+
+// AccountStatusChange 用户状态的变化记录
+type AccountStatusChange struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Uid       int64     `gorm:"not null;index" json:"uid"`
+	From      string    `gorm:"column:from_status;size:24;not null" json:"from"`
+	To        string    `gorm:"column:to_status;size:24;not null" json:"to"`
+	Reason    string    `gorm:"size:255;not null;default:''" json:"reason"`
+	ActorUid  int64     `gorm:"not null;default:0" json:"actor_uid"` // 谁改的，0 是系统自动改的
+}
+
+// AccountStatus 用户现在的状态，老数据没有状态的算 active
+func (a *Account) AccountStatus() string {
+	if a.Status == "" {
+		return AccountActive
+	}
+	return a.Status
+}
+
+// Active 能不能登录
+func (a *Account) Active() bool {
+	return a.AccountStatus() == AccountActive
+}
+
+// canTransition from 能不能变成 to
+func canTransition(from, to string) bool {
+	for _, s := range accountTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// accountStatusError 不能登录的用户返回什么错误
+func accountStatusError(a *Account) error {
+	switch a.AccountStatus() {
+	case AccountDisabled:
+		return ErrAccountDisabled
+	case AccountLocked:
+		return ErrAccountLocked
+	case AccountPending:
+		return ErrAccountPending
+	}
+	return nil
+}
+
+// changeAccountStatus 修改用户的状态并记录下来，变成非 active 的时候让这个用户已经签发的 token 全部失效
+// actor 是操作的人，系统自动改的传 0
+func (s *Server) changeAccountStatus(account *Account, to, reason string, actor int64) error {
+	from := account.AccountStatus()
+	if from == to {
+		return nil
+	}
+	if !canTransition(from, to) {
+		return ErrStatusTransition.WithMsg(fmt.Sprintf("用户状态不能从 %s 变成 %s", from, to))
+	}
+	change := &AccountStatusChange{Uid: account.Uid, From: from, To: to, Reason: reason, ActorUid: actor}
+	err := s.accounts.UpdateStatus(change)
+	// 同时有别人改了状态，from 对不上
+	if errors.Is(err, ErrConflict) {
+		return ErrStatusTransition
+	}
+	if err != nil {
+		return fmt.Errorf("accounts.UpdateStatus: %w", err)
+	}
+	account.Status, account.StatusReason, account.StatusChangedAt = to, reason, &change.CreatedAt
+	if to != AccountActive {
+		if err := s.revokeSessions(account.Uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+// 用户的角色和管理后台
+// 用户分成普通用户(user)和管理员(admin)，登录的时候角色写进 jwt(MyClaims.Role)，authMiddleware 放到 c 里，
+// 要限制角色的接口用 requireRole 中间件，见 middleware.go
+//   GET  /api/admin/accounts                 用户列表，q 按用户名搜索，limit 默认 100 最多 500，cursor 传上一页的 next_cursor
+//   GET  /api/admin/accounts/:uid            一个用户，带上待办事项的数量
+//   PUT  /api/admin/accounts/:uid/role       修改角色 {"role": "admin"}
+//   POST /api/admin/accounts/:uid/disable    禁用，不能再登录、续期，可以带上原因 {"reason": "..."}
+//   POST /api/admin/accounts/:uid/enable     启用，禁用、锁定、待验证的用户都变成正常
+//   PUT  /api/admin/accounts/:uid/status     修改状态 {"status": "locked", "reason": "..."}，能怎么变见 account_status.go
+//   GET  /api/admin/accounts/:uid/status     状态变化记录，最近的在前面，最多 100 条
+//   POST /api/admin/accounts/:uid/password   重置密码 {"password": "..."}
+// /api/admin 下面的接口都要 admin 角色。修改角色、禁用、锁定、重置密码之后，这个用户已经签发的 token 全部失效，
+// 重新登录拿到新角色的 token；管理员不能修改自己的角色、不能禁用锁定自己
+// 第一个管理员用命令行设置：go run . role <用户名> admin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 状态变化记录最多返回多少条
+const maxStatusHistory = 100
+
+// 用户的角色
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// AdminAccount 管理后台返回的用户信息，不返回密码
+type AdminAccount struct {
+	Uid             int64      `json:"uid"`
+	Name            string     `json:"name"`
+	NickName        string     `json:"nick_name"`
+	Role            string     `json:"role"`
+	Status          string     `json:"status"`
+	StatusReason    string     `json:"status_reason"`
+	StatusChangedAt *time.Time `json:"status_changed_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	Todos           *TodoStats `json:"todos,omitempty"` // 只有查一个用户的时候返回
+}
+
+// TodoStats 用户的待办事项数量，不算回收站里的
+type TodoStats struct {
+	Total     int64 `json:"total"`
+	Completed int64 `json:"completed"`
+	Pending   int64 `json:"pending"`
+	Overdue   int64 `json:"overdue"` // 没完成并且过了截止时间
+	Lists     int   `json:"lists"`   // 自己建的清单，包括收件箱
+}
+
+type RoleParam struct {
+	Role string `json:"role" binding:"required,oneof=user admin"`
+}
+
+type StatusParam struct {
+	Status string `json:"status" binding:"required,oneof=active disabled locked pending_verification"`
+	Reason string `json:"reason" binding:"max=255"`
+}
+
+type StatusReasonParam struct {
+	Reason string `json:"reason" binding:"max=255"`
+}
+
+type ResetPasswordParam struct {
+	Password string `json:"password" binding:"required,max=128"`
+}
+
+func adminAccount(a *Account) AdminAccount {
+	role := a.Role
+	if role == "" {
+		role = RoleUser
+	}
+	return AdminAccount{
+		Uid:             a.Uid,
+		Name:            a.Name,
+		NickName:        a.NickName,
+		Role:            role,
+		Status:          a.AccountStatus(),
+		StatusReason:    a.StatusReason,
+		StatusChangedAt: a.StatusChangedAt,
+		CreatedAt:       a.CreatedAt,
+	}
+}
+
+// listAccountsHandler 用户列表，按注册顺序
+func (s *Server) listAccountsHandler(c *gin.Context) {
+	limit := defaultTodoLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTodoLimit {
+			renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "limit", Reason: "range"}))
+			return
+		}
+		limit = n
+	}
+	var after uint64
+	if v := c.Query("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "cursor", Reason: "cursor"}))
+			return
+		}
+		after = n
+	}
+
+	// 多查一条，查出来了说明还有下一页
+	accounts, err := s.accounts.Search(c.Query("q"), uint(after), limit+1)
+	if err != nil {
+		renderError(c, fmt.Errorf("accounts.Search: %w", err))
+		return
+	}
+	var next string
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+		next = strconv.FormatUint(uint64(accounts[limit-1].ID), 10)
+	}
+	items := make([]AdminAccount, len(accounts))
+	for i := range accounts {
+		items[i] = adminAccount(&accounts[i])
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code:       0,
+		Msg:        "success",
+		Data:       items,
+		NextCursor: next,
+	})
+}
+
+// getAccountHandler 一个用户，带上待办事项的数量
+func (s *Server) getAccountHandler(c *gin.Context) {
+	account, ok := s.accountParam(c)
+	if !ok {
+		return
+	}
+	stats, err := s.todoStats(account.Uid)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	data := adminAccount(account)
+	data.Todos = stats
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: data,
+	})
+}
+
+// updateRoleHandler 修改角色
+func (s *Server) updateRoleHandler(c *gin.Context) {
+	var param RoleParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	account, ok := s.accountParam(c)
+	if !ok || !notSelf(c, account) {
+		return
+	}
+	if err := s.accounts.UpdateRole(account.Uid, param.Role); err != nil {
+		renderError(c, fmt.Errorf("accounts.UpdateRole: %w", err))
+		return
+	}
+	// 旧的 token 里还是原来的角色
+	if err := s.revokeSessions(account.Uid); err != nil {
+		renderError(c, err)
+		return
+	}
+	s.renderAccount(c, account.Uid)
+}
+
+// disableAccountHandler 禁用用户
+func (s *Server) disableAccountHandler(c *gin.Context) {
+	var param StatusReasonParam
+	if err := c.ShouldBind(&param); err != nil && !errors.Is(err, io.EOF) {
+		renderError(c, bindError(err))
+		return
+	}
+	s.setAccountStatus(c, AccountDisabled, param.Reason)
+}
+
+// enableAccountHandler 启用用户
+func (s *Server) enableAccountHandler(c *gin.Context) {
+	var param StatusReasonParam
+	if err := c.ShouldBind(&param); err != nil && !errors.Is(err, io.EOF) {
+		renderError(c, bindError(err))
+		return
+	}
+	s.setAccountStatus(c, AccountActive, param.Reason)
+}
+
+// updateStatusHandler 修改用户的状态
+func (s *Server) updateStatusHandler(c *gin.Context) {
+	var param StatusParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	s.setAccountStatus(c, param.Status, param.Reason)
+}
+
+// setAccountStatus 修改路由里 uid 对应的用户的状态，返回修改后的用户
+func (s *Server) setAccountStatus(c *gin.Context, status, reason string) {
+	account, ok := s.accountParam(c)
+	if !ok || (status != AccountActive && !notSelf(c, account)) {
+		return
+	}
+	if err := s.changeAccountStatus(account, status, reason, c.GetInt64(CtxUidKey)); err != nil {
+		renderError(c, err)
+		return
+	}
+	s.renderAccount(c, account.Uid)
+}
+
+// statusHistoryHandler 用户状态的变化记录
+func (s *Server) statusHistoryHandler(c *gin.Context) {
+	account, ok := s.accountParam(c)
+	if !ok {
+		return
+	}
+	changes, err := s.accounts.StatusHistory(account.Uid, maxStatusHistory)
+	if err != nil {
+		renderError(c, fmt.Errorf("accounts.StatusHistory: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: changes,
+	})
+}
+
+// resetPasswordHandler 重置密码，用户所有设备都要用新密码重新登录
+func (s *Server) resetPasswordHandler(c *gin.Context) {
+	var param ResetPasswordParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	account, ok := s.accountParam(c)
+	if !ok {
+		return
+	}
+	algo, hash, err := hashPassword(param.Password)
+	if err != nil {
+		renderError(c, fmt.Errorf("hashPassword: %w", err))
+		return
+	}
+	if err := s.accounts.UpdatePassword(account.Uid, algo, hash); err != nil {
+		renderError(c, fmt.Errorf("accounts.UpdatePassword: %w", err))
+		return
+	}
+	if err := s.revokeSessions(account.Uid); err != nil {
+		renderError(c, err)
+		return
+	}
+	s.renderAccount(c, account.Uid)
+}
+
+// accountParam 查出路由里 uid 对应的用户，出错的时候已经返回了错误响应
+func (s *Server) accountParam(c *gin.Context) (*Account, bool) {
+	uid, err := strconv.ParseInt(c.Param("uid"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "uid", Reason: "number"}))
+		return nil, false
+	}
+	account, err := s.accounts.GetByUid(uid)
+	if errors.Is(err, ErrNotFound) {
+		renderError(c, ErrUserNotFound)
+		return nil, false
+	}
+	if err != nil {
+		renderError(c, fmt.Errorf("accounts.GetByUid: %w", err))
+		return nil, false
+	}
+	return account, true
+}
+
+// notSelf 管理员不能修改自己的角色、禁用自己，免得系统里一个管理员都没有了
+func notSelf(c *gin.Context, account *Account) bool {
+	v, _ := c.Get(CtxUidKey)
+	if account.Uid == v.(int64) {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "uid", Reason: "self"}))
+		return false
+	}
+	return true
+}
+
+// renderAccount 返回用户现在的信息
+func (s *Server) renderAccount(c *gin.Context, uid int64) {
+	account, err := s.accounts.GetByUid(uid)
+	if err != nil {
+		renderError(c, fmt.Errorf("accounts.GetByUid: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: adminAccount(account),
+	})
+}
+
+// todoStats 统计用户的待办事项，共享给别人的清单里的也算这个用户的
+func (s *Server) todoStats(uid int64) (*TodoStats, error) {
+	done, pending := true, false
+	var stats TodoStats
+	counts := []struct {
+		n *int64
+		q TodoQuery
+	}{
+		{&stats.Total, TodoQuery{}},
+		{&stats.Completed, TodoQuery{Status: &done}},
+		{&stats.Pending, TodoQuery{Status: &pending}},
+		{&stats.Overdue, TodoQuery{Status: &pending, DueBefore: time.Now()}},
+	}
+	for _, count := range counts {
+		n, err := s.todos.Count(uid, count.q)
+		if err != nil {
+			return nil, fmt.Errorf("todos.Count: %w", err)
+		}
+		*count.n = n
+	}
+	lists, err := s.lists.List(uid)
+	if err != nil {
+		return nil, fmt.Errorf("lists.List: %w", err)
+	}
+	stats.Lists = len(lists)
+	return &stats, nil
+}
+
+// runRoleCommand 处理 role <用户名> user|admin 命令，设置第一个管理员用
+func runRoleCommand(accounts AccountRepository, args []string) error {
+	if len(args) != 2 || (args[1] != RoleUser && args[1] != RoleAdmin) {
+		return fmt.Errorf("usage: role <username> user|admin")
+	}
+	account, err := accounts.GetByName(args[0])
+	if err != nil {
+		return fmt.Errorf("accounts.GetByName %q: %w", args[0], err)
+	}
+	if err := accounts.UpdateRole(account.Uid, args[1]); err != nil {
+		return fmt.Errorf("accounts.UpdateRole: %w", err)
+	}
+	fmt.Printf("%s is now %s, takes effect on next login\n", account.Name, args[1])
+	return nil
+}
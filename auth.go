@@ -2,10 +2,12 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 	"net/http"
 	"time"
 )
@@ -13,113 +15,145 @@ import (
 
 type AuthParam struct {
 	Name string `json:"name" binding:"required"`	// binding:"required" 代表前端必须要传这个字段
-	Password string `json:"password" binding:"required"`
+	Password string `json:"password" binding:"required,max=128"`	// 按字节还有限制，见 password.go 的 passwordMaxBytes
 }
 
 
 // loginHandler 用户登录的函数
-func loginHandler(c *gin.Context){
+func (s *Server) loginHandler(c *gin.Context){
 	// 1，获取参数，校验参数
 	var param AuthParam
 	if err := c.ShouldBind(&param);err != nil{
-		c.JSON(http.StatusOK, Resp{
-			Code: 1,
-			Msg: "参数错误",
-		})
+		renderError(c, bindError(err))
 		return
 	}
 
 	// 2，逻辑处理
-	// 拿 用户名和密码，去数据库校验，能查到记录代表登录成功
-	var u Account
-	// 将查到的数据，赋值到u结构体中
-	err := db.Where("name=? and password=?",param.Name,md5secret(param.Password)).First(&u).Error
+	// 先记一次失败，失败次数太多了先等一等，用户名存不存在都一样，见 throttle.go
+	ip := c.ClientIP()
+	wait, err := s.loginAttempt(param.Name, ip)
 	if err != nil{
-		if errors.Is(err, gorm.ErrRecordNotFound){
-			c.JSON(http.StatusOK, Resp{
-				Code: 1,
-				Msg: "用户名或者密码错误",
-			})
+		renderError(c, fmt.Errorf("loginAttempt: %w", err))
+		return
+	}
+	if wait > 0{
+		renderTooManyAttempts(c, wait)
+		return
+	}
+
+	// 先根据用户名查出用户，再在 Go 里面用常量时间比较密码，不再把密码hash拼到sql条件里
+	u, err := s.accounts.GetByName(param.Name)
+	if err != nil{
+		if errors.Is(err, ErrNotFound){
+			// 用户不存在也算一次hash，响应时间和密码错误时差不多
+			dummyVerifyPassword(param.Password)
+			renderError(c, ErrLoginFailed)
 			return
 		}
-		c.JSON(http.StatusOK, Resp{
-			Code: 1,
-			Msg: "服务端异常，请稍后再试",
-		})
+		renderError(c, fmt.Errorf("accounts.GetByName: %w", err))
+		return
+	}
+	ok, needRehash := verifyPassword(u.PwdAlgo, u.Password, param.Password)
+	if !ok {
+		renderError(c, ErrLoginFailed)
 		return
 	}
+	s.loginSucceeded(param.Name, ip)
+	// 密码对了才告诉是被禁用了、锁定了还是没通过验证，见 account_status.go
+	if err := accountStatusError(u); err != nil {
+		renderError(c, err)
+		return
+	}
+	// 老的md5密码 或者 加密参数过时了，趁着拿到明文密码，重新加密写回数据库
+	// 升级失败不影响这次登录，下次登录还会再试
+	if needRehash {
+		if algo, hash, err := hashPassword(param.Password); err == nil {
+			if err := s.accounts.UpdatePassword(u.Uid, algo, hash); err != nil {
+				fmt.Println("loginHandler rehash password err:", err)
+			}
+		}
+	}
 
-	// 登录登录成功，生成token返回给用户
-	token,err := GenToken(u.Uid, u.Name)
+	// 登录登录成功，生成token返回给用户，同时返回 refresh token，access token 过期后用它来续期
+	pair,err := s.genTokenPair(u.Uid, u.Name, u.Role, "")
 	if err != nil{
 		// 生成token失败
-		c.JSON(http.StatusOK, Resp{Code: 1, Msg: "服务端异常，请稍后再试"})
+		renderError(c, fmt.Errorf("genTokenPair: %w", err))
 		return
 	}
-	// TODO 生成token成功后，存到redis，中间件middleware.go中，token校验有效后，会读redis中token
-
 
+	// 通知用户的其他设备和 webhook，见 events.go
+	// 已经登录成功了，写发件箱失败只打日志
+	if err := s.publish(u.Uid, EventAccountLogin, gin.H{"ip": c.ClientIP(), "user_agent": c.Request.UserAgent()}); err != nil{
+		fmt.Println("publish login err:", err)
+	}
 
 	// 3，返回响应
 	c.JSON(http.StatusOK, Resp{
 		Code: 0,
 		Msg: "success",
-		Data: token,
+		Data: pair,
 	})
 
 }
 
 // regHandler 注册用户的函数
-func regHandler(c *gin.Context){
+func (s *Server) regHandler(c *gin.Context){
 	var param AuthParam
 	// 获取参数，参数解析，根据结构体的tag，来进行校验，绑定到param结构体中
 	if err := c.ShouldBind(&param);err != nil{
-		c.JSON(http.StatusOK, Resp{
-			Code: 1,
-			Msg: "参数错误",
-		})
+		renderError(c, bindError(err))
 		return
 	}
 
-	// 校验成功，拿着参数注册用户，数据库中创建一条记录
-	var user Account
-	// 用name字段因为，建Account表的时候，定义的name是唯一约束，解析前端的参数在param中
-	// 所以传param.Name来验证用户是否已经创建过，查出来的数据赋值给 user结构体变量
-	err := db.Where("name = ? ", param.Name).First(&user).Error;
-		// 错误有2中可能
-		// 用户名存在
-		if err == nil{
-			c.JSON(http.StatusOK, Resp{
-				Code: 1,
-				Msg: "用户名已存在",	//可以返回参数错误，因为这样容易被暴力破解用户，最好返回其他数据
-			})
-			return
-		}
-
-		// 也不是 查询name 没有注册过导致数据库查询应该是要报 gorm.ErrRecordNotFound 的错
-		// 因为取反了，那就是服务端异常
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusOK, Resp{
-				Code: 1,
-				Msg: "服务端异常, 请稍后再试",	//可以返回参数错误，因为这样容易被暴力破解用户，最好返回其他数据
-			})
-			return
-		}
-
-	// 走到这，代表没有查到name 可以注册用户，也就是报错是 gorm.ErrRecordNotFound
-	err = db.Create(&Account{
-		Uid: time.Now().Unix(),	// 现在用时间戳生成唯一id ,todo 后面用雪花算法实现唯一的id，
-		Name: param.Name,
-		Password: md5secret(param.Password),
-	}).Error
+	// 同一个 ip 注册太多次了先等一等，见 throttle.go
+	// 先计数再判断，同时来的请求也不会超过限制
+	attempts, err := s.attempts.Incr(registerIPKey(c.ClientIP()), conf.Auth.RegisterIPWindow)
+	if err != nil{
+		renderError(c, fmt.Errorf("attempts.Incr: %w", err))
+		return
+	}
+	if attempts.Count > conf.Auth.RegisterIPLimit{
+		renderTooManyAttempts(c, conf.Auth.RegisterIPWindow)
+		return
+	}
 
+	// 校验成功，拿着参数注册用户，数据库中创建一条记录
+	algo, hash, err := hashPassword(param.Password)
 	if err != nil{
-		c.JSON(http.StatusOK, Resp{
-			Code: 1,
-			Msg: "服务端异常, 请稍后再试",	//可以返回参数错误，因为这样容易被暴力破解用户，最好返回其他数据
-		})
+		renderError(c, fmt.Errorf("hashPassword: %w", err))
 		return
 	}
+	// 要审核的话，新用户是待验证的状态，管理员启用之后才能登录，见 account_status.go
+	status := AccountActive
+	if conf.Auth.VerifyRegistration {
+		status = AccountPending
+	}
+	// 用户名是唯一的，已经注册过的用户名 Create 返回 ErrDuplicate
+	account := &Account{
+		Uid: newUid(),	// 毫秒时间戳 + 随机数生成唯一id ,todo 后面用雪花算法实现唯一的id，
+		Name: param.Name,
+		Password: hash,
+		PwdAlgo: algo,
+		Role: RoleUser,
+		Status: status,
+	}
+	err = s.accounts.Create(account)
+	// 错误有2中可能
+	// 用户名存在，也和注册成功返回一样的响应，不然能用注册接口试出来哪些用户名注册过，见 throttle.go
+	// 真的是自己忘了注册过，登录的时候会提示用户名或者密码错误
+	if err != nil && !errors.Is(err, ErrDuplicate){
+		// 其他错误，服务端异常
+		renderError(c, fmt.Errorf("accounts.Create: %w", err))
+		return
+	}
+	// 每个用户都有一个收件箱，见 todo_list.go
+	// 这里失败了不影响注册，第一次用到收件箱的时候 s.inbox 会再建
+	if err == nil{
+		if err := s.lists.Create(&TodoList{Uid: account.Uid, Name: InboxName, IsInbox: true}); err != nil {
+			fmt.Println("regHandler create inbox err:", err)
+		}
+	}
 	// 没报错，注册成功，让用户登录一遍后再生成token返回
 	c.JSON(http.StatusOK, Resp{
 		Code: 0,
@@ -131,12 +165,85 @@ func regHandler(c *gin.Context){
 
 }
 
+type LogoutParam struct {
+	RefreshToken string `json:"refresh_token"` // 可选，传了的话这次登录的 refresh token 也一起作废
+}
+
+// logoutHandler 退出登录，当前的 token 放进黑名单，直到它自己过期
+func (s *Server) logoutHandler(c *gin.Context){
+	var param LogoutParam
+	_ = c.ShouldBind(&param)	// 参数是可选的，不传也能退出
+
+	v,_ := c.Get(CtxClaimsKey)
+	mc := v.(*MyClaims)
+	ttl := time.Until(time.Unix(mc.ExpiresAt, 0))
+	if err := s.revocations.Revoke(mc.Id, ttl); err != nil{
+		renderError(c, fmt.Errorf("logoutHandler revoke: %w", err))
+		return
+	}
+
+	if param.RefreshToken != ""{
+		// 只能作废自己的 refresh token
+		rt, err := s.refreshTokens.GetByHash(hashRefreshToken(param.RefreshToken))
+		if err == nil && rt.Uid == mc.Uid{
+			s.revokeRefreshFamily(rt.FamilyID)
+		}
+	}
+
+	c.JSON(http.StatusOK, Resp{Code: 0, Msg: "success"})
+}
+
+// logoutAllHandler 退出所有设备，这个用户之前签发的 token 和 refresh token 全部失效
+func (s *Server) logoutAllHandler(c *gin.Context){
+	v,_ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if err := s.revokeSessions(uid); err != nil{
+		renderError(c, fmt.Errorf("logoutAllHandler: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, Resp{Code: 0, Msg: "success"})
+}
+
+// revokeSessions 这个用户之前签发的 token 和 refresh token 全部失效，通知其他设备重新登录
+// 退出所有设备、管理员禁用用户、修改角色、重置密码都用这个
+func (s *Server) revokeSessions(uid int64) error {
+	// 吊销和 account.logout_all 的发件箱在一个事务里
+	err := s.inTx(func(tx *Server) error{
+		// access token 最多再活 conf.Auth.TokenExpire，记录保存这么久就够了
+		if err := tx.revocations.RevokeUser(uid, time.Now(), conf.Auth.TokenExpire); err != nil{
+			return fmt.Errorf("revoke: %w", err)
+		}
+		if err := tx.refreshTokens.RevokeUser(uid, time.Now()); err != nil{
+			return fmt.Errorf("revoke refresh token: %w", err)
+		}
+		return tx.publish(uid, EventAccountLogoutAll, nil)
+	})
+	if err != nil{
+		return err
+	}
+	// 已经连着的 SSE、WebSocket 不会再校验 token，发完上面的事件就断开
+	s.events.Kick(uid)
+	return nil
+}
+
+// newUid 生成用户的 uid：毫秒时间戳左移10位，低10位是随机数
+// 以前直接用秒级时间戳，同一秒注册的两个用户 uid 一样，会看到对方的待办事项
+// 总共不超过 53 位，前端 js 的 number 也能精确表示
+func newUid() int64 {
+	var b [2]byte
+	_, _ = rand.Read(b[:])
+	return time.Now().UnixNano()/int64(time.Millisecond)<<10 | int64(binary.BigEndian.Uint16(b[:])&(1<<10-1))
+}
+
 // md5 加密密码
+// 老的加密方式，新密码不再用它，只留着给 verifyPassword 校验还没升级的老数据
 func md5secret(pwd string) string{
 	h := md5.New()
 	h.Write([]byte(pwd))
-	// 再通过 加盐的 随机字符串进行加密
-	return hex.EncodeToString(h.Sum([]byte(MySecret)))
+	// 再通过 加盐的 随机字符串进行加密，盐在配置里 conf.Auth.LegacySecret
+	return hex.EncodeToString(h.Sum([]byte(conf.Auth.LegacySecret)))
 }
 
 
@@ -0,0 +1,377 @@
+package main
+
+// 配置相关代码
+// 以前数据库地址、端口、密钥、token有效期都写死在代码里，换个环境就得改代码
+// 现在统一放到 Config 结构体里，按下面的顺序加载，后面的覆盖前面的：
+//   1，代码里的默认值 defaultConfig()
+//   2，yaml 配置文件：-config 参数 或者 TODO_CONFIG 环境变量指定，都没指定的话，当前目录有 config.yaml 就读它
+//   3，环境变量，TODO_ 开头，见 configBindings
+//   4，命令行参数，见 configBindings，密钥之类的不提供命令行参数(ps 命令能看到)
+// 加载完之后 validate 校验一遍，有问题直接启动失败，不要等到用的时候才发现
+// 配置文件的例子见 config.example.yaml
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Server  ServerConfig  `yaml:"server"`
+	DB      DBConfig      `yaml:"db"`
+	Auth    AuthConfig    `yaml:"auth"`
+	Todo    TodoConfig    `yaml:"todo"`
+	Notify  NotifyConfig  `yaml:"notify"`
+	Webhook WebhookConfig `yaml:"webhook"`
+}
+
+type ServerConfig struct {
+	Addr string `yaml:"addr"` // http 监听地址
+	// 信任的反向代理的 ip 或者网段，只有从这些地址连过来的请求才看 X-Forwarded-For、X-Real-IP，
+	// 为空的时候客户端 ip 就是连接的地址，不然谁都能伪造请求头绕过按 ip 的限制，见 throttle.go
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type DBConfig struct {
+	Driver      string `yaml:"driver"`       // mysql / postgres / sqlite
+	DSN         string `yaml:"dsn"`          // sqlite 写文件路径，":memory:" 是内存数据库
+	AutoMigrate bool   `yaml:"auto_migrate"` // 启动时自动执行没执行过的 migration，见 migrate.go，线上建议关掉，手动 migrate up
+}
+
+type AuthConfig struct {
+	TokenExpire        time.Duration `yaml:"token_expire"`         // access token 有效期
+	RefreshTokenExpire time.Duration `yaml:"refresh_token_expire"` // refresh token 有效期
+	JWTAlg             string        `yaml:"jwt_alg"`              // jwt 签名算法 RS256 / EdDSA
+	JWTRotateInterval  time.Duration `yaml:"jwt_rotate_interval"`  // jwt 签名密钥轮换周期
+	PwdAlgo            string        `yaml:"pwd_algo"`             // 密码加密算法 argon2id / bcrypt
+	LegacySecret       string        `yaml:"legacy_secret"`        // 老的 md5 密码的盐，必须和老数据加密时用的一样
+	VerifyRegistration bool          `yaml:"verify_registration"`  // 新注册的用户要管理员审核之后才能登录
+	// 防暴力破解，见 throttle.go
+	LoginMaxFailures   int           `yaml:"login_max_failures"`    // 同一个用户名失败多少次之后锁定
+	LoginIPMaxFailures int           `yaml:"login_ip_max_failures"` // 同一个 ip 失败多少次之后锁定
+	LoginLockout       time.Duration `yaml:"login_lockout"`         // 锁定多久，这么久没有再失败计数就清零
+	RegisterIPLimit    int           `yaml:"register_ip_limit"`     // 同一个 ip 在 register_ip_window 内最多注册几次
+	RegisterIPWindow   time.Duration `yaml:"register_ip_window"`    // 注册次数按多长时间算
+}
+
+type TodoConfig struct {
+	TrashRetention time.Duration `yaml:"trash_retention"` // 回收站里的数据保留多久，超过了定时彻底删除，0 代表一直保留，见 trash.go
+	MaxDepth       int           `yaml:"max_depth"`       // 子任务最多几层，1 代表不能建子任务，见 subtask.go
+}
+
+// NotifyConfig 提醒怎么发，见 reminder.go 和 notify.go
+type NotifyConfig struct {
+	PollInterval   time.Duration `yaml:"poll_interval"`   // 多久检查一次到时间的提醒
+	WebhookTimeout time.Duration `yaml:"webhook_timeout"` // 调用 webhook 的超时时间
+	SMTPAddr       string        `yaml:"smtp_addr"`       // 发邮件的 smtp 服务器 host:port，为空代表不能用邮件提醒
+	SMTPFrom       string        `yaml:"smtp_from"`       // 发件人
+	SMTPUsername   string        `yaml:"smtp_username"`   // 为空不登录
+	SMTPPassword   string        `yaml:"smtp_password"`
+}
+
+// WebhookConfig 用户注册的 webhook 怎么发，见 webhook.go
+type WebhookConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval"` // 多久检查一次要发的事件
+	Timeout      time.Duration `yaml:"timeout"`       // 调用一次最多等多久
+	MaxAttempts  int           `yaml:"max_attempts"`  // 最多发几次，失败了按 30s、1m、2m… 翻倍重试
+	LogRetention time.Duration `yaml:"log_retention"` // 发送记录保留多久，0 一直保留
+	AllowPrivate bool          `yaml:"allow_private"` // 允许调用本机、内网地址，只在开发测试的时候打开
+}
+
+var conf = defaultConfig() // 全局的配置，main 中用 loadConfig 的结果覆盖
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr: ":8888",
+		},
+		DB: DBConfig{
+			Driver: DBDriverMySQL,
+			DSN:    "root:123123@tcp(127.0.0.1:3306)/gogogo?charset=utf8mb4&parseTime=True",
+		},
+		Auth: AuthConfig{
+			TokenExpire:        time.Hour * 1,
+			RefreshTokenExpire: time.Hour * 24 * 7,
+			JWTAlg:             KeyAlgRS256,
+			JWTRotateInterval:  time.Hour * 24 * 30,
+			PwdAlgo:            PwdAlgoArgon2id,
+			LegacySecret:       "夏天夏天悄悄过去",
+			LoginMaxFailures:   10,
+			LoginIPMaxFailures: 100,
+			LoginLockout:       time.Minute * 15,
+			RegisterIPLimit:    20,
+			RegisterIPWindow:   time.Hour,
+		},
+		Todo: TodoConfig{
+			TrashRetention: time.Hour * 24 * 30,
+			MaxDepth:       3,
+		},
+		Notify: NotifyConfig{
+			PollInterval:   time.Minute,
+			WebhookTimeout: 10 * time.Second,
+		},
+		Webhook: WebhookConfig{
+			PollInterval: 10 * time.Second,
+			Timeout:      10 * time.Second,
+			MaxAttempts:  8,
+			LogRetention: time.Hour * 24 * 30,
+		},
+	}
+}
+
+// configBinding 一个配置项对应的 环境变量 和 命令行参数
+type configBinding struct {
+	env   string
+	flag  string // 为空代表不能通过命令行参数设置
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var configBindings = []configBinding{
+	{"TODO_SERVER_ADDR", "addr", "http listen address", setString(func(c *Config) *string { return &c.Server.Addr })},
+	{"TODO_SERVER_TRUSTED_PROXIES", "trusted-proxies", "comma separated reverse proxy ips or cidrs whose X-Forwarded-For is trusted", setStrings(func(c *Config) *[]string { return &c.Server.TrustedProxies })},
+	{"TODO_DB_DRIVER", "db-driver", "database driver: mysql, postgres or sqlite", setString(func(c *Config) *string { return &c.DB.Driver })},
+	{"TODO_DB_DSN", "dsn", "database dsn", setString(func(c *Config) *string { return &c.DB.DSN })},
+	{"TODO_DB_AUTO_MIGRATE", "auto-migrate", "apply pending migrations on startup: true or false", setBool(func(c *Config) *bool { return &c.DB.AutoMigrate })},
+	{"TODO_AUTH_TOKEN_EXPIRE", "token-expire", "access token lifetime, e.g. 1h", setDuration(func(c *Config) *time.Duration { return &c.Auth.TokenExpire })},
+	{"TODO_AUTH_REFRESH_TOKEN_EXPIRE", "refresh-token-expire", "refresh token lifetime, e.g. 168h", setDuration(func(c *Config) *time.Duration { return &c.Auth.RefreshTokenExpire })},
+	{"TODO_AUTH_JWT_ALG", "jwt-alg", "jwt signing algorithm: RS256 or EdDSA", setString(func(c *Config) *string { return &c.Auth.JWTAlg })},
+	{"TODO_AUTH_JWT_ROTATE_INTERVAL", "jwt-rotate-interval", "jwt signing key rotation interval, e.g. 720h", setDuration(func(c *Config) *time.Duration { return &c.Auth.JWTRotateInterval })},
+	{"TODO_AUTH_PWD_ALGO", "pwd-algo", "password hashing algorithm: argon2id or bcrypt", setString(func(c *Config) *string { return &c.Auth.PwdAlgo })},
+	{"TODO_AUTH_LEGACY_SECRET", "", "", setString(func(c *Config) *string { return &c.Auth.LegacySecret })},
+	{"TODO_AUTH_LOGIN_MAX_FAILURES", "login-max-failures", "failed logins per username before lockout", setInt(func(c *Config) *int { return &c.Auth.LoginMaxFailures })},
+	{"TODO_AUTH_LOGIN_IP_MAX_FAILURES", "login-ip-max-failures", "failed logins per ip before lockout", setInt(func(c *Config) *int { return &c.Auth.LoginIPMaxFailures })},
+	{"TODO_AUTH_LOGIN_LOCKOUT", "login-lockout", "lockout duration after too many failed logins, e.g. 15m", setDuration(func(c *Config) *time.Duration { return &c.Auth.LoginLockout })},
+	{"TODO_AUTH_REGISTER_IP_LIMIT", "register-ip-limit", "registrations per ip within register-ip-window", setInt(func(c *Config) *int { return &c.Auth.RegisterIPLimit })},
+	{"TODO_AUTH_REGISTER_IP_WINDOW", "register-ip-window", "window for register-ip-limit, e.g. 1h", setDuration(func(c *Config) *time.Duration { return &c.Auth.RegisterIPWindow })},
+	{"TODO_AUTH_VERIFY_REGISTRATION", "verify-registration", "new accounts need admin approval before login: true or false", setBool(func(c *Config) *bool { return &c.Auth.VerifyRegistration })},
+	{"TODO_TODO_TRASH_RETENTION", "trash-retention", "how long deleted todos stay in the trash, 0 keeps them forever, e.g. 720h", setDuration(func(c *Config) *time.Duration { return &c.Todo.TrashRetention })},
+	{"TODO_TODO_MAX_DEPTH", "max-depth", "how many levels of subtasks a todo tree may have, 1 disables subtasks", setInt(func(c *Config) *int { return &c.Todo.MaxDepth })},
+	{"TODO_NOTIFY_POLL_INTERVAL", "notify-poll-interval", "how often to look for due reminders, e.g. 1m", setDuration(func(c *Config) *time.Duration { return &c.Notify.PollInterval })},
+	{"TODO_NOTIFY_WEBHOOK_TIMEOUT", "notify-webhook-timeout", "timeout of reminder webhook calls, e.g. 10s", setDuration(func(c *Config) *time.Duration { return &c.Notify.WebhookTimeout })},
+	{"TODO_NOTIFY_SMTP_ADDR", "smtp-addr", "smtp server host:port for email reminders, empty disables email", setString(func(c *Config) *string { return &c.Notify.SMTPAddr })},
+	{"TODO_NOTIFY_SMTP_FROM", "smtp-from", "sender address of email reminders", setString(func(c *Config) *string { return &c.Notify.SMTPFrom })},
+	{"TODO_NOTIFY_SMTP_USERNAME", "smtp-username", "smtp login user, empty skips authentication", setString(func(c *Config) *string { return &c.Notify.SMTPUsername })},
+	{"TODO_NOTIFY_SMTP_PASSWORD", "", "", setString(func(c *Config) *string { return &c.Notify.SMTPPassword })},
+	{"TODO_WEBHOOK_POLL_INTERVAL", "webhook-poll-interval", "how often to look for pending webhook deliveries, e.g. 10s", setDuration(func(c *Config) *time.Duration { return &c.Webhook.PollInterval })},
+	{"TODO_WEBHOOK_TIMEOUT", "webhook-timeout", "timeout of one webhook delivery attempt, e.g. 10s", setDuration(func(c *Config) *time.Duration { return &c.Webhook.Timeout })},
+	{"TODO_WEBHOOK_MAX_ATTEMPTS", "webhook-max-attempts", "how many times a webhook delivery is tried before giving up", setInt(func(c *Config) *int { return &c.Webhook.MaxAttempts })},
+	{"TODO_WEBHOOK_ALLOW_PRIVATE", "webhook-allow-private", "allow webhooks to loopback and private addresses, for development only: true or false", setBool(func(c *Config) *bool { return &c.Webhook.AllowPrivate })},
+	{"TODO_WEBHOOK_LOG_RETENTION", "webhook-log-retention", "how long finished webhook deliveries are kept, 0 keeps them forever, e.g. 720h", setDuration(func(c *Config) *time.Duration { return &c.Webhook.LogRetention })},
+}
+
+var (
+	flagConfig = flag.String("config", "", "path of the yaml config file (env TODO_CONFIG)")
+	flagValues = map[string]*string{} // 命令行参数名 -> 值
+)
+
+func init() {
+	for _, b := range configBindings {
+		if b.flag != "" {
+			flagValues[b.flag] = flag.String(b.flag, "", b.usage+" (env "+b.env+")")
+		}
+	}
+}
+
+// loadConfig 按 默认值 -> 配置文件 -> 环境变量 -> 命令行参数 的顺序加载配置，并校验
+// 调用之前要先 flag.Parse()
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+
+	// 1，配置文件
+	path := *flagConfig
+	if path == "" {
+		path = os.Getenv("TODO_CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		path = "config.yaml"
+	}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		// UnmarshalStrict 配置文件里写错了字段名直接报错，不会悄悄忽略
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	case explicit || !os.IsNotExist(err):
+		// 明确指定了配置文件却读不到，要报错；默认的 config.yaml 不存在没关系
+		return nil, fmt.Errorf("read config file %s: %w", path, err)
+	}
+
+	// 2，环境变量
+	for _, b := range configBindings {
+		if v, ok := os.LookupEnv(b.env); ok {
+			if err := b.set(c, v); err != nil {
+				return nil, fmt.Errorf("env %s: %w", b.env, err)
+			}
+		}
+	}
+
+	// 3，命令行参数，只有明确传了的参数才覆盖
+	var flagErr error
+	flag.Visit(func(f *flag.Flag) {
+		for _, b := range configBindings {
+			if b.flag == f.Name && flagErr == nil {
+				if err := b.set(c, *flagValues[b.flag]); err != nil {
+					flagErr = fmt.Errorf("flag -%s: %w", b.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// validate 校验配置，把所有的问题一次性都列出来
+func (c *Config) validate() error {
+	var problems []string
+	if c.Server.Addr == "" {
+		problems = append(problems, "server.addr is required")
+	}
+	switch c.DB.Driver {
+	case DBDriverMySQL, DBDriverPostgres, DBDriverSQLite:
+	default:
+		problems = append(problems, fmt.Sprintf("db.driver %q is not one of mysql, postgres, sqlite", c.DB.Driver))
+	}
+	if c.DB.DSN == "" {
+		problems = append(problems, "db.dsn is required")
+	}
+	if c.Auth.TokenExpire <= 0 {
+		problems = append(problems, "auth.token_expire must be positive")
+	}
+	if c.Auth.RefreshTokenExpire <= c.Auth.TokenExpire {
+		problems = append(problems, "auth.refresh_token_expire must be longer than auth.token_expire")
+	}
+	if c.Auth.JWTAlg != KeyAlgRS256 && c.Auth.JWTAlg != KeyAlgEdDSA {
+		problems = append(problems, fmt.Sprintf("auth.jwt_alg %q is not one of RS256, EdDSA", c.Auth.JWTAlg))
+	}
+	if c.Auth.JWTRotateInterval <= 0 {
+		problems = append(problems, "auth.jwt_rotate_interval must be positive")
+	}
+	if c.Auth.PwdAlgo != PwdAlgoArgon2id && c.Auth.PwdAlgo != PwdAlgoBcrypt {
+		problems = append(problems, fmt.Sprintf("auth.pwd_algo %q is not one of argon2id, bcrypt", c.Auth.PwdAlgo))
+	}
+	if c.Auth.LoginMaxFailures < 1 {
+		problems = append(problems, "auth.login_max_failures must be positive")
+	}
+	if c.Auth.LoginIPMaxFailures < 1 {
+		problems = append(problems, "auth.login_ip_max_failures must be positive")
+	}
+	if c.Auth.LoginLockout <= 0 {
+		problems = append(problems, "auth.login_lockout must be positive")
+	}
+	if c.Auth.RegisterIPLimit < 1 {
+		problems = append(problems, "auth.register_ip_limit must be positive")
+	}
+	if c.Auth.RegisterIPWindow <= 0 {
+		problems = append(problems, "auth.register_ip_window must be positive")
+	}
+	if c.Auth.LegacySecret == "" {
+		problems = append(problems, "auth.legacy_secret is required")
+	}
+	for _, p := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			problems = append(problems, fmt.Sprintf("server.trusted_proxies %q is not an ip or cidr", p))
+		}
+	}
+	if c.Todo.TrashRetention < 0 {
+		problems = append(problems, "todo.trash_retention must not be negative")
+	}
+	if c.Todo.MaxDepth < 1 {
+		problems = append(problems, "todo.max_depth must be at least 1")
+	}
+	if c.Notify.PollInterval <= 0 {
+		problems = append(problems, "notify.poll_interval must be positive")
+	}
+	if c.Notify.WebhookTimeout <= 0 {
+		problems = append(problems, "notify.webhook_timeout must be positive")
+	}
+	if c.Notify.SMTPAddr != "" && c.Notify.SMTPFrom == "" {
+		problems = append(problems, "notify.smtp_from is required when notify.smtp_addr is set")
+	}
+	if c.Webhook.PollInterval <= 0 {
+		problems = append(problems, "webhook.poll_interval must be positive")
+	}
+	if c.Webhook.Timeout <= 0 {
+		problems = append(problems, "webhook.timeout must be positive")
+	}
+	if c.Webhook.MaxAttempts < 1 {
+		problems = append(problems, "webhook.max_attempts must be at least 1")
+	}
+	if c.Webhook.LogRetention < 0 {
+		problems = append(problems, "webhook.log_retention must not be negative")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func setString(field func(c *Config) *string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+// setStrings 逗号分隔的列表，空字符串是空列表
+func setStrings(field func(c *Config) *[]string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		var items []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field(c) = items
+		return nil
+	}
+}
+
+func setBool(field func(c *Config) *bool) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *time.Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
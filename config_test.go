@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_loadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte("server:\n  addr: \":9000\"\nauth:\n  token_expire: 30m\n  jwt_alg: EdDSA\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TODO_CONFIG", path)
+	// 环境变量覆盖配置文件
+	t.Setenv("TODO_SERVER_ADDR", ":9001")
+
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig() err = %v", err)
+	}
+	if c.Server.Addr != ":9001" {
+		t.Errorf("Server.Addr = %q, want env value", c.Server.Addr)
+	}
+	if c.Auth.TokenExpire != 30*time.Minute || c.Auth.JWTAlg != KeyAlgEdDSA {
+		t.Errorf("Auth = %+v, want values from file", c.Auth)
+	}
+	if c.Auth.PwdAlgo != PwdAlgoArgon2id {
+		t.Errorf("Auth.PwdAlgo = %q, want default", c.Auth.PwdAlgo)
+	}
+}
+
+func Test_loadConfig_invalid(t *testing.T) {
+	tests := map[string]string{
+		"TODO_AUTH_TOKEN_EXPIRE":       "1 hour",
+		"TODO_AUTH_JWT_ALG":            "HS256",
+		"TODO_AUTH_REGISTER_IP_WINDOW": "0",
+		"TODO_DB_DSN":                  "",
+	}
+	for env, v := range tests {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("TODO_CONFIG", "")
+			t.Setenv(env, v)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("loadConfig() with %s=%q err = nil", env, v)
+			}
+		})
+	}
+}
+
+func Test_loadConfig_missingFile(t *testing.T) {
+	t.Setenv("TODO_CONFIG", filepath.Join(t.TempDir(), "nope.yaml"))
+	if _, err := loadConfig(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loadConfig() err = %v, want not exist", err)
+	}
+}
@@ -4,5 +4,8 @@ const(
 	// token中获取uid存到 全局ctx(c)中，包括handler方法从全局ctx获取token接续出来的uid的变量名保持统一
 	CtxUidKey = "uid"
 	CtxNameKey = "name"
+	CtxRoleKey = "role"
+	// 解析出来的整个 *MyClaims，退出登录的时候要用到 jti 和过期时间
+	CtxClaimsKey = "claims"
 )
 
@@ -0,0 +1,65 @@
+package main
+
+// 数据库连接相关代码
+// 支持 mysql、postgres、sqlite 三种数据库，通过配置 db.driver 选择
+// sqlite 用的是纯 Go 实现的驱动，不需要 cgo，本地开发和 CI 不用装 mysql
+// dsn 写 ":memory:" 就是内存数据库，进程退出数据就没了，适合跑测试
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const (
+	DBDriverMySQL    = "mysql"
+	DBDriverPostgres = "postgres"
+	DBDriverSQLite   = "sqlite"
+)
+
+// openDB 根据配置打开数据库连接
+func openDB(cfg DBConfig) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch cfg.Driver {
+	case DBDriverMySQL:
+		dialector = mysql.Open(cfg.DSN)
+	case DBDriverPostgres:
+		dialector = postgres.Open(cfg.DSN)
+	case DBDriverSQLite:
+		dialector = sqlite.Open(sqliteDSN(cfg.DSN))
+	default:
+		return nil, fmt.Errorf("unsupported db driver %q", cfg.Driver)
+	}
+
+	conn, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Driver == DBDriverSQLite {
+		sqlDB, err := conn.DB()
+		if err != nil {
+			return nil, err
+		}
+		// sqlite 同一时间只能有一个写连接，多个连接同时写会报 database is locked
+		// 内存数据库每个连接都是一个独立的库，也必须只用一个连接
+		sqlDB.SetMaxOpenConns(1)
+	}
+	return conn, nil
+}
+
+// sqliteDSN 给 sqlite 的 dsn 加上默认的 pragma：打开外键约束，写锁冲突的时候等一会儿再报错
+func sqliteDSN(dsn string) string {
+	if strings.Contains(dsn, "_pragma=") {
+		return dsn
+	}
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+}
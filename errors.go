@@ -0,0 +1,189 @@
+package main
+
+// 统一的错误处理
+// 以前每个 handler 自己拼 Resp{Code: 1, Msg: "..."}，HTTP 状态码永远是 200，调用方只能靠中文提示猜发生了什么
+// 现在所有会返回给调用方的错误都定义在下面的错误目录里：稳定的错误码(给程序判断) + HTTP 状态码 + 提示信息(给人看)
+// handler 出错统一调 renderError，不认识的错误一律按服务端异常处理，并打印日志
+//
+// 响应格式：
+//   默认还是老的 Resp 格式，前端不用改：{"code": 1, "msg": "无效的参数", "error": "invalid_param", "details": [...]}
+//   请求头带 Accept: application/problem+json 的返回 RFC 7807 格式：
+//   {"type": "urn:todo:error:invalid_param", "title": "无效的参数", "status": 400, "code": "invalid_param", "errors": [...]}
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// APIError 返回给调用方的错误
+type APIError struct {
+	Code   string       // 错误码，定了就不要改，调用方会拿它做判断
+	Status int          // HTTP 状态码
+	Msg    string       // 提示信息
+	Fields []FieldError // 参数校验失败的时候，具体是哪些字段
+}
+
+// FieldError 某个参数字段的错误
+type FieldError struct {
+	Field  string `json:"field"`  // json 里的字段名
+	Reason string `json:"reason"` // 校验规则，比如 required、max
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+// WithFields 返回带上字段错误的副本，目录里的错误是全局共用的，不能直接改
+func (e *APIError) WithFields(fields ...FieldError) *APIError {
+	cp := *e
+	cp.Fields = append([]FieldError(nil), fields...)
+	return &cp
+}
+
+// WithMsg 返回换了提示信息的副本
+func (e *APIError) WithMsg(msg string) *APIError {
+	cp := *e
+	cp.Msg = msg
+	return &cp
+}
+
+// 错误目录
+var (
+	ErrInvalidParam = &APIError{Code: "invalid_param", Status: http.StatusBadRequest, Msg: "无效的参数"}
+
+	ErrTokenMissing        = &APIError{Code: "token_missing", Status: http.StatusUnauthorized, Msg: "请求头 Bearer Token为空"}
+	ErrTokenMalformed      = &APIError{Code: "token_malformed", Status: http.StatusUnauthorized, Msg: "请求头Bearer auth格式错误"}
+	ErrTokenInvalid        = &APIError{Code: "token_invalid", Status: http.StatusUnauthorized, Msg: "无效的Token"}
+	ErrLoginRequired       = &APIError{Code: "login_required", Status: http.StatusUnauthorized, Msg: "登录异常，请重新登录"}
+	ErrLoginFailed         = &APIError{Code: "login_failed", Status: http.StatusUnauthorized, Msg: "用户名或者密码错误"}
+	ErrRefreshTokenInvalid = &APIError{Code: "refresh_token_invalid", Status: http.StatusUnauthorized, Msg: "无效的refresh token"}
+	ErrRefreshTokenExpired = &APIError{Code: "refresh_token_expired", Status: http.StatusUnauthorized, Msg: "refresh token已过期，请重新登录"}
+	ErrAccountDisabled     = &APIError{Code: "account_disabled", Status: http.StatusForbidden, Msg: "账号已被禁用"}
+	ErrAccountLocked       = &APIError{Code: "account_locked", Status: http.StatusForbidden, Msg: "账号已被锁定"}
+	ErrAccountPending      = &APIError{Code: "account_pending", Status: http.StatusForbidden, Msg: "账号还没有通过验证"}
+	// 登录失败、注册的次数太多了，响应头 Retry-After 是还要等几秒，见 throttle.go
+	ErrTooManyAttempts = &APIError{Code: "too_many_attempts", Status: http.StatusTooManyRequests, Msg: "尝试次数太多，请稍后再试"}
+
+	ErrUserNotFound         = &APIError{Code: "user_not_found", Status: http.StatusNotFound, Msg: "用户不存在"}
+	ErrTodoNotFound         = &APIError{Code: "todo_not_found", Status: http.StatusNotFound, Msg: "待办事项不存在"}
+	ErrListNotFound         = &APIError{Code: "list_not_found", Status: http.StatusNotFound, Msg: "清单不存在"}
+	ErrTodoParentDeleted    = &APIError{Code: "todo_parent_deleted", Status: http.StatusConflict, Msg: "上级待办事项在回收站里，请先恢复上级"}
+	ErrTagNotFound          = &APIError{Code: "tag_not_found", Status: http.StatusNotFound, Msg: "标签不存在"}
+	ErrTagExists            = &APIError{Code: "tag_exists", Status: http.StatusConflict, Msg: "标签已存在"}
+	ErrTodoNotRecurring     = &APIError{Code: "todo_not_recurring", Status: http.StatusConflict, Msg: "不是重复的待办事项"}
+	ErrRecurrenceEnded      = &APIError{Code: "recurrence_ended", Status: http.StatusConflict, Msg: "重复已经结束，没有下一次了"}
+	ErrReminderNotFound     = &APIError{Code: "reminder_not_found", Status: http.StatusNotFound, Msg: "提醒不存在"}
+	ErrWebhookNotFound      = &APIError{Code: "webhook_not_found", Status: http.StatusNotFound, Msg: "webhook不存在"}
+	ErrDeliveryNotFound     = &APIError{Code: "webhook_delivery_not_found", Status: http.StatusNotFound, Msg: "发送记录不存在"}
+	ErrNotificationNotFound = &APIError{Code: "notification_not_found", Status: http.StatusNotFound, Msg: "通知不存在"}
+	ErrInboxUndeletable     = &APIError{Code: "inbox_undeletable", Status: http.StatusConflict, Msg: "收件箱不能删除"}
+	ErrInboxUnshareable     = &APIError{Code: "inbox_unshareable", Status: http.StatusConflict, Msg: "收件箱不能共享"}
+	ErrMemberNotFound       = &APIError{Code: "member_not_found", Status: http.StatusNotFound, Msg: "成员不存在"}
+	ErrMemberExists         = &APIError{Code: "member_exists", Status: http.StatusConflict, Msg: "已经是清单的成员或者已经邀请过了"}
+	ErrInvitationNotFound   = &APIError{Code: "invitation_not_found", Status: http.StatusNotFound, Msg: "邀请不存在"}
+	ErrStatusTransition     = &APIError{Code: "status_transition", Status: http.StatusConflict, Msg: "不允许的用户状态变化"}
+	// 共享清单里看得到但是权限不够、不是管理员访问管理后台，见 share.go、admin.go
+	ErrForbidden = &APIError{Code: "forbidden", Status: http.StatusForbidden, Msg: "没有权限"}
+	// If-Match 里的版本和当前版本对不上，说明别的页面已经改过了
+	ErrPreconditionFailed = &APIError{Code: "precondition_failed", Status: http.StatusPreconditionFailed, Msg: "数据已经被修改，请刷新后再试"}
+	ErrRouteNotFound      = &APIError{Code: "route_not_found", Status: http.StatusNotFound, Msg: "接口不存在"}
+
+	ErrUnsupportedMediaType = &APIError{Code: "unsupported_media_type", Status: http.StatusUnsupportedMediaType, Msg: "不支持的Content-Type"}
+
+	ErrInternal = &APIError{Code: "internal", Status: http.StatusInternalServerError, Msg: "服务端异常，请稍后再试"}
+)
+
+// MIMEProblemJSON RFC 7807 的 Content-Type
+const MIMEProblemJSON = "application/problem+json"
+
+// Problem RFC 7807 格式的错误响应
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// renderError 所有错误响应都从这里出去，写完响应会 Abort，后面的中间件和 handler 不再执行
+// err 不是 *APIError 的，说明是没预料到的错误，打印日志后按 ErrInternal 返回，不把内部错误信息暴露给调用方
+func renderError(c *gin.Context, err error) {
+	var e *APIError
+	if !errors.As(err, &e) {
+		fmt.Println(c.Request.Method, c.Request.URL.Path, "err:", err)
+		e = ErrInternal
+	}
+
+	if wantsProblem(c) {
+		c.Header("Content-Type", MIMEProblemJSON)
+		c.AbortWithStatusJSON(e.Status, Problem{
+			Type:     "urn:todo:error:" + e.Code,
+			Title:    e.Msg,
+			Status:   e.Status,
+			Instance: c.Request.URL.Path,
+			Code:     e.Code,
+			Errors:   e.Fields,
+		})
+		return
+	}
+	c.AbortWithStatusJSON(e.Status, Resp{
+		Code:    1,
+		Msg:     e.Msg,
+		Error:   e.Code,
+		Details: e.Fields,
+	})
+}
+
+// wantsProblem 调用方在 Accept 里明确要了 problem+json 才返回 RFC 7807 格式，老前端不受影响
+func wantsProblem(c *gin.Context) bool {
+	for _, accept := range strings.Split(c.GetHeader("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]) == MIMEProblemJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// bindError 把 ShouldBind 的错误转成 ErrInvalidParam，校验失败的字段放到 Fields 里
+func bindError(err error) *APIError {
+	var ve validator.ValidationErrors
+	if !errors.As(err, &ve) {
+		// json 格式错误、类型不对之类的，没有具体字段
+		return ErrInvalidParam
+	}
+	fields := make([]FieldError, 0, len(ve))
+	for _, fe := range ve {
+		fields = append(fields, FieldError{Field: fe.Field(), Reason: fe.Tag()})
+	}
+	return ErrInvalidParam.WithFields(fields...)
+}
+
+// sortFieldErrors 按字段名排序，校验是按 map 遍历的时候顺序不固定
+func sortFieldErrors(fields []FieldError) {
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+}
+
+func init() {
+	// 校验失败时 fe.Field() 默认是结构体字段名，改成 json tag 里的名字，和请求体对得上
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return f.Name
+			}
+			return name
+		})
+	}
+}
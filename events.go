@@ -0,0 +1,359 @@
+package main
+
+// 实时推送待办事项的变化，一个页面改了，同一个用户的其他页面、其他设备马上能看到
+//   GET /api/v1/events   Server-Sent Events，浏览器用 EventSource
+//   GET /api/v1/ws       WebSocket，每条消息是一个 json 的 Event
+// 和其他接口一样用 jwt 认证，浏览器的 EventSource 和 WebSocket 不能带请求头，可以放在 url 参数里：
+//   new EventSource("/api/v1/events?access_token=xxx")
+// url 里的 token 容易被记下来，所以只有这两个接口认 url 参数，访问日志里打成 REDACTED(见 accessLogFormatter)；
+// token 过期的时候服务端断开连接，客户端换了新的 token 再连
+// 退出所有设备、被管理员禁用、修改角色、重置密码之后(见 auth.go 的 revokeSessions)，发完 account.logout_all 也断开
+//
+// 事件类型：
+//   ready          连上了，data 为空，客户端这时候拉一遍列表，断线重连之间错过的事件不补发
+//   todo.created   新建了待办事项，data 是待办事项，完成重复的待办事项生成的下一次、从回收站恢复的也是这个
+//   todo.updated   修改了待办事项，data 是修改之后的待办事项
+//   todo.completed 从未完成变成完成，data 同 todo.updated，这时候不再发 todo.updated
+//   todo.deleted   删除(放进回收站)了待办事项，data 是 {"id": 1}，子任务跟着删除了，不再单独发
+//   account.login       登录了，data 是 {"ip": "...", "user_agent": "..."}
+//   account.logout_all  退出了所有设备，data 为空，收到之后客户端要重新登录
+// SSE 的 event 字段是事件类型，data 字段是整个 Event；每 30 秒发一个 ping 保持连接
+// 共享清单里的待办事项，事件发给清单的所有成员，见 share.go
+// 事件只在当前进程里广播，部署多个实例的时候要用 nginx 按用户把请求转到同一个实例
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// 事件类型
+const (
+	EventReady         = "ready"
+	EventPing          = "ping"
+	EventTodoCreated   = "todo.created"
+	EventTodoUpdated   = "todo.updated"
+	EventTodoCompleted = "todo.completed"
+	EventTodoDeleted   = "todo.deleted"
+
+	EventAccountLogin     = "account.login"
+	EventAccountLogoutAll = "account.logout_all"
+)
+
+const (
+	eventBuffer    = 64               // 每个连接最多攒多少条没发出去的事件，超过了断开，客户端重连之后重新拉列表
+	eventKeepAlive = 30 * time.Second // 多久发一次 ping
+	eventWriteWait = 10 * time.Second // WebSocket 写一条消息最多等多久
+)
+
+// Event 推送给客户端的一条事件
+type Event struct {
+	ID   uint64      `json:"id"` // 进程内递增
+	Type string      `json:"type"`
+	At   time.Time   `json:"at"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// EventHub 按用户分组广播事件
+type EventHub struct {
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[int64]map[*subscriber]bool // uid -> 这个用户的所有连接
+}
+
+// subscriber 一个连接，C 被关闭代表这个连接被踢掉了
+type subscriber struct {
+	uid    int64
+	C      chan Event
+	kicked string // 被踢掉的原因 kickXXX，C 关闭之后才能读
+}
+
+// 连接被踢掉的原因
+const (
+	kickSlow   = "too slow"   // 攒了太多事件没发出去
+	kickLogout = "logged out" // 这个用户的 token 全部失效了
+)
+
+func newEventHub() *EventHub {
+	return &EventHub{subs: make(map[int64]map[*subscriber]bool)}
+}
+
+// Subscribe 订阅用户的事件，用完要 Unsubscribe
+func (h *EventHub) Subscribe(uid int64) *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub := &subscriber{uid: uid, C: make(chan Event, eventBuffer)}
+	if h.subs[uid] == nil {
+		h.subs[uid] = make(map[*subscriber]bool)
+	}
+	h.subs[uid][sub] = true
+	return sub
+}
+
+func (h *EventHub) Unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub, "")
+}
+
+// Kick 断开用户的所有连接，已经发进去的事件还会发完
+func (h *EventHub) Kick(uid int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[uid] {
+		h.remove(sub, kickLogout)
+	}
+}
+
+// remove 调用方要先加锁
+func (h *EventHub) remove(sub *subscriber, reason string) {
+	subs := h.subs[sub.uid]
+	if !subs[sub] {
+		return
+	}
+	delete(subs, sub)
+	sub.kicked = reason
+	close(sub.C)
+	if len(subs) == 0 {
+		delete(h.subs, sub.uid)
+	}
+}
+
+// Publish 发给用户的所有连接，不会阻塞，发不进去的连接直接踢掉
+func (h *EventHub) Publish(uid int64, typ string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextID++
+	ev := Event{ID: h.nextID, Type: typ, At: time.Now(), Data: data}
+	for sub := range h.subs[uid] {
+		select {
+		case sub.C <- ev:
+		default:
+			h.remove(sub, kickSlow)
+		}
+	}
+}
+
+// pendingEvent 事务里 publish 的事件，提交之后再推送，见 Server.inTx
+type pendingEvent struct {
+	uid  int64
+	typ  string
+	data interface{}
+}
+
+// publish 通知这个用户的其他页面，同时写进 webhook 的发件箱(见 webhook.go)
+// 在 inTx 的事务里调用的，发件箱和修改一起提交，写失败了整个事务回滚；提交之后才推送给在线的页面
+func (s *Server) publish(uid int64, typ string, data interface{}) error {
+	if err := s.writeOutbox(uid, typ, data); err != nil {
+		return err
+	}
+	if s.pending != nil {
+		*s.pending = append(*s.pending, pendingEvent{uid: uid, typ: typ, data: data})
+	} else {
+		s.events.Publish(uid, typ, data)
+	}
+	return nil
+}
+
+// publishTodo 待办事项变化了，发给它所在清单的所有人，todo 要先 localize
+func (s *Server) publishTodo(typ string, todo *Todo) error {
+	if err := s.publishList(todo.Uid, todo.ListID, typ, todo); err != nil {
+		return err
+	}
+	if todo.Next != nil {
+		return s.publishList(todo.Next.Uid, todo.Next.ListID, EventTodoCreated, todo.Next)
+	}
+	return nil
+}
+
+// publishList 发给清单的所有人
+func (s *Server) publishList(owner int64, listID uint, typ string, data interface{}) error {
+	uids, err := s.listAudience(owner, listID)
+	if err != nil {
+		return fmt.Errorf("listAudience: %w", err)
+	}
+	for _, uid := range uids {
+		if err := s.publish(uid, typ, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// todoEventType 修改待办事项发的事件，从未完成变成完成的是 todo.completed
+func todoEventType(completed bool) string {
+	if completed {
+		return EventTodoCompleted
+	}
+	return EventTodoUpdated
+}
+
+// queryTokenMiddleware 没有 Authorization 请求头的，用 url 参数 access_token，后面还是 authMiddleware 校验
+func queryTokenMiddleware(c *gin.Context) {
+	if c.GetHeader("Authorization") == "" {
+		if token := c.Query("access_token"); token != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	c.Next()
+}
+
+// accessLogFormatter 访问日志的格式和 gin 默认的一样，只是把 url 参数里的 access_token 换成 REDACTED
+func accessLogFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		redactAccessToken(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+// accessTokenParam 匹配 url 参数 access_token 的值
+var accessTokenParam = regexp.MustCompile(`([?&]access_token=)[^&#]*`)
+
+// redactAccessToken 把 path?query 里的 access_token 换成 REDACTED
+func redactAccessToken(path string) string {
+	if !strings.Contains(path, "access_token=") {
+		return path
+	}
+	return accessTokenParam.ReplaceAllString(path, "${1}REDACTED")
+}
+
+// tokenExpiry token 什么时候过期，到时候断开连接
+func tokenExpiry(c *gin.Context) <-chan time.Time {
+	v, _ := c.Get(CtxClaimsKey)
+	mc, ok := v.(*MyClaims)
+	if !ok || mc.ExpiresAt == 0 {
+		return nil
+	}
+	return time.After(time.Until(time.Unix(mc.ExpiresAt, 0)))
+}
+
+// eventsHandler SSE
+func (s *Server) eventsHandler(c *gin.Context) {
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	sub := s.events.Subscribe(uid)
+	defer s.events.Unsubscribe(sub)
+	expired := tokenExpiry(c)
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // nginx 不要缓冲
+	c.Render(http.StatusOK, sse.Event{Event: EventReady, Data: Event{Type: EventReady, At: time.Now()}})
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			c.Render(-1, sse.Event{Id: strconv.FormatUint(ev.ID, 10), Event: ev.Type, Data: ev})
+			return true
+		case <-ticker.C:
+			c.Render(-1, sse.Event{Event: EventPing, Data: Event{Type: EventPing, At: time.Now()}})
+			return true
+		case <-expired:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// CheckOrigin 用默认的，只允许同源的页面连接
+}
+
+// wsHandler WebSocket，只往客户端推，客户端发来的消息都忽略
+func (s *Server) wsHandler(c *gin.Context) {
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade 已经返回了 400
+		fmt.Println("websocket upgrade err:", err)
+		return
+	}
+	defer conn.Close()
+
+	sub := s.events.Subscribe(uid)
+	defer s.events.Unsubscribe(sub)
+	expired := tokenExpiry(c)
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	// 读消息才能处理客户端发来的 close、pong，读出错说明连接断了
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(ev Event) bool {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteWait))
+		return conn.WriteJSON(ev) == nil
+	}
+	closeWith := func(code int, reason string) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(eventWriteWait))
+	}
+	if !write(Event{Type: EventReady, At: time.Now()}) {
+		return
+	}
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				if sub.kicked == kickLogout {
+					closeWith(websocket.ClosePolicyViolation, kickLogout)
+				} else {
+					closeWith(websocket.CloseTryAgainLater, kickSlow)
+				}
+				return
+			}
+			if !write(ev) {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteWait)); err != nil {
+				return
+			}
+		case <-expired:
+			closeWith(websocket.ClosePolicyViolation, "token expired")
+			return
+		case <-closed:
+			return
+		}
+	}
+}
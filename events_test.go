@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEventHub(t *testing.T) {
+	h := newEventHub()
+	tom, tom2, jerry := h.Subscribe(1), h.Subscribe(1), h.Subscribe(2)
+
+	h.Publish(1, EventTodoCreated, nil)
+	for _, sub := range []*subscriber{tom, tom2} {
+		if ev := <-sub.C; ev.Type != EventTodoCreated || ev.ID != 1 {
+			t.Errorf("event = %+v", ev)
+		}
+	}
+	select {
+	case ev := <-jerry.C:
+		t.Errorf("other user got %+v", ev)
+	default:
+	}
+
+	// 一直不读的连接攒满了就被踢掉，不影响其他连接
+	for i := 0; i <= eventBuffer; i++ {
+		h.Publish(1, EventTodoUpdated, nil)
+		<-tom2.C
+	}
+	n := 0
+	for range tom.C {
+		n++
+	}
+	if n != eventBuffer {
+		t.Errorf("slow subscriber got %d events before close, want %d", n, eventBuffer)
+	}
+	h.Unsubscribe(tom) // 已经踢掉了，再取消订阅不会 panic
+	h.Unsubscribe(tom2)
+	if _, ok := <-tom2.C; ok {
+		t.Error("unsubscribed channel not closed")
+	}
+
+	// 踢掉用户的所有连接，已经发进去的事件还能读到
+	jerry2 := h.Subscribe(2)
+	h.Publish(2, EventAccountLogoutAll, nil)
+	h.Kick(2)
+	for _, sub := range []*subscriber{jerry, jerry2} {
+		if ev, ok := <-sub.C; !ok || ev.Type != EventAccountLogoutAll {
+			t.Errorf("event before kick = %+v, %v", ev, ok)
+		}
+		if _, ok := <-sub.C; ok || sub.kicked != kickLogout {
+			t.Errorf("kicked subscriber open = %v, reason %q", ok, sub.kicked)
+		}
+	}
+	h.Unsubscribe(jerry)
+	if len(h.subs) != 0 {
+		t.Errorf("subs = %v", h.subs)
+	}
+}
+
+func Test_redactAccessToken(t *testing.T) {
+	for _, c := range []struct{ path, want string }{
+		{"/api/v1/todo", "/api/v1/todo"},
+		{"/api/v1/events?access_token=eyJ.abc.def", "/api/v1/events?access_token=REDACTED"},
+		{"/api/v1/ws?x=1&access_token=eyJ.abc.def&y=2", "/api/v1/ws?x=1&access_token=REDACTED&y=2"},
+		{"/api/v1/events?my_access_token=1", "/api/v1/events?my_access_token=1"},
+	} {
+		if got := redactAccessToken(c.path); got != c.want {
+			t.Errorf("redactAccessToken(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
+
+func TestServer_accessLog(t *testing.T) {
+	var buf bytes.Buffer
+	old := gin.DefaultWriter
+	gin.DefaultWriter = &buf
+	defer func() { gin.DefaultWriter = old }()
+	r := newMemoryServer(newTestKeys(t, nil)).routes()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/events?access_token=secret-token", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if log := buf.String(); strings.Contains(log, "secret-token") || !strings.Contains(log, "/api/v1/events?access_token=REDACTED") {
+		t.Errorf("access log = %q", log)
+	}
+}
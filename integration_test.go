@@ -0,0 +1,68 @@
+//go:build integration
+// +build integration
+
+package main
+
+// 连真正的 mysql、postgres 跑的测试，默认不编译，要加 -tags integration，也可以用 make test-integration：
+//   TEST_MYSQL_DSN='root:123123@tcp(127.0.0.1:3306)/gogogo_test?charset=utf8mb4&parseTime=True' \
+//   TEST_POSTGRES_DSN='host=127.0.0.1 user=root password=123123 dbname=gogogo_test port=5432 sslmode=disable' \
+//   go test -tags integration -run Integration .
+// 只设置了其中一个的只跑那一个；测试会删掉库里所有的表，一定要用单独的测试库
+
+import (
+	"os"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// integrationDBs 按环境变量连上 mysql、postgres，删掉库里所有的表，一个都没配置的跳过
+func integrationDBs(t *testing.T) map[string]*gorm.DB {
+	t.Helper()
+	dbs := make(map[string]*gorm.DB)
+	for driver, env := range map[string]string{DBDriverMySQL: "TEST_MYSQL_DSN", DBDriverPostgres: "TEST_POSTGRES_DSN"} {
+		dsn := os.Getenv(env)
+		if dsn == "" {
+			continue
+		}
+		conn, err := openDB(DBConfig{Driver: driver, DSN: dsn})
+		if err != nil {
+			t.Fatalf("openDB(%s) err = %v", driver, err)
+		}
+		tables, err := conn.Migrator().GetTables()
+		if err != nil {
+			t.Fatalf("%s GetTables() err = %v", driver, err)
+		}
+		for _, table := range tables {
+			if err := conn.Migrator().DropTable(table); err != nil {
+				t.Fatalf("%s drop %s err = %v", driver, table, err)
+			}
+		}
+		dbs[driver] = conn
+	}
+	if len(dbs) == 0 {
+		t.Skip("TEST_MYSQL_DSN and TEST_POSTGRES_DSN are not set")
+	}
+	return dbs
+}
+
+// 按标题搜索不区分大小写，三种数据库和内存实现结果一样
+func TestIntegration_search(t *testing.T) {
+	for driver, conn := range integrationDBs(t) {
+		t.Run(driver, func(t *testing.T) {
+			if _, err := migrateUp(conn); err != nil {
+				t.Fatalf("migrateUp() err = %v", err)
+			}
+			testSearch(t, newServer(conn, newTestKeys(t, conn)))
+		})
+	}
+}
+
+// migration 里按数据库分开写的 sql(mysql 的函数索引、postgres 的部分索引、重命名列)，升级、回滚、再升级都要能执行
+func TestIntegration_migrate(t *testing.T) {
+	for driver, conn := range integrationDBs(t) {
+		t.Run(driver, func(t *testing.T) {
+			testMigrate(t, conn)
+		})
+	}
+}
@@ -4,53 +4,61 @@ import (
 	"errors"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 )
 
 // 登录成功之后来生成jwt token返回,生成jwt的相关代码
 
-// 方便测试出效果，设置token的有效期：10秒过期，例子中设置2小时过期
-//const TokenExpireDuration = time.Second * 3600
-const TokenExpireDuration = time.Hour * 1
-
-var MySecret = []byte("夏天夏天悄悄过去") // 加盐的密钥
+// token的有效期、refresh token 的有效期、签名算法 都在配置里：conf.Auth，见 config.go
+// 方便测试出效果，可以把 token_expire 设置成 10s
 
 type MyClaims struct {
 	// 定义生成token的字段，这些定义的校验的字段，一定在数据库中创建的时候，保证唯一性 unique
 	Uid  int64  `json:"uid"`
 	Name string `json:"name"`
+	// 角色，见 admin.go；加角色之前签发的 token 没有这个字段，当作普通用户
+	Role string `json:"role,omitempty"`
+	// 签发时间，精确到毫秒；iat 只精确到秒，退出所有设备之后马上重新登录，拿到的新 token 和吊销的时间点在同一秒，见 revoke.go
+	IssuedAtMs int64 `json:"iat_ms,omitempty"`
 
 	jwt.StandardClaims
 }
 
-// GenToken 定义登录成功之后(用户名/密码...)，生成JWT的方法，传进来的 uid 和 name就是 MyClaims 结构体的2个校验字段
-func GenToken(uid int64, name string) (string, error) {
+// GenToken 定义登录成功之后(用户名/密码...)，生成JWT的方法，传进来的 uid 和 name就是 MyClaims 结构体的2个校验字段，role 是用户的角色
+func (m *KeyManager) GenToken(uid int64, name string, role string) (string, error) {
+	// 每个token一个唯一的 jti，退出登录的时候根据它来吊销，见 revoke.go
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	// 创建一个我们自己的声明
 	c := MyClaims{
 		uid,
 		name, // 自定义字段
+		role,
+		now.UnixMilli(),
 		jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(TokenExpireDuration).Unix(), // 过期时间
-			Issuer:    "todo-app",                                 // 标识一下签发人
+			Id:        jti,                                    // jti
+			IssuedAt:  now.Unix(),                             // 签发时间，"退出所有设备" 根据它判断token是否失效
+			ExpiresAt: now.Add(conf.Auth.TokenExpire).Unix(), // 过期时间
+			Issuer:    "todo-app",                             // 标识一下签发人
 		},
 	}
-	// 使用指定的签名方式 jwt.SigningMethodHS256 对 对象 进行签名
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
-	// 使用指定的secret 加盐的字符串进行签名 并获得 完整的 编码后的 字符串token
-	return token.SignedString(MySecret)
+	// 用当前的签名密钥(RS256/EdDSA)进行签名，密钥的 kid 写在 token 头部，并获得 完整的 编码后的 字符串token
+	return m.Sign(c)
 }
 
 
 // ParseToken 用来 每次用户请求后端过来，携带token的时候，对token进行解析
-func ParseToken(tokenString string) (*MyClaims, error) {
+func (m *KeyManager) ParseToken(tokenString string) (*MyClaims, error) {
 	// 解析token
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&MyClaims{},
-		func(token *jwt.Token) (i interface{}, err error) {
-		// 回调函数，把加盐的字符串通过这个函数返回
-		return MySecret, nil
-	})
+		// 回调函数，根据 token 头部的 kid 返回对应的公钥
+		m.Keyfunc,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,329 @@
+package main
+
+// jwt 签名密钥的管理
+// 以前用一个写死的密钥做 HS256 签名，签名和验签是同一个密钥，别的服务想验证我们的 token 就得拿到这个密钥，等于也能伪造 token
+// 现在改成非对称签名(RS256 / EdDSA)：私钥只在本服务里用来签名，公钥通过 /.well-known/jwks.json 公开，别的服务拿公钥验签
+// 每个密钥有一个 kid，签名的时候写到 token 的头部，验签时根据 kid 找到对应的公钥
+// 密钥定期轮换：生成新密钥用来签名，旧密钥标记为退役，但是在它签出去的 token 过期之前(conf.Auth.TokenExpire)还能用来验签
+// 密钥存在数据库里，多个实例共用同一组密钥，某个实例轮换之后，其他实例定时重新加载就能拿到；
+// 定时加载之前收到新密钥签的 token，找不到 kid 的时候马上重新加载一次，最多 keyReloadInterval 一次，不然随便编个 kid 就能打满数据库
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	KeyAlgRS256 = "RS256"
+	KeyAlgEdDSA = "EdDSA"
+)
+
+// 找不到 kid 的时候，最多隔多久重新加载一次
+const keyReloadInterval = 10 * time.Second
+
+// JWTKey 签名密钥表
+type JWTKey struct {
+	Kid        string     `gorm:"primarykey;size:64"`
+	Alg        string     `gorm:"size:16;not null"`
+	PrivateKey string     `gorm:"type:text;not null"` // PKCS8 PEM 格式的私钥
+	CreatedAt  time.Time  // 创建时间，超过轮换周期就生成新的
+	RetiredAt  *time.Time // 退役时间，不为空代表不再用来签名，只用来验签
+}
+
+// signingKey 解析好的密钥
+type signingKey struct {
+	kid       string
+	alg       string
+	private   crypto.Signer
+	public    crypto.PublicKey
+	createdAt time.Time
+	retiredAt time.Time // 零值代表还在用
+}
+
+// KeyManager 管理所有的签名密钥
+type KeyManager struct {
+	db          *gorm.DB // 为空的时候密钥只存在内存里，重启后之前签发的 token 全部失效，测试用
+	alg         string
+	rotateEvery time.Duration
+
+	mu   sync.RWMutex
+	keys []*signingKey // 按创建时间倒序，第一个没退役的用来签名
+
+	reloadMu   sync.Mutex
+	reloadedAt time.Time // 上一次因为找不到 kid 重新加载的时间
+}
+
+func newKeyManager(db *gorm.DB, alg string, rotateEvery time.Duration) *KeyManager {
+	return &KeyManager{db: db, alg: alg, rotateEvery: rotateEvery}
+}
+
+// Load 从数据库加载密钥，没有可用的签名密钥 或者 签名密钥超过了轮换周期，就生成一个新的
+func (m *KeyManager) Load() error {
+	if m.db != nil {
+		var rows []JWTKey
+		if err := m.db.Order("created_at desc").Find(&rows).Error; err != nil {
+			return err
+		}
+		loaded := make([]*signingKey, 0, len(rows))
+		for _, row := range rows {
+			k, err := decodeSigningKey(row)
+			if err != nil {
+				return fmt.Errorf("load jwt key %s: %w", row.Kid, err)
+			}
+			loaded = append(loaded, k)
+		}
+		m.mu.Lock()
+		m.keys = loaded
+		m.mu.Unlock()
+	}
+
+	k, err := m.current()
+	if err != nil || time.Since(k.createdAt) >= m.rotateEvery || k.alg != m.alg {
+		return m.Rotate()
+	}
+	return nil
+}
+
+// Rotate 生成新的签名密钥，之前的签名密钥退役，退役的密钥在 conf.Auth.TokenExpire 之后删除
+func (m *KeyManager) Rotate() error {
+	k, err := generateSigningKey(m.alg)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	k.createdAt = now
+
+	if m.db != nil {
+		pemKey, err := encodePrivateKey(k.private)
+		if err != nil {
+			return err
+		}
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&JWTKey{}).Where("retired_at is null").Update("retired_at", now).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("retired_at < ?", now.Add(-conf.Auth.TokenExpire)).Delete(&JWTKey{}).Error; err != nil {
+				return err
+			}
+			return tx.Create(&JWTKey{Kid: k.kid, Alg: k.alg, PrivateKey: pemKey, CreatedAt: now}).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := []*signingKey{k}
+	for _, old := range m.keys {
+		if old.retiredAt.IsZero() {
+			old.retiredAt = now
+		}
+		if now.Sub(old.retiredAt) < conf.Auth.TokenExpire {
+			kept = append(kept, old)
+		}
+	}
+	m.keys = kept
+	return nil
+}
+
+// autoRotate 定时重新加载密钥(拿到其他实例轮换的新密钥)，到期了就轮换，在 main 中用 go 启动
+func (m *KeyManager) autoRotate(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.Load(); err != nil {
+			fmt.Println("jwt key rotate err:", err)
+		}
+	}
+}
+
+// current 当前用来签名的密钥
+func (m *KeyManager) current() (*signingKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, k := range m.keys {
+		if k.retiredAt.IsZero() {
+			return k, nil
+		}
+	}
+	return nil, errors.New("no active jwt signing key")
+}
+
+// verifyKey 根据 kid 找验签用的密钥，退役超过 conf.Auth.TokenExpire 的密钥签出来的 token 肯定已经过期了，不再认
+func (m *KeyManager) verifyKey(kid string) (*signingKey, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, k := range m.keys {
+		if k.kid != kid {
+			continue
+		}
+		if !k.retiredAt.IsZero() && time.Since(k.retiredAt) >= conf.Auth.TokenExpire {
+			return nil, false
+		}
+		return k, true
+	}
+	return nil, false
+}
+
+// reload 找不到 kid 的时候从数据库重新加载，keyReloadInterval 内只加载一次
+// 同时等着的请求，前一个加载完了直接用它加载的
+func (m *KeyManager) reload() {
+	if m.db == nil {
+		return
+	}
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	if time.Since(m.reloadedAt) < keyReloadInterval {
+		return
+	}
+	m.reloadedAt = time.Now()
+	if err := m.Load(); err != nil {
+		fmt.Println("jwt key reload err:", err)
+	}
+}
+
+// Sign 用当前的签名密钥签名，kid 写到 token 头部
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	k, err := m.current()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(k.alg), claims)
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.private)
+}
+
+// Keyfunc 给 jwt.ParseWithClaims 用的回调函数，根据头部的 kid 返回公钥
+func (m *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k, ok := m.verifyKey(kid)
+	if !ok {
+		// 可能是别的实例刚轮换的新密钥
+		m.reload()
+		k, ok = m.verifyKey(kid)
+	}
+	if !ok {
+		return nil, errors.New("unknown kid")
+	}
+	// token 头部的 alg 必须和密钥的一致，防止拿公钥当 HS256 的密钥去伪造签名
+	if token.Method.Alg() != k.alg {
+		return nil, errors.New("unexpected signing method")
+	}
+	return k.public, nil
+}
+
+// JWK 单个公钥，格式参考 RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA
+	E   string `json:"e,omitempty"`   // RSA
+	Crv string `json:"crv,omitempty"` // Ed25519
+	X   string `json:"x,omitempty"`   // Ed25519
+}
+
+// JWKS 所有还能用来验签的公钥
+func (m *KeyManager) JWKS() []JWK {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]JWK, 0, len(m.keys))
+	for _, k := range m.keys {
+		if !k.retiredAt.IsZero() && time.Since(k.retiredAt) >= conf.Auth.TokenExpire {
+			continue
+		}
+		jwk := JWK{Kid: k.kid, Use: "sig", Alg: k.alg}
+		switch pub := k.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		list = append(list, jwk)
+	}
+	return list
+}
+
+// jwksHandler /.well-known/jwks.json，按标准格式返回，不套 Resp
+func (s *Server) jwksHandler(c *gin.Context) {
+	// 允许其他服务缓存一会儿，轮换之后新旧密钥同时存在一段时间，缓存几分钟不影响验签
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, gin.H{"keys": s.keys.JWKS()})
+}
+
+func generateSigningKey(alg string) (*signingKey, error) {
+	kid, err := randomToken(12)
+	if err != nil {
+		return nil, err
+	}
+	k := &signingKey{kid: kid, alg: alg}
+	switch alg {
+	case KeyAlgRS256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		k.private, k.public = priv, &priv.PublicKey
+	case KeyAlgEdDSA:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k.private, k.public = priv, pub
+	default:
+		return nil, fmt.Errorf("unsupported jwt alg %q", alg)
+	}
+	return k, nil
+}
+
+func encodePrivateKey(priv crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func decodeSigningKey(row JWTKey) (*signingKey, error) {
+	block, _ := pem.Decode([]byte(row.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid pem")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+	k := &signingKey{
+		kid:       row.Kid,
+		alg:       row.Alg,
+		private:   priv,
+		public:    priv.Public(),
+		createdAt: row.CreatedAt,
+	}
+	if row.RetiredAt != nil {
+		k.retiredAt = *row.RetiredAt
+	}
+	return k, nil
+}
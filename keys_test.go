@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestKeyManager_Rotate(t *testing.T) {
+	for _, alg := range []string{KeyAlgRS256, KeyAlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			keys := newKeyManager(nil, alg, time.Hour)
+			if err := keys.Load(); err != nil {
+				t.Fatalf("Load() err = %v", err)
+			}
+			oldToken, err := keys.GenToken(1, "test", RoleUser)
+			if err != nil {
+				t.Fatalf("GenToken() err = %v", err)
+			}
+
+			// 轮换之后，旧密钥签的 token 还能验签，新 token 用新密钥签
+			if err := keys.Rotate(); err != nil {
+				t.Fatalf("Rotate() err = %v", err)
+			}
+			if _, err := keys.ParseToken(oldToken); err != nil {
+				t.Errorf("ParseToken(old) err = %v", err)
+			}
+			newToken, _ := keys.GenToken(1, "test", RoleUser)
+			if mc, err := keys.ParseToken(newToken); err != nil || mc.Uid != 1 {
+				t.Errorf("ParseToken(new) = %v, err = %v", mc, err)
+			}
+			if got := len(keys.JWKS()); got != 2 {
+				t.Errorf("JWKS() len = %d, want 2", got)
+			}
+
+			// 旧密钥退役超过 token 有效期之后就不再认了
+			keys.keys[1].retiredAt = time.Now().Add(-conf.Auth.TokenExpire)
+			if _, err := keys.ParseToken(oldToken); err == nil {
+				t.Errorf("ParseToken(old) accepted token signed by expired key")
+			}
+			if got := len(keys.JWKS()); got != 1 {
+				t.Errorf("JWKS() len = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestKeyManager_rejectHS256(t *testing.T) {
+	keys := newKeyManager(nil, KeyAlgRS256, time.Hour)
+	if err := keys.Load(); err != nil {
+		t.Fatalf("Load() err = %v", err)
+	}
+	k, _ := keys.current()
+	// 拿公开的 kid 用 HS256 自己签一个，必须验签失败
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, MyClaims{Uid: 1, Name: "test"})
+	token.Header["kid"] = k.kid
+	s, _ := token.SignedString([]byte(conf.Auth.LegacySecret))
+	if _, err := keys.ParseToken(s); err == nil {
+		t.Errorf("ParseToken() accepted HS256 token")
+	}
+}
+
+func TestKeyManager_reloadOnUnknownKid(t *testing.T) {
+	conn, err := openDB(DBConfig{Driver: DBDriverSQLite, DSN: ":memory:"})
+	if err != nil {
+		t.Fatalf("openDB() err = %v", err)
+	}
+	if _, err := migrateUp(conn); err != nil {
+		t.Fatalf("migrateUp() err = %v", err)
+	}
+	// 两个实例共用一个数据库，a 轮换之后 b 还没定时加载
+	a, b := newTestKeys(t, conn), newTestKeys(t, conn)
+	if err := a.Rotate(); err != nil {
+		t.Fatalf("Rotate() err = %v", err)
+	}
+	token, _ := a.GenToken(1, "test", RoleUser)
+	if mc, err := b.ParseToken(token); err != nil || mc.Uid != 1 {
+		t.Errorf("ParseToken() with new kid = %v, err = %v", mc, err)
+	}
+
+	// 编出来的 kid 不会每次都去查数据库
+	reloadedAt := b.reloadedAt
+	fake := jwt.NewWithClaims(jwt.GetSigningMethod(KeyAlgEdDSA), MyClaims{Uid: 1, Name: "test"})
+	fake.Header["kid"] = "unknown"
+	k, _ := a.current()
+	s, _ := fake.SignedString(k.private)
+	if _, err := b.ParseToken(s); err == nil {
+		t.Errorf("ParseToken() accepted unknown kid")
+	}
+	if !b.reloadedAt.Equal(reloadedAt) {
+		t.Errorf("reloaded again within %s", keyReloadInterval)
+	}
+}
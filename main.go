@@ -1,13 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"time"
 
-	"github.com/gin-gonic/gin" // gin框架
-
-	"gorm.io/driver/mysql" // gorm 需要导入
-	"gorm.io/gorm"         // gorm 需要导入
+	"gorm.io/gorm" // gorm 需要导入，数据库驱动在 db.go 中导入
 )
 
 // 结构体 对应数据库的一张表
@@ -16,13 +15,44 @@ type Todo struct {
 	// 吧 gorm.Model 里面的字段拿出来放在这，然后注释掉 gorm.Model
 	// 这样就能给这些字段设置tag: json:"-"，保证返回页面的时候，不返回这些字段
 	gorm.Model	// 改成gorm.DeletedAt不然报错，并且添加tag：json:"-" 代表不返回这个字段给前端
-	Title  string `form:"title" json:"title"`           // 待办事项名称
+	Title  string `form:"title" json:"title" binding:"required,max=255"` // 待办事项名称
 	Status bool   `json:"status"`                       //  待办事项 是否完成的状态
+	Description string `gorm:"type:text" json:"description" binding:"max=10000"` // 详细描述，Markdown 格式，原样保存，前端负责渲染
+	Priority    int    `gorm:"not null;default:0" json:"priority" binding:"min=0,max=3"` // 优先级，见 PriorityXXX
+	// 截止时间，数据库里存的是时间点，due_tz 是用户所在的时区(比如 Asia/Shanghai)，返回的时候按这个时区显示
+	DueAt *time.Time `json:"due_at"`
+	DueTZ string     `gorm:"column:due_tz;size:64;not null;default:''" json:"due_tz" binding:"omitempty,timezone"`
+	// 完成时间，status 变成 true 的时候自动设置，变回 false 的时候清空，前端传了也不管
+	CompletedAt *time.Time `json:"completed_at"`
+	// 属于哪个清单，见 todo_list.go，新建的时候不传就放到收件箱
+	ListID uint `gorm:"not null;default:0;index" json:"list_id"`
+	// 上级待办事项，0 代表是顶层的，只能新建的时候指定，见 subtask.go
+	ParentID uint `gorm:"not null;default:0;index" json:"parent_id"`
+	// 重复规则(iCalendar RRULE)，为空代表不重复，完成的时候自动生成下一次，见 todo_recur.go
+	RRule string `gorm:"column:rrule;size:255;not null;default:''" json:"rrule" binding:"max=255"`
+	// 重复的第几次，从1开始，RRULE 里的 COUNT 按这个算
+	Occurrence int `gorm:"not null;default:1" json:"occurrence"`
+	// 版本号，每次修改加1，用来做乐观锁，也是响应头里的 ETag，见 todo.go 的 todoETag
+	Version int `gorm:"not null;default:1" json:"version"`
 
 	// index 添加索引，关联账户表的 Uid ，不用数据库外键，方便分库分表，只存数据	,因为绝大多数都根据uid来增删改查的，可以增加索引
 	Uid    int64  `gorm:"uid;not null;default:0;index"` // 根据这一列能知道是谁的待办事项
+
+	// 下面几个不存数据库，查列表的时候填上
+	Progress *TodoProgress `gorm:"-" json:"progress,omitempty"` // 直接子任务完成了几个，没有子任务的不返回
+	Children []*Todo       `gorm:"-" json:"children,omitempty"` // tree=true 的时候返回子任务
+	Tags     []Tag         `gorm:"-" json:"tags,omitempty"`     // 打了哪些标签，见 tag.go
+	Next     *Todo         `gorm:"-" json:"next,omitempty"`     // 完成重复的待办事项时生成的下一次，只在修改的响应里返回
 }
 
+// 待办事项的优先级
+const (
+	PriorityNone   = 0
+	PriorityLow    = 1
+	PriorityMedium = 2
+	PriorityHigh   = 3
+)
+
 // Account 用户表
 type Account struct {
 	ID        uint `gorm:"primarykey"`
@@ -34,61 +64,91 @@ type Account struct {
 
 	Name     string `gorm:"name,unique"` // 用户名
 	Password string `gorm:"password"`
+	// 密码的加密算法，见 password.go，老数据是空字符串(md5)，登录成功后自动升级
+	PwdAlgo string `gorm:"column:pwd_algo;size:16;not null;default:''"`
 
 	NickName string `gorm:"nick_name"` // 昵称随便改
-	Status   *bool  `gorm:"status"`
-}
+	// 用户的状态 active / disabled / locked / pending_verification，不是 active 的不能登录，见 account_status.go
+	Status          string     `gorm:"size:24;not null;default:'active'"`
+	StatusReason    string     `gorm:"size:255;not null;default:''"` // 最近一次状态变化的原因
+	StatusChangedAt *time.Time // 最近一次状态变化的时间
 
-var db *gorm.DB // 全局的db对象
+	Role string `gorm:"size:16;not null;default:'user'"` // 角色，user 或者 admin，见 admin.go
+}
 
-func initDB() (err error) {
-	dsn := "root:123123@tcp(127.0.0.1:3306)/gogogo?charset=utf8mb4&parseTime=True"
-	// 初始化 全局的db对象，所以不用:=，直接用=号获取全局的db，
-	db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
-	return err
+// initDB 连接数据库
+// 以前是全局的 db 对象，handler 直接用它；现在 db 只在 main 里用来创建 Repository，注入到 Server 中，见 server.go
+func initDB() (*gorm.DB, error) {
+	// 数据库类型和地址在配置里 conf.DB.Driver / conf.DB.DSN，支持 mysql、postgres、sqlite，见 db.go
+	return openDB(conf.DB)
 }
 
 func main() {
-	// 连接数据库
-	if err := initDB(); err != nil {
-		fmt.Println("initDB connect mysql err:", err)
+	// 加载配置：默认值 -> 配置文件 -> 环境变量 -> 命令行参数，校验不通过直接退出
+	flag.Parse()
+	c, err := loadConfig()
+	if err != nil {
+		fmt.Println("loadConfig err:", err)
 		panic(err)
 	}
+	conf = c
 
-	// 使用 Todo结构体(传指针)，来自动创建表
-	db.AutoMigrate(&Todo{})
-	// 创建用户表
-	db.AutoMigrate(&Account{})
-
-	r := gin.Default()
-	// 加载前端静态文件 和 static 静态文件返回，并增加页面请求的路由
-	r.LoadHTMLFiles("./index.html")
-	r.Static("static", "./static")
-
-	// 注册
-	r.POST("/register",regHandler)
-	// 登录
-	r.POST("/login",loginHandler)
-
-
-	r.GET("/", func(c *gin.Context) {
-		c.HTML(200, "index.html", nil)
-	})
-
-	// 注册路由，curd
-	// 添加待办事项的路由组 g
-	g := r.Group("/api/v1", authMiddleware)	// 给路由组添加jwt权限认证中间件
-	{
-		g.POST("/todo", createTodoHandler)
-		g.PUT("/todo", updateTodoHandler)
-		g.GET("/todo", getTodoHandler)
-		// delete 方式，url是参数在url里面  http://127.0.0.1:8888/api/v1/todo/1，参数赋值给id
-		g.DELETE("/todo/:id", deleteTodoHandler)
+	// 连接数据库
+	db, err := initDB()
+	if err != nil {
+		fmt.Println("initDB connect database err:", err)
+		panic(err)
 	}
 
-	fmt.Println("http://127.0.0.1:8888/")
+	// 表结构的版本管理，见 migrate.go
+	// go run . migrate up|down|status 只处理 migration，不启动服务
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(db, flag.Args()[1:]); err != nil {
+			fmt.Println("migrate err:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if conf.DB.AutoMigrate {
+		if _, err := migrateUp(db); err != nil {
+			fmt.Println("migrateUp err:", err)
+			panic(err)
+		}
+	}
+	// 表结构落后于代码就拒绝启动
+	if err := checkSchema(db); err != nil {
+		fmt.Println("checkSchema err:", err)
+		panic(err)
+	}
+	// go run . role <用户名> user|admin 修改用户的角色，第一个管理员用这个设置，见 admin.go
+	if flag.Arg(0) == "role" {
+		if err := runRoleCommand(newGormAccountRepository(db), flag.Args()[1:]); err != nil {
+			fmt.Println("role err:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	// 加载 jwt 签名密钥，并且定时检查是否需要轮换
+	keys := newKeyManager(db, conf.Auth.JWTAlg, conf.Auth.JWTRotateInterval)
+	if err := keys.Load(); err != nil {
+		fmt.Println("load jwt keys err:", err)
+		panic(err)
+	}
+	go keys.autoRotate(time.Minute)
+
+	// 用 gorm 实现的 Repository 创建 Server，注册路由
+	srv := newServer(db, keys)
+	// 定时彻底删除回收站里过期的数据，见 trash.go
+	go srv.autoPurgeTrash(time.Hour)
+	// 定时发送到时间的提醒，见 reminder.go
+	go srv.runReminders(conf.Notify.PollInterval)
+	// 定时发送 webhook，见 webhook.go
+	go srv.runWebhooks(conf.Webhook.PollInterval)
+	r := srv.routes()
+
+	fmt.Printf("http://127.0.0.1%s/\n", conf.Server.Addr)
 	// 启动http server
-	r.Run(":8888")
+	r.Run(conf.Server.Addr)
 }
 
 
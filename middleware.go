@@ -1,8 +1,8 @@
 package main
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"net/http"
 	"strings"
 )
 
@@ -20,7 +20,7 @@ import (
 
 
 // authMiddleware 从请求头中获取 token，完成校验
-func authMiddleware(c *gin.Context){
+func (s *Server) authMiddleware(c *gin.Context){
 	// 1，从请求 头中获取token
 	// token 一般放在请求头(jwt推荐)，或者请求体，或者url参数中
 
@@ -31,11 +31,7 @@ func authMiddleware(c *gin.Context){
 
 
 	if authHeader == ""{
-		c.JSON(http.StatusOK, Resp{
-			Code: 1,
-			Msg: "请求头 Bearer Token为空",
-		})
-		c.Abort()	// 终止函数，不跳转到下面的函数了，直接返回
+		renderError(c, ErrTokenMissing)	// renderError 会 Abort 终止函数，不跳转到下面的函数了，直接返回
 		return
 	}
 
@@ -44,26 +40,27 @@ func authMiddleware(c *gin.Context){
 	// 拿到token，如果token获取到的是 Bearer tokenxxx 需要切割
 	// 如果直接是token，就不用切割
 	if !(len(parts) == 2 && parts[0] == "Bearer"){
-		c.JSON(http.StatusOK, Resp{
-			Code: 1,
-			Msg: "请求头Bearer auth格式错误",
-		})
-		c.Abort()	// 终止函数，不跳转到下面的函数了，直接返回
+		renderError(c, ErrTokenMalformed)
 		return
 	}
 
 	// 3，校验token
 	// 走到这，拿到了正确的token 在切割的索引1的切片中
-	mc,err := ParseToken(parts[1])
+	mc,err := s.keys.ParseToken(parts[1])
 	if err != nil{
-		c.JSON(http.StatusOK, Resp{
-			Code: 1,
-			Msg: "无效的Token",
-		})
-		c.Abort()	// 终止函数，不跳转到下面的函数了，直接返回
+		renderError(c, ErrTokenInvalid)
+		return
+	}
+	// 4，token 没过期，还要看是不是已经退出登录(被吊销)了
+	revoked, err := isTokenRevoked(s.revocations, mc)
+	if err != nil{
+		renderError(c, fmt.Errorf("isTokenRevoked: %w", err))
+		return
+	}
+	if revoked{
+		renderError(c, ErrTokenInvalid)
 		return
 	}
-	// TODO  还可以添加，解析token成功后，从redis 根据userid查， 存redis的步骤在auth.go中，用户登录成功后生成token之后，就存redis
 
 
 	// 将当前请求的 Name和 Uid 信息保存到请求的上下文 c 上
@@ -73,7 +70,26 @@ func authMiddleware(c *gin.Context){
 	// 但是 不涉及夸包调用，不会吧gin框架的ctx传给其他包，所以可以这样写， 在 Context.Context 中才会用到
 	c.Set(CtxNameKey, mc.Name)
 	c.Set(CtxUidKey, mc.Uid)
+	c.Set(CtxRoleKey, mc.Role)
+	c.Set(CtxClaimsKey, mc)
 
 	c.Next()	// 最后一步 ，可以写 next，也可以不写next，都会跳转到下一个函数
 }
 
+// requireRole 只允许 roles 里的角色访问，放在 authMiddleware 后面，角色从 token 里取，见 admin.go
+// 例如 r.Group("/api/admin", s.authMiddleware, requireRole(RoleAdmin))
+func requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString(CtxRoleKey)
+		if role == "" {
+			role = RoleUser
+		}
+		for _, r := range roles {
+			if r == role {
+				c.Next()
+				return
+			}
+		}
+		renderError(c, ErrForbidden)
+	}
+}
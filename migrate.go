@@ -0,0 +1,718 @@
+package main
+
+// 数据库表结构的版本管理
+// 以前每次启动都 db.AutoMigrate，它只会加表加字段，删字段、改名、补数据都做不了，改了什么也没法 review
+// 现在每次改表结构都在 migrations 里追加一个带版本号的 Migration，写好 Up(升级) 和 Down(回滚)
+// 已经执行过的版本记录在 schema_migrations 表里
+//
+// 命令：
+//   go run . migrate status     查看每个版本是否已经执行
+//   go run . migrate up         执行所有没执行过的版本
+//   go run . migrate down [n]   回滚最近执行的 n 个版本，默认 1 个
+// 服务启动的时候会检查，还有没执行的版本就拒绝启动，除非配置了 db.auto_migrate
+//
+// 注意：
+//   1，已经发布的 Migration 不要再改，要改就再加一个新版本
+//   2，Migration 里不要直接用 main.go 里的 Todo、Account 这些结构体，它们以后还会变，
+//      要在函数里定义当时的表结构，用 tx.Table("表名") 指定表名
+//   3，每个版本在一个事务里执行，postgres、sqlite 的建表语句也能回滚，mysql 的 DDL 会隐式提交，失败了要手动处理
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Migration 一个版本的表结构变更
+type Migration struct {
+	Version int64 // 版本号，按从小到大的顺序执行，用日期+序号，比如 2022050101
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration 记录已经执行过的版本
+type SchemaMigration struct {
+	Version   int64 `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// migrations 所有的版本，新版本追加到最后面
+var migrations = []Migration{
+	{
+		Version: 2022050101,
+		Name:    "baseline",
+		// 以前用 AutoMigrate 建的表，这个版本会把缺的字段补上，不会删除已有的数据
+		Up: func(tx *gorm.DB) error {
+			type todo struct {
+				gorm.Model
+				Title  string
+				Status bool
+				Uid    int64 `gorm:"not null;default:0;index"`
+			}
+			type account struct {
+				ID        uint `gorm:"primarykey"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt gorm.DeletedAt `gorm:"index"`
+				Uid       int64
+				Name      string
+				Password  string
+				PwdAlgo   string `gorm:"size:16;not null;default:''"`
+				NickName  string
+				Status    *bool
+			}
+			type refreshToken struct {
+				ID        uint `gorm:"primarykey"`
+				CreatedAt time.Time
+				Uid       int64     `gorm:"not null;default:0;index"`
+				FamilyID  string    `gorm:"size:64;not null;index"`
+				TokenHash string    `gorm:"size:64;not null;unique"`
+				ExpiresAt time.Time `gorm:"not null"`
+				UsedAt    *time.Time
+				RevokedAt *time.Time
+			}
+			type revocation struct {
+				Key       string    `gorm:"primarykey;size:128"`
+				Value     int64     `gorm:"not null;default:0"`
+				ExpiresAt time.Time `gorm:"not null;index"`
+			}
+			type jwtKey struct {
+				Kid        string `gorm:"primarykey;size:64"`
+				Alg        string `gorm:"size:16;not null"`
+				PrivateKey string `gorm:"type:text;not null"`
+				CreatedAt  time.Time
+				RetiredAt  *time.Time
+			}
+			return migrateTables(tx, map[string]interface{}{
+				"todos":          &todo{},
+				"accounts":       &account{},
+				"refresh_tokens": &refreshToken{},
+				"revocations":    &revocation{},
+				"jwt_keys":       &jwtKey{},
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "jwt_keys", "revocations", "refresh_tokens", "accounts", "todos")
+		},
+	},
+	{
+		Version: 2022050102,
+		Name:    "unique account name and uid",
+		// Account 结构体上一直写着 unique，但是 tag 写错了，从来没有建过唯一索引
+		// mysql 里 name 以前是 longtext，不能建索引，先改成 varchar(191)
+		// 老代码用秒级时间戳当 uid，如果有重复的 uid 建索引会失败，要先手动处理重复的用户
+		Up: func(tx *gorm.DB) error {
+			type account struct {
+				Uid  int64  `gorm:"uniqueIndex:idx_accounts_uid"`
+				Name string `gorm:"size:191;uniqueIndex:idx_accounts_name"`
+			}
+			m := tx.Table("accounts").Migrator()
+			if err := m.AlterColumn(&account{}, "Name"); err != nil {
+				return err
+			}
+			if err := m.CreateIndex(&account{}, "idx_accounts_name"); err != nil {
+				return err
+			}
+			return m.CreateIndex(&account{}, "idx_accounts_uid")
+		},
+		Down: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.DropIndex("accounts", "idx_accounts_uid"); err != nil {
+				return err
+			}
+			return m.DropIndex("accounts", "idx_accounts_name")
+		},
+	},
+	{
+		Version: 2022051001,
+		Name:    "todo list indexes",
+		// GET /api/v1/todo 按 uid 过滤，再按 创建时间 / 修改时间 + id 排序分页，见 todo_query.go
+		Up: func(tx *gorm.DB) error {
+			type todo struct {
+				ID        uint      `gorm:"index:idx_todos_uid_created_at,priority:3;index:idx_todos_uid_updated_at,priority:3"`
+				Uid       int64     `gorm:"index:idx_todos_uid_created_at,priority:1;index:idx_todos_uid_updated_at,priority:1"`
+				CreatedAt time.Time `gorm:"index:idx_todos_uid_created_at,priority:2"`
+				UpdatedAt time.Time `gorm:"index:idx_todos_uid_updated_at,priority:2"`
+			}
+			m := tx.Table("todos").Migrator()
+			if err := m.CreateIndex(&todo{}, "idx_todos_uid_created_at"); err != nil {
+				return err
+			}
+			return m.CreateIndex(&todo{}, "idx_todos_uid_updated_at")
+		},
+		Down: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.DropIndex("todos", "idx_todos_uid_updated_at"); err != nil {
+				return err
+			}
+			return m.DropIndex("todos", "idx_todos_uid_created_at")
+		},
+	},
+	{
+		Version: 2022052001,
+		Name:    "todo description, priority, due date and completed_at",
+		Up: func(tx *gorm.DB) error {
+			type todo struct {
+				ID          uint
+				Uid         int64      `gorm:"index:idx_todos_uid_due_at,priority:1"`
+				Description string     `gorm:"type:text"`
+				Priority    int        `gorm:"not null;default:0"`
+				DueAt       *time.Time `gorm:"index:idx_todos_uid_due_at,priority:2"`
+				DueTZ       string     `gorm:"column:due_tz;size:64;not null;default:''"`
+				CompletedAt *time.Time
+			}
+			m := tx.Table("todos").Migrator()
+			for _, field := range []string{"Description", "Priority", "DueAt", "DueTZ", "CompletedAt"} {
+				if err := m.AddColumn(&todo{}, field); err != nil {
+					return err
+				}
+			}
+			if err := m.CreateIndex(&todo{}, "idx_todos_uid_due_at"); err != nil {
+				return err
+			}
+			// 已经完成的老数据不知道是什么时候完成的，用最后修改时间代替
+			return tx.Table("todos").Where("status = ?", true).Update("completed_at", gorm.Expr("updated_at")).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.DropIndex("todos", "idx_todos_uid_due_at"); err != nil {
+				return err
+			}
+			// sqlite 驱动的 DropColumn 只接受结构体，这里直接写 ALTER TABLE，三种数据库都支持
+			for _, column := range []string{"completed_at", "due_tz", "due_at", "priority", "description"} {
+				if err := tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "todos"}, clause.Column{Name: column}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 2022052501,
+		Name:    "todo version",
+		// 乐观锁的版本号，老数据都从1开始
+		Up: func(tx *gorm.DB) error {
+			type todo struct {
+				Version int `gorm:"not null;default:1"`
+			}
+			return tx.Table("todos").Migrator().AddColumn(&todo{}, "Version")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "todos"}, clause.Column{Name: "version"}).Error
+		},
+	},
+	{
+		Version: 2022060101,
+		Name:    "todo lists",
+		// 清单表，见 todo_list.go；老用户每人建一个收件箱，老的待办事项都放进收件箱
+		Up: func(tx *gorm.DB) error {
+			type todoList struct {
+				ID        uint `gorm:"primarykey"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt gorm.DeletedAt `gorm:"index"`
+				Uid       int64          `gorm:"not null;default:0;index"`
+				Name      string         `gorm:"size:64;not null"`
+				IsInbox   bool           `gorm:"not null;default:false"`
+			}
+			type todo struct {
+				ListID uint `gorm:"not null;default:0;index"`
+			}
+			if err := migrateTables(tx, map[string]interface{}{"todo_lists": &todoList{}}); err != nil {
+				return err
+			}
+			m := tx.Table("todos").Migrator()
+			if err := m.AddColumn(&todo{}, "ListID"); err != nil {
+				return err
+			}
+			if err := m.CreateIndex(&todo{}, "ListID"); err != nil {
+				return err
+			}
+			var uids []int64
+			if err := tx.Table("accounts").Where("deleted_at IS NULL").Pluck("uid", &uids).Error; err != nil {
+				return err
+			}
+			now := time.Now()
+			inboxes := make([]todoList, 0, len(uids))
+			for _, uid := range uids {
+				// 这里写死名字，以后 InboxName 改了也不影响这个版本
+				inboxes = append(inboxes, todoList{CreatedAt: now, UpdatedAt: now, Uid: uid, Name: "收件箱", IsInbox: true})
+			}
+			if len(inboxes) > 0 {
+				if err := tx.Table("todo_lists").CreateInBatches(inboxes, 500).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Exec("UPDATE todos SET list_id = COALESCE((SELECT MIN(id) FROM todo_lists"+
+				" WHERE todo_lists.uid = todos.uid AND todo_lists.is_inbox = ?), 0) WHERE list_id = 0", true).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex("todos", "idx_todos_list_id"); err != nil {
+				return err
+			}
+			if err := tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "todos"}, clause.Column{Name: "list_id"}).Error; err != nil {
+				return err
+			}
+			return dropTables(tx, "todo_lists")
+		},
+	},
+	{
+		Version: 2022061001,
+		Name:    "subtasks",
+		// 子任务，见 subtask.go，老数据都是顶层的
+		Up: func(tx *gorm.DB) error {
+			type todo struct {
+				ParentID uint `gorm:"not null;default:0;index"`
+			}
+			m := tx.Table("todos").Migrator()
+			if err := m.AddColumn(&todo{}, "ParentID"); err != nil {
+				return err
+			}
+			return m.CreateIndex(&todo{}, "ParentID")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex("todos", "idx_todos_parent_id"); err != nil {
+				return err
+			}
+			return tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "todos"}, clause.Column{Name: "parent_id"}).Error
+		},
+	},
+	{
+		Version: 2022062001,
+		Name:    "tags",
+		// 标签表 和 待办事项-标签 的关系表，见 tag.go
+		Up: func(tx *gorm.DB) error {
+			type tag struct {
+				ID        uint `gorm:"primarykey"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				Uid       int64  `gorm:"not null;default:0;uniqueIndex:idx_tags_uid_name,priority:1"`
+				Name      string `gorm:"size:32;not null;uniqueIndex:idx_tags_uid_name,priority:2"`
+				Color     string `gorm:"size:16;not null;default:''"`
+			}
+			type todoTag struct {
+				TodoID    uint `gorm:"primaryKey;autoIncrement:false"`
+				TagID     uint `gorm:"primaryKey;autoIncrement:false;index:idx_todo_tags_tag_id"`
+				CreatedAt time.Time
+			}
+			return migrateTables(tx, map[string]interface{}{"tags": &tag{}, "todo_tags": &todoTag{}})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "todo_tags", "tags")
+		},
+	},
+	{
+		Version: 2022070101,
+		Name:    "recurring todos",
+		// 重复规则 和 第几次，见 todo_recur.go，老数据都不重复
+		Up: func(tx *gorm.DB) error {
+			type todo struct {
+				RRule      string `gorm:"column:rrule;size:255;not null;default:''"`
+				Occurrence int    `gorm:"not null;default:1"`
+			}
+			m := tx.Table("todos").Migrator()
+			for _, field := range []string{"RRule", "Occurrence"} {
+				if err := m.AddColumn(&todo{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"occurrence", "rrule"} {
+				if err := tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "todos"}, clause.Column{Name: column}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 2022071001,
+		Name:    "reminders and notifications",
+		// 提醒表 和 站内信表，见 reminder.go、notify.go
+		Up: func(tx *gorm.DB) error {
+			type reminder struct {
+				ID        uint `gorm:"primarykey"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				Uid       int64 `gorm:"not null;default:0;index"`
+				TodoID    uint  `gorm:"not null;default:0;index"`
+				At        *time.Time
+				Offset    *int64     `gorm:"column:offset_seconds"`
+				Channel   string     `gorm:"size:16;not null"`
+				Target    string     `gorm:"size:255;not null;default:''"`
+				Status    string     `gorm:"size:16;not null;index:idx_reminders_status_fire_at,priority:1"`
+				FireAt    *time.Time `gorm:"index:idx_reminders_status_fire_at,priority:2"`
+				SentAt    *time.Time
+				Attempts  int    `gorm:"not null;default:0"`
+				LastError string `gorm:"size:255;not null;default:''"`
+				Version   int    `gorm:"not null;default:1"`
+			}
+			type notification struct {
+				ID        uint      `gorm:"primarykey"`
+				CreatedAt time.Time `gorm:"index"`
+				Uid       int64     `gorm:"not null;default:0;index"`
+				TodoID    uint      `gorm:"not null;default:0"`
+				Title     string    `gorm:"size:255;not null"`
+				Body      string    `gorm:"type:text"`
+				ReadAt    *time.Time
+			}
+			return migrateTables(tx, map[string]interface{}{"reminders": &reminder{}, "notifications": &notification{}})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "notifications", "reminders")
+		},
+	},
+	{
+		Version: 2022072001,
+		Name:    "webhooks",
+		// 用户注册的 webhook、发送记录(发件箱)、每一次发送的结果，见 webhook.go
+		Up: func(tx *gorm.DB) error {
+			type webhookEndpoint struct {
+				ID        uint `gorm:"primarykey"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				Uid       int64  `gorm:"not null;default:0;index"`
+				URL       string `gorm:"column:url;size:1024;not null"`
+				Secret    string `gorm:"size:64;not null"`
+				EventList string `gorm:"column:events;size:512;not null;default:''"`
+				Active    bool   `gorm:"not null"`
+			}
+			type webhookDelivery struct {
+				ID            uint `gorm:"primarykey"`
+				CreatedAt     time.Time
+				UpdatedAt     time.Time
+				Uid           int64      `gorm:"not null;default:0;index"`
+				EndpointID    uint       `gorm:"not null;default:0;index"`
+				EventID       string     `gorm:"size:32;not null"`
+				Event         string     `gorm:"size:32;not null"`
+				Payload       string     `gorm:"type:text"`
+				Status        string     `gorm:"size:16;not null;index:idx_webhook_deliveries_status_next,priority:1"`
+				NextAttemptAt *time.Time `gorm:"index:idx_webhook_deliveries_status_next,priority:2"`
+				Attempts      int        `gorm:"not null;default:0"`
+				LastStatus    int        `gorm:"not null;default:0"`
+				LastError     string     `gorm:"size:255;not null;default:''"`
+				DeliveredAt   *time.Time
+				Version       int `gorm:"not null;default:1"`
+			}
+			type webhookAttempt struct {
+				ID         uint `gorm:"primarykey"`
+				CreatedAt  time.Time
+				DeliveryID uint   `gorm:"not null;default:0;index"`
+				StatusCode int    `gorm:"not null;default:0"`
+				Error      string `gorm:"size:255;not null;default:''"`
+				Response   string `gorm:"size:1024;not null;default:''"`
+				DurationMs int64  `gorm:"not null;default:0"`
+			}
+			return migrateTables(tx, map[string]interface{}{
+				"webhook_endpoints":  &webhookEndpoint{},
+				"webhook_deliveries": &webhookDelivery{},
+				"webhook_attempts":   &webhookAttempt{},
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "webhook_attempts", "webhook_deliveries", "webhook_endpoints")
+		},
+	},
+	{
+		Version: 2022080101,
+		Name:    "list_members",
+		// 共享清单的成员和邀请，见 share.go
+		Up: func(tx *gorm.DB) error {
+			type listMember struct {
+				ID         uint `gorm:"primarykey"`
+				CreatedAt  time.Time
+				UpdatedAt  time.Time
+				ListID     uint   `gorm:"not null;default:0;uniqueIndex:idx_list_members_list_uid,priority:1"`
+				Uid        int64  `gorm:"not null;default:0;uniqueIndex:idx_list_members_list_uid,priority:2;index"`
+				Role       string `gorm:"size:16;not null"`
+				Status     string `gorm:"size:16;not null"`
+				InvitedBy  int64  `gorm:"not null;default:0"`
+				AcceptedAt *time.Time
+			}
+			return migrateTables(tx, map[string]interface{}{"list_members": &listMember{}})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "list_members")
+		},
+	},
+	{
+		Version: 2022081001,
+		Name:    "account role",
+		// 用户的角色，老用户都是普通用户，见 admin.go
+		Up: func(tx *gorm.DB) error {
+			type account struct {
+				Role string `gorm:"size:16;not null;default:'user'"`
+			}
+			return tx.Table("accounts").Migrator().AddColumn(&account{}, "Role")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "accounts"}, clause.Column{Name: "role"}).Error
+		},
+	},
+	{
+		Version: 2022082001,
+		Name:    "account status",
+		// status 从 bool 改成字符串的状态，以前 false 的是被禁用了，其他都是正常的；加上状态变化的记录，见 account_status.go
+		Up: func(tx *gorm.DB) error {
+			type account struct {
+				Status          string `gorm:"size:24;not null;default:'active'"`
+				StatusReason    string `gorm:"size:255;not null;default:''"`
+				StatusChangedAt *time.Time
+			}
+			type accountStatusChange struct {
+				ID        uint `gorm:"primarykey"`
+				CreatedAt time.Time
+				Uid       int64  `gorm:"not null;index"`
+				From      string `gorm:"column:from_status;size:24;not null"`
+				To        string `gorm:"column:to_status;size:24;not null"`
+				Reason    string `gorm:"size:255;not null;default:''"`
+				ActorUid  int64  `gorm:"not null;default:0"`
+			}
+			m := tx.Table("accounts").Migrator()
+			if err := m.RenameColumn(&account{}, "status", "status_old"); err != nil {
+				return err
+			}
+			for _, field := range []string{"Status", "StatusReason", "StatusChangedAt"} {
+				if err := m.AddColumn(&account{}, field); err != nil {
+					return err
+				}
+			}
+			if err := tx.Table("accounts").Where("status_old = ?", false).
+				Updates(map[string]interface{}{"status": AccountDisabled, "status_changed_at": time.Now()}).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "accounts"}, clause.Column{Name: "status_old"}).Error; err != nil {
+				return err
+			}
+			return migrateTables(tx, map[string]interface{}{"account_status_changes": &accountStatusChange{}})
+		},
+		// 回滚的时候不是 active 的都算禁用
+		Down: func(tx *gorm.DB) error {
+			type account struct {
+				Status *bool
+			}
+			if err := dropTables(tx, "account_status_changes"); err != nil {
+				return err
+			}
+			m := tx.Table("accounts").Migrator()
+			if err := m.RenameColumn(&account{}, "status", "status_new"); err != nil {
+				return err
+			}
+			if err := m.AddColumn(&account{}, "Status"); err != nil {
+				return err
+			}
+			if err := tx.Table("accounts").Where("status_new <> ?", AccountActive).Update("status", false).Error; err != nil {
+				return err
+			}
+			for _, column := range []string{"status_new", "status_reason", "status_changed_at"} {
+				if err := tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "accounts"}, clause.Column{Name: column}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 2022090101,
+		Name:    "login attempts",
+		// 登录失败、注册次数的计数，见 throttle.go
+		Up: func(tx *gorm.DB) error {
+			type loginAttempt struct {
+				Key       string    `gorm:"primarykey;size:128"`
+				Count     int       `gorm:"not null;default:0"`
+				LastAt    time.Time `gorm:"not null"`
+				ExpiresAt time.Time `gorm:"not null;index"`
+			}
+			return migrateTables(tx, map[string]interface{}{"login_attempts": &loginAttempt{}})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "login_attempts")
+		},
+	},
+	{
+		Version: 2022091001,
+		Name:    "unique inbox",
+		// 每个用户只能有一个收件箱，同时建收件箱的时候靠唯一索引兜底，见 todo_list.go 的 inbox
+		// 只对 is_inbox 的行唯一：sqlite、postgres 用部分索引，mysql 没有部分索引，用函数索引(8.0.13 以上)，不是收件箱的是 NULL
+		Up: func(tx *gorm.DB) error {
+			// 以前同时建出来的多个收件箱，留下最早的，其他的变成普通清单
+			var keep []uint
+			if err := tx.Table("todo_lists").Where("is_inbox = ?", true).Group("uid").Pluck("MIN(id)", &keep).Error; err != nil {
+				return err
+			}
+			if len(keep) > 0 {
+				if err := tx.Table("todo_lists").Where("is_inbox = ? AND id NOT IN ?", true, keep).Update("is_inbox", false).Error; err != nil {
+					return err
+				}
+			}
+			if tx.Dialector.Name() == DBDriverMySQL {
+				return tx.Exec("CREATE UNIQUE INDEX idx_todo_lists_inbox ON todo_lists ((CASE WHEN is_inbox THEN uid END))").Error
+			}
+			return tx.Exec("CREATE UNIQUE INDEX idx_todo_lists_inbox ON todo_lists (uid) WHERE is_inbox").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropIndex("todo_lists", "idx_todo_lists_inbox")
+		},
+	},
+}
+
+// migrateTables 表不存在就建表，存在就补上缺的字段和索引
+func migrateTables(tx *gorm.DB, tables map[string]interface{}) error {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := tx.Table(name).AutoMigrate(tables[name]); err != nil {
+			return fmt.Errorf("migrate table %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func dropTables(tx *gorm.DB, names ...string) error {
+	for _, name := range names {
+		if err := tx.Migrator().DropTable(name); err != nil {
+			return fmt.Errorf("drop table %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// appliedMigrations 查出已经执行过的版本
+func appliedMigrations(db *gorm.DB) (map[int64]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// pendingMigrations 还没执行的版本
+func pendingMigrations(db *gorm.DB) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrateUp 按顺序执行所有没执行过的版本，返回执行了几个
+func migrateUp(db *gorm.DB) (int, error) {
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	for i, m := range pending {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return i, fmt.Errorf("migrate up %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return len(pending), nil
+}
+
+// migrateDown 回滚最近执行的 n 个版本，返回回滚了几个
+func migrateDown(db *gorm.DB, n int) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	done := 0
+	for i := len(migrations) - 1; i >= 0 && done < n; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate down %d %s: %w", m.Version, m.Name, err)
+		}
+		done++
+	}
+	return done, nil
+}
+
+// checkSchema 启动前检查表结构是不是最新的，落后了就拒绝启动，免得新代码查不存在的字段
+func checkSchema(db *gorm.DB) error {
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is behind: %d pending migrations starting at %d %s, run `migrate up` first",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
+
+// runMigrateCommand 处理 migrate up|down|status 命令
+func runMigrateCommand(db *gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [n]|status")
+	}
+	switch args[0] {
+	case "up":
+		n, err := migrateUp(db)
+		fmt.Printf("applied %d migrations\n", n)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			v, err := strconv.Atoi(args[1])
+			if err != nil || v < 1 {
+				return fmt.Errorf("invalid migrate down steps %q", args[1])
+			}
+			steps = v
+		}
+		n, err := migrateDown(db, steps)
+		fmt.Printf("rolled back %d migrations\n", n)
+		return err
+	case "status":
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if row, ok := applied[m.Version]; ok {
+				fmt.Printf("%d  applied %s  %s\n", m.Version, row.AppliedAt.Format(time.RFC3339), m.Name)
+			} else {
+				fmt.Printf("%d  pending                     %s\n", m.Version, m.Name)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q, usage: migrate up|down [n]|status", args[0])
+}
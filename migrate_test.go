@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func Test_migrate(t *testing.T) {
+	conn, err := openDB(DBConfig{Driver: DBDriverSQLite, DSN: ":memory:"})
+	if err != nil {
+		t.Fatalf("openDB() err = %v", err)
+	}
+	testMigrate(t, conn)
+}
+
+// testMigrate 在空库上升级、全部回滚、再升级，检查几个有数据迁移的版本
+// 各个数据库的 sql 不一样(重命名列、部分索引)，integration_test.go 里 mysql、postgres 也跑这个
+func testMigrate(t *testing.T, conn *gorm.DB) {
+	if err := checkSchema(conn); err == nil {
+		t.Fatalf("checkSchema() on empty database err = nil")
+	}
+
+	if n, err := migrateUp(conn); err != nil || n != len(migrations) {
+		t.Fatalf("migrateUp() = %d, %v", n, err)
+	}
+	if err := checkSchema(conn); err != nil {
+		t.Fatalf("checkSchema() err = %v", err)
+	}
+	// 已经是最新的了，再执行一次什么也不做
+	if n, err := migrateUp(conn); err != nil || n != 0 {
+		t.Fatalf("migrateUp() again = %d, %v", n, err)
+	}
+
+	// 全部回滚再升级回来，保证每个版本的 Down 都能执行
+	if n, err := migrateDown(conn, len(migrations)); err != nil || n != len(migrations) {
+		t.Fatalf("migrateDown() = %d, %v", n, err)
+	}
+	if conn.Migrator().HasTable("todos") {
+		t.Errorf("table todos still exists after migrate down")
+	}
+	if n, err := migrateUp(conn); err != nil || n != len(migrations) {
+		t.Fatalf("migrateUp() after down = %d, %v", n, err)
+	}
+
+	// 老的 status=false 的用户升级之后是禁用状态
+	n := 0
+	for _, m := range migrations {
+		if m.Version >= 2022082001 {
+			n++
+		}
+	}
+	if _, err := migrateDown(conn, n); err != nil {
+		t.Fatalf("migrateDown(%d) err = %v", n, err)
+	}
+	if err := conn.Exec("INSERT INTO accounts (uid, name, status) VALUES (?, ?, ?), (?, ?, ?)", 10, "old_disabled", false, 11, "old_active", true).Error; err != nil {
+		t.Fatalf("insert old accounts err = %v", err)
+	}
+	if _, err := migrateUp(conn); err != nil {
+		t.Fatalf("migrateUp() after down %d err = %v", n, err)
+	}
+	for name, want := range map[string]string{"old_disabled": AccountDisabled, "old_active": AccountActive} {
+		var account Account
+		if err := conn.Where("name = ?", name).First(&account).Error; err != nil || account.Status != want {
+			t.Errorf("%s status = %q, %v, want %q", name, account.Status, err, want)
+		}
+	}
+
+	// 以前同时建出来的两个收件箱，升级之后只留下最早的
+	if _, err := migrateDown(conn, 1); err != nil {
+		t.Fatalf("migrateDown(1) err = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := conn.Create(&TodoList{Uid: 11, Name: InboxName, IsInbox: true}).Error; err != nil {
+			t.Fatalf("create inbox %d err = %v", i, err)
+		}
+	}
+	if _, err := migrateUp(conn); err != nil {
+		t.Fatalf("migrateUp() unique inbox err = %v", err)
+	}
+	var inboxes []TodoList
+	if err := conn.Where("uid = ? and is_inbox = ?", 11, true).Find(&inboxes).Error; err != nil || len(inboxes) != 1 {
+		t.Errorf("inboxes after migrate = %+v, %v", inboxes, err)
+	}
+	if err := conn.Create(&TodoList{Uid: 11, Name: InboxName, IsInbox: true}).Error; err == nil {
+		t.Errorf("create second inbox err = nil")
+	}
+	if err := conn.Create(&TodoList{Uid: 11, Name: "工作"}).Error; err != nil {
+		t.Errorf("create list err = %v", err)
+	}
+
+	// 唯一索引生效
+	if err := conn.Create(&Account{Uid: 1, Name: "tom"}).Error; err != nil {
+		t.Fatalf("create account err = %v", err)
+	}
+	if err := conn.Create(&Account{Uid: 2, Name: "tom"}).Error; err == nil {
+		t.Errorf("create account with duplicate name err = nil")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+// 通知渠道，提醒(见 reminder.go)到时间了通过 Notifier 发出去
+//   inapp    站内信，存到 notifications 表里，前端用下面的接口查
+//   webhook  POST 一个 json 到用户填的地址，和 webhook.go 一样不能调用本机、内网地址，不跟跳转
+//   email    发邮件，要配置 notify.smtp_addr，没配置的不能选
+// 站内信：
+//   GET  /api/v1/notifications            最近的站内信，按时间倒序，unread=true 只看未读的，limit 默认 100
+//   POST /api/v1/notifications/:id/read   标记已读
+//   POST /api/v1/notifications/read       全部标记已读
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 通知渠道
+const (
+	ChannelInApp   = "inapp"
+	ChannelWebhook = "webhook"
+	ChannelEmail   = "email"
+)
+
+// Message 发给用户的一条通知
+type Message struct {
+	Uid    int64      `json:"-"`
+	TodoID uint       `json:"todo_id"`
+	Title  string     `json:"title"`
+	Body   string     `json:"body"`
+	DueAt  *time.Time `json:"due_at"`
+	Target string     `json:"-"` // webhook 地址、邮箱，站内信不用
+}
+
+// Notifier 一种通知渠道，返回错误的提醒过一会儿重试
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// newNotifiers 按配置创建所有能用的通知渠道，key 是 ChannelXXX
+func newNotifiers(cfg NotifyConfig, notifications NotificationRepository) map[string]Notifier {
+	notifiers := map[string]Notifier{
+		ChannelInApp:   &inAppNotifier{notifications: notifications},
+		ChannelWebhook: &webhookNotifier{client: newWebhookClient(cfg.WebhookTimeout)},
+	}
+	if cfg.SMTPAddr != "" {
+		notifiers[ChannelEmail] = &smtpNotifier{
+			addr:     cfg.SMTPAddr,
+			from:     cfg.SMTPFrom,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+		}
+	}
+	return notifiers
+}
+
+// ------------------------- 站内信 -------------------------
+
+// Notification 站内信表
+type Notification struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time  `gorm:"index" json:"created_at"`
+	Uid       int64      `gorm:"not null;default:0;index" json:"-"`
+	TodoID    uint       `gorm:"not null;default:0" json:"todo_id"`
+	Title     string     `gorm:"size:255;not null" json:"title"`
+	Body      string     `gorm:"type:text" json:"body"`
+	ReadAt    *time.Time `json:"read_at"` // 为空代表未读
+}
+
+type inAppNotifier struct {
+	notifications NotificationRepository
+}
+
+func (n *inAppNotifier) Notify(ctx context.Context, msg Message) error {
+	return n.notifications.Create(&Notification{Uid: msg.Uid, TodoID: msg.TodoID, Title: msg.Title, Body: msg.Body})
+}
+
+// ------------------------- webhook -------------------------
+
+type webhookNotifier struct {
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, msg.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: status %d", msg.Target, resp.StatusCode)
+	}
+	return nil
+}
+
+// ------------------------- 邮件 -------------------------
+
+type smtpNotifier struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		host, _, _ := net.SplitHostPort(n.addr)
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+	// smtp.SendMail 不支持 context，超时靠 smtp 服务器自己断开
+	return smtp.SendMail(n.addr, auth, n.from, []string{msg.Target}, n.mail(msg))
+}
+
+// mail 拼邮件内容，标题有中文，按 RFC 2047 编码
+func (n *smtpNotifier) mail(msg Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + n.from + "\r\n")
+	b.WriteString("To: " + msg.Target + "\r\n")
+	b.WriteString("Subject: " + mime.BEncoding.Encode("UTF-8", msg.Title) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n") + "\r\n")
+	return []byte(b.String())
+}
+
+// ------------------------- 接口 -------------------------
+
+// listNotificationsHandler 站内信列表
+func (s *Server) listNotificationsHandler(c *gin.Context) {
+	limit := defaultTodoLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTodoLimit {
+			renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "limit", Reason: "range"}))
+			return
+		}
+		limit = n
+	}
+	unread := false
+	if v := c.Query("unread"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "unread", Reason: "bool"}))
+			return
+		}
+		unread = b
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	notifications, err := s.notifications.List(uid, unread, limit)
+	if err != nil {
+		renderError(c, fmt.Errorf("notifications.List: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: notifications,
+	})
+}
+
+// readNotificationHandler 标记已读
+func (s *Server) readNotificationHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if err := s.notifications.MarkRead(uid, uint(id), time.Now()); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			renderError(c, ErrNotificationNotFound)
+			return
+		}
+		renderError(c, fmt.Errorf("notifications.MarkRead: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+	})
+}
+
+// readAllNotificationsHandler 全部标记已读，返回标记了多少条
+func (s *Server) readAllNotificationsHandler(c *gin.Context) {
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	n, err := s.notifications.MarkAllRead(uid, time.Now())
+	if err != nil {
+		renderError(c, fmt.Errorf("notifications.MarkAllRead: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: gin.H{"read": n},
+	})
+}
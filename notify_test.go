@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request = %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		if got.Title == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	n := &webhookNotifier{client: srv.Client()}
+	if err := n.Notify(context.Background(), Message{TodoID: 1, Title: "提醒：写周报", Target: srv.URL}); err != nil {
+		t.Fatalf("Notify() err = %v", err)
+	}
+	if got.TodoID != 1 || got.Title != "提醒：写周报" {
+		t.Errorf("body = %+v", got)
+	}
+	if err := n.Notify(context.Background(), Message{Title: "fail", Target: srv.URL}); err == nil {
+		t.Error("Notify() status 500 err = nil")
+	}
+
+	// 真正用的 client 和 webhook.go 一样，连不上本机、内网地址，也不跟跳转
+	n = newNotifiers(NotifyConfig{WebhookTimeout: time.Second}, nil)[ChannelWebhook].(*webhookNotifier)
+	if err := n.Notify(context.Background(), Message{Title: "提醒", Target: srv.URL}); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("Notify() loopback err = %v, want errBlockedAddress", err)
+	}
+	conf.Webhook.AllowPrivate = true
+	defer func() { conf.Webhook.AllowPrivate = false }()
+	redirect := httptest.NewServer(http.RedirectHandler(srv.URL, http.StatusFound))
+	defer redirect.Close()
+	if err := n.Notify(context.Background(), Message{Title: "提醒", Target: redirect.URL}); err == nil {
+		t.Error("Notify() redirect err = nil")
+	}
+}
+
+// fakeSMTP 只会最基本的 smtp 对话，收到的邮件内容发到返回的 chan
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	mails := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var b strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					b.WriteString(line)
+				}
+				mails <- b.String()
+				reply("250 ok")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, mails := fakeSMTP(t)
+	n := &smtpNotifier{addr: addr, from: "todo@example.com"}
+	err := n.Notify(context.Background(), Message{Title: "提醒：写周报", Body: "写周报\n截止时间：2022-06-03 18:00", Target: "tom@example.com"})
+	if err != nil {
+		t.Fatalf("Notify() err = %v", err)
+	}
+	mail := <-mails
+	for _, want := range []string{
+		"From: todo@example.com\r\n",
+		"To: tom@example.com\r\n",
+		"Subject: =?UTF-8?b?",
+		"Content-Type: text/plain; charset=UTF-8\r\n",
+		"\r\n\r\n写周报\r\n截止时间：2022-06-03 18:00\r\n",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail = %q, want contains %q", mail, want)
+		}
+	}
+}
+
+func Test_truncateError(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"timeout", 255, "timeout"},
+		{"abcdef", 3, "abc"},
+		{"地址不对", 4, "地"},      // 第二个字只剩 1 字节，去掉
+		{"地址不对", 6, "地址"},     // 正好在字符边界
+		{"a\xffb", 255, "ab"}, // 本来就不合法的字节也去掉
+	} {
+		got := truncateError(c.s, c.n)
+		if got != c.want || !utf8.ValidString(got) || len(got) > c.n {
+			t.Errorf("truncateError(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+}
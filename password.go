@@ -0,0 +1,162 @@
+package main
+
+// 密码加密、校验的相关代码
+// 老版本用 md5secret 做密码加密：md5 + 全局的盐，所有用户共用一个盐，库被拖走之后很容易被彩虹表撞出来
+// 现在改成 argon2id(默认) / bcrypt，每个用户随机生成自己的盐，盐和参数都编码在 Password 字段里
+// Account.PwdAlgo 记录这条记录用的是哪种算法，老数据这个字段是空字符串，当作 md5 处理
+// 老用户登录成功的时候，用明文密码重新加密一遍，写回数据库，这样老数据慢慢就迁移完了，不用逼所有用户重置密码
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PwdAlgoMD5      = "md5"      // 老数据，只用来校验，登录成功后会被升级掉
+	PwdAlgoBcrypt   = "bcrypt"   // bcrypt，盐和cost都在hash字符串里
+	PwdAlgoArgon2id = "argon2id" // argon2id，格式：$argon2id$v=19$m=65536,t=1,p=4$盐$hash
+)
+
+// bcryptCost bcrypt的计算成本，调大之后，老的hash登录时会自动重新加密
+var bcryptCost = bcrypt.DefaultCost
+
+// argon2Params argon2id 的参数，调整参数之后，老参数的hash登录时也会自动重新加密
+type argon2Params struct {
+	Memory  uint32 // 单位 KiB
+	Time    uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}
+
+var defaultArgon2Params = argon2Params{
+	Memory:  64 * 1024,
+	Time:    1,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// 密码最长多少字节：bcrypt 只处理前 72 字节，超过了 GenerateFromPassword 直接报错；
+// argon2id 没有这个限制，但也不能让人传很长的字符串进来，每次都要算一遍 64 MiB 的 hash
+const (
+	bcryptMaxPasswordBytes = 72
+	maxPasswordBytes       = 256
+)
+
+// passwordMaxBytes 配置的算法能处理的密码长度，参数校验里 max=128 限制的是字符数，中文一个字 3 字节，还要再按字节检查
+func passwordMaxBytes() int {
+	if conf.Auth.PwdAlgo == PwdAlgoBcrypt {
+		return bcryptMaxPasswordBytes
+	}
+	return maxPasswordBytes
+}
+
+// hashPassword 用配置的算法(conf.Auth.PwdAlgo)加密密码，返回算法名和加密后的字符串，分别存到 Account.PwdAlgo 和 Account.Password
+// 密码太长返回 ErrInvalidParam，调用方直接 renderError
+func hashPassword(pwd string) (algo string, hash string, err error) {
+	if len(pwd) > passwordMaxBytes() {
+		return "", "", ErrInvalidParam.WithFields(FieldError{Field: "password", Reason: "max"})
+	}
+	switch conf.Auth.PwdAlgo {
+	case PwdAlgoBcrypt:
+		b, err := bcrypt.GenerateFromPassword([]byte(pwd), bcryptCost)
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			return "", "", ErrInvalidParam.WithFields(FieldError{Field: "password", Reason: "max"})
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return PwdAlgoBcrypt, string(b), nil
+	case PwdAlgoArgon2id:
+		hash, err := argon2idHash(pwd, defaultArgon2Params)
+		if err != nil {
+			return "", "", err
+		}
+		return PwdAlgoArgon2id, hash, nil
+	}
+	return "", "", fmt.Errorf("unsupported password algo %q", conf.Auth.PwdAlgo)
+}
+
+// verifyPassword 校验明文密码和数据库中的hash是否匹配，比较都在 Go 里用常量时间完成，不再拼到sql条件里
+// needRehash 为 true 代表 算法 或者 参数 已经过时，调用方应该在登录成功后重新加密写回数据库
+func verifyPassword(algo, hash, pwd string) (ok bool, needRehash bool) {
+	switch algo {
+	case "", PwdAlgoMD5: // 老数据 PwdAlgo 是空的
+		ok = subtle.ConstantTimeCompare([]byte(md5secret(pwd)), []byte(hash)) == 1
+		return ok, ok
+	case PwdAlgoBcrypt:
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return true, err != nil || cost != bcryptCost || conf.Auth.PwdAlgo != PwdAlgoBcrypt
+	case PwdAlgoArgon2id:
+		p, salt, key, err := argon2idDecode(hash)
+		if err != nil {
+			return false, false
+		}
+		other := argon2.IDKey([]byte(pwd), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false
+		}
+		p.KeyLen, p.SaltLen = uint32(len(key)), len(salt)
+		return true, p != defaultArgon2Params || conf.Auth.PwdAlgo != PwdAlgoArgon2id
+	}
+	return false, false
+}
+
+// dummyVerifyPassword 用户不存在的时候也算一次hash，让 "用户不存在" 和 "密码错误" 的响应时间差不多，防止通过耗时猜用户名
+func dummyVerifyPassword(pwd string) {
+	// 太长的 hashPassword 直接返回错误，截断了也要算一遍，和校验真正的密码一样慢
+	if n := passwordMaxBytes(); len(pwd) > n {
+		pwd = pwd[:n]
+	}
+	_, _, _ = hashPassword(pwd)
+}
+
+// argon2idHash 随机生成盐，按 PHC 字符串格式编码
+func argon2idHash(pwd string, p argon2Params) (string, error) {
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pwd), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// argon2idDecode 解析 argon2idHash 生成的字符串，拿到参数、盐 和 hash
+func argon2idDecode(hash string) (p argon2Params, salt, key []byte, err error) {
+	// 切割后：["", "argon2id", "v=19", "m=65536,t=1,p=4", 盐, hash]
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PwdAlgoArgon2id {
+		return p, nil, nil, errInvalidHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errInvalidHash
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	return p, salt, key, nil
+}
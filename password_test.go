@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_hashPassword(t *testing.T) {
+	for _, algo := range []string{PwdAlgoArgon2id, PwdAlgoBcrypt} {
+		t.Run(algo, func(t *testing.T) {
+			old := conf.Auth.PwdAlgo
+			conf.Auth.PwdAlgo = algo
+			defer func() { conf.Auth.PwdAlgo = old }()
+
+			gotAlgo, hash, err := hashPassword("123456")
+			if err != nil || gotAlgo != algo {
+				t.Fatalf("hashPassword() algo = %v, err = %v", gotAlgo, err)
+			}
+			if ok, needRehash := verifyPassword(gotAlgo, hash, "123456"); !ok || needRehash {
+				t.Errorf("verifyPassword() ok = %v, needRehash = %v", ok, needRehash)
+			}
+			if ok, _ := verifyPassword(gotAlgo, hash, "654321"); ok {
+				t.Errorf("verifyPassword() accepted wrong password")
+			}
+			// 每个用户的盐不一样，同一个密码两次加密结果不同
+			if _, hash2, _ := hashPassword("123456"); hash2 == hash {
+				t.Errorf("hashPassword() returned the same hash twice")
+			}
+
+			// 按字节限制长度，超过了是参数错误，不是服务端异常
+			max := passwordMaxBytes()
+			if _, _, err := hashPassword(strings.Repeat("a", max)); err != nil {
+				t.Errorf("hashPassword(%d bytes) err = %v", max, err)
+			}
+			var e *APIError
+			if _, _, err := hashPassword(strings.Repeat("a", max+1)); !errors.As(err, &e) || e.Code != ErrInvalidParam.Code ||
+				len(e.Fields) != 1 || e.Fields[0].Reason != "max" {
+				t.Errorf("hashPassword(%d bytes) err = %v, want invalid_param", max+1, err)
+			}
+			// 30 个汉字 90 字节，bcrypt 放不下
+			_, _, err = hashPassword(strings.Repeat("密", 30))
+			if got := err != nil; got != (algo == PwdAlgoBcrypt) {
+				t.Errorf("hashPassword(30 chinese chars) err = %v", err)
+			}
+		})
+	}
+}
+
+func Test_verifyPassword_legacyMD5(t *testing.T) {
+	hash := md5secret("123456")
+	if ok, needRehash := verifyPassword("", hash, "123456"); !ok || !needRehash {
+		t.Errorf("verifyPassword() ok = %v, needRehash = %v, want true, true", ok, needRehash)
+	}
+	if ok, _ := verifyPassword("", hash, "1234567"); ok {
+		t.Errorf("verifyPassword() accepted wrong password")
+	}
+}
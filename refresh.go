@@ -0,0 +1,163 @@
+package main
+
+// 刷新token相关代码
+// access token(jwt) 有效期短，过期后前端拿 refresh token 调 /token/refresh 换一对新的 token，不用重新登录
+// refresh token 是随机字符串，数据库只存它的 sha256，每次使用后就作废，同时签发一个新的(轮换)
+// 同一次登录派生出来的 refresh token 属于同一个 family，
+// 如果已经用过的 refresh token 又被拿来用，说明 token 可能被盗了，直接吊销整个 family，双方都得重新登录
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RefreshToken 刷新token表
+type RefreshToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Uid       int64      `gorm:"not null;default:0;index"`
+	FamilyID  string     `gorm:"column:family_id;size:64;not null;index"`   // 同一次登录轮换出来的token共用一个 family
+	TokenHash string     `gorm:"column:token_hash;size:64;not null;unique"` // token 的 sha256，不存明文
+	ExpiresAt time.Time  `gorm:"not null"`
+	UsedAt    *time.Time // 已经换过新token的时间，不为空代表已经用过了
+	RevokedAt *time.Time // 吊销时间，不为空代表不能再用
+}
+
+// TokenPair 登录 和 刷新token 成功后返回给前端的数据
+type TokenPair struct {
+	Token        string `json:"token"`         // access token，放到请求头 Authorization: Bearer xxx
+	RefreshToken string `json:"refresh_token"` // 用来调 /token/refresh 换新的token
+	ExpiresIn    int64  `json:"expires_in"`    // access token 多少秒后过期
+}
+
+type RefreshParam struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// genTokenPair 生成 access token 和 refresh token，family 为空代表新的一次登录
+func (s *Server) genTokenPair(uid int64, name, role string, family string) (*TokenPair, error) {
+	token, err := s.keys.GenToken(uid, name, role)
+	if err != nil {
+		return nil, err
+	}
+	if family == "" {
+		if family, err = randomToken(16); err != nil {
+			return nil, err
+		}
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	err = s.refreshTokens.Create(&RefreshToken{
+		Uid:       uid,
+		FamilyID:  family,
+		TokenHash: hashRefreshToken(refresh),
+		ExpiresAt: time.Now().Add(conf.Auth.RefreshTokenExpire),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(conf.Auth.TokenExpire / time.Second),
+	}, nil
+}
+
+// refreshTokenHandler 用 refresh token 换一对新的token
+func (s *Server) refreshTokenHandler(c *gin.Context) {
+	var param RefreshParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+
+	rt, err := s.refreshTokens.GetByHash(hashRefreshToken(param.RefreshToken))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			renderError(c, ErrRefreshTokenInvalid)
+			return
+		}
+		renderError(c, fmt.Errorf("refreshTokens.GetByHash: %w", err))
+		return
+	}
+
+	now := time.Now()
+	// 已经用过 或者 被吊销的token又来了，认为token泄露，吊销整个 family
+	if rt.UsedAt != nil || rt.RevokedAt != nil {
+		s.revokeRefreshFamily(rt.FamilyID)
+		renderError(c, ErrRefreshTokenInvalid)
+		return
+	}
+	if now.After(rt.ExpiresAt) {
+		renderError(c, ErrRefreshTokenExpired)
+		return
+	}
+
+	// 用条件更新标记为已使用，两个请求同时拿同一个token来换，只有一个能更新成功，另一个按重复使用处理
+	marked, err := s.refreshTokens.MarkUsed(rt.ID, now)
+	if err != nil {
+		renderError(c, fmt.Errorf("refreshTokens.MarkUsed: %w", err))
+		return
+	}
+	if !marked {
+		s.revokeRefreshFamily(rt.FamilyID)
+		renderError(c, ErrRefreshTokenInvalid)
+		return
+	}
+
+	// 重新查一下用户，拿到最新的用户名和角色，用户被删了、不是正常状态了就不能再续期
+	u, err := s.accounts.GetByUid(rt.Uid)
+	if err != nil {
+		renderError(c, ErrRefreshTokenInvalid)
+		return
+	}
+	if err := accountStatusError(u); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	pair, err := s.genTokenPair(u.Uid, u.Name, u.Role, rt.FamilyID)
+	if err != nil {
+		renderError(c, fmt.Errorf("genTokenPair: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: pair,
+	})
+}
+
+// revokeRefreshFamily 吊销一个 family 下所有的 refresh token
+func (s *Server) revokeRefreshFamily(family string) {
+	if err := s.refreshTokens.RevokeFamily(family, time.Now()); err != nil {
+		fmt.Println("revokeRefreshFamily err:", err)
+	}
+}
+
+// randomToken 生成 n 字节的随机数，base64url 编码
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRefreshToken 数据库里只存 refresh token 的 sha256，库泄露了也拿不到能用的token
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
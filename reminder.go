@@ -0,0 +1,306 @@
+package main
+
+// 提醒，一个待办事项可以有多个提醒，到时间了通过通知渠道(见 notify.go)发出去
+//   GET    /api/v1/todo/:id/reminders                查询待办事项的提醒
+//   POST   /api/v1/todo/:id/reminders                新建提醒
+//   DELETE /api/v1/todo/:id/reminders/:reminder_id   删除提醒
+// 新建的参数，at 和 offset 二选一：
+//   {"at": "2022-06-01T09:00:00+08:00", "channel": "inapp"}                               固定时间提醒
+//   {"offset": -1800, "channel": "email", "target": "tom@example.com"}                     截止前半小时提醒，单位秒
+//   {"offset": 0, "channel": "webhook", "target": "https://example.com/hook"}              到截止时间提醒
+// 相对截止时间的提醒，截止时间改了会重新算；没有截止时间的先不发，等设置了截止时间再算
+// 重复的待办事项生成下一次的时候，相对截止时间的提醒也带过去，固定时间的不带
+//
+// 提醒都存在数据库里，runReminders 定时查出到时间了的发出去，服务重启了也不会丢，重启期间错过的启动后马上补发
+// 发送失败的隔一段时间重试，最多 maxReminderAttempts 次；待办事项删除或者完成了就不发了
+// 共享清单里的待办事项，成员都能设自己的提醒，只看得到自己设的；退出清单之后就不发了，见 share.go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 提醒的状态
+const (
+	ReminderPending   = "pending"   // 等着发
+	ReminderSent      = "sent"      // 发送成功
+	ReminderFailed    = "failed"    // 重试次数用完了
+	ReminderCancelled = "cancelled" // 到时间的时候待办事项已经删除或者完成了
+)
+
+const (
+	maxReminderAttempts = 5
+	reminderBatch       = 100              // 每次最多处理多少条
+	reminderLease       = 5 * time.Minute  // 抢到之后多久没发完，别的实例可以再发
+	maxReminderOffset   = 30 * 24 * 3600   // offset 最多前后 30 天
+	reminderSendTimeout = 30 * time.Second // 发一条最多等多久
+)
+
+// Reminder 提醒表
+type Reminder struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Uid     int64      `gorm:"not null;default:0;index" json:"-"`
+	TodoID  uint       `gorm:"not null;default:0;index" json:"todo_id"`
+	At      *time.Time `json:"at"`                                  // 固定时间提醒
+	Offset  *int64     `gorm:"column:offset_seconds" json:"offset"` // 相对截止时间提醒，单位秒，负数是截止之前
+	Channel string     `gorm:"size:16;not null" json:"channel"`
+	Target  string     `gorm:"size:255;not null;default:''" json:"target"` // webhook 地址、邮箱
+
+	Status    string     `gorm:"size:16;not null;index:idx_reminders_status_fire_at,priority:1" json:"status"`
+	FireAt    *time.Time `gorm:"index:idx_reminders_status_fire_at,priority:2" json:"fire_at"` // 什么时候发，为空代表还没有截止时间
+	SentAt    *time.Time `json:"sent_at"`
+	Attempts  int        `gorm:"not null;default:0" json:"attempts"`
+	LastError string     `gorm:"size:255;not null;default:''" json:"last_error"`
+	Version   int        `gorm:"not null;default:1" json:"-"` // 多个实例同时发的时候用来抢，见 ReminderRepository.Claim
+}
+
+type ReminderParam struct {
+	At      *time.Time `json:"at"`
+	Offset  *int64     `json:"offset"`
+	Channel string     `json:"channel" binding:"required,oneof=inapp webhook email"`
+	Target  string     `json:"target" binding:"max=255"`
+}
+
+// schedule 按截止时间算出什么时候发，重新等着发
+func (r *Reminder) schedule(due *time.Time) {
+	r.FireAt = r.At
+	if r.Offset != nil {
+		r.FireAt = nil
+		if due != nil {
+			t := due.Add(time.Duration(*r.Offset) * time.Second)
+			r.FireAt = &t
+		}
+	}
+	r.Status, r.SentAt, r.Attempts, r.LastError = ReminderPending, nil, 0, ""
+}
+
+// listRemindersHandler 查询待办事项的提醒
+func (s *Server) listRemindersHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if _, err := s.authorizeTodo(uid, uint(id), ListRoleViewer); err != nil {
+		renderError(c, err)
+		return
+	}
+	reminders, err := s.reminders.ListByTodo(uid, uint(id))
+	if err != nil {
+		renderError(c, fmt.Errorf("reminders.ListByTodo: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: reminders,
+	})
+}
+
+// createReminderHandler 新建提醒
+func (s *Server) createReminderHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	var param ReminderParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	if err := s.checkReminder(&param); err != nil {
+		renderError(c, err)
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	todo, err := s.authorizeTodo(uid, uint(id), ListRoleViewer)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	reminder := Reminder{
+		Uid:     uid,
+		TodoID:  todo.ID,
+		At:      param.At,
+		Offset:  param.Offset,
+		Channel: param.Channel,
+		Target:  param.Target,
+	}
+	reminder.schedule(todo.DueAt)
+	if err := s.reminders.Create(&reminder); err != nil {
+		renderError(c, fmt.Errorf("reminders.Create: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: reminder,
+	})
+}
+
+// checkReminder 校验 binding 校验不了的：at 和 offset 二选一，渠道能不能用，target 和渠道对不对得上
+func (s *Server) checkReminder(param *ReminderParam) error {
+	var fields []FieldError
+	switch {
+	case param.At == nil && param.Offset == nil:
+		fields = append(fields, FieldError{Field: "at", Reason: "required"})
+	case param.At != nil && param.Offset != nil:
+		fields = append(fields, FieldError{Field: "offset", Reason: "excluded_with"})
+	case param.Offset != nil && (*param.Offset < -maxReminderOffset || *param.Offset > maxReminderOffset):
+		fields = append(fields, FieldError{Field: "offset", Reason: "range"})
+	}
+	if s.notifiers[param.Channel] == nil {
+		fields = append(fields, FieldError{Field: "channel", Reason: "unsupported"})
+	}
+	switch param.Channel {
+	case ChannelInApp:
+		param.Target = ""
+	case ChannelWebhook:
+		// 和注册 webhook 一样，不能是本机、内网地址，见 webhook.go
+		if reason := webhookURLReason(param.Target); reason != "" {
+			fields = append(fields, FieldError{Field: "target", Reason: reason})
+		}
+	case ChannelEmail:
+		if !validVar(param.Target, "email") {
+			fields = append(fields, FieldError{Field: "target", Reason: "email"})
+		}
+	}
+	if len(fields) > 0 {
+		return ErrInvalidParam.WithFields(fields...)
+	}
+	return nil
+}
+
+// deleteReminderHandler 删除提醒
+func (s *Server) deleteReminderHandler(c *gin.Context) {
+	todoID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("reminder_id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "reminder_id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if err := s.reminders.Delete(uid, uint(todoID), uint(id)); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			renderError(c, ErrReminderNotFound)
+			return
+		}
+		renderError(c, fmt.Errorf("reminders.Delete: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+	})
+}
+
+// rescheduleReminders 截止时间改了之后，所有人相对截止时间的提醒重新算时间
+func (s *Server) rescheduleReminders(todo *Todo) error {
+	if err := s.reminders.Reschedule(todo.ID, todo.DueAt); err != nil {
+		return fmt.Errorf("reminders.Reschedule: %w", err)
+	}
+	return nil
+}
+
+// runReminders 定时发送到时间的提醒，在 main 中用 go 启动
+func (s *Server) runReminders(interval time.Duration) {
+	for {
+		if n, err := s.sendDueReminders(time.Now()); err != nil {
+			fmt.Println("send reminders err:", err)
+		} else if n > 0 {
+			fmt.Printf("sent %d reminders\n", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sendDueReminders 发送 now 之前到时间的提醒，返回处理了多少条
+func (s *Server) sendDueReminders(now time.Time) (int, error) {
+	reminders, err := s.reminders.ListDue(now, reminderBatch)
+	if err != nil {
+		return 0, fmt.Errorf("reminders.ListDue: %w", err)
+	}
+	n := 0
+	for _, r := range reminders {
+		// 先抢过来，别的实例就查不到它了
+		ok, err := s.reminders.Claim(r.ID, r.Version, now.Add(reminderLease))
+		if err != nil {
+			return n, fmt.Errorf("reminders.Claim: %w", err)
+		}
+		if !ok {
+			continue
+		}
+		if err := s.deliverReminder(r, now); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// deliverReminder 发送一条提醒，记录结果，返回的错误是记录结果失败
+func (s *Server) deliverReminder(r Reminder, now time.Time) error {
+	// 设提醒的人已经看不到这个待办事项了(比如退出了共享清单)也不发
+	todo, err := s.authorizeTodo(r.Uid, r.TodoID, ListRoleViewer)
+	if errors.Is(err, ErrTodoNotFound) || (err == nil && todo.Status) {
+		return s.reminders.Finish(r.ID, ReminderCancelled, "", now)
+	}
+	if err != nil {
+		return err
+	}
+	notifier := s.notifiers[r.Channel]
+	if notifier == nil {
+		// 配置改了，比如去掉了 smtp，重试也没用
+		return s.reminders.Finish(r.ID, ReminderFailed, "channel "+r.Channel+" is not configured", now)
+	}
+
+	todo.localize()
+	msg := Message{Uid: r.Uid, TodoID: todo.ID, Title: "提醒：" + todo.Title, Body: todo.Title, DueAt: todo.DueAt, Target: r.Target}
+	if todo.DueAt != nil {
+		msg.Body = fmt.Sprintf("%s\n截止时间：%s", todo.Title, todo.DueAt.Format("2006-01-02 15:04"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reminderSendTimeout)
+	defer cancel()
+	if err := notifier.Notify(ctx, msg); err != nil {
+		lastErr := truncateError(err.Error(), 255)
+		if r.Attempts+1 >= maxReminderAttempts {
+			return s.reminders.Finish(r.ID, ReminderFailed, lastErr, now)
+		}
+		// 1、2、4、8 分钟之后重试
+		return s.reminders.Retry(r.ID, lastErr, now.Add(time.Minute<<r.Attempts))
+	}
+	return s.reminders.Finish(r.ID, ReminderSent, "", now)
+}
+
+// truncateError 错误信息存进数据库之前截断到 n 字节，字段是 size:255
+// 按字节截断可能把一个字符切成两半(错误里可能有用户填的中文地址)，postgres 不收不合法的 UTF-8，
+// 写不进去的话这条一直是发送中，租约过期之后又被拿出来发，永远重试下去；截断之后去掉切坏的半个字符
+func truncateError(s string, n int) string {
+	s = strings.ToValidUTF8(s, "")
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
@@ -0,0 +1,185 @@
+package main
+
+// 数据访问层
+// handler 不再直接用 gorm 操作数据库，而是通过下面的 Repository 接口增删改查
+// 每个接口有两种实现：
+//   gorm 实现(repository_gorm.go)：线上用，mysql / postgres / sqlite 都行
+//   内存实现(repository_memory.go)：测试用，不需要数据库
+// 具体用哪个实现，在 newServer 的时候传进去，见 server.go
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound      = errors.New("record not found") // 记录不存在，或者不属于当前用户
+	ErrDuplicate     = errors.New("record already exists")
+	ErrConflict      = errors.New("record version conflict")  // 乐观锁，记录已经被别人改过了，版本号对不上
+	ErrParentDeleted = errors.New("parent record is deleted") // 上级待办事项在回收站里，子任务不能单独恢复
+)
+
+// TodoRepository 待办事项的增删改查，除了 Find 所有方法都按 uid 过滤，只能操作 uid 的数据
+// 共享清单里的待办事项，handler 先检查权限，再按待办事项真正的所有人的 uid 调用，见 share.go
+type TodoRepository interface {
+	Create(todo *Todo) error
+	Get(uid int64, id uint) (*Todo, error)
+	Find(id uint) (*Todo, error)                 // 不按 uid 过滤，检查权限用，调用方要自己确认能不能看
+	List(uid int64, q TodoQuery) ([]Todo, error) // 按 q 过滤、排序、分页，见 todo_query.go
+	Count(uid int64, q TodoQuery) (int64, error) // 符合过滤条件的总数，不管游标和 limit
+	// Update 修改 ch 里不为空的字段，版本号加1，返回修改后的记录
+	// version 不为0的时候，只有当前版本号等于 version 才修改，不相等返回 ErrConflict，判断和修改在一条 sql 里完成
+	// 改了 list_id 的，所有层的子任务一起移过去，版本号也加1
+	Update(uid int64, id uint, version int, ch TodoChanges) (*Todo, error)
+	// CompleteRecurring 完成重复的待办事项，见 todo_recur.go：按 Update 修改 id，新建下一次 next，
+	// 把 uids 这些人在 id 上打的标签、相对截止时间的提醒带到 next 上；在一个事务里完成，不会完成了却没有下一次
+	CompleteRecurring(uid int64, id uint, version int, ch TodoChanges, next *Todo, uids []int64) (*Todo, error)
+	// Delete 软删除，version 和 Update 一样，只检查这一条的版本号
+	// 所有层的子任务一起删除，删除时间和这一条一样
+	Delete(uid int64, id uint, version int) error
+
+	// 子任务，见 subtask.go
+	Children(uid int64, parentIDs []uint) ([]Todo, error)          // parentIDs 的直接子任务，按 id 排序
+	Progress(uid int64, ids []uint) (map[uint]TodoProgress, error) // ids 的直接子任务完成了几个，没有子任务的不在 map 里
+
+	// 回收站，见 trash.go，只操作已经软删除的记录
+	ListDeleted(uid int64, limit int) ([]Todo, error) // 按删除时间倒序
+	// Restore 恢复，版本号加1，和它一起删除的子任务也一起恢复
+	// 上级还在回收站里返回 ErrParentDeleted，上级已经彻底删除了就恢复成顶层的待办事项
+	Restore(uid int64, id uint) (*Todo, error)
+	Purge(uid int64, id uint) error                     // 彻底删除一条，连同回收站里它所有层的子任务
+	PurgeAll(uid int64) (int64, error)                  // 清空回收站，返回删除了多少条
+	PurgeDeletedBefore(before time.Time) (int64, error) // 所有用户删除时间早于 before 的都彻底删除，定时任务用
+
+	// MoveList 把 from 清单里所有的待办事项(包括回收站里的)移到 to 清单，删除清单的时候用，返回移动了多少条
+	MoveList(uid int64, from, to uint) (int64, error)
+}
+
+// TodoListRepository 清单的增删改查，见 todo_list.go
+type TodoListRepository interface {
+	Create(list *TodoList) error // 已经有收件箱了再建收件箱返回 ErrDuplicate
+	Get(uid int64, id uint) (*TodoList, error)
+	Find(id uint) (*TodoList, error) // 不按 uid 过滤，检查权限用，见 share.go
+	GetInbox(uid int64) (*TodoList, error)
+	List(uid int64) ([]TodoList, error) // 收件箱排第一个，其他的按创建顺序
+	Rename(uid int64, id uint, name string) (*TodoList, error)
+	Delete(uid int64, id uint) error // 软删除
+}
+
+// TagRepository 标签的增删改查，标签和待办事项是多对多的关系，存在 todo_tags 表里，见 tag.go
+type TagRepository interface {
+	Create(tag *Tag) error // 同一个用户的标签重名返回 ErrDuplicate
+	Get(uid int64, id uint) (*Tag, error)
+	List(uid int64) ([]Tag, error)                               // 按名字排序
+	Update(uid int64, id uint, name, color string) (*Tag, error) // 重名返回 ErrDuplicate
+	Delete(uid int64, id uint) error                             // 所有待办事项上的这个标签一起去掉
+
+	// 打标签、去掉标签，已经打过的再打不报错，调用方要先确认待办事项和标签都是自己的
+	Attach(todoID, tagID uint) error
+	Detach(todoID, tagID uint) error
+	ListByTodos(uid int64, todoIDs []uint) (map[uint][]Tag, error) // 每个待办事项打了哪些标签，按名字排序
+}
+
+// ListMemberRepository 共享清单的成员和邀请，见 share.go
+type ListMemberRepository interface {
+	Create(m *ListMember) error // 已经是成员或者邀请过了返回 ErrDuplicate
+	Get(listID, id uint) (*ListMember, error)
+	GetByUser(listID uint, uid int64) (*ListMember, error)
+	ListByList(listID uint) ([]ListMember, error)              // 按 id 排序
+	ListByUser(uid int64, status string) ([]ListMember, error) // 按 id 排序
+	UpdateRole(listID, id uint, role string) (*ListMember, error)
+	Delete(listID, id uint) error
+	DeleteByList(listID uint) error // 删除清单的时候用
+
+	// 被邀请的人处理邀请，只能处理发给自己的、还没接受的，不然返回 ErrNotFound
+	Accept(uid int64, id uint, at time.Time) (*ListMember, error)
+	Decline(uid int64, id uint) error
+}
+
+// ReminderRepository 提醒的存储，见 reminder.go
+type ReminderRepository interface {
+	Create(r *Reminder) error
+	ListByTodo(uid int64, todoID uint) ([]Reminder, error) // 按 id 排序
+	Delete(uid int64, todoID, id uint) error
+	// Reschedule 截止时间改成 due，所有人在这个待办事项上设的相对截止时间的提醒重新算时间、重新等着发
+	Reschedule(todoID uint, due *time.Time) error
+
+	// 下面是定时任务用的，不按用户过滤
+	ListDue(now time.Time, limit int) ([]Reminder, error) // 等着发并且到时间了的，按时间排序
+	// Claim 版本号还是 version 才抢到，抢到的把发送时间推到 until、版本号加1
+	// 多个实例同时跑只有一个能抢到，抢到之后进程挂了，到 until 会再发一次
+	Claim(id uint, version int, until time.Time) (bool, error)
+	Finish(id uint, status, lastErr string, at time.Time) error // 改成 sent、failed 或者 cancelled，sent 记录发送时间，failed 次数加1
+	Retry(id uint, lastErr string, fireAt time.Time) error      // 发送失败，次数加1，到 fireAt 再试
+}
+
+// WebhookRepository 用户注册的 webhook 和 发送记录(发件箱)，见 webhook.go
+type WebhookRepository interface {
+	Create(e *WebhookEndpoint) error
+	Get(uid int64, id uint) (*WebhookEndpoint, error)
+	List(uid int64) ([]WebhookEndpoint, error) // 按 id 排序
+	Update(uid int64, id uint, url, events string, active bool) (*WebhookEndpoint, error)
+	Delete(uid int64, id uint) error // 发送记录一起删除
+
+	CreateDelivery(d *WebhookDelivery) error
+	GetDelivery(uid int64, endpointID, id uint) (*WebhookDelivery, error)
+	ListDeliveries(uid int64, endpointID uint, limit int) ([]WebhookDelivery, error) // 按 id 倒序
+	ListAttempts(deliveryID uint) ([]WebhookAttempt, error)                          // 按 id 排序
+
+	// 下面是后台发送用的，不按用户过滤
+	ListDue(now time.Time, limit int) ([]WebhookDelivery, error) // 等着发并且到时间了的，按时间排序
+	// Claim 和 ReminderRepository.Claim 一样，抢到的把下次发送时间推到 until、版本号加1
+	Claim(id uint, version int, until time.Time) (bool, error)
+	// RecordAttempt 记一次发送：保存 attempt，次数加1，状态改成 status，next 是下次什么时候发
+	// 成功的时候 delivered_at 是 attempt.CreatedAt
+	RecordAttempt(id uint, attempt *WebhookAttempt, status string, next *time.Time) error
+	PurgeDeliveries(before time.Time) (int64, error) // 删除 before 之前结束(成功或者失败)的发送记录
+}
+
+// NotificationRepository 站内信的存储，见 notify.go
+type NotificationRepository interface {
+	Create(n *Notification) error
+	List(uid int64, unreadOnly bool, limit int) ([]Notification, error) // 按时间倒序
+	MarkRead(uid int64, id uint, at time.Time) error                    // 已经读过的不改时间
+	MarkAllRead(uid int64, at time.Time) (int64, error)                 // 返回标记了多少条
+}
+
+// TodoChanges 要修改的字段，为空的不改
+type TodoChanges struct {
+	Title       *string
+	Description *string
+	Status      *bool // 同时维护 completed_at：变成完成的时候设置为当前时间，变回未完成的时候清空
+	Priority    *int
+	ListID      *uint // 移到别的清单，调用方要先确认清单是自己的
+	SetDueAt    bool  // 为 true 才修改截止时间，DueAt 为空代表去掉截止时间
+	DueAt       *time.Time
+	DueTZ       *string
+	RRule       *string // 调用方要先用 parseRRule 校验、转成规范的写法
+	Occurrence  *int
+}
+
+// AccountRepository 用户的增删改查
+type AccountRepository interface {
+	Create(account *Account) error // 用户名已存在返回 ErrDuplicate
+	GetByName(name string) (*Account, error)
+	GetByUid(uid int64) (*Account, error)
+	UpdatePassword(uid int64, algo, hash string) error
+
+	// 管理后台用，见 admin.go
+	Search(q string, afterID uint, limit int) ([]Account, error) // 用户名包含 q，按 id 排序，从 afterID 后面开始查
+	UpdateRole(uid int64, role string) error
+	// UpdateStatus 把用户的状态从 change.From 改成 change.To，同时记录这次变化，见 account_status.go
+	// 状态已经不是 change.From 了(被别人改过)返回 ErrConflict
+	UpdateStatus(change *AccountStatusChange) error
+	StatusHistory(uid int64, limit int) ([]AccountStatusChange, error) // 最近的在前面
+}
+
+// RefreshTokenRepository refresh token 的存储，见 refresh.go
+type RefreshTokenRepository interface {
+	Create(rt *RefreshToken) error
+	GetByHash(hash string) (*RefreshToken, error)
+	// MarkUsed 把没用过的 token 标记为已使用，token 已经被用过了返回 false
+	MarkUsed(id uint, at time.Time) (bool, error)
+	RevokeFamily(family string, at time.Time) error
+	RevokeUser(uid int64, at time.Time) error
+}
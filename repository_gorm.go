@@ -0,0 +1,1160 @@
+package main
+
+// Repository 接口的 gorm 实现
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// notFound 把 gorm.ErrRecordNotFound 转成 ErrNotFound，handler 不用关心 gorm 的错误类型
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// duplicate 把唯一索引冲突的错误转成 ErrDuplicate，各个数据库的错误码由 gorm 的驱动翻译
+func duplicate(db *gorm.DB, err error) error {
+	if t, ok := db.Dialector.(gorm.ErrorTranslator); ok && errors.Is(t.Translate(err), gorm.ErrDuplicatedKey) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// ------------------------- Todo -------------------------
+
+type gormTodoRepository struct {
+	db *gorm.DB
+}
+
+func newGormTodoRepository(db *gorm.DB) *gormTodoRepository {
+	return &gormTodoRepository{db: db}
+}
+
+func (r *gormTodoRepository) Create(todo *Todo) error {
+	todo.Version = 1
+	todo.DueAt = localTime(todo.DueAt)
+	return r.db.Create(todo).Error
+}
+
+// localTime 前端传来的时间带着各种时区，存数据库之前统一转成本地时区
+// 和 filter 里的原因一样，sqlite 里时间按字符串比较，时区不一样比较结果就不对了
+func localTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	local := t.Local()
+	return &local
+}
+
+func (r *gormTodoRepository) Get(uid int64, id uint) (*Todo, error) {
+	var todo Todo
+	// uid 和 id 作为联合条件查询，查不到别人的数据
+	if err := r.db.Where("id = ? and uid = ?", id, uid).First(&todo).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &todo, nil
+}
+
+func (r *gormTodoRepository) Find(id uint) (*Todo, error) {
+	var todo Todo
+	if err := r.db.Where("id = ?", id).First(&todo).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &todo, nil
+}
+
+func (r *gormTodoRepository) List(uid int64, q TodoQuery) ([]Todo, error) {
+	tx := r.filter(uid, q)
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+	// 排序字段只能是 TodoSortXXX 里的几个，parseTodoQuery 校验过了，可以直接拼到 sql 里
+	col, colVars := todoSortColumn(q.Sort)
+	if q.After != nil {
+		if q.Sort == TodoSortID {
+			tx = tx.Where("id "+op+" ?", q.After.ID)
+		} else {
+			var v interface{} = q.After.Value.Local()
+			if q.Sort == TodoSortPriority {
+				v = q.After.Num
+			}
+			vars := append(append(append(append([]interface{}{}, colVars...), v), colVars...), v, q.After.ID)
+			tx = tx.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", col, op, col, op), vars...)
+		}
+	}
+	if q.Sort != TodoSortID {
+		tx = tx.Order(clause.OrderBy{Expression: clause.Expr{SQL: col + " " + dir, Vars: colVars}})
+	}
+	tx = tx.Order("id " + dir)
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+	todos := make([]Todo, 0) // 没有数据的时候返回 [] 而不是 null
+	err := tx.Find(&todos).Error
+	return todos, err
+}
+
+func (r *gormTodoRepository) Count(uid int64, q TodoQuery) (int64, error) {
+	var n int64
+	err := r.filter(uid, q).Count(&n).Error
+	return n, err
+}
+
+// todoSortColumn 排序用的 sql 表达式，可以为空的时间字段用 COALESCE 换成 todoSortNullTime，排在最后面
+// todoSortNullTime 作为参数传进去，不写在 sql 里，sqlite 里时间是按字符串比较的，要和游标里的值格式一样
+func todoSortColumn(sort string) (string, []interface{}) {
+	switch sort {
+	case TodoSortDueAt, TodoSortCompletedAt:
+		return "COALESCE(" + sort + ", ?)", []interface{}{todoSortNullTime.Local()}
+	}
+	return sort, nil
+}
+
+// filter 按 q 里的过滤条件拼 where，不包括游标
+// 时间都转成本地时区再比较，sqlite 里时间存的是字符串，时区不一样没法直接比
+func (r *gormTodoRepository) filter(uid int64, q TodoQuery) *gorm.DB {
+	tx := r.db.Model(&Todo{}).Where("uid = ?", uid)
+	if q.Status != nil {
+		tx = tx.Where("status = ?", *q.Status)
+	}
+	if q.Title != "" {
+		// postgres 的 LIKE 区分大小写，两边都转成小写，三种数据库和内存实现结果一样
+		tx = tx.Where("LOWER(title) LIKE LOWER(?) ESCAPE '!'", "%"+escapeLike(q.Title)+"%")
+	}
+	ranges := []struct {
+		cond string
+		t    time.Time
+	}{
+		{"created_at >= ?", q.CreatedAfter},
+		{"created_at < ?", q.CreatedBefore},
+		{"updated_at >= ?", q.UpdatedAfter},
+		{"updated_at < ?", q.UpdatedBefore},
+		{"due_at >= ?", q.DueAfter},
+		{"due_at < ?", q.DueBefore},
+	}
+	for _, rg := range ranges {
+		if !rg.t.IsZero() {
+			tx = tx.Where(rg.cond, rg.t.Local())
+		}
+	}
+	if q.ListID > 0 {
+		tx = tx.Where("list_id = ?", q.ListID)
+	}
+	if q.ParentID != nil {
+		tx = tx.Where("parent_id = ?", *q.ParentID)
+	}
+	if len(q.Priorities) > 0 {
+		tx = tx.Where("priority IN ?", q.Priorities)
+	}
+	if len(q.Tags) > 0 {
+		// 打了其中一个标签；TagsAll 的时候要全都打了，q.Tags 里没有重复的
+		// 只认查询的人自己的标签，不然共享清单的成员能挨个试出别人的标签打在哪些待办事项上
+		own := r.db.Model(&Tag{}).Select("id").Where("uid = ? AND id IN ?", q.TagUid, q.Tags)
+		sub := r.db.Model(&TodoTag{}).Select("todo_id").Where("tag_id IN (?)", own)
+		if q.TagsAll {
+			sub = sub.Group("todo_id").Having("COUNT(*) = ?", len(q.Tags))
+		}
+		tx = tx.Where("id IN (?)", sub)
+	}
+	return tx
+}
+
+// escapeLike 转义 LIKE 里的通配符，用 ! 当转义字符，mysql、postgres、sqlite 都支持
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func (r *gormTodoRepository) Update(uid int64, id uint, version int, ch TodoChanges) (*Todo, error) {
+	if ch.ListID == nil {
+		return r.update(uid, id, version, ch)
+	}
+	// 子任务和上级在同一个清单里，一起移过去
+	var todo *Todo
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		todos := &gormTodoRepository{db: tx}
+		var err error
+		if todo, err = todos.update(uid, id, version, ch); err != nil {
+			return err
+		}
+		ids, err := subtaskIDs(tx, uid, []uint{id}, false)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		return tx.Model(&Todo{}).Where("id IN ? and list_id <> ?", ids, todo.ListID).
+			Updates(map[string]interface{}{"list_id": todo.ListID, "version": gorm.Expr("version + 1")}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return todo, nil
+}
+
+// update 修改这一条，不管子任务
+func (r *gormTodoRepository) update(uid int64, id uint, version int, ch TodoChanges) (*Todo, error) {
+	// 只更新指定的字段，不用 db.Save 更新所有字段
+	fields := map[string]interface{}{}
+	if ch.Title != nil {
+		fields["title"] = *ch.Title
+	}
+	if ch.Description != nil {
+		fields["description"] = *ch.Description
+	}
+	if ch.Priority != nil {
+		fields["priority"] = *ch.Priority
+	}
+	if ch.ListID != nil {
+		fields["list_id"] = *ch.ListID
+	}
+	if ch.SetDueAt {
+		fields["due_at"] = localTime(ch.DueAt)
+	}
+	if ch.DueTZ != nil {
+		fields["due_tz"] = *ch.DueTZ
+	}
+	if ch.RRule != nil {
+		fields["rrule"] = *ch.RRule
+	}
+	if ch.Occurrence != nil {
+		fields["occurrence"] = *ch.Occurrence
+	}
+	if ch.Status != nil {
+		fields["status"] = *ch.Status
+		if *ch.Status {
+			// 本来就是完成状态的保留原来的完成时间，在一条 sql 里判断，不用先查出来
+			// mysql 的 SET 是从左往右执行的，gorm 按字段名排序，completed_at 在 status 前面，这里读到的还是修改前的 status
+			fields["completed_at"] = gorm.Expr("CASE WHEN status = ? THEN completed_at ELSE ? END", true, time.Now())
+		} else {
+			fields["completed_at"] = nil
+		}
+	}
+	if len(fields) == 0 {
+		// 什么都不改，版本号也不变，只检查一下版本号
+		todo, err := r.Get(uid, id)
+		if err == nil && version > 0 && todo.Version != version {
+			return nil, ErrConflict
+		}
+		return todo, err
+	}
+	fields["version"] = gorm.Expr("version + 1")
+
+	// uid 和 id 作为联合条件，不是自己的数据更新不到
+	tx := r.db.Model(&Todo{}).Where("id = ? and uid = ?", id, uid)
+	if version > 0 {
+		tx = tx.Where("version = ?", version)
+	}
+	res := tx.Updates(fields)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	// 版本号每次都会变，RowsAffected 是0 只能是记录不存在 或者 版本号对不上
+	if res.RowsAffected == 0 {
+		return nil, r.missing(uid, id)
+	}
+	return r.Get(uid, id)
+}
+
+// missing 条件更新影响了0行，记录还在说明是版本号对不上
+func (r *gormTodoRepository) missing(uid int64, id uint) error {
+	if _, err := r.Get(uid, id); err != nil {
+		return err
+	}
+	return ErrConflict
+}
+
+func (r *gormTodoRepository) CompleteRecurring(uid int64, id uint, version int, ch TodoChanges, next *Todo, uids []int64) (*Todo, error) {
+	var todo *Todo
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// 事务里都要用 tx，sqlite 只有一个连接
+		todos := &gormTodoRepository{db: tx}
+		var err error
+		if todo, err = todos.Update(uid, id, version, ch); err != nil {
+			return err
+		}
+		if err := todos.Create(next); err != nil {
+			return err
+		}
+		return copyOccurrence(&gormTagRepository{db: tx}, &gormReminderRepository{db: tx}, uids, id, next)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return todo, nil
+}
+
+func (r *gormTodoRepository) Delete(uid int64, id uint, version int) error {
+	// 删除是 软删除，给 deleted_at 字段添加标记，数据还在数据库中
+	// 子任务的删除时间和上级用同一个值，恢复的时候靠这个找出一起删除的子任务
+	now := time.Now()
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var todo Todo
+		if err := tx.Where("id = ? and uid = ?", id, uid).First(&todo).Error; err != nil {
+			return notFound(err)
+		}
+		q := tx.Model(&Todo{}).Where("id = ? and uid = ?", id, uid)
+		if version > 0 {
+			q = q.Where("version = ?", version)
+		}
+		res := q.UpdateColumn("deleted_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrConflict
+		}
+		ids, err := subtaskIDs(tx, uid, []uint{id}, false)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		return tx.Model(&Todo{}).Where("id IN ?", ids).UpdateColumn("deleted_at", now).Error
+	})
+}
+
+// subtaskIDs 查出 ids 下面所有层的子任务，deleted 为 true 查回收站里的，否则查没删除的
+// parent_id 只能在新建的时候指定，上级一定比子任务先建，不会有环，一层查一次
+func subtaskIDs(tx *gorm.DB, uid int64, ids []uint, deleted bool) ([]uint, error) {
+	var all []uint
+	for len(ids) > 0 {
+		q := tx.Unscoped().Model(&Todo{}).Where("uid = ? and parent_id IN ?", uid, ids)
+		if deleted {
+			q = q.Where("deleted_at IS NOT NULL")
+		} else {
+			q = q.Where("deleted_at IS NULL")
+		}
+		var children []uint
+		if err := q.Pluck("id", &children).Error; err != nil {
+			return nil, err
+		}
+		all = append(all, children...)
+		ids = children
+	}
+	return all, nil
+}
+
+func (r *gormTodoRepository) Children(uid int64, parentIDs []uint) ([]Todo, error) {
+	todos := make([]Todo, 0)
+	if len(parentIDs) == 0 {
+		return todos, nil
+	}
+	err := r.db.Where("uid = ? and parent_id IN ?", uid, parentIDs).Order("id").Find(&todos).Error
+	return todos, err
+}
+
+func (r *gormTodoRepository) Progress(uid int64, ids []uint) (map[uint]TodoProgress, error) {
+	progress := make(map[uint]TodoProgress)
+	if len(ids) == 0 {
+		return progress, nil
+	}
+	var rows []struct {
+		ParentID uint
+		Total    int
+		Done     int
+	}
+	err := r.db.Model(&Todo{}).
+		Select("parent_id, COUNT(*) AS total, SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS done", true).
+		Where("uid = ? and parent_id IN ?", uid, ids).Group("parent_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		progress[row.ParentID] = TodoProgress{Done: row.Done, Total: row.Total}
+	}
+	return progress, nil
+}
+
+func (r *gormTodoRepository) ListDeleted(uid int64, limit int) ([]Todo, error) {
+	todos := make([]Todo, 0)
+	// Unscoped 才能查到软删除的数据
+	err := r.db.Unscoped().Where("uid = ? and deleted_at IS NOT NULL", uid).
+		Order("deleted_at DESC").Order("id DESC").Limit(limit).Find(&todos).Error
+	return todos, err
+}
+
+func (r *gormTodoRepository) Restore(uid int64, id uint) (*Todo, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var todo Todo
+		if err := tx.Unscoped().Where("id = ? and uid = ? and deleted_at IS NOT NULL", id, uid).First(&todo).Error; err != nil {
+			return notFound(err)
+		}
+		fields := map[string]interface{}{"deleted_at": nil, "version": gorm.Expr("version + 1")}
+		if todo.ParentID != 0 {
+			var parent Todo
+			err := tx.Unscoped().Where("id = ? and uid = ?", todo.ParentID, uid).First(&parent).Error
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				// 上级已经彻底删除了
+				fields["parent_id"] = 0
+			case err != nil:
+				return err
+			case parent.DeletedAt.Valid:
+				return ErrParentDeleted
+			}
+		}
+		ids := []uint{id}
+		// 一层一层找删除时间和它一样的子任务，单独删除的子任务留在回收站里
+		for parents := ids; len(parents) > 0; {
+			var children []Todo
+			err := tx.Unscoped().Select("id", "deleted_at").
+				Where("uid = ? and parent_id IN ? and deleted_at IS NOT NULL", uid, parents).Find(&children).Error
+			if err != nil {
+				return err
+			}
+			parents = nil
+			for _, child := range children {
+				if child.DeletedAt.Time.Equal(todo.DeletedAt.Time) {
+					parents = append(parents, child.ID)
+				}
+			}
+			ids = append(ids, parents...)
+		}
+		if err := tx.Unscoped().Model(&Todo{}).Where("id = ?", id).Updates(fields).Error; err != nil {
+			return err
+		}
+		if len(ids) == 1 {
+			return nil
+		}
+		return tx.Unscoped().Model(&Todo{}).Where("id IN ?", ids[1:]).
+			Updates(map[string]interface{}{"deleted_at": nil, "version": gorm.Expr("version + 1")}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.Get(uid, id)
+}
+
+func (r *gormTodoRepository) Purge(uid int64, id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Unscoped().Where("id = ? and uid = ? and deleted_at IS NOT NULL", id, uid).Delete(&Todo{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		// 上级在回收站里的时候，子任务一定也在回收站里
+		ids, err := subtaskIDs(tx, uid, []uint{id}, true)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			if err := tx.Unscoped().Where("id IN ?", ids).Delete(&Todo{}).Error; err != nil {
+				return err
+			}
+		}
+		// 打的标签、提醒也删掉，见 tag.go、reminder.go
+		ids = append(ids, id)
+		if err := tx.Where("todo_id IN ?", ids).Delete(&TodoTag{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("todo_id IN ?", ids).Delete(&Reminder{}).Error
+	})
+}
+
+func (r *gormTodoRepository) PurgeAll(uid int64) (int64, error) {
+	return r.purge("uid = ? and deleted_at IS NOT NULL", uid)
+}
+
+func (r *gormTodoRepository) PurgeDeletedBefore(before time.Time) (int64, error) {
+	return r.purge("deleted_at < ?", before.Local())
+}
+
+// purge 彻底删除回收站里符合条件的待办事项，连同它们打的标签、提醒
+func (r *gormTodoRepository) purge(cond string, args ...interface{}) (int64, error) {
+	var n int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		ids := tx.Unscoped().Model(&Todo{}).Select("id").Where(cond, args...)
+		if err := tx.Where("todo_id IN (?)", ids).Delete(&TodoTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("todo_id IN (?)", ids).Delete(&Reminder{}).Error; err != nil {
+			return err
+		}
+		res := tx.Unscoped().Where(cond, args...).Delete(&Todo{})
+		n = res.RowsAffected
+		return res.Error
+	})
+	return n, err
+}
+
+func (r *gormTodoRepository) MoveList(uid int64, from, to uint) (int64, error) {
+	res := r.db.Unscoped().Model(&Todo{}).Where("uid = ? and list_id = ?", uid, from).
+		Updates(map[string]interface{}{"list_id": to, "version": gorm.Expr("version + 1")})
+	return res.RowsAffected, res.Error
+}
+
+// ------------------------- TodoList -------------------------
+
+type gormTodoListRepository struct {
+	db *gorm.DB
+}
+
+func newGormTodoListRepository(db *gorm.DB) *gormTodoListRepository {
+	return &gormTodoListRepository{db: db}
+}
+
+func (r *gormTodoListRepository) Create(list *TodoList) error {
+	// 已经有收件箱了，唯一索引冲突，见 migration 2022091001
+	return duplicate(r.db, r.db.Create(list).Error)
+}
+
+func (r *gormTodoListRepository) Get(uid int64, id uint) (*TodoList, error) {
+	var list TodoList
+	if err := r.db.Where("id = ? and uid = ?", id, uid).First(&list).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &list, nil
+}
+
+func (r *gormTodoListRepository) Find(id uint) (*TodoList, error) {
+	var list TodoList
+	if err := r.db.Where("id = ?", id).First(&list).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &list, nil
+}
+
+func (r *gormTodoListRepository) GetInbox(uid int64) (*TodoList, error) {
+	var list TodoList
+	if err := r.db.Where("uid = ? and is_inbox = ?", uid, true).Order("id").First(&list).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &list, nil
+}
+
+func (r *gormTodoListRepository) List(uid int64) ([]TodoList, error) {
+	lists := make([]TodoList, 0)
+	err := r.db.Where("uid = ?", uid).Order("is_inbox DESC").Order("id").Find(&lists).Error
+	return lists, err
+}
+
+func (r *gormTodoListRepository) Rename(uid int64, id uint, name string) (*TodoList, error) {
+	res := r.db.Model(&TodoList{}).Where("id = ? and uid = ?", id, uid).Update("name", name)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return r.Get(uid, id)
+}
+
+func (r *gormTodoListRepository) Delete(uid int64, id uint) error {
+	res := r.db.Where("id = ? and uid = ?", id, uid).Delete(&TodoList{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ------------------------- ListMember -------------------------
+
+type gormListMemberRepository struct {
+	db *gorm.DB
+}
+
+func newGormListMemberRepository(db *gorm.DB) *gormListMemberRepository {
+	return &gormListMemberRepository{db: db}
+}
+
+func (r *gormListMemberRepository) Create(m *ListMember) error {
+	// 先查一遍，不用区分各个数据库唯一索引冲突的错误；同时插入的还有唯一索引兜底
+	var n int64
+	if err := r.db.Model(&ListMember{}).Where("list_id = ? and uid = ?", m.ListID, m.Uid).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicate
+	}
+	return r.db.Create(m).Error
+}
+
+func (r *gormListMemberRepository) Get(listID, id uint) (*ListMember, error) {
+	var m ListMember
+	if err := r.db.Where("id = ? and list_id = ?", id, listID).First(&m).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &m, nil
+}
+
+func (r *gormListMemberRepository) GetByUser(listID uint, uid int64) (*ListMember, error) {
+	var m ListMember
+	if err := r.db.Where("list_id = ? and uid = ?", listID, uid).First(&m).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &m, nil
+}
+
+func (r *gormListMemberRepository) ListByList(listID uint) ([]ListMember, error) {
+	members := make([]ListMember, 0)
+	err := r.db.Where("list_id = ?", listID).Order("id").Find(&members).Error
+	return members, err
+}
+
+func (r *gormListMemberRepository) ListByUser(uid int64, status string) ([]ListMember, error) {
+	members := make([]ListMember, 0)
+	err := r.db.Where("uid = ? and status = ?", uid, status).Order("id").Find(&members).Error
+	return members, err
+}
+
+func (r *gormListMemberRepository) UpdateRole(listID, id uint, role string) (*ListMember, error) {
+	res := r.db.Model(&ListMember{}).Where("id = ? and list_id = ?", id, listID).Update("role", role)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return r.Get(listID, id)
+}
+
+func (r *gormListMemberRepository) Delete(listID, id uint) error {
+	res := r.db.Where("id = ? and list_id = ?", id, listID).Delete(&ListMember{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *gormListMemberRepository) DeleteByList(listID uint) error {
+	return r.db.Where("list_id = ?", listID).Delete(&ListMember{}).Error
+}
+
+func (r *gormListMemberRepository) Accept(uid int64, id uint, at time.Time) (*ListMember, error) {
+	res := r.db.Model(&ListMember{}).Where("id = ? and uid = ? and status = ?", id, uid, MemberInvited).
+		Updates(map[string]interface{}{"status": MemberAccepted, "accepted_at": at.Local()})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+	var m ListMember
+	if err := r.db.Where("id = ?", id).First(&m).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &m, nil
+}
+
+func (r *gormListMemberRepository) Decline(uid int64, id uint) error {
+	res := r.db.Where("id = ? and uid = ? and status = ?", id, uid, MemberInvited).Delete(&ListMember{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ------------------------- Tag -------------------------
+
+type gormTagRepository struct {
+	db *gorm.DB
+}
+
+func newGormTagRepository(db *gorm.DB) *gormTagRepository {
+	return &gormTagRepository{db: db}
+}
+
+// checkName 同一个用户的标签不能重名，id 是正在改名的标签，并发的时候靠唯一索引兜底
+func (r *gormTagRepository) checkName(uid int64, id uint, name string) error {
+	var n int64
+	if err := r.db.Model(&Tag{}).Where("uid = ? and name = ? and id <> ?", uid, name, id).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+func (r *gormTagRepository) Create(tag *Tag) error {
+	if err := r.checkName(tag.Uid, 0, tag.Name); err != nil {
+		return err
+	}
+	return r.db.Create(tag).Error
+}
+
+func (r *gormTagRepository) Get(uid int64, id uint) (*Tag, error) {
+	var tag Tag
+	if err := r.db.Where("id = ? and uid = ?", id, uid).First(&tag).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &tag, nil
+}
+
+func (r *gormTagRepository) List(uid int64) ([]Tag, error) {
+	tags := make([]Tag, 0)
+	err := r.db.Where("uid = ?", uid).Order("name").Order("id").Find(&tags).Error
+	return tags, err
+}
+
+func (r *gormTagRepository) Update(uid int64, id uint, name, color string) (*Tag, error) {
+	if _, err := r.Get(uid, id); err != nil {
+		return nil, err
+	}
+	if err := r.checkName(uid, id, name); err != nil {
+		return nil, err
+	}
+	err := r.db.Model(&Tag{}).Where("id = ? and uid = ?", id, uid).
+		Updates(map[string]interface{}{"name": name, "color": color}).Error
+	if err != nil {
+		return nil, err
+	}
+	return r.Get(uid, id)
+}
+
+func (r *gormTagRepository) Delete(uid int64, id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? and uid = ?", id, uid).Delete(&Tag{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return tx.Where("tag_id = ?", id).Delete(&TodoTag{}).Error
+	})
+}
+
+func (r *gormTagRepository) Attach(todoID, tagID uint) error {
+	// 已经打过了就什么都不做
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&TodoTag{TodoID: todoID, TagID: tagID}).Error
+}
+
+func (r *gormTagRepository) Detach(todoID, tagID uint) error {
+	return r.db.Where("todo_id = ? and tag_id = ?", todoID, tagID).Delete(&TodoTag{}).Error
+}
+
+func (r *gormTagRepository) ListByTodos(uid int64, todoIDs []uint) (map[uint][]Tag, error) {
+	result := make(map[uint][]Tag)
+	if len(todoIDs) == 0 {
+		return result, nil
+	}
+	var links []TodoTag
+	if err := r.db.Where("todo_id IN ?", todoIDs).Find(&links).Error; err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return result, nil
+	}
+	tagIDs := make([]uint, 0, len(links))
+	for _, link := range links {
+		tagIDs = append(tagIDs, link.TagID)
+	}
+	var tags []Tag
+	if err := r.db.Where("uid = ? and id IN ?", uid, tagIDs).Order("name").Order("id").Find(&tags).Error; err != nil {
+		return nil, err
+	}
+	byTodo := make(map[uint]map[uint]bool, len(todoIDs))
+	for _, link := range links {
+		if byTodo[link.TodoID] == nil {
+			byTodo[link.TodoID] = make(map[uint]bool)
+		}
+		byTodo[link.TodoID][link.TagID] = true
+	}
+	// 按标签的顺序放，每个待办事项的标签都按名字排好了
+	for _, tag := range tags {
+		for todoID, tagIDs := range byTodo {
+			if tagIDs[tag.ID] {
+				result[todoID] = append(result[todoID], tag)
+			}
+		}
+	}
+	return result, nil
+}
+
+// ------------------------- Reminder -------------------------
+
+type gormReminderRepository struct {
+	db *gorm.DB
+}
+
+func newGormReminderRepository(db *gorm.DB) *gormReminderRepository {
+	return &gormReminderRepository{db: db}
+}
+
+func (r *gormReminderRepository) Create(reminder *Reminder) error {
+	reminder.Version = 1
+	reminder.At = localTime(reminder.At)
+	reminder.FireAt = localTime(reminder.FireAt)
+	return r.db.Create(reminder).Error
+}
+
+func (r *gormReminderRepository) ListByTodo(uid int64, todoID uint) ([]Reminder, error) {
+	var reminders []Reminder
+	err := r.db.Where("uid = ? and todo_id = ?", uid, todoID).Order("id").Find(&reminders).Error
+	return reminders, err
+}
+
+func (r *gormReminderRepository) Delete(uid int64, todoID, id uint) error {
+	res := r.db.Where("id = ? and uid = ? and todo_id = ?", id, uid, todoID).Delete(&Reminder{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *gormReminderRepository) Reschedule(todoID uint, due *time.Time) error {
+	var reminders []Reminder
+	err := r.db.Where("todo_id = ? and offset_seconds IS NOT NULL", todoID).Find(&reminders).Error
+	if err != nil {
+		return err
+	}
+	// 数据库之间时间加秒数的写法不一样，查出来算好了一条一条改
+	for _, reminder := range reminders {
+		reminder.schedule(due)
+		err := r.db.Model(&Reminder{}).Where("id = ?", reminder.ID).Updates(map[string]interface{}{
+			"fire_at":    localTime(reminder.FireAt),
+			"status":     reminder.Status,
+			"sent_at":    nil,
+			"attempts":   0,
+			"last_error": "",
+			"version":    gorm.Expr("version + 1"),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *gormReminderRepository) ListDue(now time.Time, limit int) ([]Reminder, error) {
+	var reminders []Reminder
+	err := r.db.Where("status = ? and fire_at <= ?", ReminderPending, now.Local()).
+		Order("fire_at").Order("id").Limit(limit).Find(&reminders).Error
+	return reminders, err
+}
+
+func (r *gormReminderRepository) Claim(id uint, version int, until time.Time) (bool, error) {
+	res := r.db.Model(&Reminder{}).Where("id = ? and version = ?", id, version).
+		Updates(map[string]interface{}{"fire_at": until.Local(), "version": gorm.Expr("version + 1")})
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *gormReminderRepository) Finish(id uint, status, lastErr string, at time.Time) error {
+	fields := map[string]interface{}{"status": status, "last_error": lastErr}
+	switch status {
+	case ReminderSent:
+		fields["sent_at"] = at.Local()
+	case ReminderFailed:
+		fields["attempts"] = gorm.Expr("attempts + 1")
+	}
+	return r.db.Model(&Reminder{}).Where("id = ?", id).Updates(fields).Error
+}
+
+func (r *gormReminderRepository) Retry(id uint, lastErr string, fireAt time.Time) error {
+	return r.db.Model(&Reminder{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"fire_at":    fireAt.Local(),
+		"last_error": lastErr,
+		"attempts":   gorm.Expr("attempts + 1"),
+	}).Error
+}
+
+// ------------------------- Webhook -------------------------
+
+type gormWebhookRepository struct {
+	db *gorm.DB
+}
+
+func newGormWebhookRepository(db *gorm.DB) *gormWebhookRepository {
+	return &gormWebhookRepository{db: db}
+}
+
+func (r *gormWebhookRepository) Create(e *WebhookEndpoint) error {
+	return r.db.Create(e).Error
+}
+
+func (r *gormWebhookRepository) Get(uid int64, id uint) (*WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	if err := r.db.Where("id = ? and uid = ?", id, uid).First(&e).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &e, nil
+}
+
+func (r *gormWebhookRepository) List(uid int64) ([]WebhookEndpoint, error) {
+	var endpoints []WebhookEndpoint
+	err := r.db.Where("uid = ?", uid).Order("id").Find(&endpoints).Error
+	return endpoints, err
+}
+
+func (r *gormWebhookRepository) Update(uid int64, id uint, url, events string, active bool) (*WebhookEndpoint, error) {
+	res := r.db.Model(&WebhookEndpoint{}).Where("id = ? and uid = ?", id, uid).
+		Updates(map[string]interface{}{"url": url, "events": events, "active": active})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+	return r.Get(uid, id)
+}
+
+func (r *gormWebhookRepository) Delete(uid int64, id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? and uid = ?", id, uid).Delete(&WebhookEndpoint{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		deliveries := tx.Model(&WebhookDelivery{}).Select("id").Where("endpoint_id = ?", id)
+		if err := tx.Where("delivery_id IN (?)", deliveries).Delete(&WebhookAttempt{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("endpoint_id = ?", id).Delete(&WebhookDelivery{}).Error
+	})
+}
+
+func (r *gormWebhookRepository) CreateDelivery(d *WebhookDelivery) error {
+	d.Version = 1
+	d.NextAttemptAt = localTime(d.NextAttemptAt)
+	return r.db.Create(d).Error
+}
+
+func (r *gormWebhookRepository) GetDelivery(uid int64, endpointID, id uint) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := r.db.Where("id = ? and uid = ? and endpoint_id = ?", id, uid, endpointID).First(&d).Error
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &d, nil
+}
+
+func (r *gormWebhookRepository) ListDeliveries(uid int64, endpointID uint, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := r.db.Where("uid = ? and endpoint_id = ?", uid, endpointID).Order("id DESC").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (r *gormWebhookRepository) ListAttempts(deliveryID uint) ([]WebhookAttempt, error) {
+	var attempts []WebhookAttempt
+	err := r.db.Where("delivery_id = ?", deliveryID).Order("id").Find(&attempts).Error
+	return attempts, err
+}
+
+func (r *gormWebhookRepository) ListDue(now time.Time, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := r.db.Where("status = ? and next_attempt_at <= ?", WebhookPending, now.Local()).
+		Order("next_attempt_at").Order("id").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (r *gormWebhookRepository) Claim(id uint, version int, until time.Time) (bool, error) {
+	res := r.db.Model(&WebhookDelivery{}).Where("id = ? and version = ?", id, version).
+		Updates(map[string]interface{}{"next_attempt_at": until.Local(), "version": gorm.Expr("version + 1")})
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *gormWebhookRepository) RecordAttempt(id uint, attempt *WebhookAttempt, status string, next *time.Time) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		attempt.DeliveryID = id
+		if err := tx.Create(attempt).Error; err != nil {
+			return err
+		}
+		fields := map[string]interface{}{
+			"status":          status,
+			"attempts":        gorm.Expr("attempts + 1"),
+			"last_status":     attempt.StatusCode,
+			"last_error":      attempt.Error,
+			"next_attempt_at": localTime(next),
+		}
+		if status == WebhookSucceeded {
+			fields["delivered_at"] = attempt.CreatedAt.Local()
+		}
+		return tx.Model(&WebhookDelivery{}).Where("id = ?", id).Updates(fields).Error
+	})
+}
+
+func (r *gormWebhookRepository) PurgeDeliveries(before time.Time) (int64, error) {
+	var n int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		cond := "status IN ? and updated_at < ?"
+		args := []interface{}{[]string{WebhookSucceeded, WebhookFailed}, before.Local()}
+		ids := tx.Model(&WebhookDelivery{}).Select("id").Where(cond, args...)
+		if err := tx.Where("delivery_id IN (?)", ids).Delete(&WebhookAttempt{}).Error; err != nil {
+			return err
+		}
+		res := tx.Where(cond, args...).Delete(&WebhookDelivery{})
+		n = res.RowsAffected
+		return res.Error
+	})
+	return n, err
+}
+
+// ------------------------- Notification -------------------------
+
+type gormNotificationRepository struct {
+	db *gorm.DB
+}
+
+func newGormNotificationRepository(db *gorm.DB) *gormNotificationRepository {
+	return &gormNotificationRepository{db: db}
+}
+
+func (r *gormNotificationRepository) Create(n *Notification) error {
+	return r.db.Create(n).Error
+}
+
+func (r *gormNotificationRepository) List(uid int64, unreadOnly bool, limit int) ([]Notification, error) {
+	tx := r.db.Where("uid = ?", uid)
+	if unreadOnly {
+		tx = tx.Where("read_at IS NULL")
+	}
+	var notifications []Notification
+	err := tx.Order("id DESC").Limit(limit).Find(&notifications).Error
+	return notifications, err
+}
+
+func (r *gormNotificationRepository) MarkRead(uid int64, id uint, at time.Time) error {
+	var n Notification
+	if err := r.db.Where("id = ? and uid = ?", id, uid).First(&n).Error; err != nil {
+		return notFound(err)
+	}
+	if n.ReadAt != nil {
+		return nil
+	}
+	return r.db.Model(&Notification{}).Where("id = ?", id).Update("read_at", at.Local()).Error
+}
+
+func (r *gormNotificationRepository) MarkAllRead(uid int64, at time.Time) (int64, error) {
+	res := r.db.Model(&Notification{}).Where("uid = ? and read_at IS NULL", uid).Update("read_at", at.Local())
+	return res.RowsAffected, res.Error
+}
+
+// ------------------------- Account -------------------------
+
+type gormAccountRepository struct {
+	db *gorm.DB
+}
+
+func newGormAccountRepository(db *gorm.DB) *gormAccountRepository {
+	return &gormAccountRepository{db: db}
+}
+
+func (r *gormAccountRepository) Create(account *Account) error {
+	// 先查一下用户名有没有被注册过
+	_, err := r.GetByName(account.Name)
+	if err == nil {
+		return ErrDuplicate
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	// 同时注册同一个用户名，查的时候都还没有，靠唯一索引兜底
+	return duplicate(r.db, r.db.Create(account).Error)
+}
+
+func (r *gormAccountRepository) GetByName(name string) (*Account, error) {
+	var account Account
+	if err := r.db.Where("name = ?", name).First(&account).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &account, nil
+}
+
+func (r *gormAccountRepository) GetByUid(uid int64) (*Account, error) {
+	var account Account
+	if err := r.db.Where("uid = ?", uid).First(&account).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &account, nil
+}
+
+func (r *gormAccountRepository) UpdatePassword(uid int64, algo, hash string) error {
+	return r.db.Model(&Account{}).Where("uid = ?", uid).
+		Updates(map[string]interface{}{"password": hash, "pwd_algo": algo}).Error
+}
+
+func (r *gormAccountRepository) Search(q string, afterID uint, limit int) ([]Account, error) {
+	accounts := make([]Account, 0)
+	tx := r.db.Where("id > ?", afterID)
+	if q != "" {
+		tx = tx.Where("LOWER(name) LIKE LOWER(?) ESCAPE '!'", "%"+escapeLike(q)+"%") // 不区分大小写，见 filter
+	}
+	err := tx.Order("id").Limit(limit).Find(&accounts).Error
+	return accounts, err
+}
+
+func (r *gormAccountRepository) UpdateRole(uid int64, role string) error {
+	return r.db.Model(&Account{}).Where("uid = ?", uid).Update("role", role).Error
+}
+
+func (r *gormAccountRepository) UpdateStatus(change *AccountStatusChange) error {
+	change.CreatedAt = time.Now()
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// 带上原来的状态做条件更新，两个管理员同时改，只有一个能成功
+		res := tx.Model(&Account{}).Where("uid = ? AND status = ?", change.Uid, change.From).
+			Updates(map[string]interface{}{
+				"status":            change.To,
+				"status_reason":     change.Reason,
+				"status_changed_at": change.CreatedAt,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrConflict
+		}
+		return tx.Create(change).Error
+	})
+}
+
+func (r *gormAccountRepository) StatusHistory(uid int64, limit int) ([]AccountStatusChange, error) {
+	changes := make([]AccountStatusChange, 0)
+	err := r.db.Where("uid = ?", uid).Order("id DESC").Limit(limit).Find(&changes).Error
+	return changes, err
+}
+
+// ------------------------- RefreshToken -------------------------
+
+type gormRefreshTokenRepository struct {
+	db *gorm.DB
+}
+
+func newGormRefreshTokenRepository(db *gorm.DB) *gormRefreshTokenRepository {
+	return &gormRefreshTokenRepository{db: db}
+}
+
+func (r *gormRefreshTokenRepository) Create(rt *RefreshToken) error {
+	return r.db.Create(rt).Error
+}
+
+func (r *gormRefreshTokenRepository) GetByHash(hash string) (*RefreshToken, error) {
+	var rt RefreshToken
+	if err := r.db.Where("token_hash = ?", hash).First(&rt).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &rt, nil
+}
+
+func (r *gormRefreshTokenRepository) MarkUsed(id uint, at time.Time) (bool, error) {
+	// 用条件更新，两个请求同时拿同一个token来换，只有一个能更新成功
+	res := r.db.Model(&RefreshToken{}).Where("id = ? and used_at is null", id).Update("used_at", at)
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *gormRefreshTokenRepository) RevokeFamily(family string, at time.Time) error {
+	return r.db.Model(&RefreshToken{}).
+		Where("family_id = ? and revoked_at is null", family).
+		Update("revoked_at", at).Error
+}
+
+func (r *gormRefreshTokenRepository) RevokeUser(uid int64, at time.Time) error {
+	return r.db.Model(&RefreshToken{}).
+		Where("uid = ? and revoked_at is null", uid).
+		Update("revoked_at", at).Error
+}
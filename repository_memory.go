@@ -0,0 +1,1368 @@
+package main
+
+// Repository 接口的内存实现，数据存在 map 里，进程退出就没了
+// 写 handler 的测试用，行为要和 gorm 实现保持一致(软删除、按 uid 过滤、自增 id)
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ------------------------- Todo -------------------------
+
+type memoryTodoRepository struct {
+	mu        sync.Mutex
+	nextID    uint
+	todos     map[uint]*Todo
+	tags      *memoryTagRepository      // 按标签过滤、彻底删除的时候去掉标签要用
+	reminders *memoryReminderRepository // 彻底删除的时候去掉提醒要用
+}
+
+func newMemoryTodoRepository(tags *memoryTagRepository, reminders *memoryReminderRepository) *memoryTodoRepository {
+	return &memoryTodoRepository{todos: make(map[uint]*Todo), tags: tags, reminders: reminders}
+}
+
+func (r *memoryTodoRepository) Create(todo *Todo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	now := time.Now()
+	todo.ID, todo.CreatedAt, todo.UpdatedAt, todo.Version = r.nextID, now, now, 1
+	cp := *todo
+	r.todos[todo.ID] = &cp
+	return nil
+}
+
+// get 调用方要先加锁，软删除的记录当作不存在
+func (r *memoryTodoRepository) get(uid int64, id uint) (*Todo, error) {
+	todo, ok := r.todos[id]
+	if !ok || todo.Uid != uid || todo.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	return todo, nil
+}
+
+func (r *memoryTodoRepository) Get(uid int64, id uint) (*Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	todo, err := r.get(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	cp := *todo
+	return &cp, nil
+}
+
+func (r *memoryTodoRepository) Find(id uint) (*Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	todo, ok := r.todos[id]
+	if !ok || todo.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	cp := *todo
+	return &cp, nil
+}
+
+func (r *memoryTodoRepository) List(uid int64, q TodoQuery) ([]Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	todos := make([]Todo, 0)
+	for _, todo := range r.todos {
+		if todo.Uid == uid && !todo.DeletedAt.Valid && q.match(*todo) && r.tags.match(todo.ID, q) && q.afterCursor(*todo) {
+			todos = append(todos, *todo)
+		}
+	}
+	// map 是无序的，按排序字段 + id 排序，和数据库的 order by 一致
+	sort.Slice(todos, func(i, j int) bool { return q.less(todos[i], todos[j]) })
+	if q.Limit > 0 && len(todos) > q.Limit {
+		todos = todos[:q.Limit]
+	}
+	return todos, nil
+}
+
+func (r *memoryTodoRepository) Count(uid int64, q TodoQuery) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, todo := range r.todos {
+		if todo.Uid == uid && !todo.DeletedAt.Valid && q.match(*todo) && r.tags.match(todo.ID, q) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryTodoRepository) Update(uid int64, id uint, version int, ch TodoChanges) (*Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	todo, err := r.get(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	if version > 0 && todo.Version != version {
+		return nil, ErrConflict
+	}
+	now := time.Now()
+	if ch.Title != nil {
+		todo.Title = *ch.Title
+	}
+	if ch.Description != nil {
+		todo.Description = *ch.Description
+	}
+	if ch.Priority != nil {
+		todo.Priority = *ch.Priority
+	}
+	if ch.ListID != nil {
+		todo.ListID = *ch.ListID
+		// 子任务和上级在同一个清单里，一起移过去
+		for _, child := range r.subtasks(uid, id, false) {
+			if child.ListID != todo.ListID {
+				child.ListID, child.UpdatedAt = todo.ListID, now
+				child.Version++
+			}
+		}
+	}
+	if ch.SetDueAt {
+		todo.DueAt = ch.DueAt
+	}
+	if ch.DueTZ != nil {
+		todo.DueTZ = *ch.DueTZ
+	}
+	if ch.RRule != nil {
+		todo.RRule = *ch.RRule
+	}
+	if ch.Occurrence != nil {
+		todo.Occurrence = *ch.Occurrence
+	}
+	if ch.Status != nil {
+		if !*ch.Status {
+			todo.CompletedAt = nil
+		} else if !todo.Status {
+			todo.CompletedAt = &now
+		}
+		todo.Status = *ch.Status
+	}
+	// 和 gorm 的 Updates 一样，什么都不改的时候不动 updated_at 和版本号
+	if ch != (TodoChanges{}) {
+		todo.UpdatedAt = now
+		todo.Version++
+	}
+	cp := *todo
+	return &cp, nil
+}
+
+func (r *memoryTodoRepository) CompleteRecurring(uid int64, id uint, version int, ch TodoChanges, next *Todo, uids []int64) (*Todo, error) {
+	// 内存实现只有修改会失败，修改成功了后面的都不会失败
+	todo, err := r.Update(uid, id, version, ch)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Create(next); err != nil {
+		return nil, err
+	}
+	if err := copyOccurrence(r.tags, r.reminders, uids, id, next); err != nil {
+		return nil, err
+	}
+	return todo, nil
+}
+
+func (r *memoryTodoRepository) Delete(uid int64, id uint, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	todo, err := r.get(uid, id)
+	if err != nil {
+		return err
+	}
+	if version > 0 && todo.Version != version {
+		return ErrConflict
+	}
+	deletedAt := gorm.DeletedAt{Time: time.Now(), Valid: true}
+	todo.DeletedAt = deletedAt
+	for _, child := range r.subtasks(uid, id, false) {
+		child.DeletedAt = deletedAt
+	}
+	return nil
+}
+
+// subtasks 调用方要先加锁，id 下面所有层的子任务，deleted 为 true 找回收站里的，否则找没删除的
+func (r *memoryTodoRepository) subtasks(uid int64, id uint, deleted bool) []*Todo {
+	var all []*Todo
+	for _, todo := range r.todos {
+		if todo.Uid == uid && todo.ParentID == id && todo.DeletedAt.Valid == deleted {
+			all = append(all, todo)
+			all = append(all, r.subtasks(uid, todo.ID, deleted)...)
+		}
+	}
+	return all
+}
+
+func (r *memoryTodoRepository) Children(uid int64, parentIDs []uint) ([]Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	parents := make(map[uint]bool, len(parentIDs))
+	for _, id := range parentIDs {
+		parents[id] = true
+	}
+	todos := make([]Todo, 0)
+	for _, todo := range r.todos {
+		if todo.Uid == uid && parents[todo.ParentID] && !todo.DeletedAt.Valid {
+			todos = append(todos, *todo)
+		}
+	}
+	sort.Slice(todos, func(i, j int) bool { return todos[i].ID < todos[j].ID })
+	return todos, nil
+}
+
+func (r *memoryTodoRepository) Progress(uid int64, ids []uint) (map[uint]TodoProgress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	wanted := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	progress := make(map[uint]TodoProgress)
+	for _, todo := range r.todos {
+		if todo.Uid != uid || !wanted[todo.ParentID] || todo.DeletedAt.Valid {
+			continue
+		}
+		p := progress[todo.ParentID]
+		p.Total++
+		if todo.Status {
+			p.Done++
+		}
+		progress[todo.ParentID] = p
+	}
+	return progress, nil
+}
+
+// getDeleted 调用方要先加锁，只找软删除了的记录
+func (r *memoryTodoRepository) getDeleted(uid int64, id uint) (*Todo, error) {
+	todo, ok := r.todos[id]
+	if !ok || todo.Uid != uid || !todo.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	return todo, nil
+}
+
+func (r *memoryTodoRepository) ListDeleted(uid int64, limit int) ([]Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	todos := make([]Todo, 0)
+	for _, todo := range r.todos {
+		if todo.Uid == uid && todo.DeletedAt.Valid {
+			todos = append(todos, *todo)
+		}
+	}
+	sort.Slice(todos, func(i, j int) bool {
+		a, b := todos[i].DeletedAt.Time, todos[j].DeletedAt.Time
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return todos[i].ID > todos[j].ID
+	})
+	if limit > 0 && len(todos) > limit {
+		todos = todos[:limit]
+	}
+	return todos, nil
+}
+
+func (r *memoryTodoRepository) Restore(uid int64, id uint) (*Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	todo, err := r.getDeleted(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	if todo.ParentID != 0 {
+		parent, ok := r.todos[todo.ParentID]
+		if !ok {
+			// 上级已经彻底删除了
+			todo.ParentID = 0
+		} else if parent.DeletedAt.Valid {
+			return nil, ErrParentDeleted
+		}
+	}
+	now := time.Now()
+	r.restore(todo, todo.DeletedAt.Time, now)
+	cp := *todo
+	return &cp, nil
+}
+
+// restore 调用方要先加锁，恢复 todo 和删除时间是 deletedAt 的子任务，单独删除的子任务留在回收站里
+func (r *memoryTodoRepository) restore(todo *Todo, deletedAt, now time.Time) {
+	todo.DeletedAt = gorm.DeletedAt{}
+	todo.UpdatedAt = now
+	todo.Version++
+	for _, child := range r.todos {
+		if child.Uid == todo.Uid && child.ParentID == todo.ID && child.DeletedAt.Valid && child.DeletedAt.Time.Equal(deletedAt) {
+			r.restore(child, deletedAt, now)
+		}
+	}
+}
+
+func (r *memoryTodoRepository) Purge(uid int64, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.getDeleted(uid, id); err != nil {
+		return err
+	}
+	for _, child := range r.subtasks(uid, id, true) {
+		r.remove(child.ID)
+	}
+	r.remove(id)
+	return nil
+}
+
+func (r *memoryTodoRepository) PurgeAll(uid int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for id, todo := range r.todos {
+		if todo.Uid == uid && todo.DeletedAt.Valid {
+			r.remove(id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryTodoRepository) PurgeDeletedBefore(before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for id, todo := range r.todos {
+		if todo.DeletedAt.Valid && todo.DeletedAt.Time.Before(before) {
+			r.remove(id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// remove 调用方要先加锁，彻底删除，连同打的标签
+func (r *memoryTodoRepository) remove(id uint) {
+	delete(r.todos, id)
+	r.tags.forget(id)
+	r.reminders.forget(id)
+}
+
+func (r *memoryTodoRepository) MoveList(uid int64, from, to uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, todo := range r.todos {
+		if todo.Uid == uid && todo.ListID == from {
+			todo.ListID, todo.UpdatedAt = to, time.Now()
+			todo.Version++
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ------------------------- TodoList -------------------------
+
+type memoryTodoListRepository struct {
+	mu     sync.Mutex
+	nextID uint
+	lists  map[uint]*TodoList
+}
+
+func newMemoryTodoListRepository() *memoryTodoListRepository {
+	return &memoryTodoListRepository{lists: make(map[uint]*TodoList)}
+}
+
+func (r *memoryTodoListRepository) Create(list *TodoList) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 和数据库的唯一索引一样，一个用户只能有一个收件箱
+	if list.IsInbox {
+		for _, l := range r.lists {
+			if l.Uid == list.Uid && l.IsInbox {
+				return ErrDuplicate
+			}
+		}
+	}
+	r.nextID++
+	now := time.Now()
+	list.ID, list.CreatedAt, list.UpdatedAt = r.nextID, now, now
+	cp := *list
+	r.lists[list.ID] = &cp
+	return nil
+}
+
+// get 调用方要先加锁，软删除的记录当作不存在
+func (r *memoryTodoListRepository) get(uid int64, id uint) (*TodoList, error) {
+	list, ok := r.lists[id]
+	if !ok || list.Uid != uid || list.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	return list, nil
+}
+
+func (r *memoryTodoListRepository) Get(uid int64, id uint) (*TodoList, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list, err := r.get(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	cp := *list
+	return &cp, nil
+}
+
+func (r *memoryTodoListRepository) Find(id uint) (*TodoList, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list, ok := r.lists[id]
+	if !ok || list.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	cp := *list
+	return &cp, nil
+}
+
+func (r *memoryTodoListRepository) GetInbox(uid int64) (*TodoList, error) {
+	lists, _ := r.List(uid)
+	if len(lists) == 0 || !lists[0].IsInbox {
+		return nil, ErrNotFound
+	}
+	return &lists[0], nil
+}
+
+func (r *memoryTodoListRepository) List(uid int64) ([]TodoList, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lists := make([]TodoList, 0)
+	for _, list := range r.lists {
+		if list.Uid == uid && !list.DeletedAt.Valid {
+			lists = append(lists, *list)
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		if lists[i].IsInbox != lists[j].IsInbox {
+			return lists[i].IsInbox
+		}
+		return lists[i].ID < lists[j].ID
+	})
+	return lists, nil
+}
+
+func (r *memoryTodoListRepository) Rename(uid int64, id uint, name string) (*TodoList, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list, err := r.get(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	list.Name, list.UpdatedAt = name, time.Now()
+	cp := *list
+	return &cp, nil
+}
+
+func (r *memoryTodoListRepository) Delete(uid int64, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list, err := r.get(uid, id)
+	if err != nil {
+		return err
+	}
+	list.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	return nil
+}
+
+// ------------------------- ListMember -------------------------
+
+type memoryListMemberRepository struct {
+	mu      sync.Mutex
+	nextID  uint
+	members map[uint]*ListMember
+}
+
+func newMemoryListMemberRepository() *memoryListMemberRepository {
+	return &memoryListMemberRepository{members: make(map[uint]*ListMember)}
+}
+
+func (r *memoryListMemberRepository) Create(m *ListMember) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, other := range r.members {
+		if other.ListID == m.ListID && other.Uid == m.Uid {
+			return ErrDuplicate
+		}
+	}
+	r.nextID++
+	now := time.Now()
+	m.ID, m.CreatedAt, m.UpdatedAt = r.nextID, now, now
+	cp := *m
+	r.members[m.ID] = &cp
+	return nil
+}
+
+func (r *memoryListMemberRepository) Get(listID, id uint) (*ListMember, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.members[id]
+	if !ok || m.ListID != listID {
+		return nil, ErrNotFound
+	}
+	cp := *m
+	return &cp, nil
+}
+
+func (r *memoryListMemberRepository) GetByUser(listID uint, uid int64) (*ListMember, error) {
+	members, _ := r.filter(func(m *ListMember) bool { return m.ListID == listID && m.Uid == uid })
+	if len(members) == 0 {
+		return nil, ErrNotFound
+	}
+	return &members[0], nil
+}
+
+func (r *memoryListMemberRepository) ListByList(listID uint) ([]ListMember, error) {
+	return r.filter(func(m *ListMember) bool { return m.ListID == listID })
+}
+
+func (r *memoryListMemberRepository) ListByUser(uid int64, status string) ([]ListMember, error) {
+	return r.filter(func(m *ListMember) bool { return m.Uid == uid && m.Status == status })
+}
+
+// filter 符合条件的按 id 排序
+func (r *memoryListMemberRepository) filter(match func(m *ListMember) bool) ([]ListMember, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make([]ListMember, 0)
+	for _, m := range r.members {
+		if match(m) {
+			members = append(members, *m)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members, nil
+}
+
+func (r *memoryListMemberRepository) UpdateRole(listID, id uint, role string) (*ListMember, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.members[id]
+	if !ok || m.ListID != listID {
+		return nil, ErrNotFound
+	}
+	m.Role, m.UpdatedAt = role, time.Now()
+	cp := *m
+	return &cp, nil
+}
+
+func (r *memoryListMemberRepository) Delete(listID, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.members[id]
+	if !ok || m.ListID != listID {
+		return ErrNotFound
+	}
+	delete(r.members, id)
+	return nil
+}
+
+func (r *memoryListMemberRepository) DeleteByList(listID uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, m := range r.members {
+		if m.ListID == listID {
+			delete(r.members, id)
+		}
+	}
+	return nil
+}
+
+func (r *memoryListMemberRepository) Accept(uid int64, id uint, at time.Time) (*ListMember, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.members[id]
+	if !ok || m.Uid != uid || m.Status != MemberInvited {
+		return nil, ErrNotFound
+	}
+	m.Status, m.AcceptedAt, m.UpdatedAt = MemberAccepted, &at, time.Now()
+	cp := *m
+	return &cp, nil
+}
+
+func (r *memoryListMemberRepository) Decline(uid int64, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.members[id]
+	if !ok || m.Uid != uid || m.Status != MemberInvited {
+		return ErrNotFound
+	}
+	delete(r.members, id)
+	return nil
+}
+
+// ------------------------- Tag -------------------------
+
+type todoTagKey struct {
+	todoID, tagID uint
+}
+
+type memoryTagRepository struct {
+	mu     sync.Mutex
+	nextID uint
+	tags   map[uint]*Tag
+	links  map[todoTagKey]bool
+}
+
+func newMemoryTagRepository() *memoryTagRepository {
+	return &memoryTagRepository{tags: make(map[uint]*Tag), links: make(map[todoTagKey]bool)}
+}
+
+// checkName 调用方要先加锁，同一个用户的标签不能重名，id 是正在改名的标签
+func (r *memoryTagRepository) checkName(uid int64, id uint, name string) error {
+	for _, tag := range r.tags {
+		if tag.Uid == uid && tag.Name == name && tag.ID != id {
+			return ErrDuplicate
+		}
+	}
+	return nil
+}
+
+func (r *memoryTagRepository) Create(tag *Tag) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkName(tag.Uid, 0, tag.Name); err != nil {
+		return err
+	}
+	r.nextID++
+	now := time.Now()
+	tag.ID, tag.CreatedAt, tag.UpdatedAt = r.nextID, now, now
+	cp := *tag
+	r.tags[tag.ID] = &cp
+	return nil
+}
+
+func (r *memoryTagRepository) Get(uid int64, id uint) (*Tag, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tag, ok := r.tags[id]
+	if !ok || tag.Uid != uid {
+		return nil, ErrNotFound
+	}
+	cp := *tag
+	return &cp, nil
+}
+
+// sortTags 按名字排序，和数据库的 order by 一致
+func sortTags(tags []Tag) {
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Name != tags[j].Name {
+			return tags[i].Name < tags[j].Name
+		}
+		return tags[i].ID < tags[j].ID
+	})
+}
+
+func (r *memoryTagRepository) List(uid int64) ([]Tag, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tags := make([]Tag, 0)
+	for _, tag := range r.tags {
+		if tag.Uid == uid {
+			tags = append(tags, *tag)
+		}
+	}
+	sortTags(tags)
+	return tags, nil
+}
+
+func (r *memoryTagRepository) Update(uid int64, id uint, name, color string) (*Tag, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tag, ok := r.tags[id]
+	if !ok || tag.Uid != uid {
+		return nil, ErrNotFound
+	}
+	if err := r.checkName(uid, id, name); err != nil {
+		return nil, err
+	}
+	tag.Name, tag.Color, tag.UpdatedAt = name, color, time.Now()
+	cp := *tag
+	return &cp, nil
+}
+
+func (r *memoryTagRepository) Delete(uid int64, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tag, ok := r.tags[id]
+	if !ok || tag.Uid != uid {
+		return ErrNotFound
+	}
+	delete(r.tags, id)
+	for key := range r.links {
+		if key.tagID == id {
+			delete(r.links, key)
+		}
+	}
+	return nil
+}
+
+func (r *memoryTagRepository) Attach(todoID, tagID uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.links[todoTagKey{todoID, tagID}] = true
+	return nil
+}
+
+func (r *memoryTagRepository) Detach(todoID, tagID uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.links, todoTagKey{todoID, tagID})
+	return nil
+}
+
+func (r *memoryTagRepository) ListByTodos(uid int64, todoIDs []uint) (map[uint][]Tag, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make(map[uint][]Tag)
+	for _, todoID := range todoIDs {
+		for key := range r.links {
+			if tag, ok := r.tags[key.tagID]; ok && key.todoID == todoID && tag.Uid == uid {
+				result[todoID] = append(result[todoID], *tag)
+			}
+		}
+		if tags, ok := result[todoID]; ok {
+			sortTags(tags)
+		}
+	}
+	return result, nil
+}
+
+// match 待办事项有没有打 q 里的标签，q.TagsAll 的时候要全都打了
+func (r *memoryTagRepository) match(todoID uint, q TodoQuery) bool {
+	if len(q.Tags) == 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, tagID := range q.Tags {
+		// 和 gorm 实现一样，只认查询的人自己的标签
+		if tag, ok := r.tags[tagID]; ok && tag.Uid == q.TagUid && r.links[todoTagKey{todoID, tagID}] {
+			n++
+		}
+	}
+	if q.TagsAll {
+		return n == len(q.Tags)
+	}
+	return n > 0
+}
+
+// forget 待办事项彻底删除了，去掉它打的标签
+func (r *memoryTagRepository) forget(todoID uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.links {
+		if key.todoID == todoID {
+			delete(r.links, key)
+		}
+	}
+}
+
+// ------------------------- Reminder -------------------------
+
+type memoryReminderRepository struct {
+	mu        sync.Mutex
+	nextID    uint
+	reminders map[uint]*Reminder
+}
+
+func newMemoryReminderRepository() *memoryReminderRepository {
+	return &memoryReminderRepository{reminders: make(map[uint]*Reminder)}
+}
+
+func (r *memoryReminderRepository) Create(reminder *Reminder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	now := time.Now()
+	reminder.ID, reminder.CreatedAt, reminder.UpdatedAt, reminder.Version = r.nextID, now, now, 1
+	cp := *reminder
+	r.reminders[cp.ID] = &cp
+	return nil
+}
+
+func (r *memoryReminderRepository) ListByTodo(uid int64, todoID uint) ([]Reminder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reminders := make([]Reminder, 0)
+	for _, reminder := range r.reminders {
+		if reminder.Uid == uid && reminder.TodoID == todoID {
+			reminders = append(reminders, *reminder)
+		}
+	}
+	sort.Slice(reminders, func(i, j int) bool { return reminders[i].ID < reminders[j].ID })
+	return reminders, nil
+}
+
+func (r *memoryReminderRepository) Delete(uid int64, todoID, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reminder, ok := r.reminders[id]
+	if !ok || reminder.Uid != uid || reminder.TodoID != todoID {
+		return ErrNotFound
+	}
+	delete(r.reminders, id)
+	return nil
+}
+
+func (r *memoryReminderRepository) Reschedule(todoID uint, due *time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, reminder := range r.reminders {
+		if reminder.TodoID == todoID && reminder.Offset != nil {
+			reminder.schedule(due)
+			reminder.Version++
+			reminder.UpdatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (r *memoryReminderRepository) ListDue(now time.Time, limit int) ([]Reminder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reminders := make([]Reminder, 0)
+	for _, reminder := range r.reminders {
+		if reminder.Status == ReminderPending && reminder.FireAt != nil && !reminder.FireAt.After(now) {
+			reminders = append(reminders, *reminder)
+		}
+	}
+	sort.Slice(reminders, func(i, j int) bool {
+		if !reminders[i].FireAt.Equal(*reminders[j].FireAt) {
+			return reminders[i].FireAt.Before(*reminders[j].FireAt)
+		}
+		return reminders[i].ID < reminders[j].ID
+	})
+	if len(reminders) > limit {
+		reminders = reminders[:limit]
+	}
+	return reminders, nil
+}
+
+func (r *memoryReminderRepository) Claim(id uint, version int, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reminder, ok := r.reminders[id]
+	if !ok || reminder.Version != version {
+		return false, nil
+	}
+	reminder.FireAt = &until
+	reminder.Version++
+	return true, nil
+}
+
+func (r *memoryReminderRepository) Finish(id uint, status, lastErr string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reminder, ok := r.reminders[id]
+	if !ok {
+		return nil
+	}
+	reminder.Status, reminder.LastError, reminder.UpdatedAt = status, lastErr, time.Now()
+	switch status {
+	case ReminderSent:
+		reminder.SentAt = &at
+	case ReminderFailed:
+		reminder.Attempts++
+	}
+	return nil
+}
+
+func (r *memoryReminderRepository) Retry(id uint, lastErr string, fireAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reminder, ok := r.reminders[id]
+	if !ok {
+		return nil
+	}
+	reminder.FireAt, reminder.LastError, reminder.UpdatedAt = &fireAt, lastErr, time.Now()
+	reminder.Attempts++
+	return nil
+}
+
+// forget 待办事项彻底删除了，去掉它的提醒
+func (r *memoryReminderRepository) forget(todoID uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, reminder := range r.reminders {
+		if reminder.TodoID == todoID {
+			delete(r.reminders, id)
+		}
+	}
+}
+
+// ------------------------- Webhook -------------------------
+
+type memoryWebhookRepository struct {
+	mu           sync.Mutex
+	nextID       uint
+	nextDelivery uint
+	nextAttempt  uint
+	endpoints    map[uint]*WebhookEndpoint
+	deliveries   map[uint]*WebhookDelivery
+	attempts     map[uint][]WebhookAttempt // delivery_id -> 每一次发送
+}
+
+func newMemoryWebhookRepository() *memoryWebhookRepository {
+	return &memoryWebhookRepository{
+		endpoints:  make(map[uint]*WebhookEndpoint),
+		deliveries: make(map[uint]*WebhookDelivery),
+		attempts:   make(map[uint][]WebhookAttempt),
+	}
+}
+
+func (r *memoryWebhookRepository) Create(e *WebhookEndpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	now := time.Now()
+	e.ID, e.CreatedAt, e.UpdatedAt = r.nextID, now, now
+	cp := *e
+	r.endpoints[cp.ID] = &cp
+	return nil
+}
+
+func (r *memoryWebhookRepository) Get(uid int64, id uint) (*WebhookEndpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.endpoints[id]
+	if !ok || e.Uid != uid {
+		return nil, ErrNotFound
+	}
+	cp := *e
+	return &cp, nil
+}
+
+func (r *memoryWebhookRepository) List(uid int64) ([]WebhookEndpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoints := make([]WebhookEndpoint, 0)
+	for _, e := range r.endpoints {
+		if e.Uid == uid {
+			endpoints = append(endpoints, *e)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].ID < endpoints[j].ID })
+	return endpoints, nil
+}
+
+func (r *memoryWebhookRepository) Update(uid int64, id uint, url, events string, active bool) (*WebhookEndpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.endpoints[id]
+	if !ok || e.Uid != uid {
+		return nil, ErrNotFound
+	}
+	e.URL, e.EventList, e.Active, e.UpdatedAt = url, events, active, time.Now()
+	cp := *e
+	return &cp, nil
+}
+
+func (r *memoryWebhookRepository) Delete(uid int64, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.endpoints[id]
+	if !ok || e.Uid != uid {
+		return ErrNotFound
+	}
+	delete(r.endpoints, id)
+	for did, d := range r.deliveries {
+		if d.EndpointID == id {
+			delete(r.deliveries, did)
+			delete(r.attempts, did)
+		}
+	}
+	return nil
+}
+
+func (r *memoryWebhookRepository) CreateDelivery(d *WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextDelivery++
+	now := time.Now()
+	d.ID, d.CreatedAt, d.UpdatedAt, d.Version = r.nextDelivery, now, now, 1
+	cp := *d
+	r.deliveries[cp.ID] = &cp
+	return nil
+}
+
+func (r *memoryWebhookRepository) GetDelivery(uid int64, endpointID, id uint) (*WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.deliveries[id]
+	if !ok || d.Uid != uid || d.EndpointID != endpointID {
+		return nil, ErrNotFound
+	}
+	cp := *d
+	return &cp, nil
+}
+
+func (r *memoryWebhookRepository) ListDeliveries(uid int64, endpointID uint, limit int) ([]WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deliveries := make([]WebhookDelivery, 0)
+	for _, d := range r.deliveries {
+		if d.Uid == uid && d.EndpointID == endpointID {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (r *memoryWebhookRepository) ListAttempts(deliveryID uint) ([]WebhookAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]WebhookAttempt{}, r.attempts[deliveryID]...), nil
+}
+
+func (r *memoryWebhookRepository) ListDue(now time.Time, limit int) ([]WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deliveries := make([]WebhookDelivery, 0)
+	for _, d := range r.deliveries {
+		if d.Status == WebhookPending && d.NextAttemptAt != nil && !d.NextAttemptAt.After(now) {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].NextAttemptAt.Equal(*deliveries[j].NextAttemptAt) {
+			return deliveries[i].NextAttemptAt.Before(*deliveries[j].NextAttemptAt)
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (r *memoryWebhookRepository) Claim(id uint, version int, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.deliveries[id]
+	if !ok || d.Version != version {
+		return false, nil
+	}
+	d.NextAttemptAt = &until
+	d.Version++
+	return true, nil
+}
+
+func (r *memoryWebhookRepository) RecordAttempt(id uint, attempt *WebhookAttempt, status string, next *time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.deliveries[id]
+	if !ok {
+		return nil
+	}
+	r.nextAttempt++
+	attempt.ID, attempt.DeliveryID = r.nextAttempt, id
+	r.attempts[id] = append(r.attempts[id], *attempt)
+	d.Status, d.NextAttemptAt, d.UpdatedAt = status, next, time.Now()
+	d.Attempts++
+	d.LastStatus, d.LastError = attempt.StatusCode, attempt.Error
+	if status == WebhookSucceeded {
+		at := attempt.CreatedAt
+		d.DeliveredAt = &at
+	}
+	return nil
+}
+
+func (r *memoryWebhookRepository) PurgeDeliveries(before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for id, d := range r.deliveries {
+		if d.Status != WebhookPending && d.UpdatedAt.Before(before) {
+			delete(r.deliveries, id)
+			delete(r.attempts, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ------------------------- Notification -------------------------
+
+type memoryNotificationRepository struct {
+	mu            sync.Mutex
+	nextID        uint
+	notifications map[uint]*Notification
+}
+
+func newMemoryNotificationRepository() *memoryNotificationRepository {
+	return &memoryNotificationRepository{notifications: make(map[uint]*Notification)}
+}
+
+func (r *memoryNotificationRepository) Create(n *Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	n.ID, n.CreatedAt = r.nextID, time.Now()
+	cp := *n
+	r.notifications[cp.ID] = &cp
+	return nil
+}
+
+func (r *memoryNotificationRepository) List(uid int64, unreadOnly bool, limit int) ([]Notification, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	notifications := make([]Notification, 0)
+	for _, n := range r.notifications {
+		if n.Uid == uid && (!unreadOnly || n.ReadAt == nil) {
+			notifications = append(notifications, *n)
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].ID > notifications[j].ID })
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+	return notifications, nil
+}
+
+func (r *memoryNotificationRepository) MarkRead(uid int64, id uint, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.notifications[id]
+	if !ok || n.Uid != uid {
+		return ErrNotFound
+	}
+	if n.ReadAt == nil {
+		n.ReadAt = &at
+	}
+	return nil
+}
+
+func (r *memoryNotificationRepository) MarkAllRead(uid int64, at time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var count int64
+	for _, n := range r.notifications {
+		if n.Uid == uid && n.ReadAt == nil {
+			n.ReadAt = &at
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ------------------------- Account -------------------------
+
+type memoryAccountRepository struct {
+	mu       sync.Mutex
+	nextID   uint
+	accounts map[string]*Account // 用户名 -> 用户
+
+	nextChangeID uint
+	changes      []AccountStatusChange // 状态变化记录，按时间排序
+}
+
+func newMemoryAccountRepository() *memoryAccountRepository {
+	return &memoryAccountRepository{accounts: make(map[string]*Account)}
+}
+
+func (r *memoryAccountRepository) Create(account *Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.accounts[account.Name]; ok {
+		return ErrDuplicate
+	}
+	r.nextID++
+	now := time.Now()
+	account.ID, account.CreatedAt, account.UpdatedAt = r.nextID, now, now
+	if account.Status == "" {
+		account.Status = AccountActive
+	}
+	cp := *account
+	r.accounts[account.Name] = &cp
+	return nil
+}
+
+func (r *memoryAccountRepository) GetByName(name string) (*Account, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	account, ok := r.accounts[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *account
+	return &cp, nil
+}
+
+// getByUid 调用方要先加锁
+func (r *memoryAccountRepository) getByUid(uid int64) (*Account, error) {
+	for _, account := range r.accounts {
+		if account.Uid == uid {
+			return account, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryAccountRepository) GetByUid(uid int64) (*Account, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	account, err := r.getByUid(uid)
+	if err != nil {
+		return nil, err
+	}
+	cp := *account
+	return &cp, nil
+}
+
+func (r *memoryAccountRepository) UpdatePassword(uid int64, algo, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	account, err := r.getByUid(uid)
+	if err != nil {
+		return err
+	}
+	account.Password, account.PwdAlgo, account.UpdatedAt = hash, algo, time.Now()
+	return nil
+}
+
+func (r *memoryAccountRepository) Search(q string, afterID uint, limit int) ([]Account, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	accounts := make([]Account, 0)
+	for _, account := range r.accounts {
+		if account.ID > afterID && strings.Contains(strings.ToLower(account.Name), strings.ToLower(q)) {
+			accounts = append(accounts, *account)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+	}
+	return accounts, nil
+}
+
+func (r *memoryAccountRepository) UpdateRole(uid int64, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	account, err := r.getByUid(uid)
+	if err != nil {
+		return err
+	}
+	account.Role, account.UpdatedAt = role, time.Now()
+	return nil
+}
+
+func (r *memoryAccountRepository) UpdateStatus(change *AccountStatusChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	account, err := r.getByUid(change.Uid)
+	if err != nil {
+		return err
+	}
+	if account.AccountStatus() != change.From {
+		return ErrConflict
+	}
+	now := time.Now()
+	account.Status, account.StatusReason, account.StatusChangedAt, account.UpdatedAt = change.To, change.Reason, &now, now
+	r.nextChangeID++
+	change.ID, change.CreatedAt = r.nextChangeID, now
+	r.changes = append(r.changes, *change)
+	return nil
+}
+
+func (r *memoryAccountRepository) StatusHistory(uid int64, limit int) ([]AccountStatusChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := make([]AccountStatusChange, 0)
+	for i := len(r.changes) - 1; i >= 0 && len(changes) < limit; i-- {
+		if r.changes[i].Uid == uid {
+			changes = append(changes, r.changes[i])
+		}
+	}
+	return changes, nil
+}
+
+// ------------------------- RefreshToken -------------------------
+
+type memoryRefreshTokenRepository struct {
+	mu     sync.Mutex
+	nextID uint
+	tokens map[string]*RefreshToken // token hash -> token
+}
+
+func newMemoryRefreshTokenRepository() *memoryRefreshTokenRepository {
+	return &memoryRefreshTokenRepository{tokens: make(map[string]*RefreshToken)}
+}
+
+func (r *memoryRefreshTokenRepository) Create(rt *RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tokens[rt.TokenHash]; ok {
+		return ErrDuplicate
+	}
+	r.nextID++
+	rt.ID, rt.CreatedAt = r.nextID, time.Now()
+	cp := *rt
+	r.tokens[rt.TokenHash] = &cp
+	return nil
+}
+
+func (r *memoryRefreshTokenRepository) GetByHash(hash string) (*RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rt, ok := r.tokens[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *rt
+	return &cp, nil
+}
+
+func (r *memoryRefreshTokenRepository) MarkUsed(id uint, at time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.tokens {
+		if rt.ID == id {
+			if rt.UsedAt != nil {
+				return false, nil
+			}
+			rt.UsedAt = &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *memoryRefreshTokenRepository) RevokeFamily(family string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.tokens {
+		if rt.FamilyID == family && rt.RevokedAt == nil {
+			rt.RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+func (r *memoryRefreshTokenRepository) RevokeUser(uid int64, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.tokens {
+		if rt.Uid == uid && rt.RevokedAt == nil {
+			rt.RevokedAt = &at
+		}
+	}
+	return nil
+}
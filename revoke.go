@@ -0,0 +1,194 @@
+package main
+
+// token 吊销相关代码
+// jwt 本身是无状态的，签发出去之后在过期之前一直有效，泄露了也没办法，所以服务端要记一份 "黑名单"
+// 每个 token 签发的时候带一个唯一的 jti(MyClaims.Id)，退出登录就把 jti 放进黑名单，存到 token 过期为止
+// "退出所有设备" 记录一个时间点，这个用户在这个时间点之前签发的 token 全部失效
+// 时间点和 token 的签发时间(MyClaims.IssuedAtMs)都精确到毫秒，同一毫秒签发的也算作吊销；
+// 没有 iat_ms 的老 token 按 iat 的秒算，和吊销时间点在同一秒的也算作吊销
+// RevocationStore 的方法都能直接对应到 redis：SET key value EX ttl / GET key，以后换 redis 实现这个接口就行
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RevocationStore token 黑名单的存储
+type RevocationStore interface {
+	// Revoke 吊销一个 jti，ttl 传 token 剩下的有效期，过了这个时间 token 自己就过期了，记录可以清理掉
+	Revoke(jti string, ttl time.Duration) error
+	// IsRevoked jti 是否已经被吊销
+	IsRevoked(jti string) (bool, error)
+	// RevokeUser 吊销这个用户在 since 之前签发的所有 token
+	RevokeUser(uid int64, since time.Time, ttl time.Duration) error
+	// UserRevokedSince 返回 RevokeUser 记录的时间点，没有记录返回零值
+	UserRevokedSince(uid int64) (time.Time, error)
+}
+
+// ------------------------- 内存实现 -------------------------
+// 只适合单实例部署 和 测试，多实例部署要用 sql 或者 redis 实现
+
+type memoryRevocationStore struct {
+	mu    sync.Mutex
+	items map[string]memoryRevocation
+}
+
+type memoryRevocation struct {
+	value     int64
+	expiresAt time.Time
+}
+
+func newMemoryRevocationStore() *memoryRevocationStore {
+	return &memoryRevocationStore{items: make(map[string]memoryRevocation)}
+}
+
+func (s *memoryRevocationStore) set(key string, value int64, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	// 顺便清理掉过期的记录
+	for k, v := range s.items {
+		if now.After(v.expiresAt) {
+			delete(s.items, k)
+		}
+	}
+	s.items[key] = memoryRevocation{value: value, expiresAt: now.Add(ttl)}
+}
+
+func (s *memoryRevocationStore) get(key string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.items[key]
+	if !ok || time.Now().After(v.expiresAt) {
+		return 0, false
+	}
+	return v.value, true
+}
+
+func (s *memoryRevocationStore) Revoke(jti string, ttl time.Duration) error {
+	s.set(revokedJtiKey(jti), 1, ttl)
+	return nil
+}
+
+func (s *memoryRevocationStore) IsRevoked(jti string) (bool, error) {
+	_, ok := s.get(revokedJtiKey(jti))
+	return ok, nil
+}
+
+func (s *memoryRevocationStore) RevokeUser(uid int64, since time.Time, ttl time.Duration) error {
+	s.set(revokedUidKey(uid), since.UnixMilli(), ttl)
+	return nil
+}
+
+func (s *memoryRevocationStore) UserRevokedSince(uid int64) (time.Time, error) {
+	v, ok := s.get(revokedUidKey(uid))
+	if !ok {
+		return time.Time{}, nil
+	}
+	return revokedSince(v), nil
+}
+
+// ------------------------- sql 实现 -------------------------
+
+// Revocation 黑名单表，key 和 redis 的 key 一样
+type Revocation struct {
+	Key       string    `gorm:"primarykey;size:128"`
+	Value     int64     `gorm:"not null;default:0"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type sqlRevocationStore struct {
+	db *gorm.DB
+}
+
+func newSQLRevocationStore(db *gorm.DB) *sqlRevocationStore {
+	return &sqlRevocationStore{db: db}
+}
+
+func (s *sqlRevocationStore) set(key string, value int64, ttl time.Duration) error {
+	now := time.Now()
+	// 顺便清理掉过期的记录，退出登录的频率不高，不用单独起定时任务
+	if err := s.db.Where("expires_at < ?", now).Delete(&Revocation{}).Error; err != nil {
+		return err
+	}
+	// key 已经存在就覆盖，相当于 redis 的 SET
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&Revocation{
+		Key:       key,
+		Value:     value,
+		ExpiresAt: now.Add(ttl),
+	}).Error
+}
+
+func (s *sqlRevocationStore) get(key string) (int64, bool, error) {
+	var r Revocation
+	// key 在 mysql 里是关键字，用结构体当条件，让 gorm 按数据库方言加引号
+	err := s.db.Where(&Revocation{Key: key}).Where("expires_at > ?", time.Now()).First(&r).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return r.Value, true, nil
+}
+
+func (s *sqlRevocationStore) Revoke(jti string, ttl time.Duration) error {
+	return s.set(revokedJtiKey(jti), 1, ttl)
+}
+
+func (s *sqlRevocationStore) IsRevoked(jti string) (bool, error) {
+	_, ok, err := s.get(revokedJtiKey(jti))
+	return ok, err
+}
+
+func (s *sqlRevocationStore) RevokeUser(uid int64, since time.Time, ttl time.Duration) error {
+	return s.set(revokedUidKey(uid), since.UnixMilli(), ttl)
+}
+
+func (s *sqlRevocationStore) UserRevokedSince(uid int64) (time.Time, error) {
+	v, ok, err := s.get(revokedUidKey(uid))
+	if err != nil || !ok {
+		return time.Time{}, err
+	}
+	return revokedSince(v), nil
+}
+
+// revokedSince RevokeUser 存的是毫秒，以前存的是秒，还没过期的老记录按秒算
+func revokedSince(v int64) time.Time {
+	if v < 1e11 {
+		return time.Unix(v, 0)
+	}
+	return time.UnixMilli(v)
+}
+
+func revokedJtiKey(jti string) string {
+	return "revoked:jti:" + jti
+}
+
+func revokedUidKey(uid int64) string {
+	return "revoked:uid:" + strconv.FormatInt(uid, 10)
+}
+
+// isTokenRevoked 中间件用来判断解析成功的 token 是否已经被吊销
+func isTokenRevoked(revocations RevocationStore, mc *MyClaims) (bool, error) {
+	if mc.Id != "" {
+		revoked, err := revocations.IsRevoked(mc.Id)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	since, err := revocations.UserRevokedSince(mc.Uid)
+	if err != nil || since.IsZero() {
+		return false, err
+	}
+	// 同一毫秒签发的也算作吊销；老 token 只有 iat，按秒算
+	if mc.IssuedAtMs == 0 {
+		return mc.IssuedAt <= since.Unix(), nil
+	}
+	return mc.IssuedAtMs <= since.UnixMilli(), nil
+}
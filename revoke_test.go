@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestIsTokenRevoked(t *testing.T) {
+	conn, err := openDB(DBConfig{Driver: DBDriverSQLite, DSN: ":memory:"})
+	if err != nil {
+		t.Fatalf("openDB() err = %v", err)
+	}
+	if _, err := migrateUp(conn); err != nil {
+		t.Fatalf("migrateUp() err = %v", err)
+	}
+	stores := map[string]RevocationStore{
+		"memory": newMemoryRevocationStore(),
+		"sqlite": newSQLRevocationStore(conn),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			since := time.Date(2022, 9, 1, 12, 0, 0, 500*int(time.Millisecond), time.Local)
+			if err := store.RevokeUser(1, since, time.Hour); err != nil {
+				t.Fatalf("RevokeUser() err = %v", err)
+			}
+			if got, err := store.UserRevokedSince(1); err != nil || !got.Equal(since) {
+				t.Fatalf("UserRevokedSince() = %v, %v, want %v", got, err, since)
+			}
+			// 吊销之后同一秒里重新登录签发的 token 不受影响，同一毫秒的算作吊销
+			for _, c := range []struct {
+				issued  time.Time
+				revoked bool
+			}{
+				{since.Add(-time.Millisecond), true},
+				{since, true},
+				{since.Add(time.Millisecond), false},
+			} {
+				mc := &MyClaims{Uid: 1, IssuedAtMs: c.issued.UnixMilli(), StandardClaims: jwt.StandardClaims{IssuedAt: c.issued.Unix()}}
+				if revoked, err := isTokenRevoked(store, mc); err != nil || revoked != c.revoked {
+					t.Errorf("isTokenRevoked(issued %s) = %v, %v, want %v", c.issued.Format("15:04:05.000"), revoked, err, c.revoked)
+				}
+			}
+			// 没有 iat_ms 的老 token 按秒算，同一秒的算作吊销
+			old := &MyClaims{Uid: 1, StandardClaims: jwt.StandardClaims{IssuedAt: since.Add(400 * time.Millisecond).Unix()}}
+			if revoked, err := isTokenRevoked(store, old); err != nil || !revoked {
+				t.Errorf("isTokenRevoked(old token) = %v, %v", revoked, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+// iCalendar(RFC 5545) 的 RRULE，用来描述待办事项怎么重复，见 todo_recur.go
+// 只支持常用的部分：
+//   FREQ        DAILY、WEEKLY、MONTHLY、YEARLY，必须有
+//   INTERVAL    隔几个周期重复一次，默认 1
+//   COUNT       一共重复几次，包括第一次
+//   UNTIL       重复到什么时候，20221231T235959Z 或者 20221231(到这一天结束)，不能和 COUNT 一起用
+//   BYDAY       星期几，MO,WE,FR；MONTHLY、YEARLY 可以带序号，1MO 第一个周一，-1FR 最后一个周五
+//   BYMONTHDAY  几号，-1 是最后一天
+//   BYMONTH     几月
+//   WKST        只支持 MO，一周从周一开始
+// 例如 FREQ=WEEKLY;BYDAY=MO 每周一，FREQ=MONTHLY;BYDAY=-1FR;COUNT=6 接下来6个月每个月最后一个周五
+// 没有 DTSTART，每次都从当前这一次的截止时间往后算，时分秒和当前这一次一样
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// maxRRulePeriods 往后找多少个周期还找不到下一次就当作没有了，比如 FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30
+const maxRRulePeriods = 1000
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// RRule 解析之后的重复规则
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int       // 0 代表不限次数
+	Until      time.Time // 零值代表不限时间
+	UntilDate  bool      // UNTIL 只写了日期，到这一天结束(按截止时间的时区)
+	ByDay      []RRuleDay
+	ByMonthDay []int
+	ByMonth    []int
+}
+
+// RRuleDay BYDAY 里的一项，N 为0代表每个星期几，正数第几个，负数倒数第几个
+type RRuleDay struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// parseRRule 解析 RRULE，前面带不带 "RRULE:" 都可以，不支持的写法返回错误
+func parseRRule(s string) (*RRule, error) {
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	r := &RRule{Interval: 1}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("rrule: invalid part %q", part)
+		}
+		key, value := kv[0], kv[1]
+		if seen[key] {
+			return nil, fmt.Errorf("rrule: duplicate %s", key)
+		}
+		seen[key] = true
+		var err error
+		switch key {
+		case "FREQ":
+			switch value {
+			case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+				r.Freq = value
+			default:
+				err = errors.New("unsupported FREQ")
+			}
+		case "INTERVAL":
+			r.Interval, err = rruleInt(value, 1, 1000)
+		case "COUNT":
+			r.Count, err = rruleInt(value, 1, 100000)
+		case "UNTIL":
+			err = r.parseUntil(value)
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				var day RRuleDay
+				if day, err = parseRRuleDay(v); err != nil {
+					break
+				}
+				r.ByDay = append(r.ByDay, day)
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				var n int
+				if n, err = rruleInt(v, -31, 31); err != nil || n == 0 {
+					err = errors.New("invalid BYMONTHDAY")
+					break
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(value, ",") {
+				var n int
+				if n, err = rruleInt(v, 1, 12); err != nil {
+					break
+				}
+				r.ByMonth = append(r.ByMonth, n)
+			}
+		case "WKST":
+			if value != "MO" {
+				err = errors.New("only WKST=MO is supported")
+			}
+		default:
+			err = errors.New("unsupported part")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rrule: %s: %w", key, err)
+		}
+	}
+	if r.Freq == "" {
+		return nil, errors.New("rrule: FREQ is required")
+	}
+	if r.Count > 0 && !r.Until.IsZero() {
+		return nil, errors.New("rrule: COUNT and UNTIL must not be used together")
+	}
+	for _, day := range r.ByDay {
+		if day.N != 0 && r.Freq != FreqMonthly && r.Freq != FreqYearly {
+			return nil, errors.New("rrule: BYDAY with a number needs FREQ=MONTHLY or YEARLY")
+		}
+	}
+	// 按年的第几个星期几(没有 BYMONTH)算起来太绕，用的人也少，先不支持
+	if r.Freq == FreqYearly && len(r.ByDay) > 0 && len(r.ByMonth) == 0 {
+		return nil, errors.New("rrule: BYDAY with FREQ=YEARLY needs BYMONTH")
+	}
+	return r, nil
+}
+
+func rruleInt(s string, min, max int) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "+"))
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%q out of range", s)
+	}
+	return n, nil
+}
+
+func parseRRuleDay(s string) (RRuleDay, error) {
+	if len(s) < 2 {
+		return RRuleDay{}, fmt.Errorf("invalid BYDAY %q", s)
+	}
+	weekday, ok := rruleWeekdays[s[len(s)-2:]]
+	if !ok {
+		return RRuleDay{}, fmt.Errorf("invalid BYDAY %q", s)
+	}
+	day := RRuleDay{Weekday: weekday}
+	if prefix := s[:len(s)-2]; prefix != "" {
+		n, err := rruleInt(prefix, -5, 5)
+		if err != nil || n == 0 {
+			return RRuleDay{}, fmt.Errorf("invalid BYDAY %q", s)
+		}
+		day.N = n
+	}
+	return day, nil
+}
+
+func (r *RRule) parseUntil(s string) error {
+	if t, err := time.Parse("20060102T150405Z", s); err == nil {
+		r.Until = t
+		return nil
+	}
+	if t, err := time.Parse("20060102", s); err == nil {
+		r.Until, r.UntilDate = t, true
+		return nil
+	}
+	return fmt.Errorf("invalid UNTIL %q", s)
+}
+
+// String 规范的写法，存数据库用，解析出来还是一样的规则
+func (r *RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByMonth) > 0 {
+		parts = append(parts, "BYMONTH="+joinInts(r.ByMonth))
+	}
+	if len(r.ByMonthDay) > 0 {
+		parts = append(parts, "BYMONTHDAY="+joinInts(r.ByMonthDay))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, 0, len(r.ByDay))
+		for _, day := range r.ByDay {
+			name := strings.ToUpper(day.Weekday.String()[:2])
+			if day.N != 0 {
+				name = strconv.Itoa(day.N) + name
+			}
+			days = append(days, name)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.UntilDate {
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	} else if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+func joinInts(ns []int) string {
+	s := make([]string, 0, len(ns))
+	for _, n := range ns {
+		s = append(s, strconv.Itoa(n))
+	}
+	return strings.Join(s, ",")
+}
+
+// Next after 之后的下一次，after 所在的时区就是计算用的时区，超过 UNTIL 或者找不到返回 false
+// 不管 COUNT，数到第几次由调用方记
+func (r *RRule) Next(after time.Time) (time.Time, bool) {
+	for i := 0; i < maxRRulePeriods; i++ {
+		for _, t := range r.expand(after, i*r.Interval) {
+			if !t.After(after) {
+				continue
+			}
+			if r.ended(t) {
+				return time.Time{}, false
+			}
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ended t 是不是已经超过 UNTIL 了
+func (r *RRule) ended(t time.Time) bool {
+	if r.Until.IsZero() {
+		return false
+	}
+	if r.UntilDate {
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).After(r.Until)
+	}
+	return t.After(r.Until)
+}
+
+// expand start 所在的周期往后第 k 个周期里所有的候选时间，按时间排序
+func (r *RRule) expand(start time.Time, k int) []time.Time {
+	y, m, d := start.Date()
+	hh, mm, ss := start.Clock()
+	loc := start.Location()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hh, mm, ss, 0, loc)
+	}
+
+	var days []time.Time
+	switch r.Freq {
+	case FreqDaily:
+		days = append(days, at(y, m, d+k))
+	case FreqWeekly:
+		if len(r.ByDay) == 0 {
+			days = append(days, at(y, m, d+7*k))
+			break
+		}
+		// 一周从周一开始
+		monday := d - (int(start.Weekday())+6)%7 + 7*k
+		for i := 0; i < 7; i++ {
+			days = append(days, at(y, m, monday+i))
+		}
+	case FreqMonthly:
+		days = r.monthDays(at, y, m+time.Month(k), d)
+	case FreqYearly:
+		months := r.ByMonth
+		if len(months) == 0 {
+			months = []int{int(m)}
+		}
+		for _, month := range months {
+			days = append(days, r.monthDays(at, y+k, time.Month(month), d)...)
+		}
+	}
+
+	result := days[:0]
+	for _, t := range days {
+		if r.keep(t) {
+			result = append(result, t)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Before(result[j]) })
+	return result
+}
+
+// monthDays 某个月里的候选日期，m 可以超过 12，会进位到下一年
+func (r *RRule) monthDays(at func(int, time.Month, int) time.Time, y int, m time.Month, d int) []time.Time {
+	first := at(y, m, 1)
+	y, m = first.Year(), first.Month()
+	n := daysInMonth(y, m)
+	var days []time.Time
+	switch {
+	case len(r.ByMonthDay) > 0:
+		for _, md := range r.ByMonthDay {
+			if md < 0 {
+				md = n + md + 1
+			}
+			if md >= 1 && md <= n {
+				days = append(days, at(y, m, md))
+			}
+		}
+	case len(r.ByDay) > 0:
+		for i := 1; i <= n; i++ {
+			days = append(days, at(y, m, i))
+		}
+	default:
+		// 没有这一天的月份(比如 31 号)跳过，和 RFC 5545 一样
+		if d <= n {
+			days = append(days, at(y, m, d))
+		}
+	}
+	return days
+}
+
+// keep 候选时间是不是符合 BYMONTH、BYMONTHDAY、BYDAY
+func (r *RRule) keep(t time.Time) bool {
+	if len(r.ByMonth) > 0 && !containsInt(r.ByMonth, int(t.Month())) {
+		return false
+	}
+	n := daysInMonth(t.Year(), t.Month())
+	if len(r.ByMonthDay) > 0 {
+		ok := false
+		for _, md := range r.ByMonthDay {
+			if t.Day() == md || (md < 0 && t.Day() == n+md+1) {
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.ByDay) > 0 {
+		ok := false
+		for _, day := range r.ByDay {
+			if day.Weekday != t.Weekday() {
+				continue
+			}
+			switch {
+			case day.N == 0,
+				day.N > 0 && (t.Day()-1)/7+1 == day.N,
+				day.N < 0 && (n-t.Day())/7+1 == -day.N:
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func daysInMonth(y int, m time.Month) int {
+	return time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func containsInt(ns []int, n int) bool {
+	for _, v := range ns {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRRule_Next(t *testing.T) {
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	newYork, _ := time.LoadLocation("America/New_York")
+	tests := []struct {
+		rule  string
+		after time.Time
+		want  []string // 接下来几次，按 after 的时区，空字符串代表没有了
+	}{
+		{"FREQ=DAILY;INTERVAL=2", time.Date(2022, 5, 30, 9, 0, 0, 0, shanghai),
+			[]string{"2022-06-01 09:00", "2022-06-03 09:00"}},
+		{"FREQ=WEEKLY;BYDAY=MO,FR", time.Date(2022, 6, 1, 18, 0, 0, 0, shanghai), // 周三
+			[]string{"2022-06-03 18:00", "2022-06-06 18:00", "2022-06-10 18:00"}},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE", time.Date(2022, 6, 1, 8, 0, 0, 0, shanghai), // 周三
+			[]string{"2022-06-13 08:00", "2022-06-15 08:00", "2022-06-27 08:00"}},
+		{"FREQ=MONTHLY", time.Date(2022, 1, 31, 9, 0, 0, 0, shanghai), // 没有31号的月份跳过
+			[]string{"2022-03-31 09:00", "2022-05-31 09:00"}},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", time.Date(2022, 1, 31, 9, 0, 0, 0, shanghai),
+			[]string{"2022-02-28 09:00", "2022-03-31 09:00"}},
+		{"FREQ=MONTHLY;BYDAY=-1FR", time.Date(2022, 6, 1, 9, 0, 0, 0, shanghai),
+			[]string{"2022-06-24 09:00", "2022-07-29 09:00"}},
+		{"FREQ=YEARLY;BYMONTH=11;BYDAY=4TH", time.Date(2022, 1, 1, 12, 0, 0, 0, newYork),
+			[]string{"2022-11-24 12:00", "2023-11-23 12:00"}},
+		// 夏令时前后都是当地的 9 点
+		{"FREQ=DAILY", time.Date(2022, 3, 12, 9, 0, 0, 0, newYork),
+			[]string{"2022-03-13 09:00", "2022-03-14 09:00"}},
+		{"FREQ=DAILY;UNTIL=20220602", time.Date(2022, 6, 1, 23, 0, 0, 0, shanghai),
+			[]string{"2022-06-02 23:00", ""}},
+		{"FREQ=DAILY;UNTIL=20220601T160000Z", time.Date(2022, 6, 1, 23, 0, 0, 0, shanghai),
+			[]string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			r, err := parseRRule(tt.rule)
+			if err != nil {
+				t.Fatalf("parseRRule() err = %v", err)
+			}
+			after := tt.after
+			for i, want := range tt.want {
+				next, ok := r.Next(after)
+				got := ""
+				if ok {
+					got = next.Format("2006-01-02 15:04")
+				}
+				if got != want {
+					t.Fatalf("Next() #%d = %q, want %q", i+1, got, want)
+				}
+				after = next
+			}
+		})
+	}
+}
+
+func Test_parseRRule(t *testing.T) {
+	valid := map[string]string{
+		"RRULE:freq=weekly;byday=fr":         "FREQ=WEEKLY;BYDAY=FR",
+		"FREQ=MONTHLY;BYDAY=+1MO;COUNT=3":    "FREQ=MONTHLY;BYDAY=1MO;COUNT=3",
+		"FREQ=DAILY;INTERVAL=1;WKST=MO":      "FREQ=DAILY",
+		"FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=1": "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=1",
+	}
+	for in, want := range valid {
+		r, err := parseRRule(in)
+		if err != nil || r.String() != want {
+			t.Errorf("parseRRule(%q) = %v, %v, want %q", in, r, err, want)
+		}
+	}
+	for _, in := range []string{
+		"",
+		"BYDAY=MO",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;COUNT=3;UNTIL=20220101",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=YEARLY;BYDAY=MO",
+		"FREQ=MONTHLY;BYMONTHDAY=0",
+		"FREQ=DAILY;BYSETPOS=1",
+		"FREQ=DAILY;FREQ=WEEKLY",
+	} {
+		if _, err := parseRRule(in); err == nil {
+			t.Errorf("parseRRule(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+// Server 把 handler 用到的依赖都放在一起，handler 都是 Server 的方法
+// 以前 handler 直接用全局的 db 对象，没法单独测试；现在依赖通过 newServer 注入，测试的时候换成内存实现就行
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type Server struct {
+	todos         TodoRepository
+	lists         TodoListRepository
+	members       ListMemberRepository // 共享清单的成员，见 share.go
+	tags          TagRepository
+	reminders     ReminderRepository
+	notifications NotificationRepository
+	notifiers     map[string]Notifier // 能用的通知渠道，见 notify.go
+	events        *EventHub           // 实时推送，见 events.go
+	webhooks      WebhookRepository
+	webhookClient *http.Client // 调用用户注册的 webhook，见 webhook.go
+	accounts      AccountRepository
+	refreshTokens RefreshTokenRepository
+	revocations   RevocationStore // token 黑名单，见 revoke.go
+	attempts      AttemptStore    // 登录失败、注册次数，见 throttle.go
+	keys          *KeyManager     // jwt 签名密钥，见 keys.go
+
+	db      *gorm.DB        // 开事务用，内存实现的为空，见 inTx
+	pending *[]pendingEvent // inTx 里 publish 的事件，提交之后再推送
+}
+
+// newServer 用 gorm 实现的 Repository 创建 Server
+func newServer(db *gorm.DB, keys *KeyManager) *Server {
+	s := &Server{
+		events:        newEventHub(),
+		webhookClient: newWebhookClient(conf.Webhook.Timeout),
+		keys:          keys,
+	}
+	s.useDB(db)
+	s.notifiers = newNotifiers(conf.Notify, s.notifications)
+	return s
+}
+
+// useDB 所有 Repository 换成用 db 的 gorm 实现，db 可以是一个事务
+func (s *Server) useDB(db *gorm.DB) {
+	s.db = db
+	s.todos = newGormTodoRepository(db)
+	s.lists = newGormTodoListRepository(db)
+	s.members = newGormListMemberRepository(db)
+	s.tags = newGormTagRepository(db)
+	s.reminders = newGormReminderRepository(db)
+	s.webhooks = newGormWebhookRepository(db)
+	s.notifications = newGormNotificationRepository(db)
+	s.accounts = newGormAccountRepository(db)
+	s.refreshTokens = newGormRefreshTokenRepository(db)
+	s.revocations = newSQLRevocationStore(db)
+	s.attempts = newSQLAttemptStore(db)
+}
+
+// inTx 在一个事务里执行 fn，fn 拿到的 tx 和 s 一样，只是 Repository 都在这个事务里，fn 里只能用 tx
+// fn 里 publish 的事件，webhook 发件箱和修改一起提交或者回滚(见 webhook.go)，提交之后才推送给在线的页面
+// 内存实现没有事务，fn 直接改，内存的发件箱也不会写失败
+func (s *Server) inTx(fn func(tx *Server) error) error {
+	var pending []pendingEvent
+	tx := *s
+	tx.pending = &pending
+	var err error
+	if s.db == nil {
+		err = fn(&tx)
+	} else {
+		err = s.db.Transaction(func(db *gorm.DB) error {
+			tx.useDB(db)
+			return fn(&tx)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	for _, ev := range pending {
+		s.events.Publish(ev.uid, ev.typ, ev.data)
+	}
+	return nil
+}
+
+// newMemoryServer 全部用内存实现创建 Server，不需要数据库，测试用
+func newMemoryServer(keys *KeyManager) *Server {
+	tags := newMemoryTagRepository()
+	reminders := newMemoryReminderRepository()
+	notifications := newMemoryNotificationRepository()
+	return &Server{
+		todos:         newMemoryTodoRepository(tags, reminders),
+		lists:         newMemoryTodoListRepository(),
+		members:       newMemoryListMemberRepository(),
+		tags:          tags,
+		reminders:     reminders,
+		webhooks:      newMemoryWebhookRepository(),
+		notifications: notifications,
+		notifiers:     newNotifiers(conf.Notify, notifications),
+		events:        newEventHub(),
+		webhookClient: newWebhookClient(conf.Webhook.Timeout),
+		accounts:      newMemoryAccountRepository(),
+		refreshTokens: newMemoryRefreshTokenRepository(),
+		revocations:   newMemoryRevocationStore(),
+		attempts:      newMemoryAttemptStore(),
+		keys:          keys,
+	}
+}
+
+// routes 注册路由
+func (s *Server) routes() *gin.Engine {
+	// 不用 gin.Default，它的访问日志会把 url 参数里的 access_token 原样打出来，见 events.go
+	r := gin.New()
+	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: accessLogFormatter}), gin.Recovery())
+	// 只信任配置了的反向代理发来的 X-Forwarded-For，默认直接用连接的地址，见 throttle.go
+	if err := r.SetTrustedProxies(conf.Server.TrustedProxies); err != nil {
+		fmt.Println("SetTrustedProxies err:", err)
+		panic(err)
+	}
+	// 加载前端静态文件 和 static 静态文件返回，并增加页面请求的路由
+	r.LoadHTMLFiles("./index.html")
+	r.Static("static", "./static")
+
+	// 注册
+	r.POST("/register", s.regHandler)
+	// 登录
+	r.POST("/login", s.loginHandler)
+	// access token 过期后，用 refresh token 换新的 token
+	r.POST("/token/refresh", s.refreshTokenHandler)
+	// 退出登录 和 退出所有设备，需要带着 token 访问
+	r.POST("/logout", s.authMiddleware, s.logoutHandler)
+	r.POST("/logout/all", s.authMiddleware, s.logoutAllHandler)
+
+	// 公开 jwt 验签用的公钥，其他服务拿它来验证我们签发的 token
+	r.GET("/.well-known/jwks.json", s.jwksHandler)
+
+	r.GET("/", func(c *gin.Context) {
+		c.HTML(200, "index.html", nil)
+	})
+	// 没有的接口也按统一的错误格式返回
+	r.NoRoute(func(c *gin.Context) {
+		renderError(c, ErrRouteNotFound)
+	})
+
+	// 实时推送，浏览器的 EventSource 和 WebSocket 不能带请求头，token 可以放在 url 参数里，见 events.go
+	r.GET("/api/v1/events", queryTokenMiddleware, s.authMiddleware, s.eventsHandler)
+	r.GET("/api/v1/ws", queryTokenMiddleware, s.authMiddleware, s.wsHandler)
+
+	// 注册路由，curd
+	// 添加待办事项的路由组 g
+	g := r.Group("/api/v1", s.authMiddleware) // 给路由组添加jwt权限认证中间件
+	{
+		g.POST("/todo", s.createTodoHandler)
+		g.PUT("/todo", s.updateTodoHandler)
+		// 部分修改，只改请求体里有的字段，见 todo_patch.go
+		g.PATCH("/todo/:id", s.patchTodoHandler)
+		// 重复的待办事项跳过这一次，见 todo_recur.go
+		g.POST("/todo/:id/skip", s.skipTodoHandler)
+		g.GET("/todo", s.getTodoHandler)
+		g.GET("/todo/:id", s.getTodoByIDHandler)
+		// delete 方式，url是参数在url里面  http://127.0.0.1:8888/api/v1/todo/1，参数赋值给id
+		g.DELETE("/todo/:id", s.deleteTodoHandler)
+
+		// 清单，见 todo_list.go
+		g.GET("/lists", s.listListsHandler)
+		g.POST("/lists", s.createListHandler)
+		g.GET("/lists/:id", s.getListHandler)
+		g.PUT("/lists/:id", s.updateListHandler)
+		g.DELETE("/lists/:id", s.deleteListHandler)
+
+		// 共享清单，见 share.go
+		g.GET("/lists/:id/members", s.listMembersHandler)
+		g.POST("/lists/:id/members", s.inviteMemberHandler)
+		g.PUT("/lists/:id/members/:member_id", s.updateMemberHandler)
+		g.DELETE("/lists/:id/members/:member_id", s.removeMemberHandler)
+		g.GET("/invitations", s.listInvitationsHandler)
+		g.POST("/invitations/:id/accept", s.acceptInvitationHandler)
+		g.DELETE("/invitations/:id", s.declineInvitationHandler)
+
+		// 标签，见 tag.go
+		g.GET("/tags", s.listTagsHandler)
+		g.POST("/tags", s.createTagHandler)
+		g.PUT("/tags/:id", s.updateTagHandler)
+		g.DELETE("/tags/:id", s.deleteTagHandler)
+		g.GET("/todo/:id/tags", s.listTodoTagsHandler)
+		g.PUT("/todo/:id/tags/:tag_id", s.attachTagHandler)
+		g.DELETE("/todo/:id/tags/:tag_id", s.detachTagHandler)
+
+		// 提醒和站内信，见 reminder.go、notify.go
+		g.GET("/todo/:id/reminders", s.listRemindersHandler)
+		g.POST("/todo/:id/reminders", s.createReminderHandler)
+		g.DELETE("/todo/:id/reminders/:reminder_id", s.deleteReminderHandler)
+		g.GET("/notifications", s.listNotificationsHandler)
+		g.POST("/notifications/read", s.readAllNotificationsHandler)
+		g.POST("/notifications/:id/read", s.readNotificationHandler)
+
+		// webhook，见 webhook.go
+		g.GET("/webhooks", s.listWebhooksHandler)
+		g.POST("/webhooks", s.createWebhookHandler)
+		g.PUT("/webhooks/:id", s.updateWebhookHandler)
+		g.DELETE("/webhooks/:id", s.deleteWebhookHandler)
+		g.GET("/webhooks/:id/deliveries", s.listDeliveriesHandler)
+		g.GET("/webhooks/:id/deliveries/:delivery_id", s.getDeliveryHandler)
+		g.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", s.redeliverHandler)
+
+		// 回收站，见 trash.go
+		g.GET("/trash", s.listTrashHandler)
+		g.POST("/trash/:id/restore", s.restoreTrashHandler)
+		g.DELETE("/trash/:id", s.purgeTrashHandler)
+		g.DELETE("/trash", s.emptyTrashHandler)
+	}
+
+	// 管理后台，只有管理员能访问，见 admin.go
+	a := r.Group("/api/admin", s.authMiddleware, requireRole(RoleAdmin))
+	{
+		a.GET("/accounts", s.listAccountsHandler)
+		a.GET("/accounts/:uid", s.getAccountHandler)
+		a.PUT("/accounts/:uid/role", s.updateRoleHandler)
+		a.POST("/accounts/:uid/disable", s.disableAccountHandler)
+		a.POST("/accounts/:uid/enable", s.enableAccountHandler)
+		a.PUT("/accounts/:uid/status", s.updateStatusHandler)
+		a.GET("/accounts/:uid/status", s.statusHistoryHandler)
+		a.POST("/accounts/:uid/password", s.resetPasswordHandler)
+	}
+	return r
+}
@@ -0,0 +1,2063 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+// testBackends 同一组测试分别跑 内存实现 和 sqlite 内存数据库上的 gorm 实现，保证两种实现行为一致
+var testBackends = map[string]func(t *testing.T) *Server{
+	"memory": func(t *testing.T) *Server {
+		return newMemoryServer(newTestKeys(t, nil))
+	},
+	"sqlite": func(t *testing.T) *Server {
+		conn, err := openDB(DBConfig{Driver: DBDriverSQLite, DSN: ":memory:"})
+		if err != nil {
+			t.Fatalf("openDB() err = %v", err)
+		}
+		if _, err := migrateUp(conn); err != nil {
+			t.Fatalf("migrateUp() err = %v", err)
+		}
+		return newServer(conn, newTestKeys(t, conn))
+	},
+}
+
+// newTestKeys conn 为空的时候密钥只存在内存里
+func newTestKeys(t *testing.T, conn *gorm.DB) *KeyManager {
+	t.Helper()
+	m := newKeyManager(conn, KeyAlgEdDSA, time.Hour)
+	if err := m.Load(); err != nil {
+		t.Fatalf("keys.Load() err = %v", err)
+	}
+	return m
+}
+
+// testClient 发请求的帮助函数，token 不为空的时候自动带上 Authorization 请求头
+type testClient struct {
+	t     *testing.T
+	r     *gin.Engine
+	token string
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	gin.SetMode(gin.TestMode)
+	return &testClient{t: t, r: s.routes()}
+}
+
+func (tc *testClient) do(method, path string, body interface{}) (int, Resp) {
+	tc.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if tc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+	}
+	w := httptest.NewRecorder()
+	tc.r.ServeHTTP(w, req)
+	var resp Resp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		tc.t.Fatalf("%s %s: decode response %q: %v", method, path, w.Body.String(), err)
+	}
+	return w.Code, resp
+}
+
+// decode 把 Resp.Data 转成具体的类型
+func decode(t *testing.T, data interface{}, v interface{}) {
+	t.Helper()
+	b, _ := json.Marshal(data)
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("decode %s: %v", b, err)
+	}
+}
+
+// login 注册并登录，返回登录拿到的 token
+func (tc *testClient) login(name string) TokenPair {
+	tc.t.Helper()
+	param := AuthParam{Name: name, Password: "123456"}
+	if _, resp := tc.do(http.MethodPost, "/register", param); resp.Code != 0 {
+		tc.t.Fatalf("register = %+v", resp)
+	}
+	_, resp := tc.do(http.MethodPost, "/login", param)
+	if resp.Code != 0 {
+		tc.t.Fatalf("login = %+v", resp)
+	}
+	var pair TokenPair
+	decode(tc.t, resp.Data, &pair)
+	tc.token = pair.Token
+	return pair
+}
+
+func TestServer_auth(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			pair := tc.login("tom")
+
+			// 用户名已存在也返回注册成功，不暴露用户名有没有注册过，密码还是原来的
+			if _, resp := tc.do(http.MethodPost, "/register", AuthParam{Name: "tom", Password: "654321"}); resp.Code != 0 {
+				t.Errorf("register twice = %+v", resp)
+			}
+			// 同时注册同一个用户名，查的时候都还没有，插入的时候唯一索引冲突也是 ErrDuplicate
+			if repo, ok := s.accounts.(*gormAccountRepository); ok {
+				err := repo.db.Create(&Account{Uid: newUid(), Name: "tom"}).Error
+				if err == nil || duplicate(repo.db, err) != ErrDuplicate {
+					t.Errorf("insert duplicate name err = %v", err)
+				}
+			}
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, resp := tc.do(http.MethodPost, "/register", AuthParam{Name: "jerry", Password: "123456"}); resp.Code != 0 {
+						t.Errorf("concurrent register = %+v", resp)
+					}
+				}()
+			}
+			wg.Wait()
+			if _, resp := tc.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "654321"}); resp.Code == 0 {
+				t.Errorf("login with wrong password = %+v", resp)
+			}
+
+			// refresh token 只能用一次，重复使用会吊销整个 family
+			_, resp := tc.do(http.MethodPost, "/token/refresh", RefreshParam{RefreshToken: pair.RefreshToken})
+			if resp.Code != 0 {
+				t.Fatalf("refresh = %+v", resp)
+			}
+			var next TokenPair
+			decode(t, resp.Data, &next)
+			if _, resp := tc.do(http.MethodPost, "/token/refresh", RefreshParam{RefreshToken: pair.RefreshToken}); resp.Code == 0 {
+				t.Errorf("reuse refresh token = %+v", resp)
+			}
+			if _, resp := tc.do(http.MethodPost, "/token/refresh", RefreshParam{RefreshToken: next.RefreshToken}); resp.Code == 0 {
+				t.Errorf("refresh after family revoked = %+v", resp)
+			}
+
+			// 退出登录之后 token 就不能用了
+			if _, resp := tc.do(http.MethodPost, "/logout", nil); resp.Code != 0 {
+				t.Fatalf("logout = %+v", resp)
+			}
+			if _, resp := tc.do(http.MethodGet, "/api/v1/todo", nil); resp.Code == 0 {
+				t.Errorf("list todo after logout = %+v", resp)
+			}
+			// 密码太长是参数错误；bcrypt 只能处理 72 字节
+			old := conf.Auth.PwdAlgo
+			conf.Auth.PwdAlgo = PwdAlgoBcrypt
+			defer func() { conf.Auth.PwdAlgo = old }()
+			if status, resp := tc.do(http.MethodPost, "/register", AuthParam{Name: "jerry", Password: strings.Repeat("密", 25)}); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Field != "password" || resp.Details[0].Reason != "max" {
+				t.Errorf("register with 75 byte password = %d %+v", status, resp)
+			}
+			if status, resp := tc.do(http.MethodPost, "/register", AuthParam{Name: "jerry", Password: strings.Repeat("a", 129)}); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Reason != "max" {
+				t.Errorf("register with 129 char password = %d %+v", status, resp)
+			}
+			if status, _ := tc.do(http.MethodPost, "/login", AuthParam{Name: "jerry", Password: strings.Repeat("密", 25)}); status != http.StatusUnauthorized {
+				t.Errorf("login with long password = %d", status)
+			}
+		})
+	}
+}
+
+func TestServer_todo(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+
+			if _, resp := tc.do(http.MethodPost, "/api/v1/todo", Todo{Title: "计划1"}); resp.Code != 0 {
+				t.Fatalf("create = %+v", resp)
+			}
+			_, resp := tc.do(http.MethodGet, "/api/v1/todo", nil)
+			var todos []Todo
+			decode(t, resp.Data, &todos)
+			if len(todos) != 1 || todos[0].Title != "计划1" || todos[0].Status {
+				t.Fatalf("list = %+v", todos)
+			}
+			id := todos[0].ID
+
+			if _, resp := tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": id, "status": true}); resp.Code != 0 {
+				t.Fatalf("update = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo", nil)
+			decode(t, resp.Data, &todos)
+			if len(todos) != 1 || !todos[0].Status {
+				t.Fatalf("list after update = %+v", todos)
+			}
+
+			// 别的用户看不到、改不了、删不了
+			other := &testClient{t: t, r: tc.r}
+			other.login("jerry")
+			_, resp = other.do(http.MethodGet, "/api/v1/todo", nil)
+			var otherTodos []Todo
+			decode(t, resp.Data, &otherTodos)
+			if len(otherTodos) != 0 {
+				t.Errorf("other list = %+v", otherTodos)
+			}
+			if status, resp := other.do(http.MethodPut, "/api/v1/todo", gin.H{"id": id, "status": false}); status != http.StatusNotFound || resp.Error != ErrTodoNotFound.Code {
+				t.Errorf("other update = %d %+v", status, resp)
+			}
+			if _, resp := other.do(http.MethodDelete, "/api/v1/todo/"+strconv.Itoa(int(id)), nil); resp.Code == 0 {
+				t.Errorf("other delete = %+v", resp)
+			}
+
+			if _, resp := tc.do(http.MethodDelete, "/api/v1/todo/"+strconv.Itoa(int(id)), nil); resp.Code != 0 {
+				t.Fatalf("delete = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo", nil)
+			todos = nil
+			decode(t, resp.Data, &todos)
+			if len(todos) != 0 {
+				t.Errorf("list after delete = %+v", todos)
+			}
+		})
+	}
+}
+
+func TestServer_errors(t *testing.T) {
+	tc := newTestClient(t, newMemoryServer(newTestKeys(t, nil)))
+
+	if status, resp := tc.do(http.MethodGet, "/api/v1/todo", nil); status != http.StatusUnauthorized || resp.Code != 1 || resp.Error != ErrTokenMissing.Code {
+		t.Errorf("list todo without token = %d %+v", status, resp)
+	}
+	// 校验失败的字段用 json 里的名字
+	status, resp := tc.do(http.MethodPost, "/register", gin.H{"name": "tom"})
+	if status != http.StatusBadRequest || resp.Error != ErrInvalidParam.Code ||
+		len(resp.Details) != 1 || resp.Details[0] != (FieldError{Field: "password", Reason: "required"}) {
+		t.Errorf("register without password = %d %+v", status, resp)
+	}
+
+	// Accept 里要了 problem+json 就返回 RFC 7807 格式
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/todo", nil)
+	req.Header.Set("Accept", "application/problem+json, application/json;q=0.9")
+	w := httptest.NewRecorder()
+	tc.r.ServeHTTP(w, req)
+	var p Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decode problem %q: %v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Content-Type") != MIMEProblemJSON ||
+		p.Status != http.StatusUnauthorized || p.Code != ErrTokenMissing.Code || p.Type != "urn:todo:error:token_missing" {
+		t.Errorf("problem = %d %s %+v", w.Code, w.Header().Get("Content-Type"), p)
+	}
+}
+
+func TestServer_todoPaging(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			tc := newTestClient(t, newServer(t))
+			tc.login("tom")
+			for i := 1; i <= 5; i++ {
+				if _, resp := tc.do(http.MethodPost, "/api/v1/todo", Todo{Title: "计划" + strconv.Itoa(i)}); resp.Code != 0 {
+					t.Fatalf("create = %+v", resp)
+				}
+			}
+			_, resp := tc.do(http.MethodGet, "/api/v1/todo", nil)
+			var todos []Todo
+			decode(t, resp.Data, &todos)
+			tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todos[1].ID, "status": true})
+
+			// 倒序每页 2 条，翻完所有页
+			var titles []string
+			path := "/api/v1/todo?limit=2&sort=-created_at"
+			for pages := 0; ; pages++ {
+				if pages > 3 {
+					t.Fatalf("too many pages, titles = %v", titles)
+				}
+				_, resp := tc.do(http.MethodGet, path, nil)
+				if resp.Code != 0 || resp.Total == nil || *resp.Total != 5 {
+					t.Fatalf("list %s = %+v", path, resp)
+				}
+				var page []Todo
+				decode(t, resp.Data, &page)
+				for _, todo := range page {
+					titles = append(titles, todo.Title)
+				}
+				if resp.NextCursor == "" {
+					break
+				}
+				path = "/api/v1/todo?limit=2&sort=-created_at&cursor=" + resp.NextCursor
+			}
+			if fmt.Sprint(titles) != "[计划5 计划4 计划3 计划2 计划1]" {
+				t.Errorf("titles = %v", titles)
+			}
+
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?status=false&title=%E5%88%924", nil)
+			todos = nil
+			decode(t, resp.Data, &todos)
+			if len(todos) != 1 || todos[0].Title != "计划4" || *resp.Total != 1 {
+				t.Errorf("filter = %+v", resp)
+			}
+			// 游标不能换个排序方式接着用
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?limit=2", nil)
+			if status, resp := tc.do(http.MethodGet, "/api/v1/todo?sort=-id&cursor="+resp.NextCursor, nil); status != http.StatusBadRequest {
+				t.Errorf("cursor with another sort = %d %+v", status, resp)
+			}
+		})
+	}
+}
+
+func TestServer_todoFields(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			tc := newTestClient(t, newServer(t))
+			tc.login("tom")
+
+			if status, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "计划1", "priority": 5, "due_tz": "Mars/Base"}); status != http.StatusBadRequest || len(resp.Details) != 2 {
+				t.Errorf("create invalid = %d %+v", status, resp)
+			}
+
+			_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{
+				"title":       "周报",
+				"description": "**本周**进展",
+				"priority":    PriorityHigh,
+				"due_at":      "2022-05-20T10:00:00Z",
+				"due_tz":      "Asia/Shanghai",
+			})
+			var created Todo
+			decode(t, resp.Data, &created)
+			if resp.Code != 0 || created.ID == 0 || created.Priority != PriorityHigh || created.DueAt == nil ||
+				created.DueAt.Format(time.RFC3339) != "2022-05-20T18:00:00+08:00" {
+				t.Fatalf("create = %+v", resp)
+			}
+			tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "没有截止时间"})
+
+			// 完成的时候设置完成时间，取消完成的时候清空
+			_, resp = tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": created.ID, "status": true})
+			var updated Todo
+			decode(t, resp.Data, &updated)
+			if !updated.Status || updated.CompletedAt == nil || updated.Title != "周报" {
+				t.Fatalf("complete = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": created.ID, "status": false, "title": "月报"})
+			updated = Todo{}
+			decode(t, resp.Data, &updated)
+			if updated.Status || updated.CompletedAt != nil || updated.Title != "月报" || updated.Description != "**本周**进展" {
+				t.Fatalf("uncomplete = %+v", resp)
+			}
+
+			// 按截止时间倒序，没有截止时间的排最前面
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?sort=-due_at&limit=1", nil)
+			var todos []Todo
+			decode(t, resp.Data, &todos)
+			if len(todos) != 1 || todos[0].DueAt != nil {
+				t.Fatalf("sort by due_at = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?sort=-due_at&limit=1&cursor="+resp.NextCursor, nil)
+			todos = nil
+			decode(t, resp.Data, &todos)
+			if len(todos) != 1 || todos[0].ID != created.ID || resp.NextCursor != "" {
+				t.Fatalf("sort by due_at page 2 = %+v", resp)
+			}
+
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?priority=2,3&due_before=2022-06-01T00:00:00%2B08:00", nil)
+			todos = nil
+			decode(t, resp.Data, &todos)
+			if len(todos) != 1 || todos[0].ID != created.ID {
+				t.Errorf("filter by priority and due = %+v", resp)
+			}
+		})
+	}
+}
+
+func TestServer_todoPatch(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			tc := newTestClient(t, newServer(t))
+			tc.login("tom")
+			_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{
+				"title": "周报", "description": "草稿", "priority": PriorityLow,
+				"due_at": "2022-05-20T10:00:00Z", "due_tz": "UTC",
+			})
+			var todo Todo
+			decode(t, resp.Data, &todo)
+			path := "/api/v1/todo/" + strconv.Itoa(int(todo.ID))
+
+			// 只改传了的字段，null 清空
+			_, resp = tc.do(http.MethodPatch, path, gin.H{"title": "月报", "due_at": nil, "priority": nil})
+			var patched Todo
+			decode(t, resp.Data, &patched)
+			if resp.Code != 0 || patched.Title != "月报" || patched.DueAt != nil || patched.Priority != PriorityNone ||
+				patched.Description != "草稿" || patched.DueTZ != "UTC" || patched.Status {
+				t.Fatalf("patch = %+v", resp)
+			}
+
+			status, resp := tc.do(http.MethodPatch, path, gin.H{"title": nil, "status": "yes", "completed_at": nil, "color": "red"})
+			if status != http.StatusBadRequest || fmt.Sprint(resp.Details) != "[{color unknown} {completed_at readonly} {status bool} {title string}]" {
+				t.Errorf("patch invalid = %d %+v", status, resp)
+			}
+			// 校验失败的时候一个字段都不改
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo", nil)
+			var todos []Todo
+			decode(t, resp.Data, &todos)
+			if len(todos) != 1 || todos[0].Title != "月报" {
+				t.Errorf("list after invalid patch = %+v", todos)
+			}
+
+			other := &testClient{t: t, r: tc.r}
+			other.login("jerry")
+			if status, _ := other.do(http.MethodPatch, path, gin.H{"title": "别人的"}); status != http.StatusNotFound {
+				t.Errorf("other patch = %d", status)
+			}
+
+			req := httptest.NewRequest(http.MethodPatch, path, bytes.NewReader([]byte("title=x")))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			w := httptest.NewRecorder()
+			tc.r.ServeHTTP(w, req)
+			if w.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("patch form = %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_todoETag(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			tc := newTestClient(t, newServer(t))
+			tc.login("tom")
+			_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "周报"})
+			var todo Todo
+			decode(t, resp.Data, &todo)
+			path := "/api/v1/todo/" + strconv.Itoa(int(todo.ID))
+
+			// withHeader 带上额外请求头发请求
+			withHeader := func(method, path, key, value string, body interface{}) *httptest.ResponseRecorder {
+				b, _ := json.Marshal(body)
+				req := httptest.NewRequest(method, path, bytes.NewReader(b))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+				req.Header.Set(key, value)
+				w := httptest.NewRecorder()
+				tc.r.ServeHTTP(w, req)
+				return w
+			}
+
+			w := withHeader(http.MethodGet, path, "If-None-Match", `"0"`, nil)
+			etag := w.Header().Get("ETag")
+			if w.Code != http.StatusOK || etag != `"1"` {
+				t.Fatalf("get = %d %q", w.Code, etag)
+			}
+			if w := withHeader(http.MethodGet, path, "If-None-Match", etag, nil); w.Code != http.StatusNotModified {
+				t.Errorf("get not modified = %d", w.Code)
+			}
+
+			// 两个页面拿着同一个版本改，后改的那个失败
+			if w := withHeader(http.MethodPatch, path, "If-Match", etag, gin.H{"title": "月报"}); w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+				t.Fatalf("patch = %d %s", w.Code, w.Body.String())
+			}
+			if w := withHeader(http.MethodPut, "/api/v1/todo", "If-Match", etag, gin.H{"id": todo.ID, "status": true}); w.Code != http.StatusPreconditionFailed {
+				t.Errorf("put with stale etag = %d %s", w.Code, w.Body.String())
+			}
+			if w := withHeader(http.MethodDelete, path, "If-Match", etag, nil); w.Code != http.StatusPreconditionFailed {
+				t.Errorf("delete with stale etag = %d %s", w.Code, w.Body.String())
+			}
+			if w := withHeader(http.MethodPatch, path, "If-Match", `W/"2"`, gin.H{"title": "年报"}); w.Code != http.StatusPreconditionFailed {
+				t.Errorf("patch with weak etag = %d %s", w.Code, w.Body.String())
+			}
+
+			// 不带 If-Match 的老前端照常能改
+			if _, resp := tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todo.ID, "status": true}); resp.Code != 0 {
+				t.Fatalf("put without If-Match = %+v", resp)
+			}
+			if w := withHeader(http.MethodDelete, path, "If-Match", `"3"`, nil); w.Code != http.StatusOK {
+				t.Errorf("delete = %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_trash(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+			var ids []string
+			var remindedIDs []uint
+			for _, title := range []string{"计划1", "计划2", "计划3"} {
+				_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": title})
+				var todo Todo
+				decode(t, resp.Data, &todo)
+				ids = append(ids, strconv.Itoa(int(todo.ID)))
+				if title == "计划2" {
+					// 彻底删除的时候提醒也要删掉，子任务的也是
+					_, resp = tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "子任务", "parent_id": todo.ID})
+					var sub Todo
+					decode(t, resp.Data, &sub)
+					for _, id := range []uint{todo.ID, sub.ID} {
+						if _, resp := tc.do(http.MethodPost, "/api/v1/todo/"+strconv.Itoa(int(id))+"/reminders", gin.H{"at": "2022-06-01T09:00:00Z", "channel": "inapp"}); resp.Code != 0 {
+							t.Fatalf("create reminder = %+v", resp)
+						}
+					}
+					remindedIDs = []uint{todo.ID, sub.ID}
+				}
+				tc.do(http.MethodDelete, "/api/v1/todo/"+ids[len(ids)-1], nil)
+			}
+
+			_, resp := tc.do(http.MethodGet, "/api/v1/trash", nil)
+			var trash []Todo
+			decode(t, resp.Data, &trash)
+			if len(trash) != 4 || trash[0].Title != "计划3" || !trash[0].DeletedAt.Valid {
+				t.Fatalf("trash = %+v", resp)
+			}
+			// 没在回收站里的不能恢复，也不能彻底删除
+			if status, _ := tc.do(http.MethodPost, "/api/v1/trash/999/restore", nil); status != http.StatusNotFound {
+				t.Errorf("restore missing = %d", status)
+			}
+
+			_, resp = tc.do(http.MethodPost, "/api/v1/trash/"+ids[0]+"/restore", nil)
+			var restored Todo
+			decode(t, resp.Data, &restored)
+			if resp.Code != 0 || restored.Title != "计划1" || restored.DeletedAt.Valid || restored.Version != 2 {
+				t.Fatalf("restore = %+v", resp)
+			}
+			if status, _ := tc.do(http.MethodDelete, "/api/v1/trash/"+ids[0], nil); status != http.StatusNotFound {
+				t.Errorf("purge not deleted todo = %d", status)
+			}
+			if _, resp := tc.do(http.MethodDelete, "/api/v1/trash/"+ids[1], nil); resp.Code != 0 {
+				t.Errorf("purge = %+v", resp)
+			}
+			if status, _ := tc.do(http.MethodPost, "/api/v1/trash/"+ids[1]+"/restore", nil); status != http.StatusNotFound {
+				t.Errorf("restore purged = %d", status)
+			}
+			tom, _ := s.accounts.GetByName("tom")
+			for _, id := range remindedIDs {
+				if reminders, err := s.reminders.ListByTodo(tom.Uid, id); err != nil || len(reminders) != 0 {
+					t.Errorf("reminders of purged todo %d = %+v, %v", id, reminders, err)
+				}
+			}
+
+			// 定时任务只删除过期的
+			if n, err := s.purgeExpiredTrash(time.Hour); err != nil || n != 0 {
+				t.Errorf("purgeExpiredTrash(1h) = %d, %v", n, err)
+			}
+			if n, err := s.purgeExpiredTrash(time.Nanosecond); err != nil || n != 1 {
+				t.Errorf("purgeExpiredTrash(1ns) = %d, %v", n, err)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/trash", nil)
+			trash = nil
+			decode(t, resp.Data, &trash)
+			_, list := tc.do(http.MethodGet, "/api/v1/todo", nil)
+			if len(trash) != 0 || *list.Total != 1 {
+				t.Errorf("after purge trash = %+v, list = %+v", trash, list)
+			}
+		})
+	}
+}
+
+func TestServer_lists(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+
+			// 注册的时候建好了收件箱
+			_, resp := tc.do(http.MethodGet, "/api/v1/lists", nil)
+			var lists []TodoList
+			decode(t, resp.Data, &lists)
+			if len(lists) != 1 || !lists[0].IsInbox || lists[0].Name != InboxName {
+				t.Fatalf("lists = %+v", resp)
+			}
+			inbox := lists[0].ID
+			// 收件箱只有一个，同时建的时候拿到的也是同一个
+			tom, _ := s.accounts.GetByName("tom")
+			if err := s.lists.Create(&TodoList{Uid: tom.Uid, Name: InboxName, IsInbox: true}); !errors.Is(err, ErrDuplicate) {
+				t.Errorf("create second inbox err = %v", err)
+			}
+			var wg sync.WaitGroup
+			ids := make([]uint, 4)
+			for i := range ids {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if list, err := s.inbox(42); err == nil {
+						ids[i] = list.ID
+					}
+				}(i)
+			}
+			wg.Wait()
+			for _, id := range ids {
+				if id == 0 || id != ids[0] {
+					t.Errorf("concurrent inbox ids = %v", ids)
+					break
+				}
+			}
+
+			_, resp = tc.do(http.MethodPost, "/api/v1/lists", gin.H{"name": "工作"})
+			var work TodoList
+			decode(t, resp.Data, &work)
+			if resp.Code != 0 || work.Name != "工作" || work.IsInbox {
+				t.Fatalf("create list = %+v", resp)
+			}
+			workID := strconv.Itoa(int(work.ID))
+
+			// 不指定清单的放到收件箱
+			_, resp = tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "计划1"})
+			var todo1 Todo
+			decode(t, resp.Data, &todo1)
+			if todo1.ListID != inbox {
+				t.Errorf("default list_id = %d, want %d", todo1.ListID, inbox)
+			}
+			_, resp = tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "计划2", "list_id": work.ID})
+			var todo2 Todo
+			decode(t, resp.Data, &todo2)
+			if todo2.ListID != work.ID {
+				t.Errorf("list_id = %d, want %d", todo2.ListID, work.ID)
+			}
+			// 不存在的清单
+			if status, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "计划3", "list_id": 999}); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Field != "list_id" {
+				t.Errorf("missing list = %d %+v", status, resp)
+			}
+
+			// 换清单
+			_, resp = tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(todo1.ID)), gin.H{"list_id": work.ID})
+			decode(t, resp.Data, &todo1)
+			if resp.Code != 0 || todo1.ListID != work.ID {
+				t.Fatalf("patch list_id = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?list_id="+workID, nil)
+			if *resp.Total != 2 {
+				t.Errorf("filter by list = %+v", resp)
+			}
+
+			_, resp = tc.do(http.MethodPut, "/api/v1/lists/"+workID, gin.H{"name": "公司"})
+			decode(t, resp.Data, &work)
+			if work.Name != "公司" {
+				t.Errorf("rename = %+v", resp)
+			}
+			if status, _ := tc.do(http.MethodDelete, "/api/v1/lists/"+strconv.Itoa(int(inbox)), nil); status != http.StatusConflict {
+				t.Errorf("delete inbox = %d", status)
+			}
+
+			// 删除清单，里面的待办事项回到收件箱
+			if _, resp := tc.do(http.MethodDelete, "/api/v1/lists/"+workID, nil); resp.Code != 0 {
+				t.Fatalf("delete list = %+v", resp)
+			}
+			if status, _ := tc.do(http.MethodGet, "/api/v1/lists/"+workID, nil); status != http.StatusNotFound {
+				t.Errorf("get deleted list = %d", status)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?list_id="+strconv.Itoa(int(inbox)), nil)
+			if *resp.Total != 2 {
+				t.Errorf("inbox after delete = %+v", resp)
+			}
+
+			// 别人的清单看不到
+			other := newTestClient(t, s)
+			other.login("jerry")
+			if status, _ := other.do(http.MethodGet, "/api/v1/lists/"+strconv.Itoa(int(inbox)), nil); status != http.StatusNotFound {
+				t.Errorf("other user's list = %d", status)
+			}
+		})
+	}
+}
+
+func TestServer_subtasks(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+			create := func(title string, parent uint) Todo {
+				t.Helper()
+				_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": title, "parent_id": parent})
+				var todo Todo
+				decode(t, resp.Data, &todo)
+				if resp.Code != 0 || todo.ParentID != parent {
+					t.Fatalf("create %s = %+v", title, resp)
+				}
+				return todo
+			}
+			root := create("搬家", 0)
+			pack := create("打包", root.ID)
+			create("找车", root.ID)
+			books := create("书", pack.ID)
+			create("其他", 0)
+			// 默认最多3层
+			if status, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "第4层", "parent_id": books.ID}); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Reason != "depth" {
+				t.Errorf("too deep = %d %+v", status, resp)
+			}
+			if status, _ := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "没有上级", "parent_id": 999}); status != http.StatusBadRequest {
+				t.Errorf("missing parent = %d", status)
+			}
+			if status, _ := tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(pack.ID)), gin.H{"parent_id": 0}); status != http.StatusBadRequest {
+				t.Errorf("patch parent_id = %d", status)
+			}
+			tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(books.ID)), gin.H{"status": true})
+
+			_, resp := tc.do(http.MethodGet, "/api/v1/todo?tree=true", nil)
+			var tree []Todo
+			decode(t, resp.Data, &tree)
+			if *resp.Total != 2 || len(tree) != 2 || len(tree[0].Children) != 2 || len(tree[0].Children[0].Children) != 1 {
+				t.Fatalf("tree = %+v", resp)
+			}
+			if p := tree[0].Progress; p == nil || p.Done != 0 || p.Total != 2 {
+				t.Errorf("root progress = %+v", p)
+			}
+			if p := tree[0].Children[0].Progress; p == nil || p.Done != 1 || p.Total != 1 {
+				t.Errorf("pack progress = %+v", p)
+			}
+			if tree[1].Progress != nil {
+				t.Errorf("leaf progress = %+v", tree[1].Progress)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?parent_id="+strconv.Itoa(int(root.ID)), nil)
+			if *resp.Total != 2 {
+				t.Errorf("children = %+v", resp)
+			}
+
+			// 子任务不能单独移到别的清单，上级移过去的时候所有层的子任务一起移
+			_, resp = tc.do(http.MethodPost, "/api/v1/lists", gin.H{"name": "家里"})
+			var home TodoList
+			decode(t, resp.Data, &home)
+			if status, resp := tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(pack.ID)), gin.H{"list_id": home.ID}); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Field != "list_id" || resp.Details[0].Reason != "subtask" {
+				t.Errorf("patch subtask list_id = %d %+v", status, resp)
+			}
+			if status, _ := tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": books.ID, "list_id": home.ID}); status != http.StatusBadRequest {
+				t.Errorf("put subtask list_id = %d", status)
+			}
+			if _, resp := tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(root.ID)), gin.H{"list_id": home.ID}); resp.Code != 0 {
+				t.Fatalf("move root = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?list_id="+strconv.Itoa(int(home.ID)), nil)
+			if *resp.Total != 4 {
+				t.Errorf("todos in moved list = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo/"+strconv.Itoa(int(books.ID)), nil)
+			var moved Todo
+			decode(t, resp.Data, &moved)
+			if moved.ListID != home.ID || moved.Version != books.Version+2 {
+				t.Errorf("moved subtask = %+v", moved)
+			}
+
+			// 删除上级，子任务一起进回收站
+			if _, resp := tc.do(http.MethodDelete, "/api/v1/todo/"+strconv.Itoa(int(root.ID)), nil); resp.Code != 0 {
+				t.Fatalf("delete = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo", nil)
+			if *resp.Total != 1 {
+				t.Errorf("after delete = %+v", resp)
+			}
+			// 上级在回收站里，子任务不能单独恢复
+			if status, resp := tc.do(http.MethodPost, "/api/v1/trash/"+strconv.Itoa(int(books.ID))+"/restore", nil); status != http.StatusConflict ||
+				resp.Error != ErrTodoParentDeleted.Code {
+				t.Errorf("restore child = %d %+v", status, resp)
+			}
+			if _, resp := tc.do(http.MethodPost, "/api/v1/trash/"+strconv.Itoa(int(root.ID))+"/restore", nil); resp.Code != 0 {
+				t.Fatalf("restore = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo", nil)
+			if *resp.Total != 5 {
+				t.Errorf("after restore = %+v", resp)
+			}
+
+			// 彻底删除上级，子任务也一起删掉
+			tc.do(http.MethodDelete, "/api/v1/todo/"+strconv.Itoa(int(root.ID)), nil)
+			if _, resp := tc.do(http.MethodDelete, "/api/v1/trash/"+strconv.Itoa(int(root.ID)), nil); resp.Code != 0 {
+				t.Fatalf("purge = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/trash", nil)
+			var trash []Todo
+			decode(t, resp.Data, &trash)
+			if len(trash) != 0 {
+				t.Errorf("trash after purge = %+v", trash)
+			}
+		})
+	}
+}
+
+func TestServer_tags(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+
+			tags := map[string]string{}
+			for _, name := range []string{"工作", "紧急"} {
+				_, resp := tc.do(http.MethodPost, "/api/v1/tags", gin.H{"name": name, "color": "#ff4d4f"})
+				var tag Tag
+				decode(t, resp.Data, &tag)
+				if resp.Code != 0 || tag.Name != name {
+					t.Fatalf("create tag = %+v", resp)
+				}
+				tags[name] = strconv.Itoa(int(tag.ID))
+			}
+			if status, resp := tc.do(http.MethodPost, "/api/v1/tags", gin.H{"name": "工作"}); status != http.StatusConflict || resp.Error != ErrTagExists.Code {
+				t.Errorf("duplicate tag = %d %+v", status, resp)
+			}
+			if status, _ := tc.do(http.MethodPost, "/api/v1/tags", gin.H{"name": "颜色", "color": "red"}); status != http.StatusBadRequest {
+				t.Errorf("bad color = %d", status)
+			}
+
+			var ids []string
+			for _, title := range []string{"计划1", "计划2", "计划3"} {
+				_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": title})
+				var todo Todo
+				decode(t, resp.Data, &todo)
+				ids = append(ids, strconv.Itoa(int(todo.ID)))
+			}
+			attach := func(todo, tag string) {
+				t.Helper()
+				if _, resp := tc.do(http.MethodPut, "/api/v1/todo/"+todo+"/tags/"+tag, nil); resp.Code != 0 {
+					t.Fatalf("attach = %+v", resp)
+				}
+			}
+			attach(ids[0], tags["工作"])
+			attach(ids[0], tags["紧急"])
+			attach(ids[0], tags["紧急"]) // 重复打不报错
+			attach(ids[1], tags["工作"])
+			attach(ids[2], tags["紧急"])
+
+			_, resp := tc.do(http.MethodGet, "/api/v1/todo/"+ids[0]+"/tags", nil)
+			var todoTags []Tag
+			decode(t, resp.Data, &todoTags)
+			if len(todoTags) != 2 || todoTags[0].Name != "工作" {
+				t.Errorf("todo tags = %+v", resp)
+			}
+
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?tag="+tags["工作"]+","+tags["紧急"], nil)
+			if *resp.Total != 3 {
+				t.Errorf("tag or = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?tag_mode=and&tag="+tags["工作"]+","+tags["紧急"], nil)
+			var todos []Todo
+			decode(t, resp.Data, &todos)
+			if *resp.Total != 1 || len(todos) != 1 || len(todos[0].Tags) != 2 {
+				t.Errorf("tag and = %+v", resp)
+			}
+			if status, _ := tc.do(http.MethodGet, "/api/v1/todo?tag_mode=xor", nil); status != http.StatusBadRequest {
+				t.Errorf("bad tag_mode = %d", status)
+			}
+
+			if _, resp := tc.do(http.MethodDelete, "/api/v1/todo/"+ids[0]+"/tags/"+tags["紧急"], nil); resp.Code != 0 {
+				t.Fatalf("detach = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?tag="+tags["紧急"], nil)
+			if *resp.Total != 1 {
+				t.Errorf("after detach = %+v", resp)
+			}
+
+			// 别人的标签打不上
+			other := newTestClient(t, s)
+			other.login("jerry")
+			_, resp = other.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "jerry 的计划"})
+			var otherTodo Todo
+			decode(t, resp.Data, &otherTodo)
+			if status, _ := other.do(http.MethodPut, "/api/v1/todo/"+strconv.Itoa(int(otherTodo.ID))+"/tags/"+tags["工作"], nil); status != http.StatusNotFound {
+				t.Errorf("other user's tag = %d", status)
+			}
+
+			// 删除标签，待办事项上的也去掉
+			if _, resp := tc.do(http.MethodDelete, "/api/v1/tags/"+tags["工作"], nil); resp.Code != 0 {
+				t.Fatalf("delete tag = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo/"+ids[1]+"/tags", nil)
+			todoTags = nil
+			decode(t, resp.Data, &todoTags)
+			if len(todoTags) != 0 {
+				t.Errorf("tags after delete = %+v", todoTags)
+			}
+		})
+	}
+}
+
+func TestServer_recurring(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+
+			if status, _ := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "写周报", "rrule": "FREQ=WEEKLY"}); status != http.StatusBadRequest {
+				t.Errorf("rrule without due_at = %d", status)
+			}
+			if status, _ := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "写周报", "due_at": "2022-06-03T18:00:00+08:00", "rrule": "FREQ=HOURLY"}); status != http.StatusBadRequest {
+				t.Errorf("bad rrule = %d", status)
+			}
+			_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{
+				"title": "写周报", "due_at": "2022-06-03T18:00:00+08:00", "due_tz": "Asia/Shanghai",
+				"rrule": "freq=weekly;byday=fr;count=4",
+			})
+			var todo Todo
+			decode(t, resp.Data, &todo)
+			if resp.Code != 0 || todo.RRule != "FREQ=WEEKLY;BYDAY=FR;COUNT=4" || todo.Occurrence != 1 {
+				t.Fatalf("create = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodPost, "/api/v1/tags", gin.H{"name": "工作"})
+			var tag Tag
+			decode(t, resp.Data, &tag)
+			tc.do(http.MethodPut, "/api/v1/todo/"+strconv.Itoa(int(todo.ID))+"/tags/"+strconv.Itoa(int(tag.ID)), nil)
+
+			// 完成，生成下一次，标签也带上
+			_, resp = tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todo.ID, "status": true})
+			var done Todo
+			decode(t, resp.Data, &done)
+			if resp.Code != 0 || !done.Status || done.RRule != "" || done.Next == nil {
+				t.Fatalf("complete = %+v", resp)
+			}
+			next := done.Next
+			if next.DueAt.Format(time.RFC3339) != "2022-06-10T18:00:00+08:00" || next.Occurrence != 2 || next.RRule != todo.RRule {
+				t.Fatalf("next = %+v", next)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo/"+strconv.Itoa(int(next.ID))+"/tags", nil)
+			var tags []Tag
+			decode(t, resp.Data, &tags)
+			if len(tags) != 1 {
+				t.Errorf("next tags = %+v", resp)
+			}
+			// 改回未完成再完成，不会再生成
+			tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todo.ID, "status": false})
+			_, resp = tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todo.ID, "status": true})
+			done = Todo{}
+			decode(t, resp.Data, &done)
+			if done.Next != nil {
+				t.Errorf("completed twice = %+v", resp)
+			}
+
+			// 跳过这一次
+			_, resp = tc.do(http.MethodPost, "/api/v1/todo/"+strconv.Itoa(int(next.ID))+"/skip", nil)
+			var skipped Todo
+			decode(t, resp.Data, &skipped)
+			if skipped.DueAt.Format(time.RFC3339) != "2022-06-17T18:00:00+08:00" || skipped.Occurrence != 3 || skipped.Status {
+				t.Fatalf("skip = %+v", resp)
+			}
+			// 完成第3次，COUNT=4，跳过1次就没有了
+			_, resp = tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": next.ID, "status": true, "skip": 1})
+			done = Todo{}
+			decode(t, resp.Data, &done)
+			if resp.Code != 0 || done.Next != nil {
+				t.Errorf("complete after count = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo?status=false", nil)
+			if *resp.Total != 0 {
+				t.Errorf("open todos = %+v", resp)
+			}
+
+			// PATCH 完成也一样，rrule 传 null 不再重复
+			_, resp = tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "浇花", "due_at": "2022-06-01T09:00:00Z", "rrule": "FREQ=DAILY;INTERVAL=3"})
+			decode(t, resp.Data, &todo)
+			_, resp = tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(todo.ID)), gin.H{"status": true})
+			done = Todo{}
+			decode(t, resp.Data, &done)
+			if done.Next == nil || !done.Next.DueAt.Equal(time.Date(2022, 6, 4, 9, 0, 0, 0, time.UTC)) {
+				t.Fatalf("patch complete = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(done.Next.ID)), gin.H{"rrule": nil})
+			decode(t, resp.Data, &todo)
+			if todo.RRule != "" {
+				t.Errorf("patch rrule null = %+v", resp)
+			}
+			if status, resp := tc.do(http.MethodPost, "/api/v1/todo/"+strconv.Itoa(int(todo.ID))+"/skip", nil); status != http.StatusConflict ||
+				resp.Error != ErrTodoNotRecurring.Code {
+				t.Errorf("skip not recurring = %d %+v", status, resp)
+			}
+
+			// 生成下一次失败的时候，完成也要回滚，不能完成了却没有下一次
+			if repo, ok := s.todos.(*gormTodoRepository); ok {
+				_, resp = tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "交房租", "due_at": "2022-06-01T09:00:00Z", "rrule": "FREQ=MONTHLY"})
+				decode(t, resp.Data, &todo)
+				if err := repo.db.Migrator().DropTable(&Reminder{}); err != nil {
+					t.Fatalf("drop reminders: %v", err)
+				}
+				if status, _ := tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todo.ID, "status": true}); status != http.StatusInternalServerError {
+					t.Errorf("complete without reminders table = %d", status)
+				}
+				_, resp = tc.do(http.MethodGet, "/api/v1/todo/"+strconv.Itoa(int(todo.ID)), nil)
+				var cur Todo
+				decode(t, resp.Data, &cur)
+				if cur.Status || cur.RRule == "" || cur.Version != todo.Version {
+					t.Errorf("after failed complete = %+v", resp)
+				}
+				_, resp = tc.do(http.MethodGet, "/api/v1/todo?status=false", nil)
+				if *resp.Total != 2 {
+					t.Errorf("open todos after failed complete = %+v", resp)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_search(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			testSearch(t, newServer(t))
+		})
+	}
+}
+
+// testSearch 按标题、用户名搜索都不区分大小写，通配符当普通字符；integration_test.go 里 mysql、postgres 也跑这个
+func testSearch(t *testing.T, s *Server) {
+	tc := newTestClient(t, s)
+	tc.login("Tom_Cat")
+	for _, title := range []string{"Buy MILK", "milk tea", "water", "100%_done"} {
+		if _, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": title}); resp.Code != 0 {
+			t.Fatalf("create %s = %+v", title, resp)
+		}
+	}
+	for title, want := range map[string]int64{"Milk": 2, "MILK TEA": 1, "%": 1, "_": 1, "Water": 1} {
+		if _, resp := tc.do(http.MethodGet, "/api/v1/todo?title="+url.QueryEscape(title), nil); resp.Total == nil || *resp.Total != want {
+			t.Errorf("search %q = %+v, want %d", title, resp, want)
+		}
+	}
+	for q, want := range map[string]int{"tom": 1, "CAT": 1, "_": 1, "jerry": 0} {
+		if accounts, err := s.accounts.Search(q, 0, 10); err != nil || len(accounts) != want {
+			t.Errorf("accounts.Search(%q) = %d, %v, want %d", q, len(accounts), err, want)
+		}
+	}
+}
+
+func TestServer_reminders(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer hook.Close()
+
+			_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "写周报", "due_at": "2022-06-03T18:00:00+08:00", "rrule": "FREQ=WEEKLY"})
+			var todo Todo
+			decode(t, resp.Data, &todo)
+			path := "/api/v1/todo/" + strconv.Itoa(int(todo.ID)) + "/reminders"
+
+			for _, param := range []gin.H{
+				{"channel": "inapp"},
+				{"offset": -1800, "at": "2022-06-01T09:00:00Z", "channel": "inapp"},
+				{"offset": -1800, "channel": "email", "target": "tom@example.com"}, // 没配置 smtp
+				{"offset": -1800, "channel": "webhook", "target": "ftp://example.com"},
+				{"offset": -1800, "channel": "sms"},
+			} {
+				if status, resp := tc.do(http.MethodPost, path, param); status != http.StatusBadRequest {
+					t.Errorf("create %v = %d %+v", param, status, resp)
+				}
+			}
+			// webhook 渠道也不能用本机、内网的地址
+			for _, u := range []string{hook.URL, "http://169.254.169.254/latest/meta-data", "http://100.100.100.200/latest/meta-data"} {
+				if status, resp := tc.do(http.MethodPost, path, gin.H{"offset": -1800, "channel": "webhook", "target": u}); status != http.StatusBadRequest ||
+					len(resp.Details) != 1 || resp.Details[0].Field != "target" || resp.Details[0].Reason != "private" {
+					t.Errorf("create webhook %s = %d %+v", u, status, resp)
+				}
+			}
+			// 测试用的 hook 在本机上
+			conf.Webhook.AllowPrivate = true
+			defer func() { conf.Webhook.AllowPrivate = false }()
+
+			_, resp = tc.do(http.MethodPost, path, gin.H{"offset": -1800, "channel": "inapp"})
+			var inapp Reminder
+			decode(t, resp.Data, &inapp)
+			if resp.Code != 0 || inapp.Status != ReminderPending || !inapp.FireAt.Equal(time.Date(2022, 6, 3, 9, 30, 0, 0, time.UTC)) {
+				t.Fatalf("create offset = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodPost, path, gin.H{"at": "2022-06-01T09:00:00Z", "channel": "webhook", "target": hook.URL})
+			var webhook Reminder
+			decode(t, resp.Data, &webhook)
+			if resp.Code != 0 || !webhook.FireAt.Equal(time.Date(2022, 6, 1, 9, 0, 0, 0, time.UTC)) {
+				t.Fatalf("create at = %+v", resp)
+			}
+
+			// 改截止时间，相对截止时间的提醒跟着改，固定时间的不变
+			tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todo.ID, "due_at": "2022-06-04T18:00:00+08:00"})
+			_, resp = tc.do(http.MethodGet, path, nil)
+			var reminders []Reminder
+			decode(t, resp.Data, &reminders)
+			if len(reminders) != 2 || !reminders[0].FireAt.Equal(time.Date(2022, 6, 4, 9, 30, 0, 0, time.UTC)) ||
+				!reminders[1].FireAt.Equal(webhook.FireAt.UTC()) {
+				t.Fatalf("reschedule = %+v", resp)
+			}
+
+			// 还没到时间
+			if n, err := s.sendDueReminders(time.Date(2022, 5, 31, 0, 0, 0, 0, time.UTC)); err != nil || n != 0 {
+				t.Errorf("sendDueReminders() early = %d, %v", n, err)
+			}
+			now := time.Date(2022, 6, 5, 0, 0, 0, 0, time.UTC)
+			if n, err := s.sendDueReminders(now); err != nil || n != 2 {
+				t.Fatalf("sendDueReminders() = %d, %v", n, err)
+			}
+			// webhook 失败了，一分钟之后重试；同一时间再跑一次不会重复发
+			if n, err := s.sendDueReminders(now); err != nil || n != 0 {
+				t.Errorf("sendDueReminders() again = %d, %v", n, err)
+			}
+			_, resp = tc.do(http.MethodGet, path, nil)
+			reminders = nil
+			decode(t, resp.Data, &reminders)
+			if reminders[0].Status != ReminderSent || reminders[0].SentAt == nil {
+				t.Errorf("inapp reminder = %+v", reminders[0])
+			}
+			if reminders[1].Status != ReminderPending || reminders[1].Attempts != 1 || reminders[1].LastError == "" ||
+				!reminders[1].FireAt.Equal(now.Add(time.Minute)) {
+				t.Errorf("webhook reminder = %+v", reminders[1])
+			}
+
+			// 站内信
+			_, resp = tc.do(http.MethodGet, "/api/v1/notifications?unread=true", nil)
+			var notifications []Notification
+			decode(t, resp.Data, &notifications)
+			if len(notifications) != 1 || notifications[0].TodoID != todo.ID || notifications[0].Title != "提醒：写周报" {
+				t.Fatalf("notifications = %+v", resp)
+			}
+			id := strconv.Itoa(int(notifications[0].ID))
+			if _, resp := tc.do(http.MethodPost, "/api/v1/notifications/"+id+"/read", nil); resp.Code != 0 {
+				t.Errorf("read = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/notifications?unread=true", nil)
+			notifications = nil
+			decode(t, resp.Data, &notifications)
+			if len(notifications) != 0 {
+				t.Errorf("unread after read = %+v", resp)
+			}
+			if status, _ := tc.do(http.MethodPost, "/api/v1/notifications/999/read", nil); status != http.StatusNotFound {
+				t.Errorf("read missing = %d", status)
+			}
+
+			// 完成之后生成下一次，相对截止时间的提醒带过去；这一次的 webhook 重试的时候取消
+			_, resp = tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todo.ID, "status": true})
+			var done Todo
+			decode(t, resp.Data, &done)
+			if done.Next == nil {
+				t.Fatalf("complete = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/todo/"+strconv.Itoa(int(done.Next.ID))+"/reminders", nil)
+			reminders = nil
+			decode(t, resp.Data, &reminders)
+			if len(reminders) != 1 || reminders[0].Channel != ChannelInApp || !reminders[0].FireAt.Equal(done.Next.DueAt.Add(-30*time.Minute)) {
+				t.Errorf("next reminders = %+v", resp)
+			}
+			if n, err := s.sendDueReminders(now.Add(time.Minute)); err != nil || n != 1 {
+				t.Errorf("sendDueReminders() retry = %d, %v", n, err)
+			}
+			_, resp = tc.do(http.MethodGet, path, nil)
+			reminders = nil
+			decode(t, resp.Data, &reminders)
+			if reminders[1].Status != ReminderCancelled {
+				t.Errorf("webhook after complete = %+v", reminders[1])
+			}
+
+			if _, resp := tc.do(http.MethodDelete, path+"/"+strconv.Itoa(int(inapp.ID)), nil); resp.Code != 0 {
+				t.Errorf("delete = %+v", resp)
+			}
+			if status, _ := tc.do(http.MethodDelete, path+"/"+strconv.Itoa(int(inapp.ID)), nil); status != http.StatusNotFound {
+				t.Errorf("delete again = %d", status)
+			}
+		})
+	}
+}
+
+func TestServer_events(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			tc := newTestClient(t, newServer(t))
+			pair := tc.login("tom")
+			srv := httptest.NewServer(tc.r)
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + "/api/v1/events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("events without token = %d", resp.StatusCode)
+			}
+
+			// SSE，token 放在 url 参数里
+			resp, err = http.Get(srv.URL + "/api/v1/events?access_token=" + pair.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+				t.Fatalf("Content-Type = %q", ct)
+			}
+			r := bufio.NewReader(resp.Body)
+			readSSE := func() (string, Event) {
+				t.Helper()
+				var typ string
+				var ev Event
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						t.Fatalf("read sse: %v", err)
+					}
+					line = strings.TrimRight(line, "\n")
+					switch {
+					case line == "":
+						return typ, ev
+					case strings.HasPrefix(line, "event:"):
+						typ = strings.TrimPrefix(line, "event:")
+					case strings.HasPrefix(line, "data:"):
+						if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &ev); err != nil {
+							t.Fatalf("decode sse data %q: %v", line, err)
+						}
+					}
+				}
+			}
+			if typ, _ := readSSE(); typ != EventReady {
+				t.Fatalf("first sse event = %q", typ)
+			}
+
+			// WebSocket
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/ws?access_token="+pair.Token, nil)
+			if err != nil {
+				t.Fatalf("dial ws: %v", err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var ev Event
+			if err := conn.ReadJSON(&ev); err != nil || ev.Type != EventReady {
+				t.Fatalf("first ws event = %+v, %v", ev, err)
+			}
+
+			_, created := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "买菜"})
+			var todo Todo
+			decode(t, created.Data, &todo)
+			typ, ev := readSSE()
+			var got Todo
+			decode(t, ev.Data, &got)
+			if typ != EventTodoCreated || ev.Type != EventTodoCreated || got.ID != todo.ID || got.Title != "买菜" {
+				t.Errorf("sse created = %q %+v", typ, ev)
+			}
+			ev = Event{}
+			if err := conn.ReadJSON(&ev); err != nil || ev.Type != EventTodoCreated {
+				t.Errorf("ws created = %+v, %v", ev, err)
+			}
+
+			for _, c := range []struct {
+				patch gin.H
+				want  string
+			}{
+				{gin.H{"title": "买菜和水果"}, EventTodoUpdated},
+				{gin.H{"status": true}, EventTodoCompleted},
+				{gin.H{"status": true}, EventTodoUpdated}, // 已经完成了
+			} {
+				tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(todo.ID)), c.patch)
+				if typ, _ := readSSE(); typ != c.want {
+					t.Errorf("sse after patch %v = %q, want %q", c.patch, typ, c.want)
+				}
+				ev = Event{}
+				if err := conn.ReadJSON(&ev); err != nil || ev.Type != c.want {
+					t.Errorf("ws after patch %v = %+v, %v", c.patch, ev, err)
+				}
+			}
+
+			// 别的用户的变化收不到
+			other := &testClient{t: t, r: tc.r}
+			other.login("jerry")
+			other.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "别人的"})
+
+			tc.do(http.MethodDelete, "/api/v1/todo/"+strconv.Itoa(int(todo.ID)), nil)
+			typ, ev = readSSE()
+			var deleted struct {
+				ID uint `json:"id"`
+			}
+			decode(t, ev.Data, &deleted)
+			if typ != EventTodoDeleted || deleted.ID != todo.ID {
+				t.Errorf("sse deleted = %q %+v", typ, ev)
+			}
+			ev = Event{}
+			if err := conn.ReadJSON(&ev); err != nil || ev.Type != EventTodoDeleted {
+				t.Errorf("ws deleted = %+v, %v", ev, err)
+			}
+
+			// 退出所有设备之后，连着的 SSE、WebSocket 收到 account.logout_all 就断开
+			tc.do(http.MethodPost, "/logout/all", nil)
+			if typ, _ := readSSE(); typ != EventAccountLogoutAll {
+				t.Errorf("sse logout all = %q", typ)
+			}
+			if line, err := r.ReadString('\n'); err != io.EOF {
+				t.Errorf("sse after logout all = %q, %v", line, err)
+			}
+			ev = Event{}
+			if err := conn.ReadJSON(&ev); err != nil || ev.Type != EventAccountLogoutAll {
+				t.Errorf("ws logout all = %+v, %v", ev, err)
+			}
+			if err := conn.ReadJSON(&ev); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("ws after logout all err = %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_webhooks(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+
+			type received struct {
+				header http.Header
+				body   []byte
+			}
+			var got []received
+			fail := true
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				got = append(got, received{r.Header.Clone(), body})
+				if fail {
+					fail = false
+					http.Error(w, "try later", http.StatusServiceUnavailable)
+				}
+			}))
+			defer hook.Close()
+
+			// 本机、内网的地址不能注册
+			for _, u := range []string{hook.URL, "http://localhost:8080/hook", "http://10.0.0.1/hook", "http://169.254.169.254/latest/meta-data", "http://100.100.100.200/latest/meta-data", "http://198.18.0.1/hook", "http://[::1]/hook", "http://[64:ff9b::a9fe:a9fe]/hook"} {
+				if status, resp := tc.do(http.MethodPost, "/api/v1/webhooks", gin.H{"url": u}); status != http.StatusBadRequest ||
+					len(resp.Details) != 1 || resp.Details[0].Field != "url" {
+					t.Errorf("create %s = %d %+v", u, status, resp)
+				}
+			}
+			// 测试用的 hook 在本机上
+			conf.Webhook.AllowPrivate = true
+			defer func() { conf.Webhook.AllowPrivate = false }()
+
+			for _, param := range []gin.H{
+				{"url": "ftp://example.com/hook"},
+				{"url": hook.URL, "events": []string{"todo.exploded"}},
+			} {
+				if status, resp := tc.do(http.MethodPost, "/api/v1/webhooks", param); status != http.StatusBadRequest {
+					t.Errorf("create %v = %d %+v", param, status, resp)
+				}
+			}
+			_, resp := tc.do(http.MethodPost, "/api/v1/webhooks", gin.H{"url": hook.URL, "events": []string{"todo.completed", "todo.created", "todo.created"}})
+			var endpoint WebhookEndpoint
+			decode(t, resp.Data, &endpoint)
+			if resp.Code != 0 || endpoint.Secret == "" || !endpoint.Active || len(endpoint.Events) != 2 {
+				t.Fatalf("create = %+v", resp)
+			}
+			_, resp = tc.do(http.MethodGet, "/api/v1/webhooks", nil)
+			var endpoints []WebhookEndpoint
+			decode(t, resp.Data, &endpoints)
+			if len(endpoints) != 1 || endpoints[0].Secret != "" {
+				t.Errorf("list = %+v", resp)
+			}
+			path := "/api/v1/webhooks/" + strconv.Itoa(int(endpoint.ID))
+
+			// 第一次 503，30 秒之后重试成功
+			_, resp = tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "买菜"})
+			var todo Todo
+			decode(t, resp.Data, &todo)
+			now := time.Now().Add(time.Second)
+			if n, err := s.deliverWebhooks(now); err != nil || n != 1 {
+				t.Fatalf("deliverWebhooks() = %d, %v", n, err)
+			}
+			if n, err := s.deliverWebhooks(now); err != nil || n != 0 {
+				t.Errorf("deliverWebhooks() before backoff = %d, %v", n, err)
+			}
+			if n, err := s.deliverWebhooks(now.Add(30 * time.Second)); err != nil || n != 1 {
+				t.Fatalf("deliverWebhooks() retry = %d, %v", n, err)
+			}
+			if len(got) != 2 {
+				t.Fatalf("received %d requests", len(got))
+			}
+			last := got[1]
+			if last.header.Get("X-Webhook-Event") != EventTodoCreated || last.header.Get("Content-Type") != "application/json" {
+				t.Errorf("headers = %v", last.header)
+			}
+			sig := last.header.Get("X-Webhook-Signature")
+			ts, _ := strconv.ParseInt(strings.TrimPrefix(strings.SplitN(sig, ",", 2)[0], "t="), 10, 64)
+			if sig != signWebhook(endpoint.Secret, ts, last.body) {
+				t.Errorf("signature = %q", sig)
+			}
+			var payload struct {
+				ID   string `json:"id"`
+				Type string `json:"type"`
+				Data Todo   `json:"data"`
+			}
+			decode(t, json.RawMessage(last.body), &payload)
+			if payload.ID == "" || payload.Type != EventTodoCreated || payload.Data.ID != todo.ID || string(got[0].body) != string(last.body) {
+				t.Errorf("payload = %s", last.body)
+			}
+
+			// 没订阅 todo.updated，完成了才发
+			tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(todo.ID)), gin.H{"title": "买菜和水果"})
+			tc.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(todo.ID)), gin.H{"status": true})
+			if n, err := s.deliverWebhooks(now.Add(time.Minute)); err != nil || n != 1 {
+				t.Fatalf("deliverWebhooks() completed = %d, %v", n, err)
+			}
+			if len(got) != 3 || got[2].header.Get("X-Webhook-Event") != EventTodoCompleted {
+				t.Errorf("completed request = %+v", got[len(got)-1].header)
+			}
+
+			// 发送记录
+			_, resp = tc.do(http.MethodGet, path+"/deliveries", nil)
+			var deliveries []WebhookDelivery
+			decode(t, resp.Data, &deliveries)
+			if len(deliveries) != 2 || deliveries[0].Event != EventTodoCompleted || deliveries[1].Status != WebhookSucceeded ||
+				deliveries[1].Attempts != 2 || deliveries[1].DeliveredAt == nil {
+				t.Fatalf("deliveries = %+v", resp)
+			}
+			first := path + "/deliveries/" + strconv.Itoa(int(deliveries[1].ID))
+			_, resp = tc.do(http.MethodGet, first, nil)
+			var delivery WebhookDelivery
+			decode(t, resp.Data, &delivery)
+			if len(delivery.AttemptLogs) != 2 || delivery.AttemptLogs[0].StatusCode != http.StatusServiceUnavailable ||
+				delivery.AttemptLogs[0].Response != "try later\n" || delivery.AttemptLogs[1].StatusCode != http.StatusOK || len(delivery.Body) == 0 {
+				t.Errorf("delivery = %+v", resp)
+			}
+
+			// 重发，事件 id 不变
+			_, resp = tc.do(http.MethodPost, first+"/redeliver", nil)
+			var redelivery WebhookDelivery
+			decode(t, resp.Data, &redelivery)
+			if resp.Code != 0 || redelivery.ID == delivery.ID || redelivery.EventID != delivery.EventID || redelivery.Status != WebhookPending {
+				t.Fatalf("redeliver = %+v", resp)
+			}
+			if n, err := s.deliverWebhooks(now.Add(time.Minute)); err != nil || n != 1 {
+				t.Errorf("deliverWebhooks() redeliver = %d, %v", n, err)
+			}
+			if len(got) != 4 || string(got[3].body) != string(last.body) {
+				t.Errorf("redelivered body = %s", got[len(got)-1].body)
+			}
+
+			// 停用之后不再写发件箱
+			_, resp = tc.do(http.MethodPut, path, gin.H{"url": hook.URL, "active": false})
+			endpoint = WebhookEndpoint{}
+			decode(t, resp.Data, &endpoint)
+			if endpoint.Active || len(endpoint.Events) != 0 || endpoint.Secret != "" {
+				t.Errorf("update = %+v", resp)
+			}
+			tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "浇花"})
+			if n, err := s.deliverWebhooks(now.Add(time.Hour)); err != nil || n != 0 {
+				t.Errorf("deliverWebhooks() disabled = %d, %v", n, err)
+			}
+
+			if _, resp := tc.do(http.MethodDelete, path, nil); resp.Code != 0 {
+				t.Errorf("delete = %+v", resp)
+			}
+			if status, _ := tc.do(http.MethodGet, first, nil); status != http.StatusNotFound {
+				t.Errorf("delivery after delete = %d", status)
+			}
+			if status, _ := tc.do(http.MethodGet, path+"/deliveries", nil); status != http.StatusNotFound {
+				t.Errorf("deliveries after delete = %d", status)
+			}
+		})
+	}
+}
+
+// 写发件箱失败的时候，待办事项的修改一起回滚，不会改好了却没有事件
+func TestServer_webhookOutboxRollback(t *testing.T) {
+	s := testBackends["sqlite"](t)
+	tc := newTestClient(t, s)
+	pair := tc.login("tom")
+	mc, err := s.keys.ParseToken(pair.Token)
+	if err != nil {
+		t.Fatalf("ParseToken() err = %v", err)
+	}
+	conf.Webhook.AllowPrivate = true
+	defer func() { conf.Webhook.AllowPrivate = false }()
+
+	_, resp := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "写周报"})
+	var todo Todo
+	decode(t, resp.Data, &todo)
+	if _, resp := tc.do(http.MethodPost, "/api/v1/webhooks", gin.H{"url": "http://127.0.0.1:1/hook"}); resp.Code != 0 {
+		t.Fatalf("create webhook = %+v", resp)
+	}
+	if err := s.db.Migrator().DropTable(&WebhookDelivery{}); err != nil {
+		t.Fatalf("drop webhook_deliveries: %v", err)
+	}
+	sub := s.events.Subscribe(mc.Uid)
+	defer s.events.Unsubscribe(sub)
+
+	if status, _ := tc.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "浇花"}); status != http.StatusInternalServerError {
+		t.Errorf("create without outbox = %d", status)
+	}
+	if _, resp := tc.do(http.MethodGet, "/api/v1/todo", nil); *resp.Total != 1 {
+		t.Errorf("todos after failed create = %+v", resp)
+	}
+	path := "/api/v1/todo/" + strconv.Itoa(int(todo.ID))
+	if status, _ := tc.do(http.MethodPut, "/api/v1/todo", gin.H{"id": todo.ID, "status": true}); status != http.StatusInternalServerError {
+		t.Errorf("update without outbox = %d", status)
+	}
+	if status, _ := tc.do(http.MethodPatch, path, gin.H{"title": "写月报"}); status != http.StatusInternalServerError {
+		t.Errorf("patch without outbox = %d", status)
+	}
+	if status, _ := tc.do(http.MethodDelete, path, nil); status != http.StatusInternalServerError {
+		t.Errorf("delete without outbox = %d", status)
+	}
+	_, resp = tc.do(http.MethodGet, path, nil)
+	var cur Todo
+	decode(t, resp.Data, &cur)
+	if resp.Code != 0 || cur.Status || cur.Title != "写周报" || cur.Version != todo.Version {
+		t.Errorf("todo after failed changes = %+v", resp)
+	}
+	// 退出所有设备也一样，token 还能用
+	if status, _ := tc.do(http.MethodPost, "/logout/all", nil); status != http.StatusInternalServerError {
+		t.Errorf("logout all without outbox = %d", status)
+	}
+	if status, _ := tc.do(http.MethodGet, path, nil); status != http.StatusOK {
+		t.Errorf("token after failed logout all = %d", status)
+	}
+	// 回滚了的修改也不推送给在线的页面
+	select {
+	case ev := <-sub.C:
+		t.Errorf("event after rollback = %+v", ev)
+	default:
+	}
+}
+
+func TestServer_sharing(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tom := newTestClient(t, s)
+			tom.login("tom")
+			jerry := &testClient{t: t, r: tom.r}
+			jerry.login("jerry")
+			spike := &testClient{t: t, r: tom.r}
+			spike.login("spike")
+
+			_, resp := tom.do(http.MethodPost, "/api/v1/lists", gin.H{"name": "家庭"})
+			var list TodoList
+			decode(t, resp.Data, &list)
+			listPath := "/api/v1/lists/" + strconv.Itoa(int(list.ID))
+			_, resp = tom.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "买菜", "list_id": list.ID})
+			var todo Todo
+			decode(t, resp.Data, &todo)
+			todoPath := "/api/v1/todo/" + strconv.Itoa(int(todo.ID))
+
+			// 邀请，用户名不存在也返回一样的响应
+			status, unknown := tom.do(http.MethodPost, listPath+"/members", gin.H{"username": "nobody", "role": "viewer"})
+			if status != http.StatusOK || unknown.Code != 0 {
+				t.Errorf("invite unknown user = %d %+v", status, unknown)
+			}
+			_, resp = tom.do(http.MethodGet, "/api/v1/lists", nil)
+			var lists []TodoList
+			decode(t, resp.Data, &lists)
+			if status, _ := tom.do(http.MethodPost, "/api/v1/lists/"+strconv.Itoa(int(lists[0].ID))+"/members", gin.H{"username": "jerry", "role": "viewer"}); status != http.StatusConflict {
+				t.Errorf("share inbox = %d", status)
+			}
+			if _, resp := tom.do(http.MethodPost, listPath+"/members", gin.H{"username": "jerry", "role": "viewer"}); !reflect.DeepEqual(resp, unknown) {
+				t.Fatalf("invite = %+v, want same as unknown user %+v", resp, unknown)
+			}
+			// 不存在的用户名不会留下成员记录
+			_, resp = tom.do(http.MethodGet, listPath+"/members", nil)
+			var invited []ListMember
+			decode(t, resp.Data, &invited)
+			if len(invited) != 2 || invited[1].Status != MemberInvited || invited[1].Username != "jerry" {
+				t.Fatalf("members after invite = %+v", resp)
+			}
+			member := invited[1]
+			if status, _ := tom.do(http.MethodPost, listPath+"/members", gin.H{"username": "jerry", "role": "editor"}); status != http.StatusConflict {
+				t.Errorf("invite again = %d", status)
+			}
+			// 接受之前看不到
+			if status, _ := jerry.do(http.MethodGet, listPath, nil); status != http.StatusNotFound {
+				t.Errorf("get list before accept = %d", status)
+			}
+			_, resp = jerry.do(http.MethodGet, "/api/v1/notifications", nil)
+			var notifications []Notification
+			decode(t, resp.Data, &notifications)
+			if len(notifications) != 1 || !strings.Contains(notifications[0].Title, "家庭") {
+				t.Errorf("invitation notification = %+v", resp)
+			}
+			_, resp = jerry.do(http.MethodGet, "/api/v1/invitations", nil)
+			var invitations []ListMember
+			decode(t, resp.Data, &invitations)
+			if len(invitations) != 1 || invitations[0].ListName != "家庭" || invitations[0].Inviter != "tom" {
+				t.Fatalf("invitations = %+v", resp)
+			}
+			invitationPath := "/api/v1/invitations/" + strconv.Itoa(int(invitations[0].ID))
+			if status, _ := spike.do(http.MethodPost, invitationPath+"/accept", nil); status != http.StatusNotFound {
+				t.Errorf("accept other's invitation = %d", status)
+			}
+			_, resp = jerry.do(http.MethodPost, invitationPath+"/accept", nil)
+			decode(t, resp.Data, &list)
+			if resp.Code != 0 || list.Role != ListRoleViewer {
+				t.Fatalf("accept = %+v", resp)
+			}
+
+			// viewer 只能看
+			_, resp = jerry.do(http.MethodGet, "/api/v1/lists", nil)
+			decode(t, resp.Data, &lists)
+			if len(lists) != 2 || lists[1].ID != list.ID || lists[1].Role != ListRoleViewer {
+				t.Errorf("jerry's lists = %+v", resp)
+			}
+			_, resp = jerry.do(http.MethodGet, "/api/v1/todo?list_id="+strconv.Itoa(int(list.ID)), nil)
+			if resp.Code != 0 || *resp.Total != 1 {
+				t.Errorf("jerry list todos = %+v", resp)
+			}
+			// 只能按自己的标签过滤，别人的标签 id 拿来试返回参数错误
+			var tomTag, jerryTag Tag
+			_, resp = tom.do(http.MethodPost, "/api/v1/tags", gin.H{"name": "私人"})
+			decode(t, resp.Data, &tomTag)
+			tom.do(http.MethodPut, todoPath+"/tags/"+strconv.Itoa(int(tomTag.ID)), nil)
+			if status, resp := jerry.do(http.MethodGet, "/api/v1/todo?list_id="+strconv.Itoa(int(list.ID))+"&tag="+strconv.Itoa(int(tomTag.ID)), nil); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Field != "tag" || resp.Details[0].Reason != "exists" {
+				t.Errorf("filter by owner's tag = %d %+v", status, resp)
+			}
+			_, resp = jerry.do(http.MethodPost, "/api/v1/tags", gin.H{"name": "采购"})
+			decode(t, resp.Data, &jerryTag)
+			if _, resp := jerry.do(http.MethodPut, todoPath+"/tags/"+strconv.Itoa(int(jerryTag.ID)), nil); resp.Code != 0 {
+				t.Fatalf("viewer attach tag = %+v", resp)
+			}
+			_, resp = jerry.do(http.MethodGet, "/api/v1/todo?list_id="+strconv.Itoa(int(list.ID))+"&tag="+strconv.Itoa(int(jerryTag.ID)), nil)
+			if resp.Code != 0 || *resp.Total != 1 {
+				t.Errorf("filter by own tag = %+v", resp)
+			}
+			// 直接查 Repository 也一样，别人的标签不算
+			tomAccount, _ := s.accounts.GetByName("tom")
+			viewer, _ := s.accounts.GetByName("jerry")
+			if n, err := s.todos.Count(tomAccount.Uid, TodoQuery{ListID: list.ID, Tags: []uint{tomTag.ID}, TagUid: viewer.Uid}); err != nil || n != 0 {
+				t.Errorf("todos.Count() with other's tag = %d, %v", n, err)
+			}
+			if status, _ := jerry.do(http.MethodGet, todoPath, nil); status != http.StatusOK {
+				t.Errorf("jerry get todo = %d", status)
+			}
+			if status, _ := jerry.do(http.MethodPatch, todoPath, gin.H{"title": "买水果"}); status != http.StatusForbidden {
+				t.Errorf("viewer patch = %d", status)
+			}
+			if status, _ := jerry.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "买肉", "list_id": list.ID}); status != http.StatusForbidden {
+				t.Errorf("viewer create = %d", status)
+			}
+			// 别人看不到
+			if status, _ := spike.do(http.MethodGet, todoPath, nil); status != http.StatusNotFound {
+				t.Errorf("stranger get todo = %d", status)
+			}
+			if status, _ := spike.do(http.MethodGet, "/api/v1/todo?list_id="+strconv.Itoa(int(list.ID)), nil); status != http.StatusNotFound {
+				t.Errorf("stranger list todos = %d", status)
+			}
+
+			// 改成 editor 之后能改、能新建，新建的属于创建清单的人
+			_, resp = tom.do(http.MethodPut, listPath+"/members/"+strconv.Itoa(int(member.ID)), gin.H{"role": "editor"})
+			decode(t, resp.Data, &member)
+			if member.Role != ListRoleEditor {
+				t.Fatalf("update role = %+v", resp)
+			}
+			jerryAccount, _ := s.accounts.GetByName("jerry")
+			sub := s.events.Subscribe(jerryAccount.Uid)
+			defer s.events.Unsubscribe(sub)
+			if _, resp := tom.do(http.MethodPatch, todoPath, gin.H{"title": "买水果"}); resp.Code != 0 {
+				t.Fatalf("owner patch = %+v", resp)
+			}
+			if ev := <-sub.C; ev.Type != EventTodoUpdated {
+				t.Errorf("member event = %+v", ev)
+			}
+			if _, resp := jerry.do(http.MethodPatch, todoPath, gin.H{"status": true}); resp.Code != 0 {
+				t.Errorf("editor patch = %+v", resp)
+			}
+			if _, resp := jerry.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "买肉", "list_id": list.ID}); resp.Code != 0 {
+				t.Errorf("editor create = %+v", resp)
+			}
+			_, resp = tom.do(http.MethodGet, "/api/v1/todo?list_id="+strconv.Itoa(int(list.ID)), nil)
+			if *resp.Total != 2 {
+				t.Errorf("owner list todos = %+v", resp)
+			}
+			// 不能移到自己的清单里
+			if status, resp := jerry.do(http.MethodPatch, todoPath, gin.H{"list_id": 0}); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Reason != "owner" {
+				t.Errorf("move to own inbox = %d %+v", status, resp)
+			}
+			if status, _ := jerry.do(http.MethodPut, listPath, gin.H{"name": "我家"}); status != http.StatusForbidden {
+				t.Errorf("editor rename = %d", status)
+			}
+
+			// owner 能改名，但是不能删除别人的清单
+			tom.do(http.MethodPut, listPath+"/members/"+strconv.Itoa(int(member.ID)), gin.H{"role": "owner"})
+			if _, resp := jerry.do(http.MethodPut, listPath, gin.H{"name": "我家"}); resp.Code != 0 {
+				t.Errorf("owner rename = %+v", resp)
+			}
+			if status, _ := jerry.do(http.MethodDelete, listPath, nil); status != http.StatusForbidden {
+				t.Errorf("member delete list = %d", status)
+			}
+			_, resp = jerry.do(http.MethodGet, listPath+"/members", nil)
+			var members []ListMember
+			decode(t, resp.Data, &members)
+			if len(members) != 2 || members[0].Username != "tom" || members[0].Role != ListRoleOwner || members[1].Username != "jerry" {
+				t.Errorf("members = %+v", resp)
+			}
+
+			// 拒绝邀请
+			jerry.do(http.MethodPost, listPath+"/members", gin.H{"username": "spike", "role": "viewer"})
+			_, resp = spike.do(http.MethodGet, "/api/v1/invitations", nil)
+			decode(t, resp.Data, &invitations)
+			if len(invitations) != 1 {
+				t.Fatalf("spike invitations = %+v", resp)
+			}
+			if _, resp := spike.do(http.MethodDelete, "/api/v1/invitations/"+strconv.Itoa(int(invitations[0].ID)), nil); resp.Code != 0 {
+				t.Errorf("decline = %+v", resp)
+			}
+			_, resp = tom.do(http.MethodGet, listPath+"/members", nil)
+			decode(t, resp.Data, &members)
+			if len(members) != 2 {
+				t.Errorf("members after decline = %+v", resp)
+			}
+
+			// 退出清单之后就看不到了
+			if _, resp := jerry.do(http.MethodDelete, listPath+"/members/"+strconv.Itoa(int(member.ID)), nil); resp.Code != 0 {
+				t.Fatalf("leave = %+v", resp)
+			}
+			if status, _ := jerry.do(http.MethodGet, todoPath, nil); status != http.StatusNotFound {
+				t.Errorf("get todo after leave = %d", status)
+			}
+		})
+	}
+}
+
+func TestServer_admin(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			admin := newTestClient(t, s)
+			admin.login("admin")
+			tom := &testClient{t: t, r: admin.r}
+			tom.login("tom")
+			tom.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "买菜"})
+			_, resp := tom.do(http.MethodPost, "/api/v1/todo", gin.H{"title": "洗碗"})
+			var todo Todo
+			decode(t, resp.Data, &todo)
+			tom.do(http.MethodPatch, "/api/v1/todo/"+strconv.Itoa(int(todo.ID)), gin.H{"status": true})
+
+			// 普通用户不能访问
+			if status, resp := admin.do(http.MethodGet, "/api/admin/accounts", nil); status != http.StatusForbidden || resp.Error != "forbidden" {
+				t.Errorf("list accounts as user = %d %+v", status, resp)
+			}
+
+			// 改成管理员之后重新登录，新的 token 里才有角色
+			account, err := s.accounts.GetByName("admin")
+			if err != nil {
+				t.Fatalf("GetByName() err = %v", err)
+			}
+			if err := s.accounts.UpdateRole(account.Uid, RoleAdmin); err != nil {
+				t.Fatalf("UpdateRole() err = %v", err)
+			}
+			_, resp = admin.do(http.MethodPost, "/login", AuthParam{Name: "admin", Password: "123456"})
+			var pair TokenPair
+			decode(t, resp.Data, &pair)
+			admin.token = pair.Token
+
+			_, resp = admin.do(http.MethodGet, "/api/admin/accounts?limit=1", nil)
+			var accounts []AdminAccount
+			decode(t, resp.Data, &accounts)
+			if len(accounts) != 1 || accounts[0].Name != "admin" || accounts[0].Role != RoleAdmin || resp.NextCursor == "" {
+				t.Fatalf("list accounts = %+v", resp)
+			}
+			_, resp = admin.do(http.MethodGet, "/api/admin/accounts?limit=1&cursor="+resp.NextCursor, nil)
+			decode(t, resp.Data, &accounts)
+			if len(accounts) != 1 || accounts[0].Name != "tom" || resp.NextCursor != "" {
+				t.Fatalf("list accounts page 2 = %+v", resp)
+			}
+			_, resp = admin.do(http.MethodGet, "/api/admin/accounts?q=TO", nil)
+			decode(t, resp.Data, &accounts)
+			if len(accounts) != 1 || accounts[0].Name != "tom" || accounts[0].Role != RoleUser {
+				t.Errorf("search accounts = %+v", resp)
+			}
+			tomPath := "/api/admin/accounts/" + strconv.FormatInt(accounts[0].Uid, 10)
+			adminPath := "/api/admin/accounts/" + strconv.FormatInt(account.Uid, 10)
+
+			_, resp = admin.do(http.MethodGet, tomPath, nil)
+			var detail AdminAccount
+			decode(t, resp.Data, &detail)
+			if detail.Todos == nil || detail.Todos.Total != 2 || detail.Todos.Completed != 1 || detail.Todos.Pending != 1 || detail.Todos.Lists != 1 {
+				t.Errorf("get account = %+v", resp)
+			}
+			if status, resp := admin.do(http.MethodGet, "/api/admin/accounts/999999", nil); status != http.StatusNotFound || resp.Error != "user_not_found" {
+				t.Errorf("get unknown account = %d %+v", status, resp)
+			}
+
+			// 不能禁用自己、改自己的角色
+			if status, resp := admin.do(http.MethodPost, adminPath+"/disable", nil); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Reason != "self" {
+				t.Errorf("disable self = %d %+v", status, resp)
+			}
+			if status, _ := admin.do(http.MethodPut, adminPath+"/role", gin.H{"role": "user"}); status != http.StatusBadRequest {
+				t.Errorf("demote self = %d", status)
+			}
+			if status, _ := admin.do(http.MethodPut, tomPath+"/role", gin.H{"role": "root"}); status != http.StatusBadRequest {
+				t.Errorf("invalid role = %d", status)
+			}
+
+			// 禁用之后旧 token 失效，也不能再登录
+			_, resp = admin.do(http.MethodPost, tomPath+"/disable", nil)
+			decode(t, resp.Data, &detail)
+			if detail.Status != AccountDisabled {
+				t.Errorf("disable = %+v", resp)
+			}
+			if status, _ := tom.do(http.MethodGet, "/api/v1/todo", nil); status != http.StatusUnauthorized {
+				t.Errorf("list todo after disable = %d", status)
+			}
+			if status, resp := tom.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "123456"}); status != http.StatusForbidden || resp.Error != "account_disabled" {
+				t.Errorf("login after disable = %d %+v", status, resp)
+			}
+			if _, resp := admin.do(http.MethodPost, tomPath+"/enable", nil); resp.Code != 0 {
+				t.Errorf("enable = %+v", resp)
+			}
+
+			// 重置密码之后只能用新密码登录
+			if status, resp := admin.do(http.MethodPost, tomPath+"/password", gin.H{"password": strings.Repeat("密", 100)}); status != http.StatusBadRequest ||
+				len(resp.Details) != 1 || resp.Details[0].Reason != "max" {
+				t.Errorf("reset to 300 byte password = %d %+v", status, resp)
+			}
+			if _, resp := admin.do(http.MethodPost, tomPath+"/password", gin.H{"password": "abcdef"}); resp.Code != 0 {
+				t.Fatalf("reset password = %+v", resp)
+			}
+			if _, resp := tom.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "123456"}); resp.Code == 0 {
+				t.Errorf("login with old password = %+v", resp)
+			}
+			if _, resp := tom.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "abcdef"}); resp.Code != 0 {
+				t.Errorf("login with new password = %+v", resp)
+			}
+		})
+	}
+}
+
+func TestServer_accountStatus(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			admin := newTestClient(t, s)
+			admin.login("admin")
+			account, _ := s.accounts.GetByName("admin")
+			if err := s.accounts.UpdateRole(account.Uid, RoleAdmin); err != nil {
+				t.Fatalf("UpdateRole() err = %v", err)
+			}
+			_, resp := admin.do(http.MethodPost, "/login", AuthParam{Name: "admin", Password: "123456"})
+			var pair TokenPair
+			decode(t, resp.Data, &pair)
+			admin.token = pair.Token
+			tom := &testClient{t: t, r: admin.r}
+			tomPair := tom.login("tom")
+			tomAccount, _ := s.accounts.GetByName("tom")
+			tomPath := "/api/admin/accounts/" + strconv.FormatInt(tomAccount.Uid, 10)
+
+			// 锁定之后 token 和 refresh token 都不能用了，也不能登录
+			_, resp = admin.do(http.MethodPut, tomPath+"/status", gin.H{"status": "locked", "reason": "异地登录"})
+			var detail AdminAccount
+			decode(t, resp.Data, &detail)
+			if detail.Status != AccountLocked || detail.StatusReason != "异地登录" || detail.StatusChangedAt == nil {
+				t.Fatalf("lock = %+v", resp)
+			}
+			if status, _ := tom.do(http.MethodGet, "/api/v1/todo", nil); status != http.StatusUnauthorized {
+				t.Errorf("list todo after lock = %d", status)
+			}
+			if status, resp := tom.do(http.MethodPost, "/token/refresh", RefreshParam{RefreshToken: tomPair.RefreshToken}); status == http.StatusOK {
+				t.Errorf("refresh after lock = %d %+v", status, resp)
+			}
+			if status, resp := tom.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "123456"}); status != http.StatusForbidden || resp.Error != "account_locked" {
+				t.Errorf("login after lock = %d %+v", status, resp)
+			}
+			// 密码错了不告诉状态
+			if _, resp := tom.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "654321"}); resp.Error != "login_failed" {
+				t.Errorf("login locked with wrong password = %+v", resp)
+			}
+
+			// 不允许的状态变化
+			admin.do(http.MethodPost, tomPath+"/disable", gin.H{"reason": "违规"})
+			if status, resp := admin.do(http.MethodPut, tomPath+"/status", gin.H{"status": "locked"}); status != http.StatusConflict || resp.Error != "status_transition" {
+				t.Errorf("disabled -> locked = %d %+v", status, resp)
+			}
+			if status, _ := admin.do(http.MethodPut, tomPath+"/status", gin.H{"status": "deleted"}); status != http.StatusBadRequest {
+				t.Errorf("unknown status = %d", status)
+			}
+			_, resp = admin.do(http.MethodPost, tomPath+"/enable", gin.H{"reason": "申诉通过"})
+			decode(t, resp.Data, &detail)
+			if detail.Status != AccountActive {
+				t.Errorf("enable = %+v", resp)
+			}
+			_, resp = tom.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "123456"})
+			var relogged TokenPair
+			decode(t, resp.Data, &relogged)
+			if resp.Code != 0 {
+				t.Errorf("login after enable = %+v", resp)
+			}
+			// 启用之后马上登录，和禁用的时候吊销 token 在同一秒，新 token 也能用
+			relogin := &testClient{t: t, r: tom.r, token: relogged.Token}
+			if _, resp := relogin.do(http.MethodGet, "/api/v1/todo", nil); resp.Code != 0 {
+				t.Errorf("token right after enable = %+v", resp)
+			}
+
+			// 每次变化都有记录，最近的在前面
+			_, resp = admin.do(http.MethodGet, tomPath+"/status", nil)
+			var changes []AccountStatusChange
+			decode(t, resp.Data, &changes)
+			want := [][2]string{{AccountDisabled, AccountActive}, {AccountLocked, AccountDisabled}, {AccountActive, AccountLocked}}
+			if len(changes) != len(want) {
+				t.Fatalf("history = %+v", resp)
+			}
+			for i, w := range want {
+				if changes[i].From != w[0] || changes[i].To != w[1] || changes[i].ActorUid != account.Uid || changes[i].CreatedAt.IsZero() {
+					t.Errorf("history[%d] = %+v, want %s -> %s", i, changes[i], w[0], w[1])
+				}
+			}
+			if changes[0].Reason != "申诉通过" || changes[2].Reason != "异地登录" {
+				t.Errorf("history reasons = %+v", changes)
+			}
+
+			// 要审核的时候新用户是待验证的状态，启用之后才能登录
+			conf.Auth.VerifyRegistration = true
+			defer func() { conf.Auth.VerifyRegistration = false }()
+			jerry := &testClient{t: t, r: admin.r}
+			jerry.do(http.MethodPost, "/register", AuthParam{Name: "jerry", Password: "123456"})
+			if status, resp := jerry.do(http.MethodPost, "/login", AuthParam{Name: "jerry", Password: "123456"}); status != http.StatusForbidden || resp.Error != "account_pending" {
+				t.Errorf("login pending = %d %+v", status, resp)
+			}
+			jerryAccount, _ := s.accounts.GetByName("jerry")
+			admin.do(http.MethodPost, "/api/admin/accounts/"+strconv.FormatInt(jerryAccount.Uid, 10)+"/enable", nil)
+			if _, resp := jerry.do(http.MethodPost, "/login", AuthParam{Name: "jerry", Password: "123456"}); resp.Code != 0 {
+				t.Errorf("login after verified = %+v", resp)
+			}
+		})
+	}
+}
+
+func TestServer_throttle(t *testing.T) {
+	for name, newServer := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			s := newServer(t)
+			tc := newTestClient(t, s)
+			tc.login("tom")
+
+			// 前 3 次失败不限制，之后要等，用户名存不存在返回的都一样
+			for _, name := range []string{"tom", "nobody"} {
+				for i := 0; i < 4; i++ {
+					if status, resp := tc.do(http.MethodPost, "/login", AuthParam{Name: name, Password: "654321"}); status != http.StatusUnauthorized || resp.Error != "login_failed" {
+						t.Fatalf("%s login failure %d = %d %+v", name, i+1, status, resp)
+					}
+				}
+			}
+			var bodies []string
+			for _, name := range []string{"tom", "nobody"} {
+				req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"name":"`+name+`","password":"123456"}`))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				tc.r.ServeHTTP(w, req)
+				if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+					t.Errorf("%s login after failures = %d %q", name, w.Code, w.Header().Get("Retry-After"))
+				}
+				bodies = append(bodies, w.Body.String())
+			}
+			if bodies[0] != bodies[1] {
+				t.Errorf("throttled responses differ: %s, %s", bodies[0], bodies[1])
+			}
+
+			// 到了上限就锁定，密码对了也不行
+			for i := 0; i < conf.Auth.LoginMaxFailures; i++ {
+				s.attempts.Incr(loginNameKey("tom"), conf.Auth.LoginLockout)
+			}
+			if status, _ := tc.do(http.MethodPost, "/login", AuthParam{Name: "Tom", Password: "123456"}); status != http.StatusTooManyRequests {
+				t.Errorf("login after lockout = %d", status)
+			}
+			// 锁定以后再试不延长锁定时间，只算 ip 的
+			locked, _ := s.attempts.Get(loginNameKey("tom"))
+			ipBefore, _ := s.attempts.Get(loginIPKey("192.0.2.1"))
+			time.Sleep(5 * time.Millisecond)
+			for i := 0; i < 3; i++ {
+				if status, _ := tc.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "654321"}); status != http.StatusTooManyRequests {
+					t.Errorf("login %d during lockout = %d", i, status)
+				}
+			}
+			if a, _ := s.attempts.Get(loginNameKey("tom")); a.Count != locked.Count || !a.Last.Equal(locked.Last) {
+				t.Errorf("name attempts during lockout = %+v, want %+v", a, locked)
+			}
+			if a, _ := s.attempts.Get(loginIPKey("192.0.2.1")); a.Count != ipBefore.Count+3 {
+				t.Errorf("ip attempts during lockout = %+v, before %+v", a, ipBefore)
+			}
+			// 登录成功之后清零
+			s.attempts.Reset(loginNameKey("tom"))
+			s.attempts.Reset(loginIPKey("192.0.2.1"))
+			if _, resp := tc.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "123456"}); resp.Code != 0 {
+				t.Fatalf("login after reset = %+v", resp)
+			}
+			if a, _ := s.attempts.Get(loginNameKey("tom")); a.Count != 0 {
+				t.Errorf("attempts after login = %+v", a)
+			}
+
+			// 同时发很多个请求，先计数再判断，不会都能试一次密码
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			codes := map[int]int{}
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					status, _ := tc.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "654321"})
+					mu.Lock()
+					codes[status]++
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			if codes[http.StatusUnauthorized] != 4 || codes[http.StatusTooManyRequests] != 4 {
+				t.Errorf("concurrent login failures = %v", codes)
+			}
+			s.attempts.Reset(loginNameKey("tom"))
+			s.attempts.Reset(loginIPKey("192.0.2.1"))
+
+			// 同一个 ip 换着用户名试也会被限制，每次换一个 X-Forwarded-For 也没用，没配置信任的代理只看连接的地址
+			old := conf.Auth.LoginIPMaxFailures
+			conf.Auth.LoginIPMaxFailures = 3
+			defer func() { conf.Auth.LoginIPMaxFailures = old }()
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"name":"user`+strconv.Itoa(i)+`","password":"123456"}`))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-Forwarded-For", "203.0.113."+strconv.Itoa(i))
+				req.Header.Set("X-Real-IP", "203.0.113."+strconv.Itoa(i))
+				w := httptest.NewRecorder()
+				tc.r.ServeHTTP(w, req)
+				if want := map[bool]int{true: http.StatusTooManyRequests, false: http.StatusUnauthorized}[i == 2]; w.Code != want {
+					t.Errorf("login %d with spoofed ip = %d, want %d", i, w.Code, want)
+				}
+			}
+			// 被拒绝的那次也算
+			if a, _ := s.attempts.Get(loginIPKey("192.0.2.1")); a.Count != 3 {
+				t.Errorf("ip attempts = %+v", a)
+			}
+			if status, _ := tc.do(http.MethodPost, "/login", AuthParam{Name: "tom", Password: "123456"}); status != http.StatusTooManyRequests {
+				t.Errorf("login after ip lockout = %d", status)
+			}
+
+			// 同一个 ip 注册次数有限制
+			oldLimit := conf.Auth.RegisterIPLimit
+			conf.Auth.RegisterIPLimit = 3
+			defer func() { conf.Auth.RegisterIPLimit = oldLimit }()
+			for i := 0; i < 2; i++ {
+				if _, resp := tc.do(http.MethodPost, "/register", AuthParam{Name: "user" + strconv.Itoa(i), Password: "123456"}); resp.Code != 0 {
+					t.Errorf("register %d = %+v", i, resp)
+				}
+			}
+			// 注册次数按自己的窗口算，不是登录的锁定时间
+			oldWindow := conf.Auth.RegisterIPWindow
+			conf.Auth.RegisterIPWindow = 2 * time.Hour
+			defer func() { conf.Auth.RegisterIPWindow = oldWindow }()
+			req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"name":"spike","password":"123456"}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			tc.r.ServeHTTP(w, req)
+			if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "7200" || !strings.Contains(w.Body.String(), "too_many_attempts") {
+				t.Errorf("register over limit = %d %q %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+			}
+		})
+	}
+}
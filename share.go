@@ -0,0 +1,466 @@
+package main
+
+// 共享清单，把自己的清单共享给别的用户一起用
+//   GET    /api/v1/lists/:id/members              清单的成员，第一个是创建清单的人，清单的成员都能看
+//   POST   /api/v1/lists/:id/members              按用户名邀请 {"username": "jerry", "role": "editor"}，对方接受了才能看到清单
+//                                                  用户名不存在也返回邀请已发送，不能用来试出哪些用户名注册过，邀请了谁在成员列表里看
+//   PUT    /api/v1/lists/:id/members/:member_id   修改成员的权限 {"role": "viewer"}
+//   DELETE /api/v1/lists/:id/members/:member_id   移除成员、撤回邀请，成员自己也可以用这个退出清单
+//   GET    /api/v1/invitations                    别人发给自己、还没处理的邀请
+//   POST   /api/v1/invitations/:id/accept         接受邀请，返回清单
+//   DELETE /api/v1/invitations/:id                拒绝邀请
+//
+// 权限从低到高：
+//   viewer  查看清单和里面的待办事项
+//   editor  还能新建、修改、删除清单里的待办事项
+//   owner   还能给清单改名、邀请和移除成员、修改成员的权限
+// 创建清单的人是 owner，并且只有创建的人能删除清单；收件箱不能共享。邀请的时候对方会收到一条站内信
+//
+// 读写待办事项和清单的 handler 都先用 authorizeTodo、authorizeList 检查权限，拿到数据真正的所有人，
+// Repository 再按所有人的 uid 查询、修改。共享清单里的待办事项不管是谁建的，都属于创建清单的人：
+//   删除之后进的是创建清单的人的回收站
+//   GET /api/v1/todo 不带 list_id 只查自己的待办事项，共享给自己的清单要带上 list_id 查
+//   只能在同一个人的清单之间移动，不能把待办事项从共享清单移到自己的清单里
+//   标签和提醒还是每个人自己的，共享清单里的待办事项上只看得到自己打的标签、自己设的提醒，viewer 也能设
+//   清单的成员都会收到待办事项的事件和 webhook，见 events.go
+// 看不到的清单和待办事项返回不存在，看得到但是权限不够的返回 ErrForbidden
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 清单成员的权限
+const (
+	ListRoleViewer = "viewer"
+	ListRoleEditor = "editor"
+	ListRoleOwner  = "owner"
+)
+
+// listRoleLevel 权限的高低，比较用
+var listRoleLevel = map[string]int{ListRoleViewer: 1, ListRoleEditor: 2, ListRoleOwner: 3}
+
+// 成员的状态
+const (
+	MemberInvited  = "invited" // 邀请了，对方还没接受
+	MemberAccepted = "accepted"
+)
+
+// ListMember 清单成员表，邀请也存在这里，拒绝邀请、移除成员直接删除
+type ListMember struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ListID     uint       `gorm:"not null;default:0;uniqueIndex:idx_list_members_list_uid,priority:1" json:"list_id"`
+	Uid        int64      `gorm:"not null;default:0;uniqueIndex:idx_list_members_list_uid,priority:2;index" json:"-"`
+	Role       string     `gorm:"size:16;not null" json:"role"`
+	Status     string     `gorm:"size:16;not null" json:"status"`
+	InvitedBy  int64      `gorm:"not null;default:0" json:"-"`
+	AcceptedAt *time.Time `json:"accepted_at"`
+
+	Username string `gorm:"-" json:"username"`            // 成员的用户名
+	ListName string `gorm:"-" json:"list_name,omitempty"` // 邀请列表里用
+	Inviter  string `gorm:"-" json:"inviter,omitempty"`   // 邀请人的用户名，邀请列表里用
+}
+
+type InviteParam struct {
+	Username string `json:"username" binding:"required,max=64"`
+	Role     string `json:"role" binding:"required,oneof=viewer editor owner"`
+}
+
+type MemberRoleParam struct {
+	Role string `json:"role" binding:"required,oneof=viewer editor owner"`
+}
+
+// listRole uid 对清单的权限，创建清单的人是 owner，接受了邀请的是邀请时给的权限，都不是返回空字符串
+func (s *Server) listRole(uid int64, list *TodoList) (string, error) {
+	if list.Uid == uid {
+		return ListRoleOwner, nil
+	}
+	m, err := s.members.GetByUser(list.ID, uid)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("members.GetByUser: %w", err)
+	}
+	if m.Status != MemberAccepted {
+		return "", nil
+	}
+	return m.Role, nil
+}
+
+// authorizeList 确认 uid 对清单至少有 need 的权限，返回的清单 Role 是 uid 的权限，list.Uid 是创建清单的人
+func (s *Server) authorizeList(uid int64, id uint, need string) (*TodoList, error) {
+	list, err := s.lists.Find(id)
+	if err != nil {
+		return nil, listError("lists.Find", err)
+	}
+	role, err := s.listRole(uid, list)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		return nil, ErrListNotFound
+	}
+	if listRoleLevel[role] < listRoleLevel[need] {
+		return nil, ErrForbidden
+	}
+	list.Role = role
+	return list, nil
+}
+
+// authorizeTodo 确认 uid 对待办事项所在的清单至少有 need 的权限，返回待办事项，todo.Uid 是它真正的所有人
+func (s *Server) authorizeTodo(uid int64, id uint, need string) (*Todo, error) {
+	todo, err := s.todos.Find(id)
+	if err != nil {
+		return nil, todoError("todos.Find", err)
+	}
+	if todo.Uid == uid {
+		return todo, nil
+	}
+	list, err := s.lists.Find(todo.ListID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrTodoNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lists.Find: %w", err)
+	}
+	role, err := s.listRole(uid, list)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		return nil, ErrTodoNotFound
+	}
+	if listRoleLevel[role] < listRoleLevel[need] {
+		return nil, ErrForbidden
+	}
+	return todo, nil
+}
+
+// listAudience 清单的所有人：创建清单的人和接受了邀请的成员
+func (s *Server) listAudience(owner int64, listID uint) ([]int64, error) {
+	members, err := s.members.ListByList(listID)
+	if err != nil {
+		return nil, fmt.Errorf("members.ListByList: %w", err)
+	}
+	uids := []int64{owner}
+	for _, m := range members {
+		if m.Status == MemberAccepted {
+			uids = append(uids, m.Uid)
+		}
+	}
+	return uids, nil
+}
+
+// username 用户名，账号已经没了返回空字符串
+func (s *Server) username(uid int64) (string, error) {
+	account, err := s.accounts.GetByUid(uid)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("accounts.GetByUid: %w", err)
+	}
+	return account.Name, nil
+}
+
+// listMembersHandler 清单的成员，包括还没接受的邀请
+func (s *Server) listMembersHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	list, err := s.authorizeList(uid, uint(id), ListRoleViewer)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	members, err := s.members.ListByList(list.ID)
+	if err != nil {
+		renderError(c, fmt.Errorf("members.ListByList: %w", err))
+		return
+	}
+	// 创建清单的人不在成员表里，id 为0，不能修改和移除
+	members = append([]ListMember{{
+		CreatedAt: list.CreatedAt,
+		UpdatedAt: list.CreatedAt,
+		ListID:    list.ID,
+		Uid:       list.Uid,
+		Role:      ListRoleOwner,
+		Status:    MemberAccepted,
+	}}, members...)
+	for i := range members {
+		if members[i].Username, err = s.username(members[i].Uid); err != nil {
+			renderError(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: members,
+	})
+}
+
+// inviteMemberHandler 按用户名邀请别人加入清单
+func (s *Server) inviteMemberHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	var param InviteParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	list, err := s.authorizeList(uid, uint(id), ListRoleOwner)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	if list.IsInbox {
+		renderError(c, ErrInboxUnshareable)
+		return
+	}
+	account, err := s.accounts.GetByName(param.Username)
+	if errors.Is(err, ErrNotFound) {
+		// 和邀请成功的响应一样，见 renderInvited
+		renderInvited(c)
+		return
+	}
+	if err != nil {
+		renderError(c, fmt.Errorf("accounts.GetByName: %w", err))
+		return
+	}
+	if account.Uid == list.Uid {
+		renderError(c, ErrMemberExists)
+		return
+	}
+	member := ListMember{ListID: list.ID, Uid: account.Uid, Role: param.Role, Status: MemberInvited, InvitedBy: uid, Username: account.Name}
+	if err := s.members.Create(&member); err != nil {
+		renderError(c, memberError("members.Create", err))
+		return
+	}
+
+	// 站内信发不出去不影响邀请，对方在邀请列表里也能看到
+	inviter, err := s.username(uid)
+	if err == nil {
+		err = s.notifications.Create(&Notification{
+			Uid:   account.Uid,
+			Title: fmt.Sprintf("%s 邀请你加入清单「%s」", inviter, list.Name),
+			Body:  "在邀请列表里接受或者拒绝",
+		})
+	}
+	if err != nil {
+		fmt.Println("inviteMemberHandler notify err:", err)
+	}
+	renderInvited(c)
+}
+
+// renderInvited 邀请的响应，用户名存不存在都一样，不带邀请的内容
+func renderInvited(c *gin.Context) {
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "邀请已发送",
+	})
+}
+
+// updateMemberHandler 修改成员的权限
+func (s *Server) updateMemberHandler(c *gin.Context) {
+	listID, memberID, ok := memberParams(c)
+	if !ok {
+		return
+	}
+	var param MemberRoleParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	list, err := s.authorizeList(uid, listID, ListRoleOwner)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	member, err := s.members.UpdateRole(list.ID, memberID, param.Role)
+	if err != nil {
+		renderError(c, memberError("members.UpdateRole", err))
+		return
+	}
+	if member.Username, err = s.username(member.Uid); err != nil {
+		renderError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: member,
+	})
+}
+
+// removeMemberHandler 移除成员、撤回邀请，owner 可以移除别人，成员可以移除自己(退出清单)
+func (s *Server) removeMemberHandler(c *gin.Context) {
+	listID, memberID, ok := memberParams(c)
+	if !ok {
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	list, err := s.authorizeList(uid, listID, ListRoleViewer)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	member, err := s.members.Get(list.ID, memberID)
+	if err != nil {
+		renderError(c, memberError("members.Get", err))
+		return
+	}
+	if member.Uid != uid && list.Role != ListRoleOwner {
+		renderError(c, ErrForbidden)
+		return
+	}
+	if err := s.members.Delete(list.ID, member.ID); err != nil {
+		renderError(c, memberError("members.Delete", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+	})
+}
+
+// memberParams 解析路由里的清单 id 和成员 id，出错的时候已经返回了错误响应
+func memberParams(c *gin.Context) (uint, uint, bool) {
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return 0, 0, false
+	}
+	memberID, err := strconv.ParseUint(c.Param("member_id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "member_id", Reason: "number"}))
+		return 0, 0, false
+	}
+	return uint(listID), uint(memberID), true
+}
+
+// listInvitationsHandler 发给自己、还没处理的邀请
+func (s *Server) listInvitationsHandler(c *gin.Context) {
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	members, err := s.members.ListByUser(uid, MemberInvited)
+	if err != nil {
+		renderError(c, fmt.Errorf("members.ListByUser: %w", err))
+		return
+	}
+	invitations := make([]ListMember, 0, len(members))
+	for _, m := range members {
+		list, err := s.lists.Find(m.ListID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			renderError(c, fmt.Errorf("lists.Find: %w", err))
+			return
+		}
+		m.ListName = list.Name
+		if m.Inviter, err = s.username(m.InvitedBy); err != nil {
+			renderError(c, err)
+			return
+		}
+		invitations = append(invitations, m)
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: invitations,
+	})
+}
+
+// acceptInvitationHandler 接受邀请，返回清单，之后清单就出现在 GET /api/v1/lists 里了
+func (s *Server) acceptInvitationHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	member, err := s.members.Accept(uid, uint(id), time.Now())
+	if err != nil {
+		renderError(c, invitationError("members.Accept", err))
+		return
+	}
+	list, err := s.lists.Find(member.ListID)
+	if err != nil {
+		renderError(c, listError("lists.Find", err))
+		return
+	}
+	list.Role = member.Role
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: list,
+	})
+}
+
+// declineInvitationHandler 拒绝邀请
+func (s *Server) declineInvitationHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if err := s.members.Decline(uid, uint(id)); err != nil {
+		renderError(c, invitationError("members.Decline", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+	})
+}
+
+// memberError 把 Repository 返回的错误转成返回给前端的错误
+func memberError(op string, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return ErrMemberNotFound
+	case errors.Is(err, ErrDuplicate):
+		return ErrMemberExists
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// invitationError 同 memberError，邀请不存在的错误码不一样
+func invitationError(op string, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvitationNotFound
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
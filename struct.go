@@ -5,4 +5,10 @@ type Resp struct {
 	Code int         `json:"code"`
 	Msg  string      `json:"msg"`
 	Data interface{} `json:"data,omitempty"`	// omitempty代表没有data的话，就省略掉
+	// 分页查询的时候才有，见 todo_query.go
+	NextCursor string `json:"next_cursor,omitempty"` // 下一页的游标，没有下一页的时候不返回
+	Total      *int64 `json:"total,omitempty"`       // 符合条件的总数
+	// 出错的时候才有，见 errors.go
+	Error   string       `json:"error,omitempty"`   // 错误码，比如 invalid_param
+	Details []FieldError `json:"details,omitempty"` // 参数校验失败的字段
 }
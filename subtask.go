@@ -0,0 +1,110 @@
+package main
+
+// 子任务
+// 待办事项下面可以建子任务(清单项)，子任务下面还可以再建，最多 conf.Todo.MaxDepth 层
+//   POST /api/v1/todo {"title": "第一步", "parent_id": 1}  新建子任务，和上级放在同一个清单里
+//   GET  /api/v1/todo?parent_id=1                          查直接子任务
+//   GET  /api/v1/todo?tree=true                            顶层的待办事项，每条带上 children 所有层的子任务
+// 列表里有子任务的待办事项带上 progress，直接子任务完成了几个，比如 {"done": 3, "total": 5}
+// 删除的时候所有层的子任务一起放进回收站，从回收站恢复的时候一起恢复，见 trash.go
+// 上级只能新建的时候指定，不能修改；子任务不能单独移到别的清单，上级移到别的清单的时候所有层的子任务一起移过去
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TodoProgress 子任务完成进度
+type TodoProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// checkParent 确认上级存在并且有 editor 权限，建了子任务之后不超过 conf.Todo.MaxDepth 层，返回上级
+// 子任务和上级属于同一个人，共享清单里的是创建清单的人，见 share.go
+func (s *Server) checkParent(uid int64, parentID uint) (*Todo, error) {
+	parent, err := s.authorizeTodo(uid, parentID, ListRoleEditor)
+	if errors.Is(err, ErrTodoNotFound) {
+		return nil, ErrInvalidParam.WithFields(FieldError{Field: "parent_id", Reason: "exists"})
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 上级在第几层，顶层的是第1层；上级没删除，它上面的也都没删除
+	depth := 1
+	for p := parent; p.ParentID != 0 && depth < conf.Todo.MaxDepth; depth++ {
+		if p, err = s.todos.Get(parent.Uid, p.ParentID); err != nil {
+			return nil, fmt.Errorf("todos.Get: %w", err)
+		}
+	}
+	if depth >= conf.Todo.MaxDepth {
+		return nil, ErrInvalidParam.WithFields(FieldError{Field: "parent_id", Reason: "depth"})
+	}
+	return parent, nil
+}
+
+// loadSubtasks 一层一层查出 roots 所有层的子任务，挂到 Children 上，一层查一次
+func (s *Server) loadSubtasks(uid int64, roots []*Todo) error {
+	for level := roots; len(level) > 0; {
+		byID := make(map[uint]*Todo, len(level))
+		ids := make([]uint, 0, len(level))
+		for _, todo := range level {
+			byID[todo.ID] = todo
+			ids = append(ids, todo.ID)
+		}
+		children, err := s.todos.Children(uid, ids)
+		if err != nil {
+			return fmt.Errorf("todos.Children: %w", err)
+		}
+		level = nil
+		for i := range children {
+			child := &children[i]
+			child.localize()
+			parent := byID[child.ParentID]
+			parent.Children = append(parent.Children, child)
+			level = append(level, child)
+		}
+	}
+	return nil
+}
+
+// fillProgress 给有子任务的待办事项填上 progress，带着 children 的所有层都填
+func (s *Server) fillProgress(uid int64, todos []*Todo) error {
+	all := flattenTodos(todos)
+	ids := make([]uint, 0, len(all))
+	for _, todo := range all {
+		ids = append(ids, todo.ID)
+	}
+	progress, err := s.todos.Progress(uid, ids)
+	if err != nil {
+		return fmt.Errorf("todos.Progress: %w", err)
+	}
+	for _, todo := range all {
+		if p, ok := progress[todo.ID]; ok {
+			todo.Progress = &p
+		}
+	}
+	return nil
+}
+
+// flattenTodos todos 和它们 children 里所有层的待办事项放到一个切片里
+func flattenTodos(todos []*Todo) []*Todo {
+	var all []*Todo
+	for level := todos; len(level) > 0; {
+		all = append(all, level...)
+		var next []*Todo
+		for _, todo := range level {
+			next = append(next, todo.Children...)
+		}
+		level = next
+	}
+	return all
+}
+
+// checkMoveList 子任务跟着上级，不能单独改 list_id，listID 是 targetList 转换之后的
+func checkMoveList(cur *Todo, listID uint) error {
+	if cur.ParentID != 0 && listID != cur.ListID {
+		return ErrInvalidParam.WithFields(FieldError{Field: "list_id", Reason: "subtask"})
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+// 标签，每个用户有自己的一套标签，一个待办事项可以打多个标签，一个标签也可以打在多个待办事项上
+//   GET    /api/v1/tags                     自己所有的标签，按名字排序
+//   POST   /api/v1/tags                     新建标签 {"name": "工作", "color": "#ff4d4f"}，color 不传前端用默认颜色
+//   PUT    /api/v1/tags/:id                 修改名字和颜色，参数和新建一样
+//   DELETE /api/v1/tags/:id                 删除标签，打了这个标签的待办事项都去掉这个标签
+//   GET    /api/v1/todo/:id/tags            待办事项打了哪些标签
+//   PUT    /api/v1/todo/:id/tags/:tag_id    打标签，已经打过了不报错
+//   DELETE /api/v1/todo/:id/tags/:tag_id    去掉标签
+// 打标签、去掉标签返回待办事项现在的所有标签
+// GET /api/v1/todo 返回的每条带上 tags，按标签过滤用 tag 和 tag_mode 参数，见 todo_query.go
+// 共享清单里的待办事项，能看到就能打自己的标签，只看得到自己打的标签，见 share.go
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tag 标签表，同一个用户的标签不能重名
+type Tag struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Uid   int64  `gorm:"not null;default:0;uniqueIndex:idx_tags_uid_name,priority:1" json:"-"`
+	Name  string `gorm:"size:32;not null;uniqueIndex:idx_tags_uid_name,priority:2" json:"name"`
+	Color string `gorm:"size:16;not null;default:''" json:"color"` // #rrggbb 或者 #rgb
+}
+
+// TodoTag 待办事项和标签的关系表，不用数据库外键，删除的时候由 Repository 维护
+type TodoTag struct {
+	TodoID    uint `gorm:"primaryKey;autoIncrement:false"`
+	TagID     uint `gorm:"primaryKey;autoIncrement:false;index"`
+	CreatedAt time.Time
+}
+
+type TagParam struct {
+	Name  string `json:"name" binding:"required,max=32"`
+	Color string `json:"color" binding:"omitempty,hexcolor"`
+}
+
+// listTagsHandler 自己所有的标签
+func (s *Server) listTagsHandler(c *gin.Context) {
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	tags, err := s.tags.List(uid)
+	if err != nil {
+		renderError(c, fmt.Errorf("tags.List: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: tags,
+	})
+}
+
+// createTagHandler 新建标签
+func (s *Server) createTagHandler(c *gin.Context) {
+	var param TagParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	tag := Tag{Uid: uid, Name: param.Name, Color: param.Color}
+	if err := s.tags.Create(&tag); err != nil {
+		renderError(c, tagError("tags.Create", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: tag,
+	})
+}
+
+// updateTagHandler 修改标签的名字和颜色
+func (s *Server) updateTagHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	var param TagParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	tag, err := s.tags.Update(uid, uint(id), param.Name, param.Color)
+	if err != nil {
+		renderError(c, tagError("tags.Update", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: tag,
+	})
+}
+
+// deleteTagHandler 删除标签
+func (s *Server) deleteTagHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if err := s.tags.Delete(uid, uint(id)); err != nil {
+		renderError(c, tagError("tags.Delete", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+	})
+}
+
+// listTodoTagsHandler 待办事项打了哪些标签
+func (s *Server) listTodoTagsHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if _, err := s.authorizeTodo(uid, uint(id), ListRoleViewer); err != nil {
+		renderError(c, err)
+		return
+	}
+	s.renderTodoTags(c, uid, uint(id))
+}
+
+// attachTagHandler 打标签
+func (s *Server) attachTagHandler(c *gin.Context) {
+	s.changeTodoTag(c, s.tags.Attach)
+}
+
+// detachTagHandler 去掉标签
+func (s *Server) detachTagHandler(c *gin.Context) {
+	s.changeTodoTag(c, s.tags.Detach)
+}
+
+// changeTodoTag 确认待办事项看得到、标签是自己的，再打标签或者去掉标签
+func (s *Server) changeTodoTag(c *gin.Context, change func(todoID, tagID uint) error) {
+	todoID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	tagID, err := strconv.ParseUint(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "tag_id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if _, err := s.authorizeTodo(uid, uint(todoID), ListRoleViewer); err != nil {
+		renderError(c, err)
+		return
+	}
+	if _, err := s.tags.Get(uid, uint(tagID)); err != nil {
+		renderError(c, tagError("tags.Get", err))
+		return
+	}
+	if err := change(uint(todoID), uint(tagID)); err != nil {
+		renderError(c, fmt.Errorf("change todo tag: %w", err))
+		return
+	}
+	s.renderTodoTags(c, uid, uint(todoID))
+}
+
+// renderTodoTags 返回待办事项现在的所有标签
+func (s *Server) renderTodoTags(c *gin.Context, uid int64, todoID uint) {
+	tags, err := s.tags.ListByTodos(uid, []uint{todoID})
+	if err != nil {
+		renderError(c, fmt.Errorf("tags.ListByTodos: %w", err))
+		return
+	}
+	data := tags[todoID]
+	if data == nil {
+		data = []Tag{}
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: data,
+	})
+}
+
+// fillTags 给待办事项填上打了的标签，带着 children 的所有层都填
+func (s *Server) fillTags(uid int64, todos []*Todo) error {
+	all := flattenTodos(todos)
+	ids := make([]uint, 0, len(all))
+	for _, todo := range all {
+		ids = append(ids, todo.ID)
+	}
+	tags, err := s.tags.ListByTodos(uid, ids)
+	if err != nil {
+		return fmt.Errorf("tags.ListByTodos: %w", err)
+	}
+	for _, todo := range all {
+		todo.Tags = tags[todo.ID]
+	}
+	return nil
+}
+
+// checkQueryTags 按标签过滤的时候，标签都要是 uid 自己的，见 todo_query.go
+func (s *Server) checkQueryTags(uid int64, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tags, err := s.tags.List(uid)
+	if err != nil {
+		return fmt.Errorf("tags.List: %w", err)
+	}
+	own := make(map[uint]bool, len(tags))
+	for _, tag := range tags {
+		own[tag.ID] = true
+	}
+	for _, id := range ids {
+		if !own[id] {
+			return ErrInvalidParam.WithFields(FieldError{Field: "tag", Reason: "exists"})
+		}
+	}
+	return nil
+}
+
+// tagError 把 Repository 返回的错误转成返回给前端的错误
+func tagError(op string, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return ErrTagNotFound
+	case errors.Is(err, ErrDuplicate):
+		return ErrTagExists
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
@@ -0,0 +1,279 @@
+package main
+
+// 登录和注册的防暴力破解
+// 登录失败按用户名和 ip 分别计数，失败次数少的时候不限制(手滑输错)，多了以后每次失败要等的时间翻倍，
+// 到了上限就锁定 conf.Auth.LoginLockout，锁定期间密码对了也不让登录
+//   用户名：上限 conf.Auth.LoginMaxFailures，防止盯着一个账号猜密码
+//   ip：上限 conf.Auth.LoginIPMaxFailures，防止一个 ip 换着用户名试；同一个出口 ip 后面可能有很多人，上限要大一些
+// 前 1/3 的次数不限制，之后从 1 秒开始翻倍。最后一次失败之后 conf.Auth.LoginLockout 内没有再失败，计数清零
+// 每次登录先计数再判断，而不是先看计数、校验完密码再加一：不然同时发 N 个请求，都能在计数之前通过检查。
+// 所以被拒绝的请求也算一次失败；密码对了用户名的计数清零，ip 的把这次减回去
+// 用户名到了上限锁定以后不再计数，也不延长锁定时间，只算 ip 的：不然别人每隔一会儿试一次，这个账号就一直锁着
+// 用户名的计数不管用户存不存在都一样算，返回的错误也一样，不能用来判断用户名有没有注册过
+// 这里的锁定是临时的，到时间自动解开，不改 Account.Status：改成 locked 要管理员解锁，别人故意输错就能把你锁住
+// 注册按 ip 限制次数，conf.Auth.RegisterIPWindow 内最多 conf.Auth.RegisterIPLimit 次；用户名已存在也返回注册成功，见 auth.go
+// ip 用的是 c.ClientIP()，只有 conf.Server.TrustedProxies 里的反向代理发来的 X-Forwarded-For 才算数，见 server.go
+// 计数存在 AttemptStore 里，多实例部署用 sql 实现，方法都能直接对应到 redis：INCR + EXPIRE / GET / DEL
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 失败次数变多以后，要等的时间从这个开始翻倍
+const loginBaseDelay = time.Second
+
+// Attempts 一个 key 的计数
+type Attempts struct {
+	Count int
+	Last  time.Time // 最后一次计数的时间
+	Prev  time.Time // Incr 返回：这次之前最后一次计数的时间，之前没有计数是零值
+}
+
+// AttemptStore 登录失败、注册次数的计数
+type AttemptStore interface {
+	// Incr 计数加一，返回加完之后的计数；window 内没有再加一，计数清零
+	Incr(key string, window time.Duration) (Attempts, error)
+	// Get 查计数，没有记录或者已经清零了返回零值
+	Get(key string) (Attempts, error)
+	// Decr 计数减一，不会减到 0 以下
+	Decr(key string) error
+	// Reset 清零
+	Reset(key string) error
+}
+
+// ------------------------- 内存实现 -------------------------
+// 只适合单实例部署 和 测试，多实例部署要用 sql 或者 redis 实现
+
+type memoryAttemptStore struct {
+	mu    sync.Mutex
+	items map[string]memoryAttempt
+}
+
+type memoryAttempt struct {
+	Attempts
+	expiresAt time.Time
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	return &memoryAttemptStore{items: make(map[string]memoryAttempt)}
+}
+
+func (s *memoryAttemptStore) Incr(key string, window time.Duration) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	// 顺便清理掉过期的记录
+	for k, v := range s.items {
+		if now.After(v.expiresAt) {
+			delete(s.items, k)
+		}
+	}
+	item := s.items[key]
+	item.Count++
+	item.Prev, item.Last, item.expiresAt = item.Last, now, now.Add(window)
+	s.items[key] = item
+	return item.Attempts, nil
+}
+
+func (s *memoryAttemptStore) Get(key string) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok || time.Now().After(item.expiresAt) {
+		return Attempts{}, nil
+	}
+	item.Prev = time.Time{}
+	return item.Attempts, nil
+}
+
+func (s *memoryAttemptStore) Decr(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item, ok := s.items[key]; ok && item.Count > 0 {
+		item.Count--
+		s.items[key] = item
+	}
+	return nil
+}
+
+func (s *memoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+	return nil
+}
+
+// ------------------------- sql 实现 -------------------------
+
+// LoginAttempt 计数表，key 和 redis 的 key 一样
+type LoginAttempt struct {
+	Key       string    `gorm:"primarykey;size:128"`
+	Count     int       `gorm:"not null;default:0"`
+	LastAt    time.Time `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type sqlAttemptStore struct {
+	db *gorm.DB
+}
+
+func newSQLAttemptStore(db *gorm.DB) *sqlAttemptStore {
+	return &sqlAttemptStore{db: db}
+}
+
+func (s *sqlAttemptStore) Incr(key string, window time.Duration) (Attempts, error) {
+	now := time.Now()
+	var row LoginAttempt
+	var prev time.Time
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// 过期的记录先删掉，这个 key 过期了就从 1 重新开始
+		if err := tx.Where("expires_at < ?", now).Delete(&LoginAttempt{}).Error; err != nil {
+			return err
+		}
+		// 上一次计数的时间，同时来的几个请求可能读到同一个，计数还是在数据库里加的，不会少算
+		var old LoginAttempt
+		err := tx.Where(&LoginAttempt{Key: key}).Limit(1).Find(&old).Error
+		if err != nil {
+			return err
+		}
+		prev = old.LastAt
+		// 不存在就插入，存在就在数据库里加一，多个实例同时失败也不会少算
+		err = tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"count":      gorm.Expr("login_attempts.count + 1"),
+				"last_at":    now,
+				"expires_at": now.Add(window),
+			}),
+		}).Create(&LoginAttempt{Key: key, Count: 1, LastAt: now, ExpiresAt: now.Add(window)}).Error
+		if err != nil {
+			return err
+		}
+		// key 在 mysql 里是关键字，用结构体当条件，让 gorm 按数据库方言加引号
+		return tx.Where(&LoginAttempt{Key: key}).First(&row).Error
+	})
+	if err != nil {
+		return Attempts{}, err
+	}
+	return Attempts{Count: row.Count, Last: row.LastAt, Prev: prev}, nil
+}
+
+func (s *sqlAttemptStore) Get(key string) (Attempts, error) {
+	var row LoginAttempt
+	err := s.db.Where(&LoginAttempt{Key: key}).Where("expires_at > ?", time.Now()).First(&row).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Attempts{}, nil
+		}
+		return Attempts{}, err
+	}
+	return Attempts{Count: row.Count, Last: row.LastAt}, nil
+}
+
+func (s *sqlAttemptStore) Decr(key string) error {
+	return s.db.Model(&LoginAttempt{}).Where(&LoginAttempt{Key: key}).Where("count > 0").
+		Update("count", gorm.Expr("count - 1")).Error
+}
+
+func (s *sqlAttemptStore) Reset(key string) error {
+	return s.db.Where(&LoginAttempt{Key: key}).Delete(&LoginAttempt{}).Error
+}
+
+// ------------------------- 限制规则 -------------------------
+
+func loginNameKey(name string) string {
+	return "login:name:" + strings.ToLower(name)
+}
+
+func loginIPKey(ip string) string {
+	return "login:ip:" + ip
+}
+
+func registerIPKey(ip string) string {
+	return "register:ip:" + ip
+}
+
+// loginDelay 失败了 n 次之后，下一次要等多久，上限是 max 次
+func loginDelay(n, max int) time.Duration {
+	lockout := conf.Auth.LoginLockout
+	if n >= max {
+		return lockout
+	}
+	free := max / 3
+	if n <= free {
+		return 0
+	}
+	d := loginBaseDelay
+	for i := free + 1; i < n && d < lockout; i++ {
+		d *= 2
+	}
+	if d > lockout {
+		d = lockout
+	}
+	return d
+}
+
+// loginAttempt 用户名和 ip 先各记一次失败，再看还要等多久才能试，0 是现在就能试
+// 按这次之前失败了几次、上一次失败的时间算；用户名已经锁定了的只记 ip 的
+func (s *Server) loginAttempt(name, ip string) (time.Duration, error) {
+	var wait time.Duration
+	checks := []struct {
+		key    string
+		max    int
+		freeze bool // 锁定以后不再计数
+	}{
+		{loginNameKey(name), conf.Auth.LoginMaxFailures, true},
+		{loginIPKey(ip), conf.Auth.LoginIPMaxFailures, false},
+	}
+	for _, check := range checks {
+		if check.freeze {
+			// 锁定从到达上限的那次失败开始算，到时间记录就过期了
+			a, err := s.attempts.Get(check.key)
+			if err != nil {
+				return 0, err
+			}
+			if a.Count >= check.max {
+				if d := time.Until(a.Last.Add(conf.Auth.LoginLockout)); d > wait {
+					wait = d
+				}
+				continue
+			}
+		}
+		a, err := s.attempts.Incr(check.key, conf.Auth.LoginLockout)
+		if err != nil {
+			return 0, err
+		}
+		if a.Count <= 1 {
+			continue
+		}
+		if d := time.Until(a.Prev.Add(loginDelay(a.Count-1, check.max))); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// loginSucceeded 登录成功，用户名的计数清零；ip 的只把这次减回去，不清零，不然拿一个自己的账号登录一下就能接着试别人的
+func (s *Server) loginSucceeded(name, ip string) {
+	if err := s.attempts.Reset(loginNameKey(name)); err != nil {
+		fmt.Println("loginSucceeded reset err:", err)
+	}
+	if err := s.attempts.Decr(loginIPKey(ip)); err != nil {
+		fmt.Println("loginSucceeded decr err:", err)
+	}
+}
+
+// renderTooManyAttempts 返回 429，Retry-After 是还要等几秒
+func renderTooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	renderError(c, ErrTooManyAttempts)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_loginDelay(t *testing.T) {
+	old := conf.Auth.LoginLockout
+	conf.Auth.LoginLockout = 15 * time.Minute
+	defer func() { conf.Auth.LoginLockout = old }()
+
+	tests := []struct {
+		n, max int
+		want   time.Duration
+	}{
+		{1, 10, 0},
+		{3, 10, 0},
+		{4, 10, time.Second},
+		{5, 10, 2 * time.Second},
+		{9, 10, 32 * time.Second},
+		{10, 10, 15 * time.Minute},
+		{11, 10, 15 * time.Minute},
+		{34, 100, time.Second},
+		{99, 100, 15 * time.Minute}, // 翻倍超过锁定时间的按锁定时间算
+		{1, 1, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := loginDelay(tt.n, tt.max); got != tt.want {
+			t.Errorf("loginDelay(%d, %d) = %v, want %v", tt.n, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestAttemptStore(t *testing.T) {
+	stores := map[string]func(t *testing.T) AttemptStore{
+		"memory": func(t *testing.T) AttemptStore { return newMemoryAttemptStore() },
+		"sqlite": func(t *testing.T) AttemptStore {
+			conn, err := openDB(DBConfig{Driver: DBDriverSQLite, DSN: ":memory:"})
+			if err != nil {
+				t.Fatalf("openDB() err = %v", err)
+			}
+			if _, err := migrateUp(conn); err != nil {
+				t.Fatalf("migrateUp() err = %v", err)
+			}
+			return newSQLAttemptStore(conn)
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			for i := 1; i <= 3; i++ {
+				a, err := s.Incr("login:name:tom", time.Minute)
+				if err != nil || a.Count != i || a.Last.IsZero() {
+					t.Fatalf("Incr() #%d = %+v, %v", i, a, err)
+				}
+			}
+			if a, err := s.Get("login:name:tom"); err != nil || a.Count != 3 {
+				t.Errorf("Get() = %+v, %v", a, err)
+			}
+			if a, _ := s.Get("login:name:jerry"); a.Count != 0 {
+				t.Errorf("Get() unknown key = %+v", a)
+			}
+			if err := s.Reset("login:name:tom"); err != nil {
+				t.Fatalf("Reset() err = %v", err)
+			}
+			if a, _ := s.Get("login:name:tom"); a.Count != 0 {
+				t.Errorf("Get() after reset = %+v", a)
+			}
+
+			// 过了窗口重新计数
+			s.Incr("login:ip:1.2.3.4", time.Millisecond)
+			time.Sleep(5 * time.Millisecond)
+			if a, _ := s.Get("login:ip:1.2.3.4"); a.Count != 0 {
+				t.Errorf("Get() after window = %+v", a)
+			}
+			if a, _ := s.Incr("login:ip:1.2.3.4", time.Minute); a.Count != 1 {
+				t.Errorf("Incr() after window = %+v", a)
+			}
+		})
+	}
+}
@@ -8,21 +8,35 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// UpdateTodoParam 修改待办事项的参数，只修改传了的字段，前端勾选完成的时候只传 {"id":2,"status": true}
+type UpdateTodoParam struct {
+	ID          uint       `json:"id" binding:"required"`
+	Title       *string    `json:"title" binding:"omitempty,min=1,max=255"`
+	Description *string    `json:"description" binding:"omitempty,max=10000"`
+	Status      *bool      `json:"status"`
+	Priority    *int       `json:"priority" binding:"omitempty,min=0,max=3"`
+	DueAt       *time.Time `json:"due_at"`
+	DueTZ       *string    `json:"due_tz" binding:"omitempty,timezone"`
+	ListID      *uint      `json:"list_id"` // 移到别的清单，传0代表移到收件箱
+	RRule       *string    `json:"rrule" binding:"omitempty,max=255"` // 重复规则，空字符串代表不再重复，见 todo_recur.go
+	Skip        int        `json:"skip" binding:"min=0,max=100"`      // 完成重复的待办事项时，再跳过后面几次
+}
+
 // createTodoHandler 创建
-func createTodoHandler(c *gin.Context) {
+func (s *Server) createTodoHandler(c *gin.Context) {
 	// 3个步骤
 
 	// 1，获取参数 取title字段，比如前端传入json数据 {"title":"计划1"}
 	var todo Todo // 尝试将数据解析到 todo中去，需要将结构体设置json的tag
 	if err := c.ShouldBind(&todo); err != nil {
 		fmt.Println("createTodoHandler 获取参数错误：", err)
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "无效的参数", // 正常情况，不能直接返回错误给前端
-		})
+		renderError(c, bindError(err)) // 正常情况，不能直接返回错误给前端
 		return // 错误就不往后走
 	}
 
@@ -32,42 +46,79 @@ func createTodoHandler(c *gin.Context) {
 	uid := v.(int64)
 	if uid <= 0{
 		// 异常
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "登录异常", // 正常情况，不能直接返回错误给前端
-		})
+		renderError(c, ErrLoginRequired)
 		return
 	}
 
 	todo.Uid = uid
+	// id、创建时间、完成时间、版本号 这些字段是服务端维护的，前端传了也不用
+	todo.Model = gorm.Model{}
+	todo.Version = 0
+	todo.CompletedAt = nil
+	todo.Progress, todo.Children, todo.Tags, todo.Next = nil, nil, nil, nil
+	// 重复的待办事项，见 todo_recur.go
+	todo.Occurrence = 1
+	rule, err := normalizeRRule(todo.RRule)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	todo.RRule = rule
+	if todo.RRule != "" && todo.DueAt == nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "due_at", Reason: "required"}))
+		return
+	}
+	if todo.Status {
+		now := time.Now()
+		todo.CompletedAt = &now
+	}
+	if todo.ParentID != 0 {
+		// 子任务，见 subtask.go，和上级放在同一个清单里
+		parent, err := s.checkParent(uid, todo.ParentID)
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		todo.ListID, todo.Uid = parent.ListID, parent.Uid
+	} else {
+		// 没指定清单的放到收件箱，指定了的要确认有权限往里面放，共享清单里的属于创建清单的人，见 share.go
+		list, err := s.resolveList(uid, todo.ListID)
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		todo.ListID, todo.Uid = list.ID, list.Uid
+	}
 	// 2，处理业务逻辑，新增一条数据
-	if err := db.Create(&todo).Error; err != nil {
-		fmt.Println("db.Create err：", err)
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "服务端异常", // 正常情况，不能直接返回错误给前端
-		})
+	// 新增 和 通知其他页面、共享清单的成员、webhook(见 events.go) 在一个事务里，写发件箱失败了也不新增
+	err = s.inTx(func(tx *Server) error {
+		if err := tx.todos.Create(&todo); err != nil {
+			return fmt.Errorf("todos.Create: %w", err)
+		}
+		todo.localize()
+		return tx.publishTodo(EventTodoCreated, &todo)
+	})
+	if err != nil {
+		renderError(c, err) // 不认识的错误，renderError 打印日志，返回服务端异常
 		return // 错误就不往后走
 	}
 
 	// 3，返回响应
-	c.JSON(200, gin.H{
-		"code": 0,
-		"msg":  "success",
-		//"data":todo,	// 也可以返回数据给前端
+	c.Header("ETag", todoETag(&todo))
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: todo,	// 返回创建好的数据，前端拿到 id 就不用再查一遍
 	})
 }
 
 // updateTodoHandler 修改
-func updateTodoHandler(c *gin.Context) {
+func (s *Server) updateTodoHandler(c *gin.Context) {
 	// 1，获取参数
-	var todo Todo
-	if err := c.ShouldBind(&todo); err != nil {
+	var param UpdateTodoParam
+	if err := c.ShouldBind(&param); err != nil {
 		fmt.Println("updateTodoHandler err：", err)
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "无效的参数",
-		})
+		renderError(c, bindError(err))
 		return
 	}
 
@@ -78,10 +129,7 @@ func updateTodoHandler(c *gin.Context) {
 	// 接口类型要断言
 	uid := v.(int64)
 	if uid <= 0{
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "登录异常，请重新登录", // 正常情况，不能直接返回错误给前端
-		})
+		renderError(c, ErrLoginRequired)
 		return
 	}
 	//// 先将前端传来赋值给 todo对象的id属性， 现在数据库中查询一遍，然后吧数据保存到obj中
@@ -96,87 +144,198 @@ func updateTodoHandler(c *gin.Context) {
 	//}
 
 
-	// 2.2 先检查数据是否存在(根据主键检索)，因为在执行 c.ShouldBind之后，自动吧前端的数据填充到结构体中
-	// 参考：https://gorm.io/zh_CN/docs/query.html#%E7%94%A8%E4%B8%BB%E9%94%AE%E6%A3%80%E7%B4%A2
-	// 这里吧 uid 和 todo.ID 作为联合条件查询
-	var obj Todo
-	if err := db.Where("id = ? and uid = ?",todo.ID, uid).First(&obj).Error; err != nil {
-		// 返回2种错误的第1种： 没有这条记录的错误，通过 errors.Is 断言递归查找错误类型是否是 gorm.ErrRecordNotFound
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(200, gin.H{
-				"code": 1,
-				"msg":  "无效的参数",
-			})
-			return
-		}
-		// 返回2种错误的第2种： 其他错误
-		fmt.Println("updateTodoHandler db.Save err：", err)
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "服务端异常，请稍后再试", // 正常情况，不能直接返回错误给前端
-		})
+	// 带了 If-Match 请求头的，版本号对得上才修改，防止两个页面互相覆盖
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	// 共享清单里的待办事项要有 editor 权限，后面都按它真正的所有人修改，见 share.go
+	cur, err := s.authorizeTodo(uid, param.ID, ListRoleEditor)
+	if err != nil {
+		renderError(c, err)
 		return
 	}
+	owner := cur.Uid
 
+	if param.RRule != nil {
+		rule, err := normalizeRRule(*param.RRule)
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		param.RRule = &rule
+	}
+	if param.ListID != nil {
+		listID, err := s.targetList(uid, owner, *param.ListID)
+		if err == nil {
+			err = checkMoveList(cur, listID)
+		}
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		param.ListID = &listID
+	}
 
-	// 验证过有数据后走到这，更新指定的字段"status",.Debug()显示具体执行的sql语句, 例如前端传 {"id":2,"status": true}
-	if err := db.Debug().Model(&todo).Update("status", todo.Status).Error; err != nil {
-		//if err := db.Save(&todo);err != nil{
-		// db.Save更新所有字段，因为gin框架创建的表有很多其他默认带的字段，前端传过来没有gin框架生成的字段和字段的值
-		// 这样会因为gin框架默认字段没有值而报错，所以选择更新指定字段，用 db.Model(&todo).Update("status", todo.Status)
-		fmt.Println("updateTodoHandler db.Save err：", err)
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "服务端异常，请稍后再试", // 正常情况，不能直接返回错误给前端
-		})
+	// 2.2 更新传了的字段, 例如前端传 {"id":2,"status": true} 只改 status
+	// 这里吧 owner 和 todo.ID 作为联合条件，数据不存在 返回 ErrNotFound
+	// 重复的待办事项完成的时候会生成下一次，见 todo_recur.go
+	var todo *Todo
+	err = s.inTx(func(tx *Server) error {
+		var completed bool
+		var err error
+		todo, completed, err = tx.updateTodo(owner, param.ID, version, TodoChanges{
+			Title:       param.Title,
+			Description: param.Description,
+			Status:      param.Status,
+			Priority:    param.Priority,
+			ListID:      param.ListID,
+			SetDueAt:    param.DueAt != nil,
+			DueAt:       param.DueAt,
+			DueTZ:       param.DueTZ,
+			RRule:       param.RRule,
+		}, param.Skip)
+		if err != nil {
+			// 没有这条记录、版本号对不上 和 其他错误，todoError 转成对应的错误返回
+			return todoError("todos.Update", err)
+		}
+		todo.localize()
+		return tx.publishTodo(todoEventType(completed), todo)
+	})
+	if err != nil {
+		renderError(c, err)
 		return
 	}
 
 	// 3，返回响应
-	c.JSON(200, gin.H{
-		"code": 0,
-		"msg":  "success",
+	c.Header("ETag", todoETag(todo))
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: todo,
 	})
 }
 
 // getTodoHandler 查询所有待办事项
-func getTodoHandler(c *gin.Context) {
-	// 1，获取请求参数，由于返回所有数据，就不获取参数
+func (s *Server) getTodoHandler(c *gin.Context) {
+	// 1，获取请求参数，分页、过滤、排序的参数见 todo_query.go
+	q, err := parseTodoQuery(c)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
 	// 2，执行业务逻辑
-	// 根据请求的uid获取全部对象 db.find()，参考 https://gorm.io/zh_CN/docs/query.html#%E6%A3%80%E7%B4%A2%E5%85%A8%E9%83%A8%E5%AF%B9%E8%B1%A1
-	var todos []Todo // todos是Todo类型的切片，如果查询单条数据就是结构体
+	// 根据请求的uid获取全部对象
 	// 2.1 根据从c中获取uid，中间件传的uid，来获取对应uid下的待办事项
 	v,_ := c.Get(CtxUidKey)
 	// 接口类型要断言
 	uid := v.(int64)
 	if uid <= 0{
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "登录异常，请重新登录", // 正常情况，不能直接返回错误给前端
-		})
+		renderError(c, ErrLoginRequired)
 		return
 	}
 
-	// 根据token解析出来的uid查询
-	if err := db.Where("uid = ?",uid).Debug().Find(&todos).Error; err != nil {
-		fmt.Println("getTodoHandler 查询失败:", err)
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "服务端异常，请稍后再试", // 正常情况，不能直接返回错误给前端
-		})
+	// 不带 list_id 只查自己的；带了的要有权限看这个清单，按创建清单的人的 uid 查，见 share.go
+	owner := uid
+	if q.ListID != 0 {
+		list, err := s.authorizeList(uid, q.ListID, ListRoleViewer)
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		owner = list.Uid
+	}
+
+	// 只能按自己的标签过滤，共享清单里也一样，见 share.go
+	if err := s.checkQueryTags(uid, q.Tags); err != nil {
+		renderError(c, err)
+		return
+	}
+	q.TagUid = uid
+
+	// 多查一条，查出来了说明还有下一页
+	limit := q.Limit
+	q.Limit = limit + 1
+	todos, err := s.todos.List(owner, q) // todos是Todo类型的切片，如果查询单条数据就是结构体
+	if err != nil {
+		renderError(c, fmt.Errorf("getTodoHandler 查询失败: %w", err))
+		return
+	}
+	var next string
+	if len(todos) > limit {
+		todos = todos[:limit]
+		next = q.cursorOf(todos[limit-1]).Encode()
+	}
+	items := make([]*Todo, len(todos))
+	for i := range todos {
+		todos[i].localize()
+		items[i] = &todos[i]
+	}
+	// 子任务树和完成进度，见 subtask.go
+	if q.Tree {
+		if err := s.loadSubtasks(owner, items); err != nil {
+			renderError(c, err)
+			return
+		}
+	}
+	if err := s.fillProgress(owner, items); err != nil {
+		renderError(c, err)
+		return
+	}
+	if err := s.fillTags(uid, items); err != nil {
+		renderError(c, err)
+		return
+	}
+	total, err := s.todos.Count(owner, q)
+	if err != nil {
+		renderError(c, fmt.Errorf("getTodoHandler 查询总数失败: %w", err))
 		return
 	}
 
 	// 3，返回响应
-	c.JSON(200, gin.H{
-		"code": 0,
-		"msg":  "success",
-		"data": todos, // 返回的大量字段，有不想返回给前端的，需要添加tag，修改结构体字段后面 json:"-"
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: todos, // 返回的大量字段，有不想返回给前端的，需要添加tag，修改结构体字段后面 json:"-"
+		NextCursor: next,
+		Total: &total,
+	})
+}
+
+// getTodoByIDHandler 查询一条待办事项，响应头带 ETag，修改的时候放到 If-Match 里
+func (s *Server) getTodoByIDHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	todo, err := s.authorizeTodo(uid, uint(id), ListRoleViewer)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	etag := todoETag(todo)
+	c.Header("ETag", etag)
+	// 前端缓存的还是最新的，不用再返回一遍
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	todo.localize()
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: todo,
 	})
 }
 
 // deleteTodoHandler 删除
-func deleteTodoHandler(c *gin.Context) {
+func (s *Server) deleteTodoHandler(c *gin.Context) {
 	// 获取参数
 	// 前端执行delete方式，url是参数在url里面  http://127.0.0.1:8888/api/v1/todo/1
 	idStr := c.Param("id") // 从 路由的 /todo/:id 获取id
@@ -184,10 +343,8 @@ func deleteTodoHandler(c *gin.Context) {
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		fmt.Println("deleteTodoHandler err:", err)
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "无效的参数",
-		})
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
 	}
 
 	// 业务逻辑
@@ -196,48 +353,90 @@ func deleteTodoHandler(c *gin.Context) {
 	// 接口类型要断言
 	uid := v.(int64)
 	if uid <= 0{
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "登录异常，请重新登录", // 正常情况，不能直接返回错误给前端
-		})
-		return
-	}
-
-	// 2.2先根据这个id查一下有没有这条记录
-	// 这里改为联合条件查询
-	var obj Todo
-	if err := db.Debug().Where("id = ? and uid = ?", id, uid).First(&obj).Error; err != nil {
-		// 返回2种错误的第1种： 没有这条记录的错误，通过 errors.Is 断言递归查找错误类型是否是 gorm.ErrRecordNotFound
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(200, gin.H{
-				"code": 1,
-				"msg":  "无效的参数",
-			})
-			return
-		}
-		// 返回2种错误的第2种： 其他错误
-		fmt.Println("deleteTodoHandler db.First err：", err)
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "服务端异常，请稍后再试", // 正常情况，不能直接返回错误给前端
-		})
+		renderError(c, ErrLoginRequired)
+		return
+	}
+
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		renderError(c, err)
 		return
 	}
 
-	// 根据主键删除数据，参考 https://gorm.io/zh_CN/docs/delete.html#%E6%A0%B9%E6%8D%AE%E4%B8%BB%E9%94%AE%E5%88%A0%E9%99%A4
+	// 共享清单里的待办事项要有 editor 权限，见 share.go
+	todo, err := s.authorizeTodo(uid, uint(id), ListRoleEditor)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	// 2.2 根据 id 和 所有人的uid 联合条件删除，没有这条记录 返回 ErrNotFound
 	// 删除是 软删除，给删除的字段添加标记，代表删除，但是数据还在数据库中，只是返回前端代表没有这个数据了
-	if err := db.Delete(&obj, id).Error; err != nil {
-		c.JSON(200, gin.H{
-			"code": 1,
-			"msg":  "服务端异常，请稍后再试", // 正常情况，不能直接返回错误给前端
-		})
+	err = s.inTx(func(tx *Server) error {
+		if err := tx.todos.Delete(todo.Uid, uint(id), version); err != nil {
+			return todoError("todos.Delete", err)
+		}
+		return tx.publishList(todo.Uid, todo.ListID, EventTodoDeleted, gin.H{"id": id})
+	})
+	if err != nil {
+		renderError(c, err)
 		return
 	}
 
 	// 返回响应
-	c.JSON(200, gin.H{
-		"code": 0,
-		"msg":  "success",
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
 	})
 }
 
+
+// localize 截止时间按 due_tz 的时区返回，数据库读出来的是服务器的时区
+func (t *Todo) localize() {
+	if t.DueAt == nil || t.DueTZ == "" {
+		return
+	}
+	if loc, err := time.LoadLocation(t.DueTZ); err == nil {
+		due := t.DueAt.In(loc)
+		t.DueAt = &due
+	}
+}
+
+// todoError 把 Repository 返回的错误转成返回给前端的错误，op 是出错的操作，打日志用
+func todoError(op string, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return ErrTodoNotFound
+	case errors.Is(err, ErrConflict):
+		return ErrPreconditionFailed
+	case errors.Is(err, ErrParentDeleted):
+		return ErrTodoParentDeleted
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// todoETag 用版本号当 ETag，每次修改版本号都会变
+func todoETag(t *Todo) string {
+	return `"` + strconv.Itoa(t.Version) + `"`
+}
+
+// ifMatchVersion 从请求头 If-Match 里取出要求的版本号
+// 没传 或者 传的是 * 返回0，代表不检查版本号；只支持一个 ETag
+// 弱 ETag(W/"1") 按 RFC 7232 不能用来比较，和格式不对的一样当作对不上，返回 ErrPreconditionFailed
+func ifMatchVersion(c *gin.Context) (int, error) {
+	v := strings.TrimSpace(c.GetHeader("If-Match"))
+	if v == "" || v == "*" {
+		return 0, nil
+	}
+	if strings.Contains(v, ",") {
+		return 0, ErrInvalidParam.WithFields(FieldError{Field: "If-Match", Reason: "single"})
+	}
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return 0, ErrPreconditionFailed
+	}
+	version, err := strconv.Atoi(v[1 : len(v)-1])
+	if err != nil || version < 1 {
+		return 0, ErrPreconditionFailed
+	}
+	return version, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+// 清单(项目)，待办事项都属于某个清单
+//   GET    /api/v1/lists      自己所有的清单，收件箱排第一个，后面是共享给自己的清单，每个带上自己的权限 role
+//   POST   /api/v1/lists      新建清单 {"name": "工作"}
+//   GET    /api/v1/lists/:id  查询一个清单
+//   PUT    /api/v1/lists/:id  改名 {"name": "生活"}
+//   DELETE /api/v1/lists/:id  删除清单，里面的待办事项(包括回收站里的)移到收件箱
+// 每个用户注册的时候自动创建一个收件箱，新建待办事项不指定 list_id 的放到收件箱，收件箱不能删除
+// 待办事项换清单：PUT /api/v1/todo 或者 PATCH /api/v1/todo/:id 传 list_id
+// 查某个清单下的待办事项：GET /api/v1/todo?list_id=1
+// 清单可以共享给别人，改名要 owner 权限，删除只能是创建清单的人，见 share.go
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// InboxName 收件箱的默认名字
+const InboxName = "收件箱"
+
+// TodoList 清单表
+type TodoList struct {
+	ID        uint           `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+
+	Uid     int64  `gorm:"not null;default:0;index" json:"-"`
+	Name    string `gorm:"size:64;not null" json:"name"`
+	IsInbox bool   `gorm:"not null;default:false" json:"is_inbox"` // 收件箱，每个用户只有一个
+
+	Role string `gorm:"-" json:"role,omitempty"` // 当前用户的权限，见 share.go
+}
+
+type TodoListParam struct {
+	Name string `json:"name" binding:"required,max=64"`
+}
+
+// listListsHandler 自己所有的清单和共享给自己的清单
+func (s *Server) listListsHandler(c *gin.Context) {
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+	// 老用户可能还没有收件箱，先建上
+	if _, err := s.inbox(uid); err != nil {
+		renderError(c, err)
+		return
+	}
+	lists, err := s.lists.List(uid)
+	if err != nil {
+		renderError(c, fmt.Errorf("lists.List: %w", err))
+		return
+	}
+	for i := range lists {
+		lists[i].Role = ListRoleOwner
+	}
+	members, err := s.members.ListByUser(uid, MemberAccepted)
+	if err != nil {
+		renderError(c, fmt.Errorf("members.ListByUser: %w", err))
+		return
+	}
+	for _, m := range members {
+		list, err := s.lists.Find(m.ListID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			renderError(c, fmt.Errorf("lists.Find: %w", err))
+			return
+		}
+		list.Role = m.Role
+		lists = append(lists, *list)
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: lists,
+	})
+}
+
+// createListHandler 新建清单
+func (s *Server) createListHandler(c *gin.Context) {
+	var param TodoListParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	list := TodoList{Uid: uid, Name: param.Name, Role: ListRoleOwner}
+	if err := s.lists.Create(&list); err != nil {
+		renderError(c, fmt.Errorf("lists.Create: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: list,
+	})
+}
+
+// getListHandler 查询一个清单
+func (s *Server) getListHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	list, err := s.authorizeList(uid, uint(id), ListRoleViewer)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: list,
+	})
+}
+
+// updateListHandler 清单改名
+func (s *Server) updateListHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	var param TodoListParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	list, err := s.authorizeList(uid, uint(id), ListRoleOwner)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	role := list.Role
+	if list, err = s.lists.Rename(list.Uid, list.ID, param.Name); err != nil {
+		renderError(c, listError("lists.Rename", err))
+		return
+	}
+	list.Role = role
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: list,
+	})
+}
+
+// deleteListHandler 删除清单，里面的待办事项移到收件箱
+func (s *Server) deleteListHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	list, err := s.authorizeList(uid, uint(id), ListRoleOwner)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	// 待办事项要移到创建清单的人的收件箱，只有创建的人能删除
+	if list.Uid != uid {
+		renderError(c, ErrForbidden)
+		return
+	}
+	if list.IsInbox {
+		renderError(c, ErrInboxUndeletable)
+		return
+	}
+	inbox, err := s.inbox(uid)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	// 先把待办事项移走再删清单，中间失败了重试一次就行，不会丢数据
+	if _, err := s.todos.MoveList(uid, list.ID, inbox.ID); err != nil {
+		renderError(c, fmt.Errorf("todos.MoveList: %w", err))
+		return
+	}
+	if err := s.lists.Delete(uid, list.ID); err != nil {
+		renderError(c, listError("lists.Delete", err))
+		return
+	}
+	if err := s.members.DeleteByList(list.ID); err != nil {
+		renderError(c, fmt.Errorf("members.DeleteByList: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+	})
+}
+
+// inbox 用户的收件箱，没有就建一个
+// 注册的时候会建收件箱，migration 也给老用户建好了，这里只是兜底
+// 一个用户只能有一个收件箱(唯一索引)，同时建的时候没建成的再查一遍别人建好的
+func (s *Server) inbox(uid int64) (*TodoList, error) {
+	list, err := s.lists.GetInbox(uid)
+	if errors.Is(err, ErrNotFound) {
+		list = &TodoList{Uid: uid, Name: InboxName, IsInbox: true}
+		err = s.lists.Create(list)
+		if errors.Is(err, ErrDuplicate) {
+			list, err = s.lists.GetInbox(uid)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inbox: %w", err)
+	}
+	return list, nil
+}
+
+// resolveList 确认待办事项要放进的清单存在并且有 editor 权限，id 为0的时候用自己的收件箱
+// 共享清单里的待办事项属于创建清单的人，list.Uid 就是待办事项的 uid
+func (s *Server) resolveList(uid int64, id uint) (*TodoList, error) {
+	if id == 0 {
+		return s.inbox(uid)
+	}
+	list, err := s.authorizeList(uid, id, ListRoleEditor)
+	if errors.Is(err, ErrListNotFound) {
+		return nil, ErrInvalidParam.WithFields(FieldError{Field: "list_id", Reason: "exists"})
+	}
+	return list, err
+}
+
+// targetList 修改待办事项的清单，只能在同一个人的清单之间移动，owner 是待办事项的 uid
+func (s *Server) targetList(uid, owner int64, id uint) (uint, error) {
+	list, err := s.resolveList(uid, id)
+	if err != nil {
+		return 0, err
+	}
+	if list.Uid != owner {
+		return 0, ErrInvalidParam.WithFields(FieldError{Field: "list_id", Reason: "owner"})
+	}
+	return list.ID, nil
+}
+
+// listError 把 Repository 返回的错误转成返回给前端的错误
+func listError(op string, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return ErrListNotFound
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
@@ -0,0 +1,219 @@
+package main
+
+// PATCH /api/v1/todo/:id 部分修改待办事项，按 JSON Merge Patch(RFC 7396) 的规则：
+//   传了的字段才修改，没传的不动
+//   字段传 null 代表清空：due_at 去掉截止时间，description、due_tz 变成空字符串，priority 变成 0
+//   title、status 不能为空，传 null 报参数错误
+//   id、completed_at、CreatedAt 这些服务端维护的字段和 parent_id 不能改，传了报参数错误，不会悄悄忽略
+//   list_id 不能为 null，传0代表移到收件箱
+//   rrule 传 null 代表不再重复，见 todo_recur.go
+// 例如 {"title": "新标题", "due_at": null} 改标题，同时去掉截止时间
+// 修改成功返回修改后的完整数据
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// MIMEMergePatchJSON JSON Merge Patch 的 Content-Type，普通的 application/json 也可以
+const MIMEMergePatchJSON = "application/merge-patch+json"
+
+// maxPatchBody 请求体最大多少字节，description 最长 10000 个字，留足余量
+const maxPatchBody = 1 << 20
+
+// patchTodoHandler 部分修改
+func (s *Server) patchTodoHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	ct, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if ct != MIMEMergePatchJSON && ct != binding.MIMEJSON {
+		renderError(c, ErrUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPatchBody+1))
+	if err != nil || len(body) > maxPatchBody {
+		renderError(c, ErrInvalidParam)
+		return
+	}
+	ch, err := parseTodoPatch(body)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	// 带了 If-Match 的，版本号对得上才修改
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+	// 共享清单里的待办事项要有 editor 权限，按它真正的所有人修改，见 share.go
+	cur, err := s.authorizeTodo(uid, uint(id), ListRoleEditor)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	if ch.ListID != nil {
+		listID, err := s.targetList(uid, cur.Uid, *ch.ListID)
+		if err == nil {
+			err = checkMoveList(cur, listID)
+		}
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		ch.ListID = &listID
+	}
+	var todo *Todo
+	err = s.inTx(func(tx *Server) error {
+		var completed bool
+		var err error
+		todo, completed, err = tx.updateTodo(cur.Uid, uint(id), version, ch, 0)
+		if err != nil {
+			return todoError("todos.Update", err)
+		}
+		todo.localize()
+		return tx.publishTodo(todoEventType(completed), todo)
+	})
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	c.Header("ETag", todoETag(todo))
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: todo,
+	})
+}
+
+// todoReadonlyFields 服务端维护的字段，不能通过 PATCH 修改
+var todoReadonlyFields = map[string]bool{
+	"id": true, "ID": true, "CreatedAt": true, "UpdatedAt": true, "DeletedAt": true,
+	"completed_at": true, "uid": true, "Uid": true, "version": true, "parent_id": true,
+	"progress": true, "children": true, "tags": true, "occurrence": true, "next": true,
+}
+
+// parseTodoPatch 把 merge patch 请求体转成 TodoChanges，每个字段单独校验，有问题的字段都放到 FieldError 里一起返回
+func parseTodoPatch(body []byte) (TodoChanges, error) {
+	var ch TodoChanges
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		// 不是 json 对象
+		return ch, ErrInvalidParam
+	}
+
+	var fields []FieldError
+	invalid := func(field, reason string) {
+		fields = append(fields, FieldError{Field: field, Reason: reason})
+	}
+	for key, raw := range patch {
+		isNull := bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+		switch key {
+		case "title":
+			var title string
+			if isNull || json.Unmarshal(raw, &title) != nil {
+				invalid(key, "string")
+			} else if !validVar(title, "min=1,max=255") {
+				invalid(key, "max")
+			} else {
+				ch.Title = &title
+			}
+		case "description":
+			var desc string // null 的时候是空字符串
+			if !isNull && json.Unmarshal(raw, &desc) != nil {
+				invalid(key, "string")
+			} else if !validVar(desc, "max=10000") {
+				invalid(key, "max")
+			} else {
+				ch.Description = &desc
+			}
+		case "status":
+			var status bool
+			if isNull || json.Unmarshal(raw, &status) != nil {
+				invalid(key, "bool")
+			} else {
+				ch.Status = &status
+			}
+		case "priority":
+			var priority int // null 的时候是 PriorityNone
+			if !isNull && json.Unmarshal(raw, &priority) != nil {
+				invalid(key, "number")
+			} else if priority < PriorityNone || priority > PriorityHigh {
+				invalid(key, "max")
+			} else {
+				ch.Priority = &priority
+			}
+		case "due_at":
+			ch.SetDueAt = true
+			if !isNull {
+				var due time.Time
+				if err := json.Unmarshal(raw, &due); err != nil {
+					invalid(key, "datetime")
+				} else {
+					ch.DueAt = &due
+				}
+			}
+		case "due_tz":
+			var tz string // null 的时候是空字符串
+			if !isNull && json.Unmarshal(raw, &tz) != nil {
+				invalid(key, "string")
+			} else if tz != "" && !validVar(tz, "timezone") {
+				invalid(key, "timezone")
+			} else {
+				ch.DueTZ = &tz
+			}
+		case "rrule":
+			var rule string // null 的时候是空字符串，不再重复
+			if !isNull && json.Unmarshal(raw, &rule) != nil {
+				invalid(key, "string")
+			} else if rule, err := normalizeRRule(rule); err != nil {
+				invalid(key, "rrule")
+			} else {
+				ch.RRule = &rule
+			}
+		case "list_id":
+			var listID uint
+			if isNull || json.Unmarshal(raw, &listID) != nil {
+				invalid(key, "number")
+			} else {
+				ch.ListID = &listID
+			}
+		default:
+			if todoReadonlyFields[key] {
+				invalid(key, "readonly")
+			} else {
+				invalid(key, "unknown")
+			}
+		}
+	}
+	if len(fields) > 0 {
+		// map 是无序的，按字段名排一下，每次返回的顺序一样
+		sortFieldErrors(fields)
+		return ch, ErrInvalidParam.WithFields(fields...)
+	}
+	return ch, nil
+}
+
+// validVar 用 binding 注册的校验器校验单个值，tag 和结构体上的 binding 写法一样
+func validVar(v interface{}, tag string) bool {
+	if validate, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		return validate.Var(v, tag) == nil
+	}
+	return true
+}
@@ -0,0 +1,357 @@
+package main
+
+// GET /api/v1/todo 的分页、过滤和排序
+// 以前一次把用户所有的待办事项都查出来，数据多的用户很慢，现在按游标(cursor)分页
+//
+// 请求参数，都是可选的：
+//   limit           每页多少条，默认 100，最多 500
+//   cursor          上一页返回的 next_cursor，原样传回来就行，不要自己拼
+//   status          true / false，按完成状态过滤
+//   title           标题包含这个字符串
+//   created_after   创建时间 >= 这个时间，RFC3339 格式，比如 2022-05-01T00:00:00+08:00
+//   created_before  创建时间 < 这个时间
+//   updated_after   修改时间 >= 这个时间
+//   updated_before  修改时间 < 这个时间
+//   due_after       截止时间 >= 这个时间，没有截止时间的不会查出来
+//   due_before      截止时间 < 这个时间
+//   list_id         清单 id，只查这个清单下的
+//   parent_id       上级待办事项 id，只查它的直接子任务，0 代表只查顶层的
+//   tag             标签 id，多个用逗号隔开，比如 tag=1,2，默认打了其中一个标签的都查出来；只能是自己的标签，不然返回参数错误
+//   tag_mode        or 或者 and，and 的时候要 tag 里的标签全都打了才查出来，默认 or
+//   tree            true 的时候不传 parent_id 就只查顶层的，分页、过滤、总数都按这一层算，
+//                   每条带上 children 所有层的子任务，见 subtask.go
+//   priority        优先级 0-3，多个用逗号隔开，比如 priority=2,3
+//   sort            排序字段 id、created_at、updated_at、due_at、completed_at、priority，前面加 - 代表倒序，默认 id
+//                   due_at、completed_at 为空的排在最后面(倒序的时候在最前面)
+//
+// 响应里 data 还是数组，另外带上 next_cursor(没有下一页的时候不返回) 和 total(符合过滤条件的总数)
+//
+// 游标分页不用 offset：记住上一页最后一条的 排序字段值 和 id，下一页从它后面开始查，
+// 翻到多少页都走索引，中间插入、删除数据也不会重复或者漏掉
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 排序字段，和数据库的列名一致
+const (
+	TodoSortID          = "id"
+	TodoSortCreatedAt   = "created_at"
+	TodoSortUpdatedAt   = "updated_at"
+	TodoSortDueAt       = "due_at"
+	TodoSortCompletedAt = "completed_at"
+	TodoSortPriority    = "priority"
+)
+
+// todoSortNullTime due_at、completed_at 为空的时候按这个时间排序，排在所有时间后面
+var todoSortNullTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+const (
+	defaultTodoLimit = 100
+	maxTodoLimit     = 500
+)
+
+// TodoQuery 查询待办事项的条件
+type TodoQuery struct {
+	Status        *bool  // 为空不过滤
+	Title         string // 标题包含
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	DueAfter      time.Time
+	DueBefore     time.Time
+	Priorities    []int  // 为空不过滤
+	ListID        uint   // 为0不过滤
+	ParentID      *uint  // 为空不过滤，0 代表只查顶层的
+	Tree          bool   // 返回子任务树，不影响查询条件，handler 用
+	Tags          []uint // 标签 id，没有重复的，为空不过滤
+	TagsAll       bool   // 为 true 要全部标签都打了，否则打了其中一个就行
+	TagUid        int64  // 查询的人，只认他自己的标签，共享清单里别人的标签不能拿来过滤，见 share.go
+
+	Sort  string // TodoSortXXX，为空按 id
+	Desc  bool
+	After *TodoCursor // 从这条记录后面开始查，为空从头开始
+	Limit int         // 最多返回多少条，<=0 不限制
+}
+
+// TodoCursor 分页游标，上一页最后一条记录的排序字段值和 id
+type TodoCursor struct {
+	Sort  string    `json:"s"`
+	Desc  bool      `json:"d,omitempty"`
+	Value time.Time `json:"v"`           // 按时间排序的时候用
+	Num   int64     `json:"n,omitempty"` // 按优先级排序的时候用
+	ID    uint      `json:"i"`
+}
+
+// Encode 编码成不透明的字符串返回给前端
+func (cur TodoCursor) Encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeTodoCursor(s string) (*TodoCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur TodoCursor
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, err
+	}
+	return &cur, nil
+}
+
+// cursorOf 根据一条记录生成游标
+func (q TodoQuery) cursorOf(todo Todo) *TodoCursor {
+	k := todoSortKey(todo, q.Sort)
+	return &TodoCursor{Sort: q.Sort, Desc: q.Desc, Value: k.t, Num: k.n, ID: todo.ID}
+}
+
+// sortKey 排序字段的值，时间字段用 t，数字字段用 n，按 id 排序的时候都是零值
+type sortKey struct {
+	t time.Time
+	n int64
+}
+
+func (a sortKey) cmp(b sortKey) int {
+	switch {
+	case a.t.Before(b.t), a.t.Equal(b.t) && a.n < b.n:
+		return -1
+	case a.t.After(b.t), a.n > b.n:
+		return 1
+	}
+	return 0
+}
+
+// todoSortKey 记录的排序字段值
+func todoSortKey(todo Todo, sort string) sortKey {
+	switch sort {
+	case TodoSortCreatedAt:
+		return sortKey{t: todo.CreatedAt}
+	case TodoSortUpdatedAt:
+		return sortKey{t: todo.UpdatedAt}
+	case TodoSortDueAt:
+		return sortKey{t: nullTimeKey(todo.DueAt)}
+	case TodoSortCompletedAt:
+		return sortKey{t: nullTimeKey(todo.CompletedAt)}
+	case TodoSortPriority:
+		return sortKey{n: int64(todo.Priority)}
+	}
+	return sortKey{}
+}
+
+func nullTimeKey(t *time.Time) time.Time {
+	if t == nil {
+		return todoSortNullTime
+	}
+	return *t
+}
+
+// parseTodoQuery 从 url 参数里解析查询条件，参数不对的返回带字段信息的 ErrInvalidParam
+func parseTodoQuery(c *gin.Context) (TodoQuery, error) {
+	q := TodoQuery{Sort: TodoSortID, Limit: defaultTodoLimit}
+	var fields []FieldError
+
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTodoLimit {
+			fields = append(fields, FieldError{Field: "limit", Reason: "range"})
+		}
+		q.Limit = n
+	}
+	if v := c.Query("status"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "status", Reason: "bool"})
+		}
+		q.Status = &b
+	}
+	q.Title = c.Query("title")
+	if v := c.Query("list_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "list_id", Reason: "number"})
+		}
+		q.ListID = uint(id)
+	}
+	if v := c.Query("parent_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "parent_id", Reason: "number"})
+		}
+		parentID := uint(id)
+		q.ParentID = &parentID
+	}
+	if v := c.Query("tree"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "tree", Reason: "bool"})
+		}
+		q.Tree = b
+	}
+	if v := c.Query("tag"); v != "" {
+		seen := make(map[uint]bool)
+		for _, s := range strings.Split(v, ",") {
+			id, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				fields = append(fields, FieldError{Field: "tag", Reason: "number"})
+				break
+			}
+			if !seen[uint(id)] {
+				seen[uint(id)] = true
+				q.Tags = append(q.Tags, uint(id))
+			}
+		}
+	}
+	switch c.DefaultQuery("tag_mode", "or") {
+	case "or":
+	case "and":
+		q.TagsAll = true
+	default:
+		fields = append(fields, FieldError{Field: "tag_mode", Reason: "oneof"})
+	}
+	if q.Tree && q.ParentID == nil {
+		var root uint
+		q.ParentID = &root
+	}
+
+	times := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"created_after", &q.CreatedAfter},
+		{"created_before", &q.CreatedBefore},
+		{"updated_after", &q.UpdatedAfter},
+		{"updated_before", &q.UpdatedBefore},
+		{"due_after", &q.DueAfter},
+		{"due_before", &q.DueBefore},
+	}
+	for _, t := range times {
+		if v := c.Query(t.name); v != "" {
+			tm, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				fields = append(fields, FieldError{Field: t.name, Reason: "datetime"})
+			}
+			*t.dst = tm
+		}
+	}
+
+	if v := c.Query("priority"); v != "" {
+		for _, p := range strings.Split(v, ",") {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < PriorityNone || n > PriorityHigh {
+				fields = append(fields, FieldError{Field: "priority", Reason: "oneof"})
+				break
+			}
+			q.Priorities = append(q.Priorities, n)
+		}
+	}
+
+	if v := c.Query("sort"); v != "" {
+		q.Desc = strings.HasPrefix(v, "-")
+		q.Sort = strings.TrimPrefix(v, "-")
+		switch q.Sort {
+		case TodoSortID, TodoSortCreatedAt, TodoSortUpdatedAt, TodoSortDueAt, TodoSortCompletedAt, TodoSortPriority:
+		default:
+			fields = append(fields, FieldError{Field: "sort", Reason: "oneof"})
+		}
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		cur, err := decodeTodoCursor(v)
+		// 换了排序方式，老的游标就不能用了
+		if err != nil || cur.Sort != q.Sort || cur.Desc != q.Desc {
+			fields = append(fields, FieldError{Field: "cursor", Reason: "invalid"})
+		}
+		q.After = cur
+	}
+
+	if len(fields) > 0 {
+		return q, ErrInvalidParam.WithFields(fields...)
+	}
+	return q, nil
+}
+
+// match 内存实现用，判断一条记录是否符合过滤条件(不包括游标)
+func (q TodoQuery) match(todo Todo) bool {
+	if q.Status != nil && todo.Status != *q.Status {
+		return false
+	}
+	// 不区分大小写，和 gorm 实现的 LOWER(title) LIKE LOWER(?) 一样
+	if q.Title != "" && !strings.Contains(strings.ToLower(todo.Title), strings.ToLower(q.Title)) {
+		return false
+	}
+	if !inRange(todo.CreatedAt, q.CreatedAfter, q.CreatedBefore) || !inRange(todo.UpdatedAt, q.UpdatedAfter, q.UpdatedBefore) {
+		return false
+	}
+	if !q.DueAfter.IsZero() || !q.DueBefore.IsZero() {
+		if todo.DueAt == nil || !inRange(*todo.DueAt, q.DueAfter, q.DueBefore) {
+			return false
+		}
+	}
+	if q.ListID > 0 && todo.ListID != q.ListID {
+		return false
+	}
+	if q.ParentID != nil && todo.ParentID != *q.ParentID {
+		return false
+	}
+	if len(q.Priorities) > 0 {
+		found := false
+		for _, p := range q.Priorities {
+			found = found || todo.Priority == p
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// inRange after <= t < before，零值代表不限制
+func inRange(t, after, before time.Time) bool {
+	if !after.IsZero() && t.Before(after) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+// less 内存实现用，按排序字段比较，相等的再按 id 比较
+func (q TodoQuery) less(a, b Todo) bool {
+	return q.compare(todoSortKey(a, q.Sort), a.ID, todoSortKey(b, q.Sort), b.ID) < 0
+}
+
+// afterCursor 内存实现用，判断记录是不是排在游标后面
+func (q TodoQuery) afterCursor(todo Todo) bool {
+	if q.After == nil {
+		return true
+	}
+	after := sortKey{t: q.After.Value, n: q.After.Num}
+	return q.compare(todoSortKey(todo, q.Sort), todo.ID, after, q.After.ID) > 0
+}
+
+// compare 按排序方向比较 (排序字段值, id)，返回 -1、0、1
+func (q TodoQuery) compare(ka sortKey, ida uint, kb sortKey, idb uint) int {
+	r := ka.cmp(kb)
+	if r == 0 {
+		switch {
+		case ida < idb:
+			r = -1
+		case ida > idb:
+			r = 1
+		}
+	}
+	if q.Desc {
+		r = -r
+	}
+	return r
+}
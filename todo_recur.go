@@ -0,0 +1,247 @@
+package main
+
+// 重复的待办事项
+// 新建或者修改的时候传 rrule(iCalendar 的 RRULE，见 rrule.go)，必须有截止时间，例如
+//   {"title": "写周报", "due_at": "2022-06-03T18:00:00+08:00", "due_tz": "Asia/Shanghai", "rrule": "FREQ=WEEKLY;BYDAY=FR"}
+// 把它改成完成(PUT /api/v1/todo 或者 PATCH /api/v1/todo/:id 传 status: true)的时候，自动生成下一次：
+//   标题、描述、优先级、清单、上级、标签都一样，截止时间按 rrule 往后算，按 due_tz 的时区算
+//   完成的这一条去掉 rrule，重复规则跟着下一次走，改回未完成再完成也不会重复生成
+//   完成和生成下一次(连同标签、提醒)在一个事务里，生成失败的话这一条也不会变成完成
+//   响应的 data.next 是生成的下一次，超过 COUNT 或者 UNTIL 就不再生成
+// PUT /api/v1/todo 完成的时候可以带 skip，再跳过后面几次，比如出差一周，完成这次顺便跳过下次
+// POST /api/v1/todo/:id/skip 这一次不做了，不标记完成，截止时间直接挪到下一次
+// rrule 传空字符串(PATCH 传 null)代表不再重复
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// normalizeRRule 校验 rrule，转成规范的写法存数据库，空字符串代表不重复
+func normalizeRRule(rule string) (string, error) {
+	if rule == "" {
+		return "", nil
+	}
+	r, err := parseRRule(rule)
+	if err != nil {
+		return "", ErrInvalidParam.WithFields(FieldError{Field: "rrule", Reason: "rrule"})
+	}
+	return r.String(), nil
+}
+
+// nextDue 从 due 往后数第 n 次，按 tz 时区算，夏令时前后也是当地的同一个钟点
+// 没有下一次了(超过 UNTIL、COUNT)返回 false，occurrence 是 due 这一次是第几次
+func nextDue(rule string, due time.Time, tz string, occurrence, n int) (time.Time, bool, error) {
+	r, err := parseRRule(rule)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("parseRRule: %w", err)
+	}
+	if r.Count > 0 && occurrence+n > r.Count {
+		return time.Time{}, false, nil
+	}
+	loc := time.Local
+	if tz != "" {
+		if l, err := time.LoadLocation(tz); err == nil {
+			loc = l
+		}
+	}
+	t := due.In(loc)
+	for i := 0; i < n; i++ {
+		var ok bool
+		if t, ok = r.Next(t); !ok {
+			return time.Time{}, false, nil
+		}
+	}
+	return t, true, nil
+}
+
+// updateTodo 修改待办事项，PUT 和 PATCH 都用这个，返回的错误用 todoError 转一下
+// uid 是待办事项的所有人，调用方要先用 authorizeTodo 检查权限，见 share.go
+// 重复的待办事项从未完成变成完成的时候生成下一次，skip 是再往后跳过几次
+// completed 是这次是不是从未完成变成了完成，发事件用，见 events.go
+func (s *Server) updateTodo(uid int64, id uint, version int, ch TodoChanges, skip int) (todo *Todo, completed bool, err error) {
+	completing := ch.Status != nil && *ch.Status
+	if ch.RRule == nil && !ch.SetDueAt && !completing {
+		todo, err = s.todos.Update(uid, id, version, ch)
+		return todo, false, err
+	}
+
+	// 修改之后的 rrule 和截止时间
+	cur, err := s.todos.Get(uid, id)
+	if err != nil {
+		return nil, false, err
+	}
+	rule, due, tz := cur.RRule, cur.DueAt, cur.DueTZ
+	if ch.RRule != nil {
+		rule = *ch.RRule
+	}
+	if ch.SetDueAt {
+		due = ch.DueAt
+	}
+	if ch.DueTZ != nil {
+		tz = *ch.DueTZ
+	}
+	if rule != "" && due == nil {
+		return nil, false, ErrInvalidParam.WithFields(FieldError{Field: "due_at", Reason: "required"})
+	}
+	completed = completing && !cur.Status
+	if !completed || rule == "" {
+		todo, err = s.todos.Update(uid, id, version, ch)
+		if err == nil && ch.SetDueAt {
+			err = s.rescheduleReminders(todo)
+		}
+		return todo, completed && err == nil, err
+	}
+
+	next, ok, err := nextDue(rule, *due, tz, cur.Occurrence, skip+1)
+	if err != nil {
+		return nil, false, err
+	}
+	empty := ""
+	ch.RRule = &empty
+	// 没带 If-Match 的也用读到的版本号做条件，两个请求同时完成只会生成一次
+	if version == 0 {
+		version = cur.Version
+	}
+	if !ok {
+		todo, err = s.todos.Update(uid, id, version, ch)
+		return todo, err == nil, err
+	}
+
+	// 下一次用修改之后的字段，修改和新建在一个事务里，见 TodoRepository.CompleteRecurring
+	after := *cur
+	if ch.Title != nil {
+		after.Title = *ch.Title
+	}
+	if ch.Description != nil {
+		after.Description = *ch.Description
+	}
+	if ch.Priority != nil {
+		after.Priority = *ch.Priority
+	}
+	if ch.ListID != nil {
+		after.ListID = *ch.ListID
+	}
+	after.DueTZ = tz
+	nextTodo := &Todo{
+		Title:       after.Title,
+		Description: after.Description,
+		Priority:    after.Priority,
+		DueAt:       &next,
+		DueTZ:       after.DueTZ,
+		RRule:       rule,
+		Occurrence:  cur.Occurrence + skip + 1,
+		ListID:      after.ListID,
+		ParentID:    after.ParentID,
+		Uid:         uid,
+	}
+	// 标签和提醒是每个人自己的，共享清单的成员打的标签、设的提醒也带过去
+	uids, err := s.listAudience(uid, after.ListID)
+	if err != nil {
+		return nil, false, err
+	}
+	todo, err = s.todos.CompleteRecurring(uid, id, version, ch, nextTodo, uids)
+	if err != nil {
+		return nil, false, err
+	}
+	todo.Next = nextTodo
+	todo.Next.localize()
+	return todo, true, nil
+}
+
+// copyOccurrence 重复的待办事项生成下一次的时候，uids 这些人在 from 上打的标签、相对截止时间的提醒带到 to 上
+// 固定时间的提醒不带；TodoRepository.CompleteRecurring 在事务里调用
+func copyOccurrence(tags TagRepository, reminders ReminderRepository, uids []int64, from uint, to *Todo) error {
+	for _, uid := range uids {
+		byTodo, err := tags.ListByTodos(uid, []uint{from})
+		if err != nil {
+			return fmt.Errorf("tags.ListByTodos: %w", err)
+		}
+		for _, tag := range byTodo[from] {
+			if err := tags.Attach(to.ID, tag.ID); err != nil {
+				return fmt.Errorf("tags.Attach: %w", err)
+			}
+		}
+		list, err := reminders.ListByTodo(uid, from)
+		if err != nil {
+			return fmt.Errorf("reminders.ListByTodo: %w", err)
+		}
+		for _, r := range list {
+			if r.Offset == nil {
+				continue
+			}
+			cp := Reminder{Uid: uid, TodoID: to.ID, Offset: r.Offset, Channel: r.Channel, Target: r.Target}
+			cp.schedule(to.DueAt)
+			if err := reminders.Create(&cp); err != nil {
+				return fmt.Errorf("reminders.Create: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// skipTodoHandler 跳过这一次，截止时间挪到下一次，不标记完成
+func (s *Server) skipTodoHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	cur, err := s.authorizeTodo(uid, uint(id), ListRoleEditor)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	if cur.RRule == "" || cur.DueAt == nil {
+		renderError(c, ErrTodoNotRecurring)
+		return
+	}
+	next, ok, err := nextDue(cur.RRule, *cur.DueAt, cur.DueTZ, cur.Occurrence, 1)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	if !ok {
+		renderError(c, ErrRecurrenceEnded)
+		return
+	}
+	if version == 0 {
+		version = cur.Version
+	}
+	occurrence := cur.Occurrence + 1
+	var todo *Todo
+	err = s.inTx(func(tx *Server) error {
+		var err error
+		todo, err = tx.todos.Update(cur.Uid, uint(id), version, TodoChanges{SetDueAt: true, DueAt: &next, Occurrence: &occurrence})
+		if err != nil {
+			return todoError("todos.Update", err)
+		}
+		if err := tx.rescheduleReminders(todo); err != nil {
+			return err
+		}
+		todo.localize()
+		return tx.publishTodo(EventTodoUpdated, todo)
+	})
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	c.Header("ETag", todoETag(todo))
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: todo,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+// 回收站
+// 删除待办事项是软删除(deleted_at 不为空)，删掉的数据在回收站里还能看到、能恢复
+//   GET    /api/v1/trash              回收站列表，按删除时间倒序，limit 参数和 GET /api/v1/todo 一样
+//   POST   /api/v1/trash/:id/restore  恢复，和它一起删除的子任务也一起恢复
+//   DELETE /api/v1/trash/:id          彻底删除一条
+//   DELETE /api/v1/trash              清空回收站
+// 删除超过 conf.Todo.TrashRetention 的数据由 autoPurgeTrash 定时彻底删除，配置成0就一直留着
+// 共享清单里的待办事项删除之后进的是创建清单的人的回收站，见 share.go
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listTrashHandler 回收站列表
+func (s *Server) listTrashHandler(c *gin.Context) {
+	limit := defaultTodoLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTodoLimit {
+			renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "limit", Reason: "range"}))
+			return
+		}
+		limit = n
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	todos, err := s.todos.ListDeleted(uid, limit)
+	if err != nil {
+		renderError(c, fmt.Errorf("todos.ListDeleted: %w", err))
+		return
+	}
+	for i := range todos {
+		todos[i].localize()
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: todos,
+	})
+}
+
+// restoreTrashHandler 从回收站恢复，恢复之后版本号加1
+func (s *Server) restoreTrashHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	var todo *Todo
+	err = s.inTx(func(tx *Server) error {
+		var err error
+		todo, err = tx.todos.Restore(uid, uint(id))
+		if err != nil {
+			return todoError("todos.Restore", err)
+		}
+		todo.localize()
+		return tx.publishTodo(EventTodoCreated, todo)
+	})
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	c.Header("ETag", todoETag(todo))
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: todo,
+	})
+}
+
+// purgeTrashHandler 彻底删除回收站里的一条，没删除的待办事项不能直接彻底删除，要先放进回收站
+func (s *Server) purgeTrashHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if err := s.todos.Purge(uid, uint(id)); err != nil {
+		renderError(c, todoError("todos.Purge", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+	})
+}
+
+// emptyTrashHandler 清空回收站，返回彻底删除了多少条
+func (s *Server) emptyTrashHandler(c *gin.Context) {
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	n, err := s.todos.PurgeAll(uid)
+	if err != nil {
+		renderError(c, fmt.Errorf("todos.PurgeAll: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: gin.H{"purged": n},
+	})
+}
+
+// purgeExpiredTrash 彻底删除放进回收站超过 retention 的数据，retention 为0不删除
+func (s *Server) purgeExpiredTrash(retention time.Duration) (int64, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	return s.todos.PurgeDeletedBefore(time.Now().Add(-retention))
+}
+
+// autoPurgeTrash 定时清理回收站，在 main 中用 go 启动
+// 多个实例同时跑也没关系，删的是同一批数据
+func (s *Server) autoPurgeTrash(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := s.purgeExpiredTrash(conf.Todo.TrashRetention)
+		if err != nil {
+			fmt.Println("purge trash err:", err)
+			continue
+		}
+		if n > 0 {
+			fmt.Printf("purged %d todos from trash\n", n)
+		}
+	}
+}
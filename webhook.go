@@ -0,0 +1,668 @@
+package main
+
+// webhook，用户注册自己的地址，待办事项和账号有变化的时候服务端 POST 过去
+//   GET    /api/v1/webhooks                                          webhook 列表
+//   POST   /api/v1/webhooks                                          注册，{"url": "https://example.com/hook", "events": ["todo.completed"]}
+//   PUT    /api/v1/webhooks/:id                                      修改，{"url": "...", "events": [], "active": false}
+//   DELETE /api/v1/webhooks/:id                                      删除，发送记录一起删除
+//   GET    /api/v1/webhooks/:id/deliveries                           发送记录，按时间倒序，limit 默认 100
+//   GET    /api/v1/webhooks/:id/deliveries/:delivery_id              一条发送记录，带上发送的内容和每一次尝试的结果
+//   POST   /api/v1/webhooks/:id/deliveries/:delivery_id/redeliver    同样的内容再发一次，生成一条新的发送记录
+// events 为空代表订阅全部事件，事件类型和 /api/v1/events 推送的一样，见 events.go
+//
+// 发出去的请求：
+//   POST <url>
+//   Content-Type: application/json
+//   X-Webhook-Event: todo.completed
+//   X-Webhook-Delivery: 12                        发送记录的 id
+//   X-Webhook-Signature: t=1654066800,v1=<hex>   签名
+//   {"id": "事件id", "type": "todo.completed", "created_at": "...", "data": {...待办事项...}}
+// 签名是 HMAC-SHA256(secret, t + "." + 请求体) 的 hex，secret 只在注册的时候返回一次
+// 接收方要校验签名，并且拒绝 t 太久以前的请求防止重放；重发的事件 id 不变，接收方用它去重
+//
+// 事件先写进 webhook_deliveries 表(发件箱)，后台 runWebhooks 定时发送，服务重启了也不会丢
+// 返回 2xx 算成功，其他状态码、超时、连不上都算失败，按 30s、1m、2m… 翻倍重试，
+// 最多 conf.Webhook.MaxAttempts 次；跳转不跟，3xx 也算失败
+// 不能调用本机、内网、链路本地、云厂商元数据(169.254.169.254、100.100.100.200)这些地址(见 blockedPrefixes)，不然用户能借服务器访问内网，
+// 还能在发送记录里看到响应(SSRF)。注册的时候解析域名检查一遍，连接的时候按真正连的 ip 再检查一遍，
+// 防止域名解析到的地址后来变了(DNS rebinding)；开发测试的时候可以用 conf.Webhook.AllowPrivate 打开
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errBlockedAddress 要连的是本机、内网这些不让连的地址
+var errBlockedAddress = errors.New("webhook: address is not allowed")
+
+// 发送记录的状态
+const (
+	WebhookPending   = "pending"   // 等着发，包括失败了等着重试的
+	WebhookSucceeded = "succeeded" // 发送成功
+	WebhookFailed    = "failed"    // 重试次数用完了，或者 webhook 停用了
+)
+
+const (
+	webhookBatch       = 100
+	webhookMaxBackoff  = 6 * time.Hour
+	webhookResponseMax = 1024 // 发送记录里最多保存多少字节的响应体
+)
+
+// WebhookEndpoint 用户注册的 webhook
+type WebhookEndpoint struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Uid       int64    `gorm:"not null;default:0;index" json:"-"`
+	URL       string   `gorm:"column:url;size:1024;not null" json:"url"`
+	Secret    string   `gorm:"size:64;not null" json:"secret,omitempty"`            // 签名用，只在注册的时候返回
+	EventList string   `gorm:"column:events;size:512;not null;default:''" json:"-"` // 订阅的事件，逗号分隔，空代表全部
+	Events    []string `gorm:"-" json:"events"`
+	Active    bool     `gorm:"not null" json:"active"` // 停用了就不再发
+}
+
+// WebhookDelivery 一个事件发给一个 webhook，既是发件箱也是发送记录
+type WebhookDelivery struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Uid        int64  `gorm:"not null;default:0;index" json:"-"`
+	EndpointID uint   `gorm:"not null;default:0;index" json:"endpoint_id"`
+	EventID    string `gorm:"size:32;not null" json:"event_id"` // 重发的时候不变
+	Event      string `gorm:"size:32;not null" json:"event"`
+	Payload    string `gorm:"type:text" json:"-"`
+
+	Status        string     `gorm:"size:16;not null;index:idx_webhook_deliveries_status_next,priority:1" json:"status"`
+	NextAttemptAt *time.Time `gorm:"index:idx_webhook_deliveries_status_next,priority:2" json:"next_attempt_at"`
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	LastStatus    int        `gorm:"not null;default:0" json:"last_status"` // 最后一次的 http 状态码，0 代表没拿到响应
+	LastError     string     `gorm:"size:255;not null;default:''" json:"last_error"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	Version       int        `gorm:"not null;default:1" json:"-"` // 多个实例同时发的时候用来抢，见 WebhookRepository.Claim
+
+	Body        json.RawMessage  `gorm:"-" json:"payload,omitempty"` // 查一条的时候才返回
+	AttemptLogs []WebhookAttempt `gorm:"-" json:"attempt_logs,omitempty"`
+}
+
+// WebhookAttempt 发送一次的结果
+type WebhookAttempt struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	DeliveryID uint      `gorm:"not null;default:0;index" json:"-"`
+	StatusCode int       `gorm:"not null;default:0" json:"status_code"`
+	Error      string    `gorm:"size:255;not null;default:''" json:"error"`
+	Response   string    `gorm:"size:1024;not null;default:''" json:"response"` // 响应体的开头
+	DurationMs int64     `gorm:"not null;default:0" json:"duration_ms"`
+}
+
+type WebhookParam struct {
+	URL    string   `json:"url" binding:"required,max=1024,url"`
+	Events []string `json:"events" binding:"max=16,dive,oneof=todo.created todo.updated todo.completed todo.deleted account.login account.logout_all"`
+	Active *bool    `json:"active"` // 新建的时候不用传，默认启用
+}
+
+// encodeEvents 去重排序，拼成逗号分隔的存数据库
+func encodeEvents(events []string) string {
+	seen := make(map[string]bool, len(events))
+	list := make([]string, 0, len(events))
+	for _, e := range events {
+		if !seen[e] {
+			seen[e] = true
+			list = append(list, e)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// decode 数据库读出来之后，把 EventList 拆成 Events
+func (e *WebhookEndpoint) decode() {
+	e.Events = []string{}
+	if e.EventList != "" {
+		e.Events = strings.Split(e.EventList, ",")
+	}
+}
+
+// subscribes 有没有订阅 typ 事件
+func (e *WebhookEndpoint) subscribes(typ string) bool {
+	if e.EventList == "" {
+		return true
+	}
+	for _, ev := range strings.Split(e.EventList, ",") {
+		if ev == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebhookURL 只能是 http(s) 地址，域名解析出来的地址都不能是本机、内网
+func checkWebhookURL(raw string) error {
+	if reason := webhookURLReason(raw); reason != "" {
+		return ErrInvalidParam.WithFields(FieldError{Field: "url", Reason: reason})
+	}
+	return nil
+}
+
+// webhookURLReason 地址不能用的原因，能用返回空字符串；提醒的 webhook 地址也用这个检查，见 reminder.go
+func webhookURLReason(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return "url"
+	}
+	if conf.Webhook.AllowPrivate {
+		return ""
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return "host"
+	}
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); !ok || blockedIP(addr) {
+			return "private"
+		}
+	}
+	return ""
+}
+
+// blockedPrefixes 不能调用的地址段，来自 IANA 的 IPv4/IPv6 Special-Purpose Address Registry，
+// 加上组播、保留地址这些不是正常公网单播的；IPv4-mapped 的 IPv6 地址先转成 IPv4 再查
+// 只看 IsPrivate 这些不够，100.64.0.0/10 里有阿里云的元数据地址 100.100.100.200
+var blockedPrefixes = []netip.Prefix{
+	// IPv4
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+	netip.MustParsePrefix("10.0.0.0/8"),      // 内网
+	netip.MustParsePrefix("100.64.0.0/10"),   // 运营商级 NAT，云厂商的元数据地址也在这里
+	netip.MustParsePrefix("127.0.0.0/8"),     // 本机
+	netip.MustParsePrefix("169.254.0.0/16"),  // 链路本地，169.254.169.254 元数据地址
+	netip.MustParsePrefix("172.16.0.0/12"),   // 内网
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF 协议分配
+	netip.MustParsePrefix("192.0.2.0/24"),    // 文档 TEST-NET-1
+	netip.MustParsePrefix("192.31.196.0/24"), // AS112-v4
+	netip.MustParsePrefix("192.52.193.0/24"), // AMT
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 中继，已废弃
+	netip.MustParsePrefix("192.168.0.0/16"),  // 内网
+	netip.MustParsePrefix("192.175.48.0/24"), // AS112 直接委派
+	netip.MustParsePrefix("198.18.0.0/15"),   // 性能测试
+	netip.MustParsePrefix("198.51.100.0/24"), // 文档 TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // 文档 TEST-NET-3
+	netip.MustParsePrefix("224.0.0.0/4"),     // 组播
+	netip.MustParsePrefix("240.0.0.0/4"),     // 保留，包括 255.255.255.255 广播
+	// IPv6
+	netip.MustParsePrefix("::/96"),          // 未指定、本机、IPv4-compatible(已废弃)
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64，后 32 位是 IPv4 地址
+	netip.MustParsePrefix("64:ff9b:1::/48"), // 本地 NAT64
+	netip.MustParsePrefix("100::/64"),       // 丢弃
+	netip.MustParsePrefix("2001::/23"),      // IETF 协议分配，包括 Teredo、性能测试、ORCHID
+	netip.MustParsePrefix("2001:db8::/32"),  // 文档
+	netip.MustParsePrefix("2002::/16"),      // 6to4，里面能嵌任意 IPv4 地址
+	netip.MustParsePrefix("3fff::/20"),      // 文档
+	netip.MustParsePrefix("5f00::/16"),      // SRv6
+	netip.MustParsePrefix("fc00::/7"),       // 唯一本地地址，相当于内网
+	netip.MustParsePrefix("fe80::/10"),      // 链路本地
+	netip.MustParsePrefix("fec0::/10"),      // 站点本地，已废弃
+	netip.MustParsePrefix("ff00::/8"),       // 组播
+}
+
+// blockedIP ip 在不能调用的地址段里
+func blockedIP(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return true
+	}
+	// 带 zone 的地址 Prefix.Contains 一律返回 false
+	ip = ip.WithZone("").Unmap()
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialControl 真正连接之前按 ip 再检查一遍，注册之后域名改解析到内网也连不上
+func dialControl(network, address string, _ syscall.RawConn) error {
+	if conf.Webhook.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip, err := netip.ParseAddr(host); err != nil || blockedIP(ip) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// signWebhook 签名，t 是 unix 时间戳
+func signWebhook(secret string, t int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(t, 10) + "."))
+	mac.Write(body)
+	return "t=" + strconv.FormatInt(t, 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff 第 attempts 次失败之后等多久再试：30s、1m、2m…，最多 6 小时
+func webhookBackoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+// newWebhookClient 调用 webhook 的 http client，不跟跳转，不走代理，不能连本机、内网
+// 提醒的 webhook 渠道也用它，见 notify.go
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialControl}
+	return &http.Client{
+		Timeout: timeout,
+		// 走代理的话连的是代理的地址，检查不到真正的目标
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// ------------------------- 发件箱 -------------------------
+
+// writeOutbox 把事件写进发件箱，每个订阅了这个事件的 webhook 一条，由 runWebhooks 发出去
+// 待办事项的事件在修改的事务里写，见 Server.inTx，不会改好了却没写进发件箱
+func (s *Server) writeOutbox(uid int64, typ string, data interface{}) error {
+	endpoints, err := s.webhooks.List(uid)
+	if err != nil {
+		return fmt.Errorf("webhooks.List: %w", err)
+	}
+	var eventID string
+	var payload []byte
+	now := time.Now()
+	for _, e := range endpoints {
+		if !e.Active || !e.subscribes(typ) {
+			continue
+		}
+		if payload == nil {
+			if eventID, err = randomToken(12); err != nil {
+				return fmt.Errorf("randomToken: %w", err)
+			}
+			payload, err = json.Marshal(gin.H{"id": eventID, "type": typ, "created_at": now, "data": data})
+			if err != nil {
+				return fmt.Errorf("json.Marshal: %w", err)
+			}
+		}
+		d := WebhookDelivery{
+			Uid:           uid,
+			EndpointID:    e.ID,
+			EventID:       eventID,
+			Event:         typ,
+			Payload:       string(payload),
+			Status:        WebhookPending,
+			NextAttemptAt: &now,
+		}
+		if err := s.webhooks.CreateDelivery(&d); err != nil {
+			return fmt.Errorf("webhooks.CreateDelivery: %w", err)
+		}
+	}
+	return nil
+}
+
+// runWebhooks 定时发送发件箱里的事件，清理过期的发送记录，在 main 中用 go 启动
+func (s *Server) runWebhooks(interval time.Duration) {
+	var lastPurge time.Time
+	for {
+		now := time.Now()
+		if n, err := s.deliverWebhooks(now); err != nil {
+			fmt.Println("deliver webhooks err:", err)
+		} else if n > 0 {
+			fmt.Printf("delivered %d webhooks\n", n)
+		}
+		if conf.Webhook.LogRetention > 0 && now.Sub(lastPurge) > time.Hour {
+			if _, err := s.webhooks.PurgeDeliveries(now.Add(-conf.Webhook.LogRetention)); err != nil {
+				fmt.Println("purge webhook deliveries err:", err)
+			}
+			lastPurge = now
+		}
+		time.Sleep(interval)
+	}
+}
+
+// deliverWebhooks 发送 now 之前该发的，返回发了多少条
+func (s *Server) deliverWebhooks(now time.Time) (int, error) {
+	deliveries, err := s.webhooks.ListDue(now, webhookBatch)
+	if err != nil {
+		return 0, fmt.Errorf("webhooks.ListDue: %w", err)
+	}
+	n := 0
+	for _, d := range deliveries {
+		// 抢到之后进程挂了，过一会儿别的实例还能再发
+		ok, err := s.webhooks.Claim(d.ID, d.Version, now.Add(conf.Webhook.Timeout+time.Minute))
+		if err != nil {
+			return n, fmt.Errorf("webhooks.Claim: %w", err)
+		}
+		if !ok {
+			continue
+		}
+		if err := s.deliverWebhook(d, now); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// deliverWebhook 发送一次，记录结果，返回的错误是记录结果失败
+func (s *Server) deliverWebhook(d WebhookDelivery, now time.Time) error {
+	attempt := WebhookAttempt{CreatedAt: now}
+	e, err := s.webhooks.Get(d.Uid, d.EndpointID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("webhooks.Get: %w", err)
+	}
+	if err != nil || !e.Active {
+		attempt.Error = "webhook is deleted or disabled"
+		return s.webhooks.RecordAttempt(d.ID, &attempt, WebhookFailed, nil)
+	}
+
+	start := time.Now()
+	status, resp, err := s.postWebhook(e, d, now)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	attempt.StatusCode, attempt.Response = status, resp
+	if err != nil {
+		attempt.Error = truncateError(err.Error(), 255) // 见 reminder.go
+	} else if status < 200 || status >= 300 {
+		attempt.Error = "unexpected status " + strconv.Itoa(status)
+	}
+	if attempt.Error == "" {
+		return s.webhooks.RecordAttempt(d.ID, &attempt, WebhookSucceeded, nil)
+	}
+	if d.Attempts+1 >= conf.Webhook.MaxAttempts {
+		return s.webhooks.RecordAttempt(d.ID, &attempt, WebhookFailed, nil)
+	}
+	next := now.Add(webhookBackoff(d.Attempts + 1))
+	return s.webhooks.RecordAttempt(d.ID, &attempt, WebhookPending, &next)
+}
+
+// postWebhook 发请求，返回状态码和响应体的开头
+func (s *Server) postWebhook(e *WebhookEndpoint, d WebhookDelivery, now time.Time) (int, string, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gin_demo-webhook")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(e.Secret, now.Unix(), body))
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseMax))
+	return resp.StatusCode, strings.ToValidUTF8(string(b), ""), nil
+}
+
+// ------------------------- 接口 -------------------------
+
+// listWebhooksHandler webhook 列表
+func (s *Server) listWebhooksHandler(c *gin.Context) {
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	endpoints, err := s.webhooks.List(uid)
+	if err != nil {
+		renderError(c, fmt.Errorf("webhooks.List: %w", err))
+		return
+	}
+	for i := range endpoints {
+		endpoints[i].decode()
+		endpoints[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: endpoints,
+	})
+}
+
+// createWebhookHandler 注册 webhook，响应里带着 secret，只返回这一次
+func (s *Server) createWebhookHandler(c *gin.Context) {
+	var param WebhookParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	if err := checkWebhookURL(param.URL); err != nil {
+		renderError(c, err)
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	secret, err := randomToken(32)
+	if err != nil {
+		renderError(c, fmt.Errorf("randomToken: %w", err))
+		return
+	}
+	e := WebhookEndpoint{
+		Uid:       uid,
+		URL:       param.URL,
+		Secret:    secret,
+		EventList: encodeEvents(param.Events),
+		Active:    param.Active == nil || *param.Active,
+	}
+	if err := s.webhooks.Create(&e); err != nil {
+		renderError(c, fmt.Errorf("webhooks.Create: %w", err))
+		return
+	}
+	e.decode()
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: e,
+	})
+}
+
+// updateWebhookHandler 修改地址、订阅的事件、启用停用，secret 不变
+func (s *Server) updateWebhookHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	var param WebhookParam
+	if err := c.ShouldBind(&param); err != nil {
+		renderError(c, bindError(err))
+		return
+	}
+	if err := checkWebhookURL(param.URL); err != nil {
+		renderError(c, err)
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	e, err := s.webhooks.Get(uid, uint(id))
+	if err != nil {
+		renderError(c, webhookError("webhooks.Get", err))
+		return
+	}
+	active := e.Active
+	if param.Active != nil {
+		active = *param.Active
+	}
+	e, err = s.webhooks.Update(uid, uint(id), param.URL, encodeEvents(param.Events), active)
+	if err != nil {
+		renderError(c, webhookError("webhooks.Update", err))
+		return
+	}
+	e.decode()
+	e.Secret = ""
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: e,
+	})
+}
+
+// deleteWebhookHandler 删除 webhook，还没发的不再发
+func (s *Server) deleteWebhookHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if err := s.webhooks.Delete(uid, uint(id)); err != nil {
+		renderError(c, webhookError("webhooks.Delete", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+	})
+}
+
+// listDeliveriesHandler 发送记录
+func (s *Server) listDeliveriesHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return
+	}
+	limit := defaultTodoLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTodoLimit {
+			renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "limit", Reason: "range"}))
+			return
+		}
+		limit = n
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	if _, err := s.webhooks.Get(uid, uint(id)); err != nil {
+		renderError(c, webhookError("webhooks.Get", err))
+		return
+	}
+	deliveries, err := s.webhooks.ListDeliveries(uid, uint(id), limit)
+	if err != nil {
+		renderError(c, fmt.Errorf("webhooks.ListDeliveries: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: deliveries,
+	})
+}
+
+// getDeliveryHandler 一条发送记录，带上内容和每一次尝试
+func (s *Server) getDeliveryHandler(c *gin.Context) {
+	d, ok := s.delivery(c)
+	if !ok {
+		return
+	}
+	attempts, err := s.webhooks.ListAttempts(d.ID)
+	if err != nil {
+		renderError(c, fmt.Errorf("webhooks.ListAttempts: %w", err))
+		return
+	}
+	d.Body, d.AttemptLogs = json.RawMessage(d.Payload), attempts
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: d,
+	})
+}
+
+// redeliverHandler 同样的内容再发一次，生成一条新的发送记录，马上发
+func (s *Server) redeliverHandler(c *gin.Context) {
+	d, ok := s.delivery(c)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	redelivery := WebhookDelivery{
+		Uid:           d.Uid,
+		EndpointID:    d.EndpointID,
+		EventID:       d.EventID,
+		Event:         d.Event,
+		Payload:       d.Payload,
+		Status:        WebhookPending,
+		NextAttemptAt: &now,
+	}
+	if err := s.webhooks.CreateDelivery(&redelivery); err != nil {
+		renderError(c, fmt.Errorf("webhooks.CreateDelivery: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, Resp{
+		Code: 0,
+		Msg:  "success",
+		Data: redelivery,
+	})
+}
+
+// delivery 按 url 里的 id、delivery_id 查发送记录，出错的时候已经返回了响应
+func (s *Server) delivery(c *gin.Context) (*WebhookDelivery, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "id", Reason: "number"}))
+		return nil, false
+	}
+	deliveryID, err := strconv.ParseUint(c.Param("delivery_id"), 10, 64)
+	if err != nil {
+		renderError(c, ErrInvalidParam.WithFields(FieldError{Field: "delivery_id", Reason: "number"}))
+		return nil, false
+	}
+	v, _ := c.Get(CtxUidKey)
+	uid := v.(int64)
+
+	d, err := s.webhooks.GetDelivery(uid, uint(id), uint(deliveryID))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			renderError(c, ErrDeliveryNotFound)
+			return nil, false
+		}
+		renderError(c, fmt.Errorf("webhooks.GetDelivery: %w", err))
+		return nil, false
+	}
+	return d, true
+}
+
+// webhookError 把 Repository 的错误转成接口的错误
+func webhookError(op string, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return ErrWebhookNotFound
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
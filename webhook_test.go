@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_webhookBackoff(t *testing.T) {
+	for _, c := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{20, webhookMaxBackoff},
+	} {
+		if got := webhookBackoff(c.attempts); got != c.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", c.attempts, got, c.want)
+		}
+	}
+}
+
+func Test_signWebhook(t *testing.T) {
+	// printf '%s' '1654066800.{"id":"1"}' | openssl dgst -sha256 -hmac secret
+	want := "t=1654066800,v1=61f3be99bea280ce5e751d11dc25ddf6cd62a101fd37ee309aba27c3c3d9cdd5"
+	if got := signWebhook("secret", 1654066800, []byte(`{"id":"1"}`)); got != want {
+		t.Errorf("signWebhook() = %q, want %q", got, want)
+	}
+}
+
+func Test_newWebhookClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// 连接的时候也检查，注册之后域名改解析到本机也连不上
+	client := newWebhookClient(time.Second)
+	if _, err := client.Post(srv.URL, "application/json", nil); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("post loopback err = %v, want %v", err, errBlockedAddress)
+	}
+	conf.Webhook.AllowPrivate = true
+	defer func() { conf.Webhook.AllowPrivate = false }()
+	resp, err := client.Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("post loopback with AllowPrivate err = %v", err)
+	}
+	resp.Body.Close()
+}
+
+func Test_blockedIP(t *testing.T) {
+	for _, c := range []struct {
+		ip      string
+		blocked bool
+	}{
+		{"0.1.2.3", true},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.100.100.200", true}, // 阿里云元数据
+		{"100.127.255.255", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.0.0.8", true},
+		{"192.0.2.1", true},
+		{"192.31.196.1", true},
+		{"192.52.193.1", true},
+		{"192.88.99.1", true},
+		{"192.168.1.1", true},
+		{"192.175.48.1", true},
+		{"198.18.0.1", true},
+		{"198.19.255.255", true},
+		{"198.51.100.1", true},
+		{"203.0.113.1", true},
+		{"224.0.0.1", true},
+		{"240.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:100.100.100.200", true},
+		{"::127.0.0.1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b:1::1", true},
+		{"100::1", true},
+		{"2001::1", true},
+		{"2001:2::1", true},
+		{"2001:db8::1", true},
+		{"2002:a9fe:a9fe::1", true},
+		{"3fff::1", true},
+		{"5f00::1", true},
+		{"fc00::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"fe80::1%eth0", true},
+		{"fec0::1", true},
+		{"ff02::1", true},
+
+		{"1.1.1.1", false},
+		{"8.8.8.8", false},
+		{"100.63.255.255", false},
+		{"100.128.0.1", false},
+		{"172.32.0.1", false},
+		{"198.17.255.255", false},
+		{"198.20.0.1", false},
+		{"223.255.255.255", false},
+		{"::ffff:8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+		{"2400:3200::1", false},
+	} {
+		ip := netip.MustParseAddr(c.ip)
+		if got := blockedIP(ip); got != c.blocked {
+			t.Errorf("blockedIP(%s) = %v, want %v", c.ip, got, c.blocked)
+		}
+		err := dialControl("tcp", net.JoinHostPort(c.ip, "443"), nil)
+		if got := errors.Is(err, errBlockedAddress); got != c.blocked {
+			t.Errorf("dialControl(%s) err = %v, want blocked %v", c.ip, err, c.blocked)
+		}
+		// ip 写在 url 里不用解析域名
+		want := ""
+		if c.blocked {
+			want = "private"
+		}
+		if strings.Contains(c.ip, "%") {
+			continue
+		}
+		u := "http://" + net.JoinHostPort(c.ip, "80") + "/hook"
+		if got := webhookURLReason(u); got != want {
+			t.Errorf("webhookURLReason(%s) = %q, want %q", u, got, want)
+		}
+	}
+	if !blockedIP(netip.Addr{}) {
+		t.Error("blockedIP(invalid) = false, want true")
+	}
+}